@@ -7,7 +7,7 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
+	"html/template"
 	"net/http"
 )
 
@@ -19,71 +19,136 @@ func (s *server) ServeAlbum(w http.ResponseWriter, r *http.Request) {
 	}
 	session, err := s.SessionData(r)
 	if err != nil {
-		log.Println(err)
-		s.internalError(w, err, s.tr("Session error"))
+		s.internalError(w, r, err, s.tr("Session error"))
 		return
 	}
-	var name string
+	var name, order, description, dateFrom, dateTo, first, last string
 	var ownerID int64
-	err = s.db.db.QueryRow("SELECT name, owner_id FROM albums WHERE aid=?", albumID).Scan(&name, &ownerID)
+	err = s.db.db.QueryRow(`
+SELECT name, owner_id, image_order, description, COALESCE(date_from, ''), COALESCE(date_to, ''),
+(SELECT COALESCE(MIN(created), '') FROM images WHERE album_id=aid), (SELECT COALESCE(MAX(created), '') FROM images WHERE album_id=aid)
+FROM albums WHERE aid=?`, albumID).Scan(&name, &ownerID, &order, &description, &dateFrom, &dateTo, &first, &last)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
 			return
 		}
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-		log.Println(err)
+		logError(r, "album error", "err", err)
 		return
 	}
-	rows, err := s.db.db.Query("SELECT iid, is_portrait, title from images WHERE album_id=? ORDER BY created", albumID)
+	comments, err := s.db.Comments(session.Uid, albumID, 0)
 	if err != nil {
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-		log.Println(err)
+		logError(r, "album error", "err", err)
+		return
+	}
+	rows, err := s.db.db.Query(`
+SELECT iid, is_portrait, is_video, title, `+commentsCntColumn+`, `+favouriteColumns+`
+FROM images WHERE album_id=? `+imageOrderBy(order), session.Uid, albumID)
+	if err != nil {
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "album error", "err", err)
 		return
 	}
 	defer rows.Close()
 
-	type img struct {
-		Src   string
-		Class string
-		Href  string
-		Title string
-	}
-	data := struct {
-		Title   string
-		MyAlbum bool
-		URL     string
-		Lang    string
-		Images  []img
-	}{
-		Title:   name,
-		MyAlbum: ownerID == session.Uid,
-		URL:     pathQuery(r),
-		Lang:    s.lang,
+	data := albumData{
+		Title:       name,
+		MyAlbum:     ownerID == session.Uid,
+		URL:         pathQuery(r),
+		Lang:        s.lang,
+		Description: renderMarkdown(description),
+		Dates:       albumDates(dateFrom, dateTo, first, last),
+		AlbumID:     albumID,
+		Comments:    comments,
 	}
 	for rows.Next() {
+		var im albumImage
 		var id int64
 		var portrait bool
-		var title string
-		if err := rows.Scan(&id, &portrait, &title); err != nil {
-			log.Println(err)
+		if err := rows.Scan(&id, &portrait, &im.Video, &im.Title, &im.Comments, &im.Favourite, &im.Favourites); err != nil {
+			logError(r, "album error", "err", err)
 			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 			return
 		}
-		class := "preview"
-		if portrait {
-			class = "preview portrait"
+		if !data.MyAlbum {
+			im.Favourites = 0
 		}
-		data.Images = append(data.Images, img{Src: fmt.Sprintf("/preview/%d", id), Class: class, Href: fmt.Sprintf("/view/%d#%d", albumID, id), Title: title})
+		im.setPreview(id, portrait, fmt.Sprintf("/view/%d", albumID))
+		data.Images = append(data.Images, im)
 	}
 	if err := rows.Err(); err != nil {
-		log.Println(err)
+		logError(r, "album error", "err", err)
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 		return
 	}
 	s.executeTemplate(w, "album.html", &data, http.StatusOK)
 }
 
+// albumData is shown by album.html (for albums and the virtual album
+// of favourites which has zero AlbumID).
+type albumData struct {
+	Title       string
+	MyAlbum     bool
+	URL         string
+	Lang        string
+	Description template.HTML
+	Dates       string
+	Images      []albumImage
+	AlbumID     int64
+	Comments    []comment
+}
+
+type albumImage struct {
+	Src        string
+	Class      string
+	Href       string
+	Title      string
+	Video      bool
+	Comments   int  // number of comments
+	Favourite  bool // favourite of the user
+	Favourites int  // number of users who marked the image (shown to the owner)
+}
+
+// setPreview sets the preview of the image linking to it on the view
+// page given by its path.
+func (im *albumImage) setPreview(id int64, portrait bool, view string) {
+	im.Src = fmt.Sprintf("/preview/%d", id)
+	im.Class = "preview"
+	if portrait {
+		im.Class = "preview portrait"
+	}
+	im.Href = fmt.Sprintf("%s#%d", view, id)
+}
+
+// commentsCntColumn selects the number of comments on an image (of the
+// images table).
+const commentsCntColumn = "(SELECT count(*) FROM comments WHERE album_id=0 AND image_id=iid AND trash_id IS NULL)"
+
+// Orders of images in the album (as stored in albums.image_order).
+const (
+	orderCreated  = "created"
+	orderFileName = "filename"
+	orderManual   = "manual"
+)
+
+func validImageOrder(order string) bool {
+	return order == orderCreated || order == orderFileName || order == orderManual
+}
+
+// imageOrderBy returns ORDER BY clause for selecting images of an
+// album in the given order.
+func imageOrderBy(order string) string {
+	switch order {
+	case orderFileName:
+		return "ORDER BY owner_file_name, created, iid"
+	case orderManual:
+		return "ORDER BY position, iid"
+	}
+	return "ORDER BY created, iid"
+}
+
 func pathQuery(r *http.Request) string {
 	if q := r.URL.RawQuery; q != "" {
 		return r.URL.Path + "?" + q
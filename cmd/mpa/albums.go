@@ -7,14 +7,14 @@ package main
 import (
 	"database/sql"
 	"fmt"
-	"log"
 	"net/http"
+	"strconv"
 	"strings"
 )
 
 func (s *server) ServeAlbums(w http.ResponseWriter, r *http.Request) {
 	login := strings.TrimPrefix(r.URL.Path, "/albums/")
-	title := "All albums"
+	title := s.tr("All albums")
 	if len(login) == len(r.URL.Path) {
 		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
 		return
@@ -22,17 +22,33 @@ func (s *server) ServeAlbums(w http.ResponseWriter, r *http.Request) {
 	if r.URL.Path == "/albums" {
 		login = ""
 	}
+	var collectionID int64
+	if c := r.URL.Query().Get("collection"); c != "" {
+		var err error
+		if collectionID, err = strconv.ParseInt(c, 10, 64); err != nil {
+			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+			return
+		}
+	}
+	const query = `
+SELECT albums.aid, albums.image_id, albums.is_portrait, albums.name,
+COALESCE(albums.date_from, ''), COALESCE(albums.date_to, ''),
+(SELECT COALESCE(MIN(created), '') FROM images WHERE album_id=albums.aid),
+(SELECT COALESCE(MAX(created), '') FROM images WHERE album_id=albums.aid),
+COALESCE(collections.cid, 0), COALESCE(collections.name, '')
+FROM albums LEFT OUTER JOIN collections ON albums.collection_id = collections.cid
+`
 	var rows *sql.Rows
 	var err error
 	if login != "" {
-		rows, err = s.db.db.Query("SELECT aid, image_id, is_portrait, name from albums WHERE owner_id=(SELECT uid FROM users WHERE login=?) ORDER BY modified DESC", login)
+		title = s.tr("Albums of user") + " " + login
+		rows, err = s.db.db.Query(query+"WHERE albums.owner_id=(SELECT uid FROM users WHERE login=?) AND (?=0 OR albums.collection_id=?) ORDER BY collections.name IS NULL, collections.name, albums.modified DESC", login, collectionID, collectionID)
 	} else {
-		rows, err = s.db.db.Query("SELECT aid, image_id, is_portrait, name from albums ORDER BY modified DESC")
-		title = "Albums of user " + login
+		rows, err = s.db.db.Query(query + "ORDER BY albums.modified DESC")
 	}
 	if err != nil {
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-		log.Println(err)
+		logError(r, "albums error", "err", err)
 		return
 	}
 	defer rows.Close()
@@ -42,40 +58,62 @@ func (s *server) ServeAlbums(w http.ResponseWriter, r *http.Request) {
 		Class string
 		Href  string
 		Title string
+		Dates string
+	}
+	type group struct {
+		Name   string
+		Href   string
+		Images []img
 	}
 	data := struct {
-		Title   string
-		MyAlbum bool
-		URL     string
-		Lang    string
-		Images  []img
+		Title  string
+		URL    string
+		Lang   string
+		Groups []*group
 	}{
 		Title: title,
 		URL:   pathQuery(r),
 		Lang:  s.lang,
 	}
+	var g *group
+	var lastCollectionID int64 = -1
 	for rows.Next() {
 		var albumID int64
 		var imageID int64
 		var portrait bool
-		var name string
-		if err := rows.Scan(&albumID, &imageID, &portrait, &name); err != nil {
+		var name, dateFrom, dateTo, first, last, collectionName string
+		var cid int64
+		if err := rows.Scan(&albumID, &imageID, &portrait, &name, &dateFrom, &dateTo, &first, &last, &cid, &collectionName); err != nil {
 			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-			log.Println(err)
+			logError(r, "albums error", "err", err)
 			return
 		}
+		if login == "" {
+			cid = 0 // do not group albums of different users
+		}
+		if g == nil || cid != lastCollectionID {
+			g = &group{}
+			if cid != 0 {
+				g.Name = collectionName
+				g.Href = fmt.Sprintf("/albums/%s?collection=%d", login, cid)
+			} else if len(data.Groups) > 0 {
+				g.Name = s.tr("Other albums")
+			}
+			data.Groups = append(data.Groups, g)
+			lastCollectionID = cid
+		}
 		class := "preview"
 		if portrait {
 			class = "preview portrait"
 		}
-		data.Images = append(data.Images, img{Src: fmt.Sprintf("/preview/%d", imageID), Class: class, Href: fmt.Sprintf("/album/%d", albumID), Title: name})
+		g.Images = append(g.Images, img{Src: fmt.Sprintf("/preview/%d", imageID), Class: class, Href: fmt.Sprintf("/album/%d", albumID), Title: name, Dates: albumDates(dateFrom, dateTo, first, last)})
 	}
 	if err := rows.Err(); err != nil {
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-		log.Println(err)
+		logError(r, "albums error", "err", err)
 		return
 	}
-	if login != "" && len(data.Images) == 0 {
+	if login != "" && len(data.Groups) == 0 {
 		var uid int64
 		err = s.db.db.QueryRow("SELECT uid FROM users WHERE login=?", login).Scan(&uid)
 		if err != nil {
@@ -84,9 +122,9 @@ func (s *server) ServeAlbums(w http.ResponseWriter, r *http.Request) {
 				return
 			}
 			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-			log.Println(err)
+			logError(r, "albums error", "err", err)
 			return
 		}
 	}
-	s.executeTemplate(w, "album.html", &data, http.StatusOK)
+	s.executeTemplate(w, "albums.html", &data, http.StatusOK)
 }
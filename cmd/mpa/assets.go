@@ -0,0 +1,168 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"fmt"
+	"html/template"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Templates and static files are embedded in the binary. In dev mode
+// (-dev option) they are read from the templates and static
+// directories of the working directory on each request instead.
+// Files in the theme directory (-theme_dir option) take precedence in
+// both modes. URLs of embedded static files used in templates
+// ({{static "style.css"}}) carry a hash of the content so they may be
+// cached by browsers for long. Files of the theme directory may change
+// at any time so they are revalidated on each request instead.
+
+//go:embed static templates
+var embeddedAssets embed.FS
+
+type assets struct {
+	dev         bool
+	overrideDir string
+	hashes      map[string]string // of embedded static files by name (not used in dev mode)
+}
+
+func newAssets(dev bool, overrideDir string) (*assets, error) {
+	a := &assets{dev: dev, overrideDir: overrideDir, hashes: make(map[string]string)}
+	if dev {
+		return a, nil
+	}
+	static, err := fs.Sub(embeddedAssets, "static")
+	if err != nil {
+		return nil, err
+	}
+	err = fs.WalkDir(static, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		b, err := fs.ReadFile(static, name)
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(b)
+		a.hashes[name] = hex.EncodeToString(sum[:])[:12]
+		return nil
+	})
+	return a, err
+}
+
+// readFile returns the content of the template or static file (such as
+// templates/index.html).
+func (a *assets) readFile(fn string) (string, error) {
+	if a.overrideDir != "" {
+		b, err := ioutil.ReadFile(filepath.Join(a.overrideDir, fn))
+		if err == nil || !os.IsNotExist(err) {
+			return string(b), err
+		}
+	}
+	var b []byte
+	var err error
+	if a.dev {
+		b, err = ioutil.ReadFile(fn)
+	} else {
+		b, err = embeddedAssets.ReadFile(fn)
+	}
+	return string(b), err
+}
+
+// parseTemplates returns parsed templates.
+func (a *assets) parseTemplates(name string, funcMap template.FuncMap, filenames ...string) (*template.Template, error) {
+	funcMap["static"] = a.staticURL
+	t := template.New(name).Funcs(funcMap)
+	for _, fn := range filenames {
+		src, err := a.readFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		if _, err = t.New(path.Base(fn)).Parse(src); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	return t, nil
+}
+
+// staticFS returns static files (with names relative to the static
+// directory).
+func (a *assets) staticFS() fs.FS {
+	var fsys fs.FS
+	if a.dev {
+		fsys = os.DirFS("static")
+	} else {
+		fsys, _ = fs.Sub(embeddedAssets, "static")
+	}
+	if a.overrideDir != "" {
+		return overrideFS{os.DirFS(filepath.Join(a.overrideDir, "static")), fsys}
+	}
+	return fsys
+}
+
+// hash returns the hash of the embedded static file or "" if it is
+// not known (in dev mode) or the file is replaced by the theme.
+func (a *assets) hash(name string) string {
+	h := a.hashes[name]
+	if h != "" && a.overrideDir != "" {
+		if info, err := os.Stat(filepath.Join(a.overrideDir, "static", filepath.FromSlash(name))); err == nil && !info.IsDir() {
+			return ""
+		}
+	}
+	return h
+}
+
+// staticURL returns the URL of the static file with the hash of its
+// content.
+func (a *assets) staticURL(name string) string {
+	if h := a.hash(name); h != "" {
+		return "/static/" + name + "?v=" + h
+	}
+	return "/static/" + name
+}
+
+// ServeStatic serves static files, with long lived cache headers if
+// requested with the hash of the current content.
+func (a *assets) ServeStatic(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/static/")
+	h := a.hash(name)
+	if h != "" {
+		w.Header().Set("ETag", `"`+h+`"`)
+	}
+	if h != "" && r.URL.Query().Get("v") == h {
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		w.Header().Set("Cache-Control", "no-cache")
+	}
+	http.StripPrefix("/static/", http.FileServer(http.FS(a.staticFS()))).ServeHTTP(w, r)
+}
+
+// overrideFS serves files of dir taking precedence over those of fs.
+type overrideFS struct {
+	dir fs.FS
+	fs  fs.FS
+}
+
+func (o overrideFS) Open(name string) (fs.File, error) {
+	f, err := o.dir.Open(name)
+	if err == nil {
+		if info, err := f.Stat(); err == nil && !info.IsDir() {
+			return f, nil
+		}
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	return o.fs.Open(name)
+}
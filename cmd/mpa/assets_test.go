@@ -0,0 +1,58 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestServeStaticCaching(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "static"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAssets(false, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(url string) (cacheControl, body string) {
+		w := httptest.NewRecorder()
+		a.ServeStatic(w, httptest.NewRequest("GET", url, nil))
+		if w.Code != 200 {
+			t.Fatalf("GET %s returned status %d", url, w.Code)
+		}
+		return w.Header().Get("Cache-Control"), w.Body.String()
+	}
+
+	url := a.staticURL("style.css")
+	if !strings.HasPrefix(url, "/static/style.css?v=") {
+		t.Fatalf("URL of embedded file %q has no hash", url)
+	}
+	if cc, _ := get(url); !strings.Contains(cc, "immutable") {
+		t.Errorf("embedded file requested with its hash served with Cache-Control %q", cc)
+	}
+	if cc, _ := get("/static/style.css?v=0123456789ab"); cc != "no-cache" {
+		t.Errorf("embedded file requested with other hash served with Cache-Control %q", cc)
+	}
+
+	// the file is replaced by the theme after the start
+	if err := ioutil.WriteFile(filepath.Join(dir, "static", "style.css"), []byte("body {}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if u := a.staticURL("style.css"); u != "/static/style.css" {
+		t.Errorf("URL of file replaced by the theme is %q", u)
+	}
+	for _, u := range []string{url, "/static/style.css"} {
+		cc, body := get(u)
+		if cc != "no-cache" || body != "body {}" {
+			t.Errorf("GET %s of file replaced by the theme returned %q with Cache-Control %q", u, body, cc)
+		}
+	}
+}
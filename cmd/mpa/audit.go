@@ -0,0 +1,251 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The audit table records who did what. It is append-only: triggers
+// created by migrateAudit abort any UPDATE or DELETE. Entries are
+// written after the action succeeded, a failure to write an entry is
+// logged but does not fail the request.
+
+// Audited actions.
+const (
+	auditLogin          = "login"
+	auditLoginFailed    = "login_failed"
+	auditAlbumCreate    = "album_create"
+	auditAlbumEdit      = "album_edit"
+	auditAlbumDelete    = "album_delete"
+	auditAlbumMerge     = "album_merge"
+	auditAlbumSplit     = "album_split"
+	auditImagesTransfer = "images_transfer"
+	auditTrashRestore   = "trash_restore"
+	auditTrashEmpty     = "trash_empty"
+	auditUserCreate     = "user_create"
+	auditUserDisable    = "user_disable"
+	auditUserEnable     = "user_enable"
+	auditPasswordChange = "password_change"
+	auditSettingsChange = "settings_change"
+	auditPrivacyChange  = "privacy_change"
+	auditCommentDelete  = "comment_delete"
+)
+
+var auditActions = []string{
+	auditLogin, auditLoginFailed, auditAlbumCreate, auditAlbumEdit, auditAlbumDelete,
+	auditAlbumMerge, auditAlbumSplit, auditImagesTransfer, auditTrashRestore, auditTrashEmpty,
+	auditUserCreate, auditUserDisable, auditUserEnable, auditPasswordChange, auditSettingsChange, auditPrivacyChange,
+	auditCommentDelete,
+}
+
+// auditTarget holds IDs of objects the action was performed on (0 if
+// not applicable).
+type auditTarget struct {
+	Album int64
+	Image int64
+	User  int64
+}
+
+type auditEntry struct {
+	Id         int64     `json:"id"`
+	Time       time.Time `json:"time"`
+	ActorID    int64     `json:"actor_id,omitempty"`
+	ActorLogin string    `json:"actor_login"`
+	Action     string    `json:"action"`
+	AlbumID    int64     `json:"album_id,omitempty"`
+	ImageID    int64     `json:"image_id,omitempty"`
+	UserID     int64     `json:"user_id,omitempty"`
+	RemoteAddr string    `json:"remote_addr"`
+	Details    string    `json:"details,omitempty"`
+}
+
+func nullID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+func (db *DB) AddAuditEntry(e *auditEntry) error {
+	_, err := db.db.Exec("INSERT INTO audit (time, actor_id, actor_login, action, album_id, image_id, user_id, remote_addr, details) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		e.Time.UTC().Unix(), nullID(e.ActorID), e.ActorLogin, e.Action, nullID(e.AlbumID), nullID(e.ImageID), nullID(e.UserID), e.RemoteAddr, e.Details)
+	return err
+}
+
+// audit records the action performed by the user of the session of
+// the request.
+func (s *server) audit(r *http.Request, action string, target auditTarget, details string) {
+	session, err := s.SessionData(r)
+	if err != nil {
+		logError(r, "session error", "err", err)
+	}
+	s.auditAs(r, session.Uid, session.Login, action, target, details)
+}
+
+// auditAs records the action performed by the given user (such as on
+// login when there is no session yet).
+func (s *server) auditAs(r *http.Request, uid int64, login, action string, target auditTarget, details string) {
+	e := auditEntry{Time: time.Now(), ActorID: uid, ActorLogin: login, Action: action,
+		AlbumID: target.Album, ImageID: target.Image, UserID: target.User, RemoteAddr: remoteAddr(r), Details: details}
+	if err := s.db.AddAuditEntry(&e); err != nil {
+		logError(r, "failed to write audit entry", "action", action, "login", login, "err", err)
+	}
+}
+
+// auditFilter selects audit entries (zero values match all).
+type auditFilter struct {
+	Login  string
+	Action string
+	Album  int64
+	From   string // date as sent by HTML date input
+	To     string
+}
+
+func (db *DB) AuditEntries(f auditFilter, limit int) ([]auditEntry, error) {
+	var conds []string
+	var args []interface{}
+	if f.Login != "" {
+		conds = append(conds, "actor_login=?")
+		args = append(args, f.Login)
+	}
+	if f.Action != "" {
+		conds = append(conds, "action=?")
+		args = append(args, f.Action)
+	}
+	if f.Album != 0 {
+		conds = append(conds, "album_id=?")
+		args = append(args, f.Album)
+	}
+	// entries are shown in the time zone of the server
+	if t, err := time.ParseInLocation("2006-01-02", f.From, time.Local); err == nil {
+		conds = append(conds, "time>=?")
+		args = append(args, t.Unix())
+	}
+	if t, err := time.ParseInLocation("2006-01-02", f.To, time.Local); err == nil {
+		conds = append(conds, "time<?")
+		args = append(args, t.AddDate(0, 0, 1).Unix())
+	}
+	q := "SELECT id, time, COALESCE(actor_id, 0), actor_login, action, COALESCE(album_id, 0), COALESCE(image_id, 0), COALESCE(user_id, 0), remote_addr, details FROM audit"
+	if len(conds) > 0 {
+		q += " WHERE " + strings.Join(conds, " AND ")
+	}
+	q += " ORDER BY id DESC"
+	if limit > 0 {
+		q += " LIMIT " + strconv.Itoa(limit)
+	}
+	rows, err := db.db.Query(q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []auditEntry
+	for rows.Next() {
+		var e auditEntry
+		var t int64
+		if err := rows.Scan(&e.Id, &t, &e.ActorID, &e.ActorLogin, &e.Action, &e.AlbumID, &e.ImageID, &e.UserID, &e.RemoteAddr, &e.Details); err != nil {
+			return nil, err
+		}
+		e.Time = time.Unix(t, 0)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// auditPageLimit is the number of the most recent matching entries
+// shown on the audit page (exports contain all of them).
+const auditPageLimit = 500
+
+// ServeAudit shows the audit log to admins or exports it as CSV or
+// JSON (depending on the format query parameter).
+func (s *server) ServeAudit(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	f := auditFilter{Login: q.Get("login"), Action: q.Get("action"), From: q.Get("from"), To: q.Get("to")}
+	if album := q.Get("album"); album != "" {
+		var err error
+		if f.Album, err = strconv.ParseInt(album, 10, 64); err != nil {
+			s.error(w, s.tr("Bad request"), s.tr("Error parsing album ID"), http.StatusBadRequest)
+			return
+		}
+	}
+	format := q.Get("format")
+	limit := auditPageLimit
+	if format != "" {
+		limit = 0
+	}
+	entries, err := s.db.AuditEntries(f, limit)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	switch format {
+	case "":
+	case "json":
+		if entries == nil {
+			entries = []auditEntry{}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.json"`)
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(entries); err != nil {
+			logError(r, "audit error", "err", err)
+		}
+		return
+	case "csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="audit.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"id", "time", "actor_id", "actor_login", "action", "album_id", "image_id", "user_id", "remote_addr", "details"})
+		for _, e := range entries {
+			cw.Write([]string{strconv.FormatInt(e.Id, 10), e.Time.UTC().Format(time.RFC3339), formatID(e.ActorID), e.ActorLogin, e.Action,
+				formatID(e.AlbumID), formatID(e.ImageID), formatID(e.UserID), e.RemoteAddr, e.Details})
+		}
+		cw.Flush()
+		if err := cw.Error(); err != nil {
+			logError(r, "audit error", "err", err)
+		}
+		return
+	default:
+		s.error(w, s.tr("Bad request"), s.tr("Unsupported export format"), http.StatusBadRequest)
+		return
+	}
+	data := struct {
+		Lang       string
+		Filter     auditFilter
+		Actions    []string
+		Entries    []auditEntry
+		Limited    bool
+		ExportCSV  string
+		ExportJSON string
+	}{Lang: s.lang, Filter: f, Actions: auditActions, Entries: entries, Limited: len(entries) == auditPageLimit}
+	q.Set("format", "csv")
+	data.ExportCSV = "/admin/audit?" + q.Encode()
+	q.Set("format", "json")
+	data.ExportJSON = "/admin/audit?" + q.Encode()
+	s.executeTemplate(w, "audit.html", &data, http.StatusOK)
+}
+
+func formatID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+	return strconv.FormatInt(id, 10)
+}
+
+// lookupUid returns uid of the user with the login (0 if not found).
+func (db *DB) lookupUid(login string) int64 {
+	var uid int64
+	if err := db.db.QueryRow("SELECT uid FROM users WHERE login=?", login).Scan(&uid); err != nil && err != sql.ErrNoRows {
+		logError(nil, "user lookup error", "login", login, "err", err)
+	}
+	return uid
+}
@@ -0,0 +1,113 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func addTestAuditEntries(t *testing.T, db *DB) {
+	t.Helper()
+	day := func(d, h int) time.Time { return time.Date(2024, 3, d, h, 0, 0, 0, time.Local) }
+	for _, e := range []auditEntry{
+		{Time: day(1, 0), ActorID: 1, ActorLogin: "admin", Action: auditLogin, RemoteAddr: "10.0.0.1"},
+		{Time: day(1, 23), ActorID: 1, ActorLogin: "admin", Action: auditUserCreate, UserID: 2, Details: "bob"},
+		{Time: day(2, 8), ActorLogin: "bob", Action: auditLoginFailed, RemoteAddr: "10.0.0.2"},
+		{Time: day(2, 9), ActorID: 2, ActorLogin: "bob", Action: auditAlbumCreate, AlbumID: 7},
+		{Time: day(3, 0), ActorID: 2, ActorLogin: "bob", Action: auditAlbumDelete, AlbumID: 7, Details: "3 images, \"Trip\""},
+	} {
+		e := e
+		if err := db.AddAuditEntry(&e); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestAuditEntries(t *testing.T) {
+	db := initTestDB(t)
+	addTestAuditEntries(t, db)
+	tests := map[string]struct {
+		filter auditFilter
+		limit  int
+		want   []int64 // IDs, the most recent first
+	}{
+		"all":          {auditFilter{}, 0, []int64{5, 4, 3, 2, 1}},
+		"limited":      {auditFilter{}, 2, []int64{5, 4}},
+		"login":        {auditFilter{Login: "bob"}, 0, []int64{5, 4, 3}},
+		"action":       {auditFilter{Action: auditLoginFailed}, 0, []int64{3}},
+		"album":        {auditFilter{Album: 7}, 0, []int64{5, 4}},
+		"from":         {auditFilter{From: "2024-03-02"}, 0, []int64{5, 4, 3}},
+		"to":           {auditFilter{To: "2024-03-01"}, 0, []int64{2, 1}},
+		"day":          {auditFilter{From: "2024-03-02", To: "2024-03-02"}, 0, []int64{4, 3}},
+		"invalid date": {auditFilter{From: "yesterday"}, 0, []int64{5, 4, 3, 2, 1}},
+		"combined":     {auditFilter{Login: "bob", Action: auditAlbumCreate, From: "2024-03-03"}, 0, nil},
+	}
+	for name, tt := range tests {
+		entries, err := db.AuditEntries(tt.filter, tt.limit)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		var ids []int64
+		for _, e := range entries {
+			ids = append(ids, e.Id)
+		}
+		if !testEqualIDs(ids, tt.want) {
+			t.Errorf("%s: got entries %v, want %v", name, ids, tt.want)
+		}
+	}
+}
+
+func TestAuditAppendOnly(t *testing.T) {
+	db := initTestDB(t)
+	addTestAuditEntries(t, db)
+	if _, err := db.db.Exec("UPDATE audit SET actor_login='mallory' WHERE id=3"); err == nil {
+		t.Error("audit entry updated")
+	}
+	if _, err := db.db.Exec("DELETE FROM audit WHERE actor_login='bob'"); err == nil {
+		t.Error("audit entries deleted")
+	}
+	if entries, err := db.AuditEntries(auditFilter{Login: "bob"}, 0); err != nil || len(entries) != 3 {
+		t.Errorf("%d entries of bob left (%v)", len(entries), err)
+	}
+}
+
+func TestAuditExport(t *testing.T) {
+	db := initTestDB(t)
+	addTestAuditEntries(t, db)
+	s := &server{db: db, tr: func(s string) string { return s }}
+
+	w := httptest.NewRecorder()
+	s.ServeAudit(w, httptest.NewRequest("GET", "/admin/audit?format=json&login=bob", nil))
+	var entries []auditEntry
+	if err := json.NewDecoder(w.Body).Decode(&entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 3 || entries[0].Action != auditAlbumDelete || entries[0].AlbumID != 7 || entries[2].ActorID != 0 {
+		t.Errorf("JSON export: %+v", entries)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/json" {
+		t.Errorf("JSON export served as %q", ct)
+	}
+
+	w = httptest.NewRecorder()
+	s.ServeAudit(w, httptest.NewRequest("GET", "/admin/audit?format=csv&album=7", nil))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 3 || records[0][0] != "id" || len(records[1]) != 10 {
+		t.Fatalf("CSV export: %q", records)
+	}
+	if r := records[1]; r[0] != "5" || r[2] != "2" || r[4] != auditAlbumDelete || r[7] != "" || r[9] != `3 images, "Trip"` {
+		t.Errorf("CSV export: first record %q", r)
+	}
+	if got, want := records[2][1], time.Date(2024, 3, 2, 9, 0, 0, 0, time.Local).UTC().Format(time.RFC3339); got != want {
+		t.Errorf("CSV export: time %q, want %q", got, want)
+	}
+}
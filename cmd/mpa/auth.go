@@ -7,22 +7,20 @@ package main
 import (
 	"context"
 	"errors"
-	"log"
 	"net/http"
 	"strings"
 	"time"
 )
 
-const (
-	sessionDuration   = 3600 // session duration in seconds
-	sessionCookieName = "mpa_sid"
-)
+const sessionCookieName = "mpa_sid"
 
 type sessionKey struct{}
 
 var ErrAuth = errors.New("failed to authenticate")
 
-func (s *server) authenticate(h http.HandlerFunc) http.HandlerFunc {
+// authenticate serves requests of logged in users with the server
+// localized for the language of the user.
+func (s *server) authenticate(h handler) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		api := strings.HasPrefix(r.URL.Path, "/api/")
 		path := r.URL.Path
@@ -33,18 +31,26 @@ func (s *server) authenticate(h http.HandlerFunc) http.HandlerFunc {
 		cookie, err := r.Cookie(sessionCookieName)
 		var extend bool
 		var session SessionData
+		var lang string
 		if err == nil {
-			extend, session, err = s.s.CheckSession(cookie.Value, sessionDuration*time.Second)
+			extend, session, err = s.s.CheckSession(cookie.Value, s.sessionLifetime)
+			if err == nil {
+				lang, err = s.checkUser(cookie.Value, session.Uid)
+			}
 			if err == nil {
 				r = r.WithContext(context.WithValue(r.Context(), sessionKey{}, session))
+				if info := reqInfo(r); info != nil {
+					info.login = session.Login
+				}
 			}
 		}
+		s := s.requestServer(r, lang)
 		if err == ErrNoSuchSession || err == http.ErrNoCookie {
 			s.loginPage(w, r, path, "", !api, http.StatusUnauthorized)
 			return
 		}
 		if err != nil {
-			log.Println(err)
+			logError(r, "session error", "err", err)
 			if api {
 				http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 			} else {
@@ -54,7 +60,7 @@ func (s *server) authenticate(h http.HandlerFunc) http.HandlerFunc {
 		}
 
 		if extend {
-			s.setSessionCookie(w, cookie.Value, 2*sessionDuration)
+			s.setSessionCookie(w, cookie.Value, 2*s.sessionLifetime)
 		}
 		if session.RequirePasswordChange {
 			if api {
@@ -63,20 +69,32 @@ func (s *server) authenticate(h http.HandlerFunc) http.HandlerFunc {
 				s.ServeChangePassword(w, r)
 			}
 		} else {
-			h(w, r)
+			h(s, w, r)
 		}
 	}
 }
 
-func (s *server) authorizeAsAdmin(h http.HandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
+// checkUser returns the language chosen by the user. It removes the
+// session (and returns ErrNoSuchSession) if the account of the user
+// has been disabled since logging in.
+func (s *server) checkUser(sid string, uid int64) (string, error) {
+	disabled, lang, err := s.db.UserStatus(uid)
+	if err == nil && disabled {
+		s.s.Remove(sid)
+		return "", ErrNoSuchSession
+	}
+	return lang, err
+}
+
+func (s *server) authorizeAsAdmin(h handler) handler {
+	return func(s *server, w http.ResponseWriter, r *http.Request) {
 		session, err := s.SessionData(r)
 		if err == nil && session.Admin {
-			h(w, r)
+			h(s, w, r)
 			return
 		}
 		if err != nil {
-			s.internalError(w, err, s.tr("Session error"))
+			s.internalError(w, r, err, s.tr("Session error"))
 			return
 		}
 		s.error(w, s.tr("Authorization error"), s.tr("Admin account required"), http.StatusUnauthorized)
@@ -105,7 +123,7 @@ func (s *server) ServeLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := r.ParseForm(); err != nil {
-		s.parseFormError(w, err)
+		s.parseFormError(w, r, err)
 		return
 	}
 	login := r.PostForm.Get("login")
@@ -114,19 +132,21 @@ func (s *server) ServeLogin(w http.ResponseWriter, r *http.Request) {
 	data, err := s.db.AuthenticateUser(login, []byte(password))
 	if err != nil {
 		if err == ErrAuth {
+			s.auditAs(r, 0, login, auditLoginFailed, auditTarget{}, "")
 			s.loginPage(w, r, redirect, s.tr("Incorrect login or password."), true, http.StatusUnauthorized)
 		} else {
-			log.Println(err)
+			logError(r, "login error", "err", err)
 			s.loginPage(w, r, redirect, s.tr("Internal server error"), true, http.StatusUnauthorized)
 		}
 		return
 	}
-	sid, err := s.s.NewSession(sessionDuration*time.Second, data)
+	sid, err := s.s.NewSession(s.sessionLifetime, data)
 	if err != nil {
-		s.internalError(w, err, s.tr("Session error"))
+		s.internalError(w, r, err, s.tr("Session error"))
 		return
 	}
-	s.setSessionCookie(w, sid, 2*sessionDuration)
+	s.auditAs(r, data.Uid, data.Login, auditLogin, auditTarget{}, "")
+	s.setSessionCookie(w, sid, 2*s.sessionLifetime)
 	http.Redirect(w, r, redirect, http.StatusSeeOther)
 }
 
@@ -144,26 +164,28 @@ func (s *server) ServeAPILogin(w http.ResponseWriter, r *http.Request) {
 	data, err := s.db.AuthenticateUser(login, []byte(password))
 	if err != nil {
 		if err == ErrAuth {
+			s.auditAs(r, 0, login, auditLoginFailed, auditTarget{}, "")
 			http.Error(w, s.tr("Incorrect login or password."), http.StatusUnauthorized)
 		} else {
-			log.Println(err)
+			logError(r, "login error", "err", err)
 			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 		}
 		return
 	}
-	sid, err := s.s.NewSession(sessionDuration*time.Second, data)
+	sid, err := s.s.NewSession(s.sessionLifetime, data)
 	if err != nil {
-		log.Println(err)
+		logError(r, "login error", "err", err)
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 		return
 	}
-	s.setSessionCookie(w, sid, 2*sessionDuration)
+	s.auditAs(r, data.Uid, data.Login, auditLogin, auditTarget{}, "api")
+	s.setSessionCookie(w, sid, 2*s.sessionLifetime)
 	w.WriteHeader(http.StatusOK) // for status logging to work properly
 }
 
-func (s *server) setSessionCookie(w http.ResponseWriter, sid string, duration int) {
-	expires := time.Now().Add(time.Duration(duration) * time.Second)
-	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", Value: sid, MaxAge: duration, Expires: expires, Secure: s.secure})
+func (s *server) setSessionCookie(w http.ResponseWriter, sid string, duration time.Duration) {
+	expires := time.Now().Add(duration)
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", Value: sid, MaxAge: int(duration / time.Second), Expires: expires, Secure: s.secure})
 }
 
 func (s *server) loginPage(w http.ResponseWriter, r *http.Request, path, msg string, fullPage bool, code int) {
@@ -180,7 +202,7 @@ func (s *server) loginPage(w http.ResponseWriter, r *http.Request, path, msg str
 func (s *server) ServeLogout(w http.ResponseWriter, r *http.Request) {
 	cookie, err := r.Cookie(sessionCookieName)
 	if err != nil {
-		log.Println(err)
+		logWarn(r, "logout without session cookie", "err", err)
 	} else {
 		s.s.Remove(cookie.Value)
 	}
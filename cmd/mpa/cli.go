@@ -0,0 +1,319 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Users may be managed from the command line (without a TTY) with
+//
+//	mpa -f DB user add [-name N] [-surname S] [-email E] [-admin] [-password_file F] LOGIN
+//	mpa -f DB user list
+//	mpa -f DB user passwd [-password_file F] LOGIN
+//	mpa -f DB user disable LOGIN
+//	mpa -f DB user enable LOGIN
+//
+// Passwords are read from the file given with -password_file ("-" for
+// the standard input) or from MPA_PASSWORD. If neither is given a
+// random password is generated, printed and the user has to change
+// it on the first login.
+
+var (
+	ErrNoSuchUser = errors.New("no such user")
+	ErrLastAdmin  = errors.New("refusing to disable the last enabled admin")
+)
+
+// adminSpec describes the admin account created on non-interactive
+// initialization.
+type adminSpec struct {
+	login, name, surname, email string
+	passwordFile                string
+}
+
+// defineAdminFlags defines flags of the admin account created by -init
+// (environment variables MPA_ADMIN_* are used for flags not given).
+func defineAdminFlags(fs *flag.FlagSet) *adminSpec {
+	a := &adminSpec{}
+	fs.StringVar(&a.login, "admin_login", "", "login of the admin created by -init (if not given the admin is asked for interactively)")
+	fs.StringVar(&a.name, "admin_name", "", "name of the admin created by -init")
+	fs.StringVar(&a.surname, "admin_surname", "", "surname of the admin created by -init")
+	fs.StringVar(&a.email, "admin_email", "", "email of the admin created by -init")
+	fs.StringVar(&a.passwordFile, "admin_password_file", "", "file with the password of the admin created by -init (- for standard input, default: MPA_ADMIN_PASSWORD)")
+	return a
+}
+
+// newUser returns the admin to be created by -init or nil if it
+// should be asked for interactively.
+func (a *adminSpec) newUser() (*newUser, error) {
+	for _, v := range []struct {
+		p   *string
+		env string
+	}{{&a.login, "MPA_ADMIN_LOGIN"}, {&a.name, "MPA_ADMIN_NAME"}, {&a.surname, "MPA_ADMIN_SURNAME"},
+		{&a.email, "MPA_ADMIN_EMAIL"}, {&a.passwordFile, "MPA_ADMIN_PASSWORD_FILE"}} {
+		if *v.p == "" {
+			*v.p = os.Getenv(v.env)
+		}
+	}
+	if a.login == "" {
+		return nil, nil
+	}
+	u := &newUser{login: a.login, name: a.name, surname: a.surname, email: a.email, admin: true}
+	var err error
+	u.password, u.generated, err = readPassword(a.passwordFile, "MPA_ADMIN_PASSWORD")
+	if err != nil {
+		return nil, err
+	}
+	return u, u.check()
+}
+
+type newUser struct {
+	login, name, surname, email string
+	admin                       bool
+	password                    []byte
+	generated                   bool // password was generated and has to be changed on first login
+}
+
+func (u *newUser) check() error {
+	tr := func(s string) string { return s }
+	if msg, ok := checkLoginName(u.login, tr); !ok {
+		return errors.New(msg)
+	}
+	if !u.generated {
+		if msg, ok := checkPasswordStrength(string(u.password), tr); !ok {
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
+
+func (u *newUser) add(db *DB, tx Execer) error {
+	adminLevel := 0
+	if u.admin {
+		adminLevel = 1
+	}
+	return db.AddUser(tx, u.login, u.name, u.surname, u.email, adminLevel, u.generated, u.password)
+}
+
+// readPassword reads the password from the file (or the standard
+// input if it is "-") or the environment variable. If neither is given
+// it returns a random password (and true).
+func readPassword(file, env string) ([]byte, bool, error) {
+	if file != "" {
+		var r io.Reader = os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, false, err
+			}
+			defer f.Close()
+			r = f
+		}
+		line, err := bufio.NewReader(r).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return nil, false, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			return nil, false, fmt.Errorf("empty password in %s", file)
+		}
+		return []byte(line), false, nil
+	}
+	if p := os.Getenv(env); p != "" {
+		return []byte(p), false, nil
+	}
+	p, err := randomPassword()
+	return p, true, err
+}
+
+// userCommand runs the user subcommand with its arguments.
+func userCommand(db *DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: mpa user add|list|passwd|disable|enable [options] [login]")
+	}
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet("user "+cmd, flag.ContinueOnError)
+	passwordFile := fs.String("password_file", "", "file with the password (- for standard input, default: MPA_PASSWORD or a random password)")
+	var u newUser
+	if cmd == "add" {
+		fs.StringVar(&u.name, "name", "", "name of the user")
+		fs.StringVar(&u.surname, "surname", "", "surname of the user")
+		fs.StringVar(&u.email, "email", "", "email of the user")
+		fs.BoolVar(&u.admin, "admin", false, "if the user is an admin")
+	}
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := db.Upgrade(); err != nil {
+		return err
+	}
+	switch cmd {
+	case "list":
+		if fs.NArg() != 0 {
+			return errors.New("usage: mpa user list")
+		}
+		return db.listUsers(os.Stdout)
+	case "add", "passwd", "disable", "enable":
+	default:
+		return fmt.Errorf("unknown user command: %s", cmd)
+	}
+	if fs.NArg() != 1 {
+		return fmt.Errorf("usage: mpa user %s [options] login", cmd)
+	}
+	login := fs.Arg(0)
+	switch cmd {
+	case "add":
+		u.login = login
+		var err error
+		if u.password, u.generated, err = readPassword(*passwordFile, "MPA_PASSWORD"); err != nil {
+			return err
+		}
+		if err := u.check(); err != nil {
+			return err
+		}
+		if err := u.add(db, db.db); err != nil {
+			return err
+		}
+		uid := db.lookupUid(login)
+		db.cliAudit(auditUserCreate, uid, login)
+		printGenerated(login, u.password, u.generated)
+	case "passwd":
+		uid := db.lookupUid(login)
+		if uid == 0 {
+			return ErrNoSuchUser
+		}
+		password, generated, err := readPassword(*passwordFile, "MPA_PASSWORD")
+		if err != nil {
+			return err
+		}
+		if !generated {
+			if msg, ok := checkPasswordStrength(string(password), func(s string) string { return s }); !ok {
+				return errors.New(msg)
+			}
+		}
+		if err := db.SetPassword(uid, password, generated); err != nil {
+			return err
+		}
+		db.cliAudit(auditPasswordChange, uid, "")
+		printGenerated(login, password, generated)
+	case "disable", "enable":
+		uid := db.lookupUid(login)
+		if uid == 0 {
+			return ErrNoSuchUser
+		}
+		if err := db.SetUserDisabled(uid, cmd == "disable"); err != nil {
+			return err
+		}
+		action := auditUserEnable
+		if cmd == "disable" {
+			action = auditUserDisable
+		}
+		db.cliAudit(action, uid, "")
+	}
+	return nil
+}
+
+func printGenerated(login string, password []byte, generated bool) {
+	if generated {
+		fmt.Printf("Temporary password of %s (to be changed on first login): %s\n", login, password)
+	}
+}
+
+// cliAudit records the action performed from the command line.
+func (db *DB) cliAudit(action string, uid int64, details string) {
+	e := auditEntry{Time: time.Now(), ActorLogin: "(cli)", Action: action, UserID: uid, Details: details}
+	if err := db.AddAuditEntry(&e); err != nil {
+		fmt.Fprintln(os.Stderr, "audit:", err)
+	}
+}
+
+func (db *DB) listUsers(w io.Writer) error {
+	rows, err := db.db.Query("SELECT uid, login, name, surname, email, admin_level, disabled FROM users ORDER BY login")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "UID\tLOGIN\tNAME\tEMAIL\tADMIN\tDISABLED")
+	for rows.Next() {
+		var uid int64
+		var login, name, surname string
+		var email sql.NullString
+		var admin, disabled bool
+		if err := rows.Scan(&uid, &login, &name, &surname, &email, &admin, &disabled); err != nil {
+			return err
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t%s\n", uid, login, strings.TrimSpace(name+" "+surname), email.String, yesNo(admin), yesNo(disabled))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return tw.Flush()
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+// SetPassword sets the password of the user (which has to be changed
+// on the next login if temporary is true).
+func (db *DB) SetPassword(uid int64, password []byte, temporary bool) error {
+	p, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	_, err = db.db.Exec("UPDATE users SET passwordhash=?, require_password_change=? WHERE uid=?", p, temporary, uid)
+	return err
+}
+
+func (db *DB) SetUserDisabled(uid int64, disabled bool) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if disabled {
+		var others int
+		err := tx.QueryRow("SELECT count(*) FROM users WHERE admin_level > 0 AND NOT disabled AND uid<>?", uid).Scan(&others)
+		if err != nil {
+			return err
+		}
+		var admin bool
+		if err := tx.QueryRow("SELECT admin_level > 0 FROM users WHERE uid=?", uid).Scan(&admin); err != nil {
+			return err
+		}
+		if admin && others == 0 {
+			return ErrLastAdmin
+		}
+	}
+	if _, err := tx.Exec("UPDATE users SET disabled=? WHERE uid=?", disabled, uid); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// UserStatus reports whether the account of the user is disabled and
+// returns the language chosen by the user.
+func (db *DB) UserStatus(uid int64) (disabled bool, lang string, err error) {
+	err = db.db.QueryRow("SELECT disabled, lang FROM users WHERE uid=?", uid).Scan(&disabled, &lang)
+	if err == sql.ErrNoRows {
+		return true, "", nil
+	}
+	return
+}
@@ -0,0 +1,52 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestUserAddWithoutEmail(t *testing.T) {
+	db := openTestDB(t)
+	t.Setenv("MPA_PASSWORD", "Secret1!x")
+	admin := &newUser{login: "admin", admin: true, password: []byte("Secret1!x")}
+	if err := db.Init("en", admin); err != nil {
+		t.Fatal(err)
+	}
+	if err := userCommand(db, []string{"add", "-name", "Bob", "bob"}); err != nil {
+		t.Fatalf("adding first user without email: %v", err)
+	}
+	if err := userCommand(db, []string{"add", "carol"}); err != nil {
+		t.Fatalf("adding second user without email: %v", err)
+	}
+	if err := userCommand(db, []string{"add", "-email", "dave@example.com", "dave"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := userCommand(db, []string{"add", "-email", "dave@example.com", "eve"}); err == nil {
+		t.Error("adding user with email already registered succeeded")
+	}
+	if err := userCommand(db, []string{"add", "bob"}); err == nil {
+		t.Error("adding user with login already registered succeeded")
+	}
+
+	var buf bytes.Buffer
+	if err := db.listUsers(&buf); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 5 { // header and 4 users
+		t.Fatalf("user list:\n%s\nwant 4 users", buf.String())
+	}
+	for _, login := range []string{"admin", "bob", "carol", "dave"} {
+		if db.lookupUid(login) == 0 {
+			t.Errorf("user %s not found", login)
+		}
+	}
+	if _, err := db.AuthenticateUser("carol", []byte("Secret1!x")); err != nil {
+		t.Errorf("authenticating user added without email: %v", err)
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"time"
+)
+
+// collection is a named group of albums of a single user.
+type collection struct {
+	Id        int64
+	OwnerID   int64
+	Name      string
+	AlbumsCnt int64
+}
+
+// Collections returns non empty collections (of all users if uid is
+// zero) ordered by name.
+func (db *DB) Collections(uid int64) ([]collection, error) {
+	rows, err := db.db.Query(`
+SELECT collections.cid, collections.owner_id, collections.name, count(albums.aid)
+FROM collections JOIN albums
+ON collections.cid = albums.collection_id
+WHERE ?=0 OR collections.owner_id=?
+GROUP BY collections.cid
+ORDER BY collections.name
+`, uid, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cs []collection
+	for rows.Next() {
+		var c collection
+		if err := rows.Scan(&c.Id, &c.OwnerID, &c.Name, &c.AlbumsCnt); err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+// setAlbumCollection puts the album into the collection of the given
+// name (creating it if needed) or removes it from its collection if
+// name is empty. Collections left without albums are deleted.
+func setAlbumCollection(tx *sql.Tx, uid, albumID int64, name string) error {
+	var collectionID sql.NullInt64
+	if name != "" {
+		err := tx.QueryRow("SELECT cid FROM collections WHERE owner_id=? AND name=?", uid, name).Scan(&collectionID)
+		if err == sql.ErrNoRows {
+			r, err := tx.Exec("INSERT INTO collections (owner_id, name) VALUES (?, ?)", uid, name)
+			if err != nil {
+				return err
+			}
+			if collectionID.Int64, err = r.LastInsertId(); err != nil {
+				return err
+			}
+			collectionID.Valid = true
+		} else if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec("UPDATE albums SET collection_id=? WHERE aid=?", collectionID, albumID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM collections WHERE owner_id=? AND NOT EXISTS(SELECT 1 FROM albums WHERE collection_id=collections.cid)", uid)
+	return err
+}
+
+// albumDates returns the event date range of the album as set
+// manually (dateFrom, dateTo in 2006-01-02 format) or otherwise as
+// derived from capture times of the first and the last image (as
+// stored in the database).
+func albumDates(dateFrom, dateTo, firstCreated, lastCreated string) string {
+	if dateFrom == "" {
+		dateFrom = dbDate(firstCreated)
+	}
+	if dateTo == "" {
+		dateTo = dbDate(lastCreated)
+	}
+	switch {
+	case dateFrom == dateTo || dateTo == "":
+		return dateFrom
+	case dateFrom == "":
+		return dateTo
+	}
+	return dateFrom + " – " + dateTo
+}
+
+func dbDate(s string) string {
+	if s == "" {
+		return ""
+	}
+	t, err := parseDBTime(s)
+	if err != nil {
+		return ""
+	}
+	return t.Format("2006-01-02")
+}
+
+func validDate(s string) bool {
+	if s == "" {
+		return true
+	}
+	_, err := time.Parse("2006-01-02", s)
+	return err == nil
+}
@@ -0,0 +1,423 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Comments are stored in the comments table either on an album
+// (image_id 0) or on an image (album_id 0). Comments on an image
+// belong to the album the image is currently in, so they follow images
+// transferred to other albums. Like albums, they are visible to all
+// logged in users; authors may edit and delete their comments and
+// owners of albums may delete any comment on their albums and images.
+//
+// Comments on items moved to the trash get trash_id set to the trash
+// ID of the item so that they are neither shown nor attached to a new
+// item reusing its ID. They are restored with the item and removed
+// when it is removed from the trash. A trigger created by
+// migrateComments removes comments of albums deleted otherwise (such
+// as emptied by a transfer of images).
+
+const maxCommentLength = 2000
+
+var (
+	ErrCommentNotFound  = errors.New("comment not found")
+	ErrNotCommentAuthor = errors.New("not the author of the comment")
+)
+
+type comment struct {
+	Id        int64     `json:"id"`
+	AlbumID   int64     `json:"album_id,omitempty"`
+	ImageID   int64     `json:"image_id,omitempty"`
+	UserID    int64     `json:"user_id"`
+	Author    string    `json:"author"`
+	Text      string    `json:"text"`
+	Created   time.Time `json:"created"`
+	Modified  time.Time `json:"modified"`
+	Edited    bool      `json:"edited"`
+	CanEdit   bool      `json:"can_edit"`
+	CanDelete bool      `json:"can_delete"`
+}
+
+// setPermissions sets what the user may do with the comment on the
+// album (or image of the album) of the given owner.
+func (c *comment) setPermissions(uid, ownerID int64) {
+	c.CanEdit = c.UserID == uid
+	c.CanDelete = c.CanEdit || ownerID == uid
+}
+
+const commentColumns = `c.cid, c.album_id, c.image_id, c.user_id, COALESCE(u.login, ''), COALESCE(u.name, ''), COALESCE(u.surname, ''),
+c.text, c.created, c.modified`
+
+func scanComment(row interface{ Scan(...interface{}) error }) (comment, error) {
+	var c comment
+	var login, name, surname string
+	var created, modified int64
+	err := row.Scan(&c.Id, &c.AlbumID, &c.ImageID, &c.UserID, &login, &name, &surname, &c.Text, &created, &modified)
+	c.Author = strings.TrimSpace(name + " " + surname)
+	if c.Author == "" {
+		c.Author = login
+	}
+	c.Created = time.Unix(created, 0)
+	c.Modified = time.Unix(modified, 0)
+	c.Edited = modified != created
+	return c, err
+}
+
+// commentAlbumOwner returns the owner of the album commented on (or of
+// the album of the image commented on). ErrCommentNotFound is returned
+// if there is no such album or image.
+func commentAlbumOwner(q Queryer, albumID, imageID int64) (int64, error) {
+	var ownerID int64
+	var err error
+	if imageID != 0 {
+		err = q.QueryRow("SELECT albums.owner_id FROM images JOIN albums ON images.album_id=albums.aid WHERE images.iid=?", imageID).Scan(&ownerID)
+	} else {
+		err = q.QueryRow("SELECT owner_id FROM albums WHERE aid=?", albumID).Scan(&ownerID)
+	}
+	if err == sql.ErrNoRows {
+		return 0, ErrCommentNotFound
+	}
+	return ownerID, err
+}
+
+// Comments returns comments on the album (if imageID is zero) or on
+// the image, oldest first, with permissions of the user set.
+func (db *DB) Comments(uid, albumID, imageID int64) ([]comment, error) {
+	ownerID, err := commentAlbumOwner(db.db, albumID, imageID)
+	if err != nil {
+		return nil, err
+	}
+	if imageID != 0 {
+		albumID = 0
+	}
+	rows, err := db.db.Query(`
+SELECT `+commentColumns+`
+FROM comments AS c LEFT JOIN users AS u ON c.user_id=u.uid
+WHERE c.album_id=? AND c.image_id=? AND c.trash_id IS NULL
+ORDER BY c.created, c.cid`, albumID, imageID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var cs []comment
+	for rows.Next() {
+		c, err := scanComment(rows)
+		if err != nil {
+			return nil, err
+		}
+		c.setPermissions(uid, ownerID)
+		cs = append(cs, c)
+	}
+	return cs, rows.Err()
+}
+
+// comment returns the comment (not in the trash) and the owner of the
+// album it is on.
+func (db *DB) comment(q Queryer, cid int64) (comment, int64, error) {
+	c, err := scanComment(q.QueryRow(`
+SELECT `+commentColumns+`
+FROM comments AS c LEFT JOIN users AS u ON c.user_id=u.uid
+WHERE c.cid=? AND c.trash_id IS NULL`, cid))
+	if err == sql.ErrNoRows {
+		return c, 0, ErrCommentNotFound
+	} else if err != nil {
+		return c, 0, err
+	}
+	ownerID, err := commentAlbumOwner(q, c.AlbumID, c.ImageID)
+	return c, ownerID, err
+}
+
+// AddComment adds the comment of the user on the album (if imageID is
+// zero) or on the image.
+func (db *DB) AddComment(uid, albumID, imageID int64, text string) (comment, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return comment{}, err
+	}
+	defer tx.Rollback()
+	if _, err := commentAlbumOwner(tx, albumID, imageID); err != nil {
+		return comment{}, err
+	}
+	if imageID != 0 {
+		albumID = 0
+	}
+	now := time.Now().UTC().Unix()
+	r, err := tx.Exec("INSERT INTO comments (album_id, image_id, user_id, text, created, modified) VALUES (?, ?, ?, ?, ?, ?)",
+		albumID, imageID, uid, text, now, now)
+	if err != nil {
+		return comment{}, err
+	}
+	cid, err := r.LastInsertId()
+	if err != nil {
+		return comment{}, err
+	}
+	c, ownerID, err := db.comment(tx, cid)
+	if err != nil {
+		return comment{}, err
+	}
+	c.setPermissions(uid, ownerID)
+	return c, tx.Commit()
+}
+
+// EditComment changes the text of the comment of the user.
+func (db *DB) EditComment(uid, cid int64, text string) (comment, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return comment{}, err
+	}
+	defer tx.Rollback()
+	c, ownerID, err := db.comment(tx, cid)
+	if err != nil {
+		return comment{}, err
+	}
+	if c.UserID != uid {
+		return comment{}, ErrNotCommentAuthor
+	}
+	if text == c.Text {
+		c.setPermissions(uid, ownerID)
+		return c, nil
+	}
+	now := time.Now().UTC().Unix()
+	if _, err := tx.Exec("UPDATE comments SET text=?, modified=? WHERE cid=?", text, now, cid); err != nil {
+		return comment{}, err
+	}
+	c.Text = text
+	c.Modified = time.Unix(now, 0)
+	c.Edited = true
+	c.setPermissions(uid, ownerID)
+	return c, tx.Commit()
+}
+
+// DeleteComment deletes the comment if the user is its author or the
+// owner of the album it is on. The deleted comment is returned.
+func (db *DB) DeleteComment(uid, cid int64) (comment, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return comment{}, err
+	}
+	defer tx.Rollback()
+	c, ownerID, err := db.comment(tx, cid)
+	if err != nil {
+		return comment{}, err
+	}
+	c.setPermissions(uid, ownerID)
+	if !c.CanDelete {
+		return comment{}, ErrNotCommentAuthor
+	}
+	if _, err := tx.Exec("DELETE FROM comments WHERE cid=?", cid); err != nil {
+		return comment{}, err
+	}
+	return c, tx.Commit()
+}
+
+// trashComments marks comments on the image (or album if imageID is
+// zero) as moved to the trash with the item of the given trash ID.
+func trashComments(tx *sql.Tx, albumID, imageID, tid int64) error {
+	var err error
+	if imageID != 0 {
+		_, err = tx.Exec("UPDATE comments SET trash_id=? WHERE album_id=0 AND image_id=? AND trash_id IS NULL", tid, imageID)
+	} else {
+		_, err = tx.Exec("UPDATE comments SET trash_id=? WHERE album_id=? AND image_id=0 AND trash_id IS NULL", tid, albumID)
+	}
+	return err
+}
+
+// restoreImageComments restores comments of the image of the given
+// trash ID restored as imageID.
+func restoreImageComments(tx *sql.Tx, tid, imageID int64) error {
+	_, err := tx.Exec("UPDATE comments SET image_id=?, trash_id=NULL WHERE album_id=0 AND trash_id=?", imageID, tid)
+	return err
+}
+
+// restoreAlbumComments restores comments of the album of the given
+// trash ID restored as albumID.
+func restoreAlbumComments(tx *sql.Tx, tid, albumID int64) error {
+	_, err := tx.Exec("UPDATE comments SET album_id=?, trash_id=NULL WHERE image_id=0 AND trash_id=?", albumID, tid)
+	return err
+}
+
+// purgeComments removes comments of items no longer in the trash.
+func purgeComments(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+DELETE FROM comments WHERE trash_id IS NOT NULL AND
+((album_id=0 AND trash_id NOT IN (SELECT tid FROM trash_images)) OR (image_id=0 AND trash_id NOT IN (SELECT tid FROM trash_albums)))`)
+	return err
+}
+
+// moveAlbumComments moves comments on the album to another album (into
+// which it is merged).
+func moveAlbumComments(tx *sql.Tx, from, to int64) error {
+	_, err := tx.Exec("UPDATE comments SET album_id=? WHERE album_id=? AND image_id=0 AND trash_id IS NULL", to, from)
+	return err
+}
+
+// checkCommentText returns the trimmed text of the comment and a
+// message describing why it is invalid (or "").
+func (s *server) checkCommentText(text string) (string, string) {
+	text = strings.TrimSpace(text)
+	switch {
+	case text == "":
+		return text, s.tr("Comment must not be empty")
+	case utf8.RuneCountInString(text) > maxCommentLength:
+		return text, fmt.Sprintf(s.tr("Comment must have at most %d characters"), maxCommentLength)
+	}
+	return text, ""
+}
+
+// commentTarget returns the album and image IDs given in the album or
+// image parameter of the form (or query).
+func commentTarget(get func(string) string) (albumID, imageID int64, err error) {
+	if v := get("image"); v != "" {
+		imageID, err = strconv.ParseInt(v, 10, 64)
+	} else {
+		albumID, err = strconv.ParseInt(get("album"), 10, 64)
+	}
+	if err == nil && albumID <= 0 && imageID <= 0 {
+		err = ErrCommentNotFound
+	}
+	return
+}
+
+// commentError writes the response for errors returned by comment
+// methods of DB.
+func (s *server) commentError(w http.ResponseWriter, r *http.Request, err error) {
+	switch err {
+	case ErrCommentNotFound:
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+	case ErrNotCommentAuthor:
+		http.Error(w, s.tr("You may not change this comment"), http.StatusForbidden)
+	default:
+		logError(r, "comment error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ServeAPIComments returns comments on the album or image given by the
+// album or image query parameter:
+//
+//	GET /api/comments?album=ID
+//	GET /api/comments?image=ID
+func (s *server) ServeAPIComments(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := s.SessionData(r)
+	if err != nil {
+		logError(r, "session error", "err", err)
+		http.Error(w, s.tr("Authorization error"), http.StatusForbidden)
+		return
+	}
+	albumID, imageID, err := commentTarget(r.URL.Query().Get)
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	cs, err := s.db.Comments(session.Uid, albumID, imageID)
+	if err != nil {
+		s.commentError(w, r, err)
+		return
+	}
+	if cs == nil {
+		cs = []comment{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Comments []comment `json:"comments"`
+	}{cs})
+}
+
+// ServeAPINewComment adds a comment with the text given in the text
+// field of the form on the album or image given in its album or image
+// field. The new comment is returned.
+func (s *server) ServeAPINewComment(w http.ResponseWriter, r *http.Request) {
+	session, form, ok := s.parseAPIForm(w, r)
+	if !ok {
+		return
+	}
+	albumID, imageID, err := commentTarget(form.Get)
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	text, msg := s.checkCommentText(form.Get("text"))
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	c, err := s.db.AddComment(session.Uid, albumID, imageID, text)
+	if err != nil {
+		s.commentError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &c)
+}
+
+// ServeAPIEditComment changes the text of the comment given in the
+// path to the one given in the text field of the form. The changed
+// comment is returned.
+func (s *server) ServeAPIEditComment(w http.ResponseWriter, r *http.Request) {
+	cid, err := idFromPath(r.URL.Path, "/api/edit/comment/")
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	session, form, ok := s.parseAPIForm(w, r)
+	if !ok {
+		return
+	}
+	text, msg := s.checkCommentText(form.Get("text"))
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	c, err := s.db.EditComment(session.Uid, cid, text)
+	if err != nil {
+		s.commentError(w, r, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, &c)
+}
+
+// ServeAPIDeleteComment deletes the comment given in the path.
+// Deletions of comments of other users by owners of albums are
+// audited.
+func (s *server) ServeAPIDeleteComment(w http.ResponseWriter, r *http.Request) {
+	cid, err := idFromPath(r.URL.Path, "/api/delete/comment/")
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	session, _, ok := s.parseAPIForm(w, r)
+	if !ok {
+		return
+	}
+	c, err := s.db.DeleteComment(session.Uid, cid)
+	if err != nil {
+		s.commentError(w, r, err)
+		return
+	}
+	if c.UserID != session.Uid {
+		s.auditAs(r, session.Uid, session.Login, auditCommentDelete, auditTarget{Album: c.AlbumID, Image: c.ImageID, User: c.UserID},
+			fmt.Sprintf("comment %d: %q", c.Id, c.Text))
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
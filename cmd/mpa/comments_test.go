@@ -0,0 +1,199 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// addTestUsers adds users of the given logins (after admin of uid 1)
+// so that they get consecutive uids starting from 2.
+func addTestUsers(t *testing.T, db *DB, logins ...string) {
+	t.Helper()
+	for _, login := range logins {
+		if err := db.AddUser(db.db, login, "", "", "", 0, false, []byte("Secret1!x")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestCommentPermissions(t *testing.T) {
+	// comment of user 2 on the album of user 1
+	tests := []struct {
+		uid                int64
+		canEdit, canDelete bool
+	}{
+		{1, false, true}, // owner of the album
+		{2, true, true},  // author
+		{3, false, false},
+	}
+	for _, tt := range tests {
+		c := comment{UserID: 2}
+		c.setPermissions(tt.uid, 1)
+		if c.CanEdit != tt.canEdit || c.CanDelete != tt.canDelete {
+			t.Errorf("user %d: CanEdit=%t CanDelete=%t, want %t %t", tt.uid, c.CanEdit, c.CanDelete, tt.canEdit, tt.canDelete)
+		}
+	}
+	// comment of the owner on own album
+	c := comment{UserID: 1}
+	if c.setPermissions(1, 1); !c.CanEdit || !c.CanDelete {
+		t.Error("owner cannot edit or delete own comment")
+	}
+}
+
+func TestDeleteComment(t *testing.T) {
+	db := initTestDB(t)
+	addTestUsers(t, db, "bob", "carol")
+	albumID, ids := addTestAlbum(t, db, 1, "Trip", testSum('a'))
+
+	c, err := db.AddComment(2, albumID, 0, "Nice trip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.CanEdit || !c.CanDelete || c.AlbumID != albumID || c.ImageID != 0 || c.Author != "bob" {
+		t.Fatalf("added comment %+v", c)
+	}
+	if _, err := db.EditComment(1, c.Id, "Changed"); err != ErrNotCommentAuthor {
+		t.Errorf("owner of the album editing comment of other user: got %v, want %v", err, ErrNotCommentAuthor)
+	}
+	if _, err := db.DeleteComment(3, c.Id); err != ErrNotCommentAuthor {
+		t.Errorf("other user deleting comment: got %v, want %v", err, ErrNotCommentAuthor)
+	}
+	if _, err := db.DeleteComment(1, c.Id); err != nil {
+		t.Errorf("owner of the album deleting comment: %v", err)
+	}
+	if _, err := db.DeleteComment(1, c.Id); err != ErrCommentNotFound {
+		t.Errorf("deleting deleted comment: got %v, want %v", err, ErrCommentNotFound)
+	}
+
+	c, err = db.AddComment(3, albumID, ids[0], "Nice view")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.DeleteComment(2, c.Id); err != ErrNotCommentAuthor {
+		t.Errorf("other user deleting comment on image: got %v, want %v", err, ErrNotCommentAuthor)
+	}
+	if d, err := db.DeleteComment(3, c.Id); err != nil || d.Text != "Nice view" {
+		t.Errorf("author deleting comment on image: %+v, %v", d, err)
+	}
+	if cs, err := db.Comments(1, albumID, ids[0]); err != nil || len(cs) != 0 {
+		t.Errorf("image has comments %+v (%v) after deleting", cs, err)
+	}
+	if _, err := db.AddComment(2, albumID, ids[0]+1, "No such image"); err != ErrCommentNotFound {
+		t.Errorf("commenting missing image: got %v, want %v", err, ErrCommentNotFound)
+	}
+}
+
+func TestCommentsInTrash(t *testing.T) {
+	db := initTestDB(t)
+	addTestUsers(t, db, "bob")
+	albumID, ids := addTestAlbum(t, db, 1, "Trip", testSum('a'), testSum('b'))
+	for _, c := range []struct {
+		imageID int64
+		text    string
+	}{
+		{0, "on album"},
+		{ids[0], "on image a"},
+		{ids[1], "on image b"},
+	} {
+		if _, err := db.AddComment(2, albumID, c.imageID, c.text); err != nil {
+			t.Fatal(err)
+		}
+	}
+	texts := func(imageID int64) []string {
+		t.Helper()
+		cs, err := db.Comments(2, albumID, imageID)
+		if err != nil {
+			t.Fatalf("comments of album %d image %d: %v", albumID, imageID, err)
+		}
+		var ts []string
+		for _, c := range cs {
+			ts = append(ts, c.Text)
+		}
+		return ts
+	}
+	trashed := func() int {
+		t.Helper()
+		var n int
+		if err := db.db.QueryRow("SELECT count(*) FROM comments WHERE trash_id IS NOT NULL").Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	if err := db.DeleteAlbum(1, albumID, 2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Comments(2, albumID, 0); err != ErrCommentNotFound {
+		t.Errorf("comments of deleted album: got %v, want %v", err, ErrCommentNotFound)
+	}
+	if n := trashed(); n != 3 {
+		t.Errorf("%d comments in the trash, want 3", n)
+	}
+	// a new album reusing the ID does not get the comments
+	now := time.Now().UTC()
+	if _, err := db.db.Exec("INSERT INTO albums (aid, owner_id, image_id, is_portrait, created, modified, name) VALUES (?, 1, 0, 0, ?, ?, 'New')", albumID, now, now); err != nil {
+		t.Fatal(err)
+	}
+	if ts := texts(0); len(ts) != 0 {
+		t.Errorf("new album reusing ID of deleted one has comments %q", ts)
+	}
+
+	albums, _, err := db.Trash(1)
+	if err != nil || len(albums) != 1 {
+		t.Fatalf("trash has %d albums (%v)", len(albums), err)
+	}
+	if _, err := db.RestoreTrash(1, []int64{albums[0].Tid}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := trashed(); n != 0 {
+		t.Errorf("%d comments left in the trash after restoring", n)
+	}
+	// the album is restored with a new ID as the old one is taken
+	var restoredID int64
+	if err := db.db.QueryRow("SELECT aid FROM albums WHERE name='Trip'").Scan(&restoredID); err != nil {
+		t.Fatal(err)
+	}
+	albumID = restoredID
+	restored := testAlbumImages(t, db, albumID)
+	if len(restored) != 2 {
+		t.Fatalf("restored album has images %v", restored)
+	}
+	for i, want := range []string{"on album", "on image a", "on image b"} {
+		imageID := int64(0)
+		if i > 0 {
+			imageID = restored[i-1]
+		}
+		if ts := texts(imageID); len(ts) != 1 || ts[0] != want {
+			t.Errorf("restored item %d has comments %q, want %q", imageID, ts, want)
+		}
+	}
+
+	// the image goes to the trash on its own and is purged from it
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := trashImage(tx, 1, albumID, restored[1], now.Unix()); !ok || err != nil {
+		t.Fatalf("trashImage = %t, %v", ok, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if n := trashed(); n != 1 {
+		t.Errorf("%d comments in the trash, want 1", n)
+	}
+	if _, err := db.PurgeTrash(1, now.Add(time.Minute).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := db.db.QueryRow("SELECT count(*) FROM comments").Scan(&n); err != nil || n != 2 {
+		t.Errorf("%d comments left after purging the trash (%v), want 2", n, err)
+	}
+	if ts := texts(0); len(ts) != 1 {
+		t.Errorf("album has comments %q after purging its image", ts)
+	}
+}
@@ -0,0 +1,274 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Configuration is taken (in order of increasing priority) from
+// defaults, the config file (given with -config or MPA_CONFIG),
+// MPA_* environment variables (such as MPA_HTTP or MPA_SESSION_LIFETIME)
+// and command line flags. Config keys are flag names (with database
+// for -f). The config file uses a subset of TOML: key = value lines
+// where value is a quoted string, an integer or a boolean, and
+// comments starting with #.
+//
+// Example:
+//
+//	database = "/data/mpa.db"
+//	files_dir = "/data/files"
+//	http = ":4000"
+//	session_lifetime = "8h"
+//	workers = 2
+
+type config struct {
+	dbFileName      string
+	filesDir        string // defaults to dbFileName + ".mpa"
+	httpAddr        string
+	metricsAddr     string
+	insecureCookie  bool
+	ffmpegPath      string
+	heicConverter   string
+	logFormat       string
+	logLevel        string
+	sessionLifetime time.Duration
+	workers         int // 0 for the number of CPUs
+	maxChunkSize    int64
+	uploadExpiry    time.Duration
+	lang            string // "" for the language set in the database
+	localeDir       string
+	themeDir        string
+	dev             bool // read templates and static files from the working directory
+}
+
+// configKeys maps config keys to flag names (which differ only for
+// the database file).
+var configKeys = map[string]string{
+	"database":         "f",
+	"files_dir":        "files_dir",
+	"http":             "http",
+	"metrics_http":     "metrics_http",
+	"insecure_cookie":  "insecure_cookie",
+	"ffmpeg":           "ffmpeg",
+	"heic_converter":   "heic_converter",
+	"log_format":       "log_format",
+	"log_level":        "log_level",
+	"session_lifetime": "session_lifetime",
+	"workers":          "workers",
+	"max_chunk_size":   "max_chunk_size",
+	"upload_expiry":    "upload_expiry",
+	"lang":             "lang",
+	"locale_dir":       "locale_dir",
+	"theme_dir":        "theme_dir",
+	"dev":              "dev",
+}
+
+// mibValue is a flag value given in MiB and stored in bytes.
+type mibValue struct{ p *int64 }
+
+func (v mibValue) String() string {
+	if v.p == nil {
+		return ""
+	}
+	return formatMiB(*v.p)
+}
+
+func (v mibValue) Set(s string) error {
+	n, ok := parseMiB(s)
+	if !ok || n == nil {
+		return errors.New("expected a number of MiB")
+	}
+	*v.p = n.(int64)
+	return nil
+}
+
+// newConfig defines flags of configuration options in fs and returns
+// the configuration to be filled by parsing the flags and by load.
+func newConfig(fs *flag.FlagSet) *config {
+	c := &config{maxChunkSize: 64 << 20}
+	fs.StringVar(&c.dbFileName, "f", "", "sqlite3 database file name")
+	fs.StringVar(&c.filesDir, "files_dir", "", "directory of stored images and previews (default: database file name with .mpa suffix)")
+	fs.StringVar(&c.httpAddr, "http", ":8080", "HTTP listen address")
+	fs.StringVar(&c.metricsAddr, "metrics_http", "", "separate listen address serving /metrics without authentication (if empty /metrics is served to admins on the main address)")
+	fs.BoolVar(&c.insecureCookie, "insecure_cookie", false, "if client should send cookie over plain HTTP connection")
+	fs.StringVar(&c.ffmpegPath, "ffmpeg", "ffmpeg", "path to ffmpeg binary used to process videos (empty to disable)")
+	fs.StringVar(&c.heicConverter, "heic_converter", "heif-convert", "program converting HEIC images to JPEG, called as: program input output.jpg (empty to disable)")
+	fs.StringVar(&c.logFormat, "log_format", "text", "log format: text, json or combined (text with access log in Apache combined log format)")
+	fs.StringVar(&c.logLevel, "log_level", "info", "minimum level of logged messages: debug, info, warn or error")
+	fs.DurationVar(&c.sessionLifetime, "session_lifetime", time.Hour, "time after the last request after which the user has to log in again")
+	fs.IntVar(&c.workers, "workers", 0, "number of workers creating previews (0 for the number of CPUs)")
+	fs.Var(mibValue{&c.maxChunkSize}, "max_chunk_size", "maximum size of a chunk of a resumable upload in MiB")
+	fs.DurationVar(&c.uploadExpiry, "upload_expiry", 24*time.Hour, "time after the last received chunk after which unfinished resumable uploads are removed")
+	fs.StringVar(&c.lang, "lang", "", "default language of the user interface, such as en or pl (default: as set on database initialization)")
+	fs.StringVar(&c.themeDir, "theme_dir", "", "directory with templates and static subdirectories of files replacing the built-in ones")
+	fs.BoolVar(&c.dev, "dev", false, "development mode: read templates and static files from the working directory on each request")
+	fs.StringVar(&c.localeDir, "locale_dir", "", "directory of message catalogs (LANG.json files) adding or changing languages of the user interface")
+	return c
+}
+
+// load sets options not given on the command line from the
+// environment and from the config file, and validates the
+// configuration.
+func (c *config) load(fs *flag.FlagSet, configFile string) error {
+	explicit := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	set := func(key, value, source string) error {
+		name, ok := configKeys[key]
+		if !ok {
+			return fmt.Errorf("%s: unknown option %s", source, key)
+		}
+		if explicit[name] {
+			return nil
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s: invalid value %q of %s: %v", source, value, key, err)
+		}
+		return nil
+	}
+	if configFile == "" {
+		configFile = os.Getenv("MPA_CONFIG")
+	}
+	if configFile != "" {
+		f, err := os.Open(configFile)
+		if err != nil {
+			return err
+		}
+		values, err := parseConfigFile(f, configFile)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		for _, kv := range values {
+			if err := set(kv[0], kv[1], fmt.Sprintf("%s:%s", configFile, kv[2])); err != nil {
+				return err
+			}
+		}
+	}
+	for key := range configKeys {
+		env := "MPA_" + strings.ToUpper(key)
+		if value, ok := os.LookupEnv(env); ok {
+			if err := set(key, value, env); err != nil {
+				return err
+			}
+		}
+	}
+	return c.validate()
+}
+
+func (c *config) validate() error {
+	switch {
+	case c.dbFileName == "":
+		return errors.New("database file name not given (use option -f, database in the config file or MPA_DATABASE)")
+	case c.sessionLifetime < time.Minute:
+		return errors.New("session_lifetime must be at least 1m")
+	case c.workers < 0:
+		return errors.New("workers must not be negative")
+	case c.maxChunkSize <= 0:
+		return errors.New("max_chunk_size must be positive")
+	case c.uploadExpiry < time.Hour:
+		return errors.New("upload_expiry must be at least 1h")
+	case c.lang != "" && c.localeDir == "" && translations[c.lang] == nil:
+		return fmt.Errorf("unsupported language: %s", c.lang)
+	}
+	if c.filesDir == "" {
+		c.filesDir = c.dbFileName + ".mpa"
+	}
+	if _, err := parseLogLevel(c.logLevel); err != nil {
+		return err
+	}
+	switch c.logFormat {
+	case logFormatText, logFormatJSON, logFormatCombined:
+	default:
+		return fmt.Errorf("unsupported log format %q (expected text, json or combined)", c.logFormat)
+	}
+	return nil
+}
+
+// parseConfigFile returns key, value and line number triples of the
+// config file.
+func parseConfigFile(r io.Reader, name string) ([][3]string, error) {
+	var values [][3]string
+	seen := make(map[string]bool)
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		i := strings.IndexByte(line, '=')
+		if i < 0 {
+			return nil, fmt.Errorf("%s:%d: expected key = value", name, n)
+		}
+		key := strings.TrimSpace(line[:i])
+		value, err := parseConfigValue(strings.TrimSpace(line[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", name, n, err)
+		}
+		if seen[key] {
+			return nil, fmt.Errorf("%s:%d: duplicate key %s", name, n, key)
+		}
+		seen[key] = true
+		values = append(values, [3]string{key, value, strconv.Itoa(n)})
+	}
+	return values, sc.Err()
+}
+
+// tomlInteger matches decimal integers with optional underscores
+// between digits.
+var tomlInteger = regexp.MustCompile(`^[+-]?[0-9]+(_[0-9]+)*$`)
+
+// parseConfigValue parses a TOML string (basic or literal), integer
+// or boolean followed by an optional comment.
+func parseConfigValue(s string) (string, error) {
+	var value, rest string
+	switch {
+	case strings.HasPrefix(s, `"`):
+		i := 1
+		for ; i < len(s) && s[i] != '"'; i++ {
+			if s[i] == '\\' {
+				i++
+			}
+		}
+		if i >= len(s) {
+			return "", errors.New("unterminated string")
+		}
+		v, err := strconv.Unquote(s[:i+1])
+		if err != nil {
+			return "", fmt.Errorf("invalid string %s", s[:i+1])
+		}
+		value, rest = v, s[i+1:]
+	case strings.HasPrefix(s, "'"):
+		i := strings.IndexByte(s[1:], '\'')
+		if i < 0 {
+			return "", errors.New("unterminated string")
+		}
+		value, rest = s[1:i+1], s[i+2:]
+	default:
+		value = s
+		if i := strings.IndexByte(s, '#'); i >= 0 {
+			value, rest = s[:i], s[i:]
+		}
+		value = strings.TrimSpace(value)
+		if tomlInteger.MatchString(value) {
+			value = strings.ReplaceAll(value, "_", "")
+		} else if value != "true" && value != "false" {
+			return "", fmt.Errorf("invalid value %q (strings must be quoted)", value)
+		}
+	}
+	if rest = strings.TrimSpace(rest); rest != "" && rest[0] != '#' {
+		return "", fmt.Errorf("unexpected %q after value", rest)
+	}
+	return value, nil
+}
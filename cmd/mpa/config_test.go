@@ -0,0 +1,169 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		s, want string
+		ok      bool
+	}{
+		{`"/data/mpa.db"`, "/data/mpa.db", true},
+		{`"a \"quoted\" \\ value"`, `a "quoted" \ value`, true},
+		{`"tab\there"`, "tab\there", true},
+		{`'C:\photos'`, `C:\photos`, true},
+		{`"# not a comment"`, "# not a comment", true},
+		{`":4000" # comment`, ":4000", true},
+		{`'x'#comment`, "x", true},
+		{"42", "42", true},
+		{"-3", "-3", true},
+		{"1_000_000", "1000000", true},
+		{"8 # workers", "8", true},
+		{"true", "true", true},
+		{"false", "false", true},
+		{"_1", "", false},
+		{"1_", "", false},
+		{"1__0", "", false},
+		{"1h", "", false}, // durations are strings
+		{"yes", "", false},
+		{`"unterminated`, "", false},
+		{`'unterminated`, "", false},
+		{`"a" "b"`, "", false},
+		{`"bad \q escape"`, "", false},
+		{"", "", false},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigValue(tt.s)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseConfigValue(%q) = %q, %v, want %q (ok %t)", tt.s, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestParseConfigFile(t *testing.T) {
+	tests := []struct {
+		name, src string
+		want      [][3]string
+		err       string
+	}{
+		{"empty", "", nil, ""},
+		{"comments and blank lines", "# mpa\n\n  # indented\ndatabase = \"/data/mpa.db\"\n\nworkers=2 # two\n",
+			[][3]string{{"database", "/data/mpa.db", "4"}, {"workers", "2", "6"}}, ""},
+		{"spaces around key", "  http   =   \":4000\"  \n", [][3]string{{"http", ":4000", "1"}}, ""},
+		{"duplicate key", "workers = 1\nhttp = \":80\"\nworkers = 2\n", nil, "mpa.toml:3: duplicate key workers"},
+		{"missing value", "workers\n", nil, "mpa.toml:1: expected key = value"},
+		{"invalid value", "\nhttp = :80\n", nil, "mpa.toml:2: invalid value"},
+	}
+	for _, tt := range tests {
+		got, err := parseConfigFile(strings.NewReader(tt.src), "mpa.toml")
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, %v, want %q", tt.name, got, err, tt.want)
+		}
+	}
+}
+
+// testLoadConfig loads the configuration from the flags, the
+// environment and the config file with the given content (if not
+// empty).
+func testLoadConfig(t *testing.T, args []string, env map[string]string, file string) (*config, error) {
+	t.Helper()
+	// unset all variables (t.Setenv restores them after the test)
+	t.Setenv("MPA_CONFIG", "")
+	os.Unsetenv("MPA_CONFIG")
+	for key := range configKeys {
+		env := "MPA_" + strings.ToUpper(key)
+		t.Setenv(env, "")
+		os.Unsetenv(env)
+	}
+	for k, v := range env {
+		t.Setenv(k, v)
+	}
+	fs := flag.NewFlagSet("mpa", flag.ContinueOnError)
+	c := newConfig(fs)
+	if err := fs.Parse(args); err != nil {
+		t.Fatal(err)
+	}
+	var configFile string
+	if file != "" {
+		configFile = filepath.Join(t.TempDir(), "mpa.toml")
+		if err := ioutil.WriteFile(configFile, []byte(file), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, c.load(fs, configFile)
+}
+
+func TestConfigPrecedence(t *testing.T) {
+	file := `database = "file.db"
+http = ":1000"
+workers = 1
+session_lifetime = "2h"
+`
+	c, err := testLoadConfig(t, []string{"-workers", "3"}, map[string]string{"MPA_HTTP": ":2000", "MPA_WORKERS": "2"}, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := struct {
+		db, files, http string
+		workers         int
+		lifetime        time.Duration
+	}{"file.db", "file.db.mpa", ":2000", 3, 2 * time.Hour}
+	if c.dbFileName != want.db || c.filesDir != want.files || c.httpAddr != want.http || c.workers != want.workers || c.sessionLifetime != want.lifetime {
+		t.Errorf("got database %q, files_dir %q, http %q, workers %d, session_lifetime %v, want %+v",
+			c.dbFileName, c.filesDir, c.httpAddr, c.workers, c.sessionLifetime, want)
+	}
+
+	// defaults are used for options given nowhere
+	c, err = testLoadConfig(t, []string{"-f", "flag.db"}, nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.dbFileName != "flag.db" || c.httpAddr != ":8080" || c.sessionLifetime != time.Hour {
+		t.Errorf("got database %q, http %q, session_lifetime %v, want defaults", c.dbFileName, c.httpAddr, c.sessionLifetime)
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		file string
+		err  string
+	}{
+		{"unknown key", nil, nil, "database = \"a.db\"\ncolour = \"red\"\n", "unknown option colour"},
+		{"invalid value in file", nil, nil, "database = \"a.db\"\nworkers = \"many\"\n", `invalid value "many" of workers`},
+		{"invalid value in environment", nil, map[string]string{"MPA_WORKERS": "many"}, "database = \"a.db\"\n", "MPA_WORKERS: invalid value"},
+		{"no database", nil, nil, "http = \":80\"\n", "database file name not given"},
+		{"invalid value ignored if given as flag", []string{"-workers", "1"}, map[string]string{"MPA_WORKERS": "many"}, "database = \"a.db\"\n", ""},
+		{"session lifetime too short", []string{"-f", "a.db"}, map[string]string{"MPA_SESSION_LIFETIME": "10s"}, "", "session_lifetime must be at least 1m"},
+	}
+	for _, tt := range tests {
+		_, err := testLoadConfig(t, tt.args, tt.env, tt.file)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tt.name, err)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: got error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
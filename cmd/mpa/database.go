@@ -13,7 +13,9 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/bgentry/speakeasy"
 	"golang.org/x/crypto/bcrypt"
@@ -23,33 +25,38 @@ import (
 type DB struct {
 	db *sql.DB
 
-	filesDir   string
-	imagesDir  string
-	previewDir string
-	uploadDir  string
+	filesDir     string
+	imagesDir    string
+	previewDir   string
+	uploadDir    string
+	resumableDir string // files of resumable uploads (see resumable.go)
 
 	filesMu sync.Mutex // protect against concurrent file write operations
 }
 
 var ErrSingleThread = errors.New("single threaded sqlite3 is not supported")
 
-func OpenDB(filename string) (*DB, error) {
-	db, err := sql.Open("sqlite", filename)
+// OpenDB opens the database and sets directories of stored files
+// (filesDir is the storage directory).
+func OpenDB(filename, filesDir string) (*DB, error) {
+	// wait for locks held by concurrent writers (such as background
+	// preview creation) instead of failing immediately
+	db, err := sql.Open("sqlite", filename+"?_pragma=busy_timeout(5000)")
 	if err != nil {
 		return nil, err
 	}
-	filesDir := filename + ".mpa"
 	return &DB{db: db, filesDir: filesDir,
-		imagesDir:  filepath.Join(filesDir, "images"),
-		previewDir: filepath.Join(filesDir, "preview"),
-		uploadDir:  filepath.Join(filesDir, "upload")}, nil
+		imagesDir:    filepath.Join(filesDir, "images"),
+		previewDir:   filepath.Join(filesDir, "preview"),
+		uploadDir:    filepath.Join(filesDir, "upload"),
+		resumableDir: filepath.Join(filesDir, "upload", "resumable")}, nil
 }
 
 func (db *DB) EnsureDirs() error {
 	info, err := os.Stat(db.filesDir)
 	if err != nil {
 		if os.IsNotExist(err) {
-			return fmt.Errorf("storage directory for images %s does not exist, create or rename it if you renamed database file", db.filesDir)
+			return fmt.Errorf("storage directory for images %s does not exist, create or rename it if you renamed database file (or set files_dir)", db.filesDir)
 		}
 		return err
 	} else if !info.IsDir() {
@@ -61,7 +68,10 @@ func (db *DB) EnsureDirs() error {
 	if err := ensureDirExists(db.previewDir, 0755); err != nil {
 		return err
 	}
-	return ensureDirExists(db.uploadDir, 0755)
+	if err := ensureDirExists(db.uploadDir, 0755); err != nil {
+		return err
+	}
+	return ensureDirExists(db.resumableDir, 0755)
 }
 
 func ensureDirExists(path string, perm os.FileMode) error {
@@ -78,14 +88,33 @@ func ensureDirExists(path string, perm os.FileMode) error {
 	return nil
 }
 
-func (db *DB) Init(lang string) (err error) {
+// Init creates the database schema and the admin account (asked for
+// interactively if admin is nil).
+func (db *DB) Init(lang string, admin *newUser) (err error) {
 	tx, err := db.db.Begin()
 	if err != nil {
 		return err
 	}
 	defer tx.Rollback()
 
-	err = createMPATable(tx, lang)
+	err = createInitialSchema(tx, lang)
+	if err == nil {
+		err = migrate(tx, 1)
+	}
+	if err == nil && admin != nil {
+		err = admin.add(db, tx)
+	} else if err == nil {
+		err = db.askAddUser(tx)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// createInitialSchema creates version 1 of the database schema.
+func createInitialSchema(tx *sql.Tx, lang string) error {
+	err := createMPATable(tx, lang)
 	if err == nil {
 		_, err = tx.Exec(`
 CREATE TABLE users(
@@ -132,15 +161,93 @@ owner_file_name TEXT)
 	if err == nil {
 		_, err = tx.Exec("CREATE INDEX imagesAlbumIDCreated ON images (album_id, created)")
 	}
-	if err == nil {
-		err = db.askAddUser(tx)
+	return err
+}
+
+// dbVersion is the version of the database schema expected by this
+// program. Version 1 is created by Init, later versions are reached
+// by applying migrations.
+const dbVersion = 16
+
+// migrations[i] upgrades the database schema from version i+1 to
+// version i+2.
+var migrations = []func(tx *sql.Tx) error{
+	migrateImagePosition,
+	migrateAlbumDetails,
+	migrateVideo,
+	migrateImageEdits,
+	migratePrivacy,
+	migrateResumableUploads,
+	migratePerceptualHash,
+	migrateStorageQuotas,
+	migrateTrash,
+	migrateAudit,
+	migrateUserDisabled,
+	migrateUserLang,
+	migrateSiteSettings,
+	migrateComments,
+	migrateFavourites,
+}
+
+// Upgrade applies migrations required to bring the database schema
+// created by older versions of the program to dbVersion.
+func (db *DB) Upgrade() error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var value string
+	if err := tx.QueryRow("SELECT value FROM mpa WHERE key='db_version'").Scan(&value); err != nil {
+		if err == sql.ErrNoRows {
+			return errors.New("missing db_version in mpa table")
+		}
+		return err
 	}
+	version, err := strconv.Atoi(value)
 	if err != nil {
+		return fmt.Errorf("error parsing db_version: %v", err)
+	}
+	if version == dbVersion {
+		return nil
+	}
+	if version > dbVersion {
+		return fmt.Errorf("database version %d is newer than supported version %d", version, dbVersion)
+	}
+	if err := migrate(tx, version); err != nil {
 		return err
 	}
 	return tx.Commit()
 }
 
+func migrate(tx *sql.Tx, version int) error {
+	for v := version; v < dbVersion; v++ {
+		if err := migrations[v-1](tx); err != nil {
+			return fmt.Errorf("migration of database from version %d to %d failed: %v", v, v+1, err)
+		}
+	}
+	_, err := tx.Exec("UPDATE mpa SET value=? WHERE key='db_version'", strconv.Itoa(dbVersion))
+	return err
+}
+
+func migrateImagePosition(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE images ADD COLUMN position INTEGER DEFAULT 0")
+	if err == nil {
+		_, err = tx.Exec("ALTER TABLE albums ADD COLUMN image_order TEXT DEFAULT 'created'")
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+UPDATE images SET position=(
+SELECT count(*) FROM images AS i
+WHERE i.album_id=images.album_id AND (i.created < images.created OR (i.created=images.created AND i.iid < images.iid)))
+`)
+	}
+	if err == nil {
+		_, err = tx.Exec("CREATE INDEX imagesAlbumIDPosition ON images (album_id, position)")
+	}
+	return err
+}
+
 func (db *DB) askAddUser(tx Execer) error {
 	sc := bufio.NewScanner(os.Stdin)
 	login, err := ask(sc, "Login: ")
@@ -244,8 +351,8 @@ func (db *DB) GetMPAOptions() (lang string, err error) {
 			if err != nil {
 				return "", fmt.Errorf("error parsing db_version: %v", err)
 			}
-			if i != 1 {
-				return "", fmt.Errorf("expected db_version 1 but found %d", i)
+			if i != dbVersion {
+				return "", fmt.Errorf("expected db_version %d but found %d", dbVersion, i)
 			}
 		case "lang":
 			mask |= 2
@@ -264,29 +371,282 @@ func (db *DB) GetMPAOptions() (lang string, err error) {
 	return
 }
 
+func migrateAlbumDetails(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE albums ADD COLUMN description TEXT DEFAULT ''")
+	if err == nil {
+		_, err = tx.Exec("ALTER TABLE albums ADD COLUMN date_from TEXT")
+	}
+	if err == nil {
+		_, err = tx.Exec("ALTER TABLE albums ADD COLUMN date_to TEXT")
+	}
+	if err == nil {
+		_, err = tx.Exec("ALTER TABLE albums ADD COLUMN collection_id INTEGER")
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+CREATE TABLE collections(
+cid INTEGER PRIMARY KEY,
+owner_id INTEGER,
+name TEXT,
+UNIQUE(owner_id, name))
+`)
+	}
+	return err
+}
+
+func migrateVideo(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE images ADD COLUMN is_video INTEGER DEFAULT 0")
+	return err
+}
+
+func migrateImageEdits(tx *sql.Tx) error {
+	for _, column := range []string{"edit_rotate INTEGER", "edit_flip_h INTEGER", "edit_flip_v INTEGER",
+		"crop_left REAL", "crop_top REAL", "crop_right REAL", "crop_bottom REAL"} {
+		if _, err := tx.Exec("ALTER TABLE images ADD COLUMN " + column + " DEFAULT 0"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// migratePrivacy adds privacy settings (see privacy.go). Originals are
+// served stripped of location by default.
+func migratePrivacy(tx *sql.Tx) error {
+	for _, table := range []string{"albums", "users"} {
+		for _, column := range []string{"strip_exif", "preview_exif"} {
+			if _, err := tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + column + " INTEGER"); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := tx.Exec("INSERT INTO mpa (key, value) VALUES ('strip_exif', '1'), ('preview_exif', '0')")
+	return err
+}
+
+func migrateResumableUploads(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE uploads(
+id TEXT PRIMARY KEY,
+owner_id INTEGER,
+file_name TEXT,
+size INTEGER,
+received INTEGER,
+expected_sha256 TEXT,
+sha256sum TEXT,
+modified INTEGER)
+`)
+	return err
+}
+
+func migratePerceptualHash(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE images ADD COLUMN phash INTEGER")
+	return err
+}
+
+func migrateStorageQuotas(tx *sql.Tx) error {
+	_, err := tx.Exec("CREATE TABLE files(sha256sum TEXT PRIMARY KEY, size INTEGER)")
+	if err == nil {
+		_, err = tx.Exec("ALTER TABLE users ADD COLUMN quota INTEGER")
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO mpa (key, value) VALUES ('default_quota', '0'), ('max_file_size', '0')")
+	}
+	return err
+}
+
+func migrateTrash(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE trash_albums(
+tid INTEGER PRIMARY KEY,
+deleted INTEGER,
+aid INTEGER,
+owner_id INTEGER,
+image_id INTEGER,
+is_portrait INTEGER,
+created INTEGER,
+modified INTEGER,
+name TEXT,
+image_order TEXT,
+description TEXT,
+date_from TEXT,
+date_to TEXT,
+collection_id INTEGER,
+strip_exif INTEGER,
+preview_exif INTEGER)
+`)
+	if err == nil {
+		_, err = tx.Exec(`
+CREATE TABLE trash_images(
+tid INTEGER PRIMARY KEY,
+deleted INTEGER,
+owner_id INTEGER,
+album_name TEXT,
+trash_album_id INTEGER,
+iid INTEGER,
+album_id INTEGER,
+sha256sum TEXT,
+title TEXT,
+is_portrait INTEGER,
+is_video INTEGER,
+created INTEGER,
+owner_file_name TEXT,
+position INTEGER,
+phash INTEGER,
+edit_rotate INTEGER,
+edit_flip_h INTEGER,
+edit_flip_v INTEGER,
+crop_left REAL,
+crop_top REAL,
+crop_right REAL,
+crop_bottom REAL)
+`)
+	}
+	if err == nil {
+		_, err = tx.Exec("CREATE INDEX trashImagesOwnerID ON trash_images (owner_id, deleted)")
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO mpa (key, value) VALUES ('trash_retention_days', '30')")
+	}
+	return err
+}
+
+// migrateAudit adds the audit log. Triggers make it append-only.
+func migrateAudit(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE audit(
+id INTEGER PRIMARY KEY,
+time INTEGER,
+actor_id INTEGER,
+actor_login TEXT,
+action TEXT,
+album_id INTEGER,
+image_id INTEGER,
+user_id INTEGER,
+remote_addr TEXT,
+details TEXT)
+`)
+	if err == nil {
+		_, err = tx.Exec("CREATE INDEX auditTime ON audit (time)")
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+CREATE TRIGGER auditNoUpdate BEFORE UPDATE ON audit
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`)
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+CREATE TRIGGER auditNoDelete BEFORE DELETE ON audit
+BEGIN SELECT RAISE(ABORT, 'audit log is append-only'); END`)
+	}
+	return err
+}
+
+// migrateUserDisabled allows disabling user accounts.
+func migrateUserDisabled(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE users ADD COLUMN disabled INTEGER DEFAULT 0")
+	return err
+}
+
+// migrateUserLang adds the language chosen by the user ("" for the
+// one negotiated from Accept-Language).
+func migrateUserLang(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE users ADD COLUMN lang TEXT DEFAULT ''")
+	return err
+}
+
+// migrateSiteSettings adds the appearance settings of the site.
+func migrateSiteSettings(tx *sql.Tx) error {
+	_, err := tx.Exec(`INSERT INTO mpa (key, value) VALUES ('site_title', ''), ('site_logo', ''), ('site_color', '#0074d9'),
+('site_theme', 'auto')`)
+	return err
+}
+
+// migrateComments adds comments on albums and images.
+func migrateComments(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE comments(
+cid INTEGER PRIMARY KEY,
+album_id INTEGER,
+image_id INTEGER,
+user_id INTEGER,
+text TEXT,
+created INTEGER,
+modified INTEGER,
+trash_id INTEGER)
+`)
+	if err == nil {
+		_, err = tx.Exec("CREATE INDEX commentsAlbumID ON comments (album_id, created)")
+	}
+	if err == nil {
+		_, err = tx.Exec("CREATE INDEX commentsImageID ON comments (image_id, created)")
+	}
+	if err == nil {
+		_, err = tx.Exec(`
+CREATE TRIGGER commentsAlbumDelete AFTER DELETE ON albums
+BEGIN DELETE FROM comments WHERE album_id=OLD.aid AND image_id=0 AND trash_id IS NULL; END`)
+	}
+	return err
+}
+
+// migrateFavourites adds favourite images of users. Favourites of
+// images in the trash (with trash_id set) are not unique.
+func migrateFavourites(tx *sql.Tx) error {
+	_, err := tx.Exec(`
+CREATE TABLE favourites(
+user_id INTEGER,
+image_id INTEGER,
+created INTEGER,
+trash_id INTEGER)
+`)
+	if err == nil {
+		_, err = tx.Exec("CREATE UNIQUE INDEX favouritesUserImage ON favourites (user_id, image_id) WHERE trash_id IS NULL")
+	}
+	if err == nil {
+		_, err = tx.Exec("CREATE INDEX favouritesImageID ON favourites (image_id)")
+	}
+	return err
+}
+
+// dbTimeLayout is the layout in which the sqlite driver stores
+// time.Time values (such as images.created).
+const dbTimeLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+func parseDBTime(s string) (time.Time, error) {
+	if i := strings.Index(s, " m="); i >= 0 {
+		s = s[:i] // strip monotonic clock reading
+	}
+	return time.Parse(dbTimeLayout, s)
+}
+
 type Execer interface {
 	Exec(query string, args ...interface{}) (sql.Result, error)
 }
 
+// AddUser adds the user. Empty email is stored as NULL so that many
+// users may be added without an email.
 func (db *DB) AddUser(tx Execer, login, name, surname, email string, adminLevel int, requirePasswordChange bool, password []byte) error {
 	p, err := bcrypt.GenerateFromPassword(password, bcrypt.DefaultCost)
 	if err != nil {
 		return err
 	}
 	_, err = tx.Exec("INSERT INTO users (login, name, surname, email, admin_level, require_password_change, passwordhash) VALUES (?, ?, ?, ?, ?, ?, ?)",
-		login, name, surname, email, adminLevel, requirePasswordChange, p)
+		login, name, surname, sql.NullString{String: email, Valid: email != ""}, adminLevel, requirePasswordChange, p)
 	return err
 }
 
 func (db *DB) AuthenticateUser(login string, password []byte) (SessionData, error) {
 	d := SessionData{Login: login}
 	var h []byte
-	if err := db.db.QueryRow("SELECT uid, admin_level, require_password_change, passwordhash FROM users WHERE login=?", login).Scan(&d.Uid, &d.Admin, &d.RequirePasswordChange, &h); err != nil {
+	var disabled bool
+	if err := db.db.QueryRow("SELECT uid, admin_level, require_password_change, passwordhash, disabled FROM users WHERE login=?", login).Scan(&d.Uid, &d.Admin, &d.RequirePasswordChange, &h, &disabled); err != nil {
 		if err == sql.ErrNoRows {
 			return d, ErrAuth
 		}
 		return d, err
 	}
+	if disabled {
+		return d, ErrAuth
+	}
 	err := bcrypt.CompareHashAndPassword(h, password)
 	if err == bcrypt.ErrMismatchedHashAndPassword {
 		return d, ErrAuth
@@ -0,0 +1,242 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openTestDB returns an empty in-memory database with files stored in
+// a temporary directory.
+func openTestDB(t *testing.T) *DB {
+	t.Helper()
+	db, err := OpenDB(":memory:", t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// each connection would open a separate in-memory database
+	db.db.SetMaxOpenConns(1)
+	t.Cleanup(func() { db.db.Close() })
+	if err := db.EnsureDirs(); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// initTestDB returns an in-memory database with the current schema and
+// user admin (uid 1).
+func initTestDB(t *testing.T) *DB {
+	t.Helper()
+	db := openTestDB(t)
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	err = createInitialSchema(tx, "en")
+	if err == nil {
+		err = migrate(tx, 1)
+	}
+	if err == nil {
+		err = db.AddUser(tx, "admin", "Admin", "Admin", "admin@example.com", 1, false, []byte("Secret1!x"))
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// addTestAlbum adds the album of user uid with images of the given
+// checksums (whose files are created) and returns IDs of the album
+// and the images.
+func addTestAlbum(t *testing.T, db *DB, uid int64, name string, sums ...string) (int64, []int64) {
+	t.Helper()
+	now := time.Now().UTC()
+	r, err := db.db.Exec("INSERT INTO albums (owner_id, image_id, is_portrait, created, modified, name) VALUES (?, 0, 0, ?, ?, ?)", uid, now, now, name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	albumID, _ := r.LastInsertId()
+	var ids []int64
+	for i, sum := range sums {
+		r, err := db.db.Exec("INSERT INTO images (album_id, sha256sum, title, is_portrait, created, owner_file_name, position) VALUES (?, ?, '', 0, ?, ?, ?)",
+			albumID, sum, now, sum+".jpg", i)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id, _ := r.LastInsertId()
+		ids = append(ids, id)
+		if err := ensureDirExists(filepath.Join(db.imagesDir, sum[:3]), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(db.imagesDir, sum[:3], sum[3:]), []byte(sum), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := db.db.Exec("UPDATE albums SET image_id=? WHERE aid=?", ids[0], albumID); err != nil {
+		t.Fatal(err)
+	}
+	return albumID, ids
+}
+
+func testSum(c byte) string {
+	return strings.Repeat(string(c), 64)
+}
+
+// testImageIDs returns IDs of images of the album in the given order.
+func testImageIDs(t *testing.T, db *DB, albumID int64, order string) []int64 {
+	t.Helper()
+	rows, err := db.db.Query("SELECT iid FROM images WHERE album_id=? "+imageOrderBy(order), albumID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func testDBVersion(t *testing.T, db *DB) int {
+	t.Helper()
+	var value string
+	if err := db.db.QueryRow("SELECT value FROM mpa WHERE key='db_version'").Scan(&value); err != nil {
+		t.Fatal(err)
+	}
+	v, err := strconv.Atoi(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return v
+}
+
+func TestUpgradeFromVersion1(t *testing.T) {
+	db := openTestDB(t)
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := createInitialSchema(tx, "en"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.AddUser(tx, "admin", "Admin", "Admin", "admin@example.com", 1, false, []byte("Secret1!x")); err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2017, 6, 1, 12, 0, 0, 0, time.UTC)
+	if _, err := tx.Exec("INSERT INTO albums (aid, owner_id, image_id, is_portrait, created, modified, name) VALUES (1, 1, 2, 0, ?, ?, 'Trip')", now, now); err != nil {
+		t.Fatal(err)
+	}
+	// image 3 was taken first so it has to get position 0
+	for _, im := range []struct {
+		iid     int64
+		created time.Time
+	}{{1, now.Add(time.Hour)}, {2, now.Add(2 * time.Hour)}, {3, now}} {
+		if _, err := tx.Exec("INSERT INTO images (iid, album_id, sha256sum, title, is_portrait, created, owner_file_name) VALUES (?, 1, ?, '', 0, ?, ?)",
+			im.iid, "sum"+strconv.FormatInt(im.iid, 10), im.created, "img.jpg"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+	if v := testDBVersion(t, db); v != dbVersion {
+		t.Fatalf("db_version = %d after upgrade, want %d", v, dbVersion)
+	}
+	// upgrading an up to date database does nothing
+	if err := db.Upgrade(); err != nil {
+		t.Fatal(err)
+	}
+
+	var order string
+	if err := db.db.QueryRow("SELECT image_order FROM albums WHERE aid=1").Scan(&order); err != nil {
+		t.Fatal(err)
+	}
+	if order != orderCreated {
+		t.Errorf("image_order = %q, want %q", order, orderCreated)
+	}
+	ids := testImageIDs(t, db, 1, orderCreated)
+	byPosition := testImageIDs(t, db, 1, orderManual)
+	for i, want := range []int64{3, 1, 2} {
+		if ids[i] != want || byPosition[i] != want {
+			t.Fatalf("images in created order %v and by position %v, want [3 1 2]", ids, byPosition)
+		}
+	}
+	if _, err := db.AuthenticateUser("admin", []byte("Secret1!x")); err != nil {
+		t.Errorf("authenticating user after upgrade: %v", err)
+	}
+}
+
+func TestUpgradeNewerVersion(t *testing.T) {
+	db := initTestDB(t)
+	if v := testDBVersion(t, db); v != dbVersion {
+		t.Fatalf("db_version = %d after init, want %d", v, dbVersion)
+	}
+	if _, err := db.db.Exec("UPDATE mpa SET value=? WHERE key='db_version'", strconv.Itoa(dbVersion+1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Upgrade(); err == nil {
+		t.Error("upgrading database newer than supported succeeded")
+	}
+}
+
+// TestTrashColumnTypes checks that columns copied to the trash tables
+// have the same types as in the tables they are copied from.
+func TestTrashColumnTypes(t *testing.T) {
+	db := initTestDB(t)
+	for _, tables := range [][2]string{{"images", "trash_images"}, {"albums", "trash_albums"}} {
+		types := testColumnTypes(t, db.db, tables[0])
+		for name, typ := range testColumnTypes(t, db.db, tables[1]) {
+			if orig, ok := types[name]; ok && orig != typ {
+				t.Errorf("%s.%s has type %s, %s.%s has type %s", tables[1], name, typ, tables[0], name, orig)
+			}
+		}
+	}
+}
+
+func testColumnTypes(t *testing.T, db *sql.DB, table string) map[string]string {
+	t.Helper()
+	rows, err := db.Query("SELECT name, type FROM pragma_table_info(?)", table)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	types := make(map[string]string)
+	for rows.Next() {
+		var name, typ string
+		if err := rows.Scan(&name, &typ); err != nil {
+			t.Fatal(err)
+		}
+		types[name] = typ
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if len(types) == 0 {
+		t.Fatalf("table %s not found", table)
+	}
+	return types
+}
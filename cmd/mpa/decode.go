@@ -0,0 +1,246 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	_ "golang.org/x/image/tiff"
+	_ "golang.org/x/image/webp"
+)
+
+// JPEG, PNG, GIF (first frame), TIFF and WebP are decoded by the
+// image package (with decoders registered by the imports above).
+// Formats listed in imageDecoders are handled before falling back to
+// the image package.
+
+// imageDecoder decodes image formats not supported by the image
+// package.
+type imageDecoder struct {
+	name   string
+	match  func(header []byte) bool
+	decode func(s *server, filename string) (image.Image, error)
+	// oriented is true if the decoded image is already rotated
+	// according to its EXIF orientation.
+	oriented bool
+}
+
+var imageDecoders = []imageDecoder{
+	{"heic", isHEIC, (*server).decodeHEIC, true}, // converter applies the rotation
+	{"raw", isRAW, (*server).decodeRAW, false},
+}
+
+// heifBrands are ISO base media file format brands of HEIF images
+// (which use the same container as MP4 videos).
+var heifBrands = map[string]bool{
+	"heic": true, "heix": true, "hevc": true, "hevx": true,
+	"heim": true, "heis": true, "mif1": true, "msf1": true,
+}
+
+func isHEIC(header []byte) bool {
+	return len(header) >= 12 && string(header[4:8]) == "ftyp" && heifBrands[string(header[8:12])]
+}
+
+// isRAW reports whether header is of a camera RAW file. Most RAW
+// formats are TIFF based, so plain TIFF files also match (and are
+// decoded as TIFF if they contain no embedded JPEG preview).
+func isRAW(header []byte) bool {
+	if len(header) < 16 {
+		return false
+	}
+	switch {
+	case string(header[:4]) == "II*\x00" || string(header[:4]) == "MM\x00*": // TIFF, CR2, NEF, ARW, DNG, PEF
+		return true
+	case string(header[:4]) == "IIRO" || string(header[:4]) == "IIRS" || string(header[:4]) == "MMOR": // ORF
+		return true
+	case string(header[:4]) == "IIU\x00": // RW2
+		return true
+	case string(header[:15]) == "FUJIFILMCCD-RAW": // RAF
+		return true
+	case string(header[4:12]) == "ftypcrx ": // CR3
+		return true
+	}
+	return false
+}
+
+func readHeader(filename string) ([]byte, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	header := make([]byte, 16)
+	n, err := io.ReadFull(f, header)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return header[:n], err
+}
+
+// decodeImage decodes the image file in any of the supported formats
+// and returns it together with its EXIF orientation.
+func (s *server) decodeImage(filename string) (image.Image, int, error) {
+	header, err := readHeader(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	orientation, _ := exifOrientation(f)
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return nil, 0, err
+	}
+	for _, d := range imageDecoders {
+		if d.match(header) {
+			img, err := d.decode(s, filename)
+			if d.oriented {
+				orientation = 1
+			}
+			return img, orientation, err
+		}
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return nil, 0, err
+	}
+	return img, orientation, f.Close()
+}
+
+// decodeImageConfig returns dimensions of the image in any of the
+// supported formats together with its EXIF orientation. Formats not
+// supported by the image package are fully decoded.
+func (s *server) decodeImageConfig(filename string) (image.Config, int, error) {
+	header, err := readHeader(filename)
+	if err != nil {
+		return image.Config{}, 0, err
+	}
+	for _, d := range imageDecoders {
+		if d.match(header) {
+			img, orientation, err := s.decodeImage(filename)
+			if err != nil {
+				return image.Config{}, 0, err
+			}
+			size := img.Bounds().Size()
+			return image.Config{ColorModel: img.ColorModel(), Width: size.X, Height: size.Y}, orientation, nil
+		}
+	}
+	f, err := os.Open(filename)
+	if err != nil {
+		return image.Config{}, 0, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return cfg, 0, err
+	}
+	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
+		return cfg, 0, err
+	}
+	orientation, _ := exifOrientation(f)
+	return cfg, orientation, nil
+}
+
+var ErrNoHEICConverter = errors.New("HEIC converter not available")
+
+// heicConverter runs an external program converting HEIC images to
+// JPEG called as "program input output.jpg" (such as heif-convert
+// from libheif or ImageMagick convert).
+type heicConverter struct {
+	path string // empty if the converter is not available
+}
+
+func newHEICConverter(path string) *heicConverter {
+	if path == "" {
+		return &heicConverter{}
+	}
+	p, err := exec.LookPath(path)
+	if err != nil {
+		logWarn(nil, "HEIC converter not available, HEIC images will be rejected", "err", err)
+		return &heicConverter{}
+	}
+	return &heicConverter{path: p}
+}
+
+func (c *heicConverter) convert(src, dst string) error {
+	if c == nil || c.path == "" {
+		return ErrNoHEICConverter
+	}
+	out, err := exec.Command(c.path, src, dst).CombinedOutput()
+	if err != nil {
+		if out = bytes.TrimSpace(out); len(out) > 0 {
+			return errors.New("HEIC converter: " + string(out))
+		}
+		return err
+	}
+	return nil
+}
+
+func (s *server) decodeHEIC(filename string) (image.Image, error) {
+	f, err := ioutil.TempFile(s.db.uploadDir, "tmp*.jpg")
+	if err != nil {
+		return nil, err
+	}
+	tmpFileName := f.Name()
+	defer os.Remove(tmpFileName)
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := s.heic.convert(filename, tmpFileName); err != nil {
+		return nil, err
+	}
+	f, err = os.Open(tmpFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return jpeg.Decode(f)
+}
+
+var ErrNoRAWPreview = errors.New("no embedded JPEG preview found")
+
+// decodeRAW decodes the largest JPEG preview embedded in the RAW file
+// (or decodes the file as TIFF if there is no embedded preview).
+func (s *server) decodeRAW(filename string) (image.Image, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	soi := []byte{0xff, 0xd8, 0xff}
+	best, bestSize := -1, 0
+	for i := 0; ; {
+		j := bytes.Index(data[i:], soi)
+		if j < 0 {
+			break
+		}
+		i += j
+		// lossless JPEG used for sensor data is not supported by
+		// image/jpeg so only previews are considered
+		cfg, err := jpeg.DecodeConfig(bytes.NewReader(data[i:]))
+		if err == nil && cfg.Width*cfg.Height > bestSize {
+			best, bestSize = i, cfg.Width*cfg.Height
+		}
+		i += len(soi)
+	}
+	if best < 0 {
+		if string(data[:4]) == "II*\x00" || string(data[:4]) == "MM\x00*" {
+			img, _, err := image.Decode(bytes.NewReader(data))
+			return img, err
+		}
+		return nil, ErrNoRAWPreview
+	}
+	return jpeg.Decode(bytes.NewReader(data[best:]))
+}
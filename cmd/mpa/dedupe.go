@@ -0,0 +1,116 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"path/filepath"
+	"strings"
+)
+
+// Before uploading, clients may send sha256 sums of the selected files
+// to /api/check/files and then, instead of uploading the files the
+// server already has, list them in the existing field of the metadata
+// sent to /api/new/album or /api/edit/album/ID.
+//
+// Only files present in albums of the same user are reported and may
+// be attached this way. Otherwise anybody knowing (or guessing from a
+// public copy) the hash of a file would get an unmodified original of
+// somebody else's image (see privacy settings) or learn that the
+// server stores it.
+
+const maxCheckFiles = 10000
+
+var ErrNotOwnedFile = errors.New("file not present in albums of the user")
+
+// existingFile references a file already stored on the server.
+type existingFile struct {
+	SHA256 string
+	Name   string // file name on the client
+}
+
+// OwnsFile reports whether file with the sha256 sum is present in any
+// album of the user.
+func (db *DB) OwnsFile(uid int64, sha256sum string) (bool, error) {
+	var one int
+	err := db.db.QueryRow("SELECT 1 FROM images JOIN albums ON images.album_id=albums.aid WHERE albums.owner_id=? AND images.sha256sum=? LIMIT 1", uid, sha256sum).Scan(&one)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *server) ServeAPICheckFiles(w http.ResponseWriter, r *http.Request) {
+	session, err := s.SessionData(r)
+	if err != nil {
+		logError(r, "session error", "err", err)
+		http.Error(w, s.tr("Authorization error"), http.StatusForbidden)
+		return
+	}
+	if r.Method != "POST" {
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct{ SHA256 []string }
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 70*maxCheckFiles)).Decode(&req); err != nil {
+		logWarn(r, "Error parsing metadata", "err", err)
+		http.Error(w, s.tr("Error parsing metadata"), http.StatusBadRequest)
+		return
+	}
+	if len(req.SHA256) > maxCheckFiles {
+		http.Error(w, s.tr("Too many files"), http.StatusBadRequest)
+		return
+	}
+	known := []string{}
+	for _, sum := range req.SHA256 {
+		sum = strings.ToLower(sum)
+		if !validSHA256(sum) {
+			http.Error(w, s.tr("Error parsing metadata"), http.StatusBadRequest)
+			return
+		}
+		ok, err := s.db.OwnsFile(session.Uid, sum)
+		if err != nil {
+			logError(r, "check files error", "err", err)
+			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+			return
+		}
+		if ok {
+			known = append(known, sum)
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Known []string `json:"known"`
+	}{known})
+}
+
+// attachExisting adds files already stored on the server referenced
+// in the metadata to the uploaded files.
+func (s *server) attachExisting(d *uploadData, uid int64) {
+	for idx, f := range d.meta.Existing {
+		sum := strings.ToLower(f.SHA256)
+		d.imgCnt++
+		ok := false
+		var err error
+		if validSHA256(sum) {
+			ok, err = s.db.OwnsFile(uid, sum)
+		}
+		if err == nil && !ok {
+			err = ErrNotOwnedFile
+		}
+		if err != nil {
+			d.errs = append(d.errs, imageError{err, f.Name, s.tr("File not found on the server, please upload it")})
+			d.m[idx] = &uploadInfo{}
+			continue
+		}
+		// the stored file is used in place, AddAlbum and EditAlbum
+		// do not move files already present in the images directory
+		filename := filepath.Join(s.db.imagesDir, sum[:3], sum[3:])
+		s.addUploadedFile(d, idx, "sha256:"+sum, f.Name, filename, sum)
+	}
+}
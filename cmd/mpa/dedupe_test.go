@@ -0,0 +1,90 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withSession returns the request as passed to handlers by the
+// authentication middleware for the logged in user.
+func withSession(r *http.Request, uid int64) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionKey{}, SessionData{Uid: uid}))
+}
+
+func TestCheckFiles(t *testing.T) {
+	db := initTestDB(t)
+	if err := db.AddUser(db.db, "bob", "", "", "", 0, false, []byte("Secret1!x")); err != nil {
+		t.Fatal(err)
+	}
+	addTestAlbum(t, db, 1, "Trip", testSum('a'), testSum('b'))
+	addTestAlbum(t, db, 2, "Home", testSum('c'))
+	s := &server{db: db, tr: func(s string) string { return s }}
+
+	check := func(uid int64, body string) (int, []string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.ServeAPICheckFiles(w, withSession(httptest.NewRequest("POST", "/api/check/files", strings.NewReader(body)), uid))
+		if w.Code != 200 {
+			return w.Code, nil
+		}
+		var resp struct{ Known []string }
+		if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+			t.Fatal(err)
+		}
+		return w.Code, resp.Known
+	}
+
+	body := `{"sha256": ["` + testSum('a') + `", "` + strings.ToUpper(testSum('b')) + `", "` + testSum('c') + `", "` + testSum('d') + `"]}`
+	if code, known := check(1, body); code != 200 || len(known) != 2 || known[0] != testSum('a') || known[1] != testSum('b') {
+		t.Errorf("owner of a and b: status %d, known %q", code, known)
+	}
+	// files of other users are not reported
+	if code, known := check(2, body); code != 200 || len(known) != 1 || known[0] != testSum('c') {
+		t.Errorf("owner of c: status %d, known %q", code, known)
+	}
+	if code, known := check(2, `{"sha256": []}`); code != 200 || known == nil || len(known) != 0 {
+		t.Errorf("no files: status %d, known %q", code, known)
+	}
+	for _, body := range []string{`{"sha256": ["abc"]}`, `{"sha256": ["../` + testSum('a')[3:] + `"]}`, `[`} {
+		if code, _ := check(1, body); code != http.StatusBadRequest {
+			t.Errorf("request %s: status %d, want %d", body, code, http.StatusBadRequest)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.ServeAPICheckFiles(w, withSession(httptest.NewRequest("GET", "/api/check/files", nil), 1))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET returned status %d", w.Code)
+	}
+	w = httptest.NewRecorder()
+	s.ServeAPICheckFiles(w, httptest.NewRequest("POST", "/api/check/files", strings.NewReader(body)))
+	if w.Code != http.StatusForbidden {
+		t.Errorf("request without session returned status %d", w.Code)
+	}
+}
+
+func TestOwnsFileAfterTransfer(t *testing.T) {
+	db := initTestDB(t)
+	albumID, _ := addTestAlbum(t, db, 1, "Trip", testSum('a'))
+	if ok, err := db.OwnsFile(1, testSum('a')); !ok || err != nil {
+		t.Fatalf("OwnsFile = %t, %v", ok, err)
+	}
+	// ownership follows the album, not the uploader
+	if _, err := db.db.Exec("UPDATE albums SET owner_id=2 WHERE aid=?", albumID); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.OwnsFile(1, testSum('a')); ok || err != nil {
+		t.Errorf("OwnsFile of previous owner = %t, %v", ok, err)
+	}
+	if ok, err := db.OwnsFile(2, testSum('a')); !ok || err != nil {
+		t.Errorf("OwnsFile of new owner = %t, %v", ok, err)
+	}
+}
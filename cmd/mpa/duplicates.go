@@ -0,0 +1,327 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/bits"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/nfnt/resize"
+)
+
+// duplicateDistance is the maximal Hamming distance of perceptual
+// hashes of images considered possible duplicates.
+const duplicateDistance = 10
+
+// dHash returns the difference hash of the image: each of the 64 bits
+// tells whether a pixel of the 9x8 grayscale thumbnail is brighter
+// than its right neighbour. It survives resizing and recompression
+// (but not cropping) of the image.
+func dHash(img image.Image, orientation int) uint64 {
+	// orientation is applied on a small thumbnail so that images
+	// rotated by EXIF and those with rotation applied hash the same
+	img = applyOrientation(resize.Resize(32, 32, img, resize.Bilinear), orientation)
+	img = resize.Resize(9, 8, img, resize.Bilinear)
+	b := img.Bounds()
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			l := color.GrayModel.Convert(img.At(b.Min.X+x, b.Min.Y+y)).(color.Gray).Y
+			r := color.GrayModel.Convert(img.At(b.Min.X+x+1, b.Min.Y+y)).(color.Gray).Y
+			h <<= 1
+			if l > r {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+func (db *DB) SetPerceptualHash(sha256sum string, h uint64) error {
+	_, err := db.db.Exec("UPDATE images SET phash=? WHERE sha256sum=?", int64(h), sha256sum)
+	return err
+}
+
+// ensurePerceptualHashes computes missing hashes of images of the user
+// (added before hashes were computed during preview generation) from
+// their existing previews.
+func (s *server) ensurePerceptualHashes(uid int64) error {
+	rows, err := s.db.db.Query(`
+SELECT DISTINCT sha256sum FROM images JOIN albums ON images.album_id=albums.aid
+WHERE albums.owner_id=? AND images.phash IS NULL AND NOT images.is_video`, uid)
+	if err != nil {
+		return err
+	}
+	var sums []string
+	for rows.Next() {
+		var sum string
+		if err := rows.Scan(&sum); err != nil {
+			rows.Close()
+			return err
+		}
+		sums = append(sums, sum)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, sum := range sums {
+		f, err := os.Open(previewPath(s.db.previewDir, sum, imageEdit{}) + ".2")
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // hash is computed when the preview is created
+			}
+			return err
+		}
+		img, err := jpeg.Decode(f)
+		f.Close()
+		if err != nil {
+			logError(nil, "perceptual hash error", "sha256", sum[:7], "err", err)
+			continue
+		}
+		if err := s.db.SetPerceptualHash(sum, dHash(img, 1)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupSimilarHashes groups indexes of the hashes so that each hash is
+// within maxDist (Hamming distance) of the first hash of its group,
+// the representative. Groups are not chained: a hash close only to a
+// member of a group does not join it. Candidate representatives are
+// found by the pigeonhole principle: hashes within maxDist agree on at
+// least one of maxDist+1 disjoint bit ranges, so only representatives
+// with the same bits in one of the ranges are compared.
+func groupSimilarHashes(hashes []uint64, maxDist int) [][]int {
+	chunks := maxDist + 1
+	if chunks > 64 {
+		chunks = 64
+	}
+	index := make([]map[uint64][]int, chunks) // representatives by chunk value
+	for i := range index {
+		index[i] = make(map[uint64][]int)
+	}
+	chunk := func(h uint64, i int) uint64 {
+		lo, hi := i*64/chunks, (i+1)*64/chunks
+		return h >> uint(lo) & (1<<uint(hi-lo) - 1)
+	}
+	var groups [][]int
+	groupOf := make(map[int]int) // group index by representative
+	for k, h := range hashes {
+		best, bestDist := -1, maxDist+1
+		for i := range index {
+			for _, r := range index[i][chunk(h, i)] {
+				if d := bits.OnesCount64(h ^ hashes[r]); d < bestDist || (d == bestDist && r < best) {
+					best, bestDist = r, d
+				}
+			}
+		}
+		if best >= 0 {
+			g := groupOf[best]
+			groups[g] = append(groups[g], k)
+			continue
+		}
+		groupOf[k] = len(groups)
+		groups = append(groups, []int{k})
+		for i := range index {
+			c := chunk(h, i)
+			index[i][c] = append(index[i][c], k)
+		}
+	}
+	return groups
+}
+
+type duplicateImage struct {
+	Id        int64
+	AlbumID   int64
+	AlbumName string
+	Class     string
+	Size      string
+	Best      bool
+
+	sha256sum string
+	phash     uint64
+	fileSize  int64
+}
+
+// duplicateGroups returns groups of possible duplicates among images
+// of the user's albums.
+func (s *server) duplicateGroups(uid int64) ([][]*duplicateImage, error) {
+	if err := s.ensurePerceptualHashes(uid); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.db.Query(`
+SELECT images.iid, images.album_id, albums.name, images.sha256sum, images.phash, images.is_portrait
+FROM images JOIN albums ON images.album_id=albums.aid
+WHERE albums.owner_id=? AND images.phash IS NOT NULL AND NOT images.is_video ORDER BY images.iid`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var imgs []*duplicateImage
+	for rows.Next() {
+		var d duplicateImage
+		var h int64
+		var portrait bool
+		if err := rows.Scan(&d.Id, &d.AlbumID, &d.AlbumName, &d.sha256sum, &h, &portrait); err != nil {
+			return nil, err
+		}
+		d.phash = uint64(h)
+		d.Class = "preview"
+		if portrait {
+			d.Class = "preview portrait"
+		}
+		imgs = append(imgs, &d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	hashes := make([]uint64, len(imgs))
+	for i, img := range imgs {
+		hashes[i] = img.phash
+	}
+	var groups [][]*duplicateImage
+	for _, idx := range groupSimilarHashes(hashes, duplicateDistance) {
+		if len(idx) < 2 {
+			continue
+		}
+		g := make([]*duplicateImage, len(idx))
+		for i, k := range idx {
+			g[i] = imgs[k]
+		}
+		// the largest original is the best candidate to keep
+		best := g[0]
+		for _, img := range g {
+			if fi, err := os.Stat(filepath.Join(s.db.imagesDir, img.sha256sum[:3], img.sha256sum[3:])); err == nil {
+				img.fileSize = fi.Size()
+			}
+			img.Size = formatFileSize(img.fileSize)
+			if img.fileSize > best.fileSize {
+				best = img
+			}
+		}
+		best.Best = true
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func formatFileSize(n int64) string {
+	switch {
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1f GiB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1f MiB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.0f KiB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%d B", n)
+}
+
+func (s *server) ServeDuplicates(w http.ResponseWriter, r *http.Request) {
+	session, err := s.SessionData(r)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Session error"))
+		return
+	}
+	groups, err := s.duplicateGroups(session.Uid)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	type group struct {
+		Number int
+		Images []*duplicateImage
+	}
+	data := struct {
+		Lang   string
+		Groups []group
+		IDs    [][]int64 // image IDs of the groups
+		Best   []int64   // ID of the best image of each group
+	}{Lang: s.lang}
+	for i, g := range groups {
+		data.Groups = append(data.Groups, group{i + 1, g})
+		var ids []int64
+		var best int64
+		for _, img := range g {
+			ids = append(ids, img.Id)
+			if img.Best {
+				best = img.Id
+			}
+		}
+		data.IDs = append(data.IDs, ids)
+		data.Best = append(data.Best, best)
+	}
+	s.executeTemplate(w, "duplicates.html", &data, http.StatusOK)
+}
+
+// ServeAPIDeleteDuplicates deletes the requested images (of albums of
+// the user) using the same path as deleting images in the album
+// editor.
+func (s *server) ServeAPIDeleteDuplicates(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := s.SessionData(r)
+	if err != nil {
+		logError(r, "session error", "err", err)
+		http.Error(w, s.tr("Authorization error"), http.StatusForbidden)
+		return
+	}
+	var req struct{ Delete []int64 }
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Delete) == 0 {
+		logWarn(r, "Error parsing metadata", "err", err)
+		http.Error(w, s.tr("Error parsing metadata"), http.StatusBadRequest)
+		return
+	}
+	byAlbum := make(map[int64][]int64)
+	names := make(map[int64]string)
+	for _, id := range req.Delete {
+		var albumID, ownerID int64
+		var name string
+		err := s.db.db.QueryRow("SELECT albums.aid, albums.owner_id, albums.name FROM images JOIN albums ON images.album_id=albums.aid WHERE images.iid=?", id).Scan(&albumID, &ownerID, &name)
+		if err != nil || ownerID != session.Uid {
+			if err != nil {
+				logError(r, "delete duplicates error", "err", err)
+			}
+			http.Error(w, s.tr("Not found in your albums"), http.StatusBadRequest)
+			return
+		}
+		byAlbum[albumID] = append(byAlbum[albumID], id)
+		names[albumID] = name
+	}
+	albumIDs := make([]int64, 0, len(byAlbum))
+	for albumID := range byAlbum {
+		albumIDs = append(albumIDs, albumID)
+	}
+	sort.Slice(albumIDs, func(i, j int) bool { return albumIDs[i] < albumIDs[j] })
+	deleted := 0
+	for _, albumID := range albumIDs {
+		rs := s.db.EditAlbum(session.Uid, albumID, names[albumID], &albumEdit{Deleted: byAlbum[albumID]}, nil, s.tr)
+		logAlbumErrors(r, albumID, rs.Errs)
+		if rs.Status != http.StatusOK {
+			http.Error(w, rs.Errs[len(rs.Errs)-1].Msg, rs.Status)
+			return
+		}
+		action := auditAlbumEdit
+		if rs.Deleted {
+			action = auditAlbumDelete
+		}
+		s.auditAs(r, session.Uid, session.Login, action, auditTarget{Album: albumID}, fmt.Sprintf("%d duplicates deleted", rs.DeletedCnt))
+		deleted += rs.DeletedCnt
+	}
+	fmt.Fprintf(w, s.trn("%d images deleted.", deleted), deleted)
+}
@@ -0,0 +1,127 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math/bits"
+	"reflect"
+	"testing"
+
+	"github.com/nfnt/resize"
+)
+
+func TestFormatFileSize(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0 B"},
+		{1023, "1023 B"},
+		{1024, "1 KiB"},
+		{1536, "2 KiB"},
+		{1<<20 - 1, "1024 KiB"},
+		{1 << 20, "1.0 MiB"},
+		{5*1<<20 + 1<<19, "5.5 MiB"},
+		{1 << 30, "1.0 GiB"},
+		{3 << 40, "3072.0 GiB"},
+	}
+	for _, tt := range tests {
+		if got := formatFileSize(tt.n); got != tt.want {
+			t.Errorf("formatFileSize(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+	}
+}
+
+// testPattern returns the image with a diagonal gradient and a dark
+// square in the upper left part.
+func testPattern(w, h int) image.Image {
+	img := image.NewGray(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(255 * (x + y) / (w + h))
+			if x < w/3 && y < h/3 {
+				v /= 4
+			}
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	return img
+}
+
+func TestDHashDistance(t *testing.T) {
+	orig := testPattern(400, 300)
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, orig, &jpeg.Options{Quality: 30}); err != nil {
+		t.Fatal(err)
+	}
+	recompressed, err := jpeg.Decode(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stored rotated by 90 degrees counterclockwise with EXIF
+	// orientation 6 telling to rotate it back
+	rotated := image.NewGray(image.Rect(0, 0, 300, 400))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			rotated.Set(y, 399-x, orig.At(x, y))
+		}
+	}
+	flipped := image.NewGray(image.Rect(0, 0, 400, 300))
+	for y := 0; y < 300; y++ {
+		for x := 0; x < 400; x++ {
+			flipped.Set(399-x, y, orig.At(x, y))
+		}
+	}
+	h := dHash(orig, 1)
+	tests := []struct {
+		name      string
+		img       image.Image
+		orient    int
+		duplicate bool
+	}{
+		{"resized", resize.Resize(120, 90, orig, resize.Bilinear), 1, true},
+		{"recompressed", recompressed, 1, true},
+		{"rotated with EXIF orientation", rotated, 6, true},
+		{"mirrored", flipped, 1, false},
+	}
+	for _, tt := range tests {
+		d := bits.OnesCount64(h ^ dHash(tt.img, tt.orient))
+		if (d <= duplicateDistance) != tt.duplicate {
+			t.Errorf("%s: distance %d, duplicate %t", tt.name, d, tt.duplicate)
+		}
+	}
+}
+
+func TestGroupSimilarHashes(t *testing.T) {
+	const (
+		a = 0x0123456789abcdef
+		b = ^uint64(a)
+	)
+	tests := []struct {
+		name   string
+		hashes []uint64
+		want   [][]int
+	}{
+		{"empty", nil, nil},
+		{"distinct", []uint64{a, b}, [][]int{{0}, {1}}},
+		{"equal", []uint64{a, b, a}, [][]int{{0, 2}, {1}}},
+		{"within distance", []uint64{a, a ^ 0x3ff, b ^ 1<<63}, [][]int{{0, 1}, {2}}},
+		{"beyond distance", []uint64{a, a ^ 0x7ff}, [][]int{{0}, {1}}},
+		// the third hash is close to the second but not to the first
+		// one so it is not chained into their group
+		{"no chaining", []uint64{a, a ^ 0xff, a ^ 0xffff}, [][]int{{0, 1}, {2}}},
+		// the closest representative is chosen
+		{"closest", []uint64{a, a ^ 0xffff, a ^ 0xfff0}, [][]int{{0}, {1, 2}}},
+	}
+	for _, tt := range tests {
+		if got := groupSimilarHashes(tt.hashes, duplicateDistance); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got groups %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -9,7 +9,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -25,19 +24,23 @@ func (s *server) ServeEditAlbum(w http.ResponseWriter, r *http.Request) {
 	}
 	session, err := s.SessionData(r)
 	if err != nil {
-		log.Println(err)
+		logError(r, "session error", "err", err)
 		s.error(w, s.tr("Authorization error"), "", http.StatusUnauthorized)
 		return
 	}
-	var name string
-	var ownerID int64
-	err = s.db.db.QueryRow("SELECT name, owner_id FROM albums WHERE aid=?", albumID).Scan(&name, &ownerID)
+	var name, order, description, dateFrom, dateTo, collectionName, stripEXIF, previewEXIF string
+	var ownerID, coverID int64
+	err = s.db.db.QueryRow(`
+SELECT albums.name, albums.owner_id, image_order, image_id, description, COALESCE(date_from, ''), COALESCE(date_to, ''), COALESCE(collections.name, ''),
+`+privacySQL("strip_exif")+", "+privacySQL("preview_exif")+`
+FROM albums LEFT OUTER JOIN collections ON albums.collection_id = collections.cid WHERE aid=?`, albumID).Scan(
+		&name, &ownerID, &order, &coverID, &description, &dateFrom, &dateTo, &collectionName, &stripEXIF, &previewEXIF)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			s.error(w, s.tr("Page not found"), "", http.StatusNotFound)
 			return
 		}
-		log.Println(err)
+		logError(r, "edit album error", "err", err)
 		s.error(w, s.tr("Internal server error"), "", http.StatusInternalServerError)
 		return
 	}
@@ -46,38 +49,69 @@ func (s *server) ServeEditAlbum(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	rows, err := s.db.db.Query("SELECT iid, is_portrait, title from images WHERE album_id=? ORDER BY created", albumID)
+	rows, err := s.db.db.Query("SELECT iid, is_portrait, is_video, title, "+imageEditColumns+" from images WHERE album_id=? "+imageOrderBy(order), albumID)
 	if err != nil {
-		log.Println(err)
+		logError(r, "edit album error", "err", err)
 		s.error(w, s.tr("Internal server error"), "", http.StatusInternalServerError)
 		return
 	}
 	defer rows.Close()
 
 	type img struct {
-		Src   string `json:"-"`
-		Class string `json:"-"`
-		Id    int64  `json:"id"`
-		Title string `json:"title"`
+		Src   string    `json:"-"`
+		Class string    `json:"-"`
+		Id    int64     `json:"id"`
+		Title string    `json:"title"`
+		Video bool      `json:"video"`
+		Edit  imageEdit `json:"edit"`
 	}
 	data := struct {
 		Title     string
 		URL       string
 		SubmitURL string
+		MoveURL   string
+		MergeURL  string
+		SplitURL  string
+		DeleteURL string
 		Lang      string
+		Order     string
+		Cover     int64
 		Images    []img
+		Albums    []albumName
+
+		Description string
+		DateFrom    string
+		DateTo      string
+		Collection  string
+		Collections []collection
+		StripEXIF   string
+		PreviewEXIF string
 	}{
 		Title:     name,
 		URL:       pathQuery(r),
 		SubmitURL: fmt.Sprintf("/api/edit/album/%d", albumID),
+		MoveURL:   fmt.Sprintf("/api/transfer/album/%d", albumID),
+		MergeURL:  fmt.Sprintf("/api/merge/album/%d", albumID),
+		SplitURL:  fmt.Sprintf("/api/split/album/%d", albumID),
+		DeleteURL: fmt.Sprintf("/api/delete/album/%d", albumID),
 		Lang:      s.lang,
+		Order:     order,
+		Cover:     coverID,
+
+		Description: description,
+		DateFrom:    dateFrom,
+		DateTo:      dateTo,
+		Collection:  collectionName,
+		StripEXIF:   stripEXIF,
+		PreviewEXIF: previewEXIF,
 	}
 	for rows.Next() {
 		var id int64
-		var portrait bool
+		var portrait, video bool
 		var title string
-		if err := rows.Scan(&id, &portrait, &title); err != nil {
-			log.Println(err)
+		var edit imageEdit
+		if err := rows.Scan(append([]interface{}{&id, &portrait, &video, &title}, edit.scanArgs()...)...); err != nil {
+			logError(r, "edit album error", "err", err)
 			s.error(w, s.tr("Internal server error"), "", http.StatusInternalServerError)
 			return
 		}
@@ -85,10 +119,27 @@ func (s *server) ServeEditAlbum(w http.ResponseWriter, r *http.Request) {
 		if portrait {
 			class = "preview portrait"
 		}
-		data.Images = append(data.Images, img{Src: fmt.Sprintf("/preview/%d", id), Class: class, Id: id, Title: title})
+		data.Images = append(data.Images, img{Src: fmt.Sprintf("/preview/%d", id), Class: class, Id: id, Title: title, Video: video, Edit: edit})
 	}
 	if err := rows.Err(); err != nil {
-		log.Println(err)
+		logError(r, "edit album error", "err", err)
+		s.error(w, s.tr("Internal server error"), "", http.StatusInternalServerError)
+		return
+	}
+	albums, err := s.db.UserAlbums(session.Uid)
+	if err != nil {
+		logError(r, "edit album error", "err", err)
+		s.error(w, s.tr("Internal server error"), "", http.StatusInternalServerError)
+		return
+	}
+	for _, a := range albums {
+		if a.Id != albumID {
+			data.Albums = append(data.Albums, a)
+		}
+	}
+	data.Collections, err = s.db.Collections(session.Uid)
+	if err != nil {
+		logError(r, "edit album error", "err", err)
 		s.error(w, s.tr("Internal server error"), "", http.StatusInternalServerError)
 		return
 	}
@@ -103,7 +154,7 @@ func (s *server) ServeAPIEditAlbum(w http.ResponseWriter, r *http.Request) {
 	}
 	session, err := s.SessionData(r)
 	if err != nil {
-		log.Println(err)
+		logError(r, "session error", "err", err)
 		// Forbidden used as API calls expect modal login served on Unauthorized.
 		// Actually it is probably internal server error.
 		http.Error(w, s.tr("Authorization error"), http.StatusForbidden)
@@ -117,7 +168,7 @@ func (s *server) ServeAPIEditAlbum(w http.ResponseWriter, r *http.Request) {
 			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
 			return
 		}
-		log.Println(err)
+		logError(r, "edit album error", "err", err)
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 		return
 	}
@@ -128,7 +179,7 @@ func (s *server) ServeAPIEditAlbum(w http.ResponseWriter, r *http.Request) {
 
 	tempDir, err := ioutil.TempDir(s.db.uploadDir, "tmp")
 	if err != nil {
-		log.Println(err)
+		logError(r, "edit album error", "err", err)
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 		return
 	}
@@ -138,41 +189,68 @@ func (s *server) ServeAPIEditAlbum(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if d.meta.Name == "" {
-		log.Println("Bad request: Album name not specified")
+		logWarn(r, "Album name not specified")
 		http.Error(w, s.tr("Album name not specified"), http.StatusBadRequest)
 		return
 	}
 
-	if d.meta.Name == name && d.imgCnt == 0 && len(d.meta.Edit.Deleted) == 0 && len(d.meta.Edit.Titles) == 0 {
-		log.Println("Bad request: No changes to the album requested")
+	e := &d.meta.Edit
+	if d.meta.Name == name && d.imgCnt == 0 && len(e.Deleted) == 0 && len(e.Titles) == 0 && len(e.Order) == 0 && e.Sort == "" && e.Cover == 0 && !e.detailsChanged() && len(e.Transforms) == 0 {
+		logWarn(r, "No changes to the album requested")
 		http.Error(w, s.tr("No changes to the album requested"), http.StatusBadRequest)
 		return
 	}
+	if e.Sort != "" && !validImageOrder(e.Sort) {
+		logWarn(r, "Unsupported image order", "order", e.Sort)
+		http.Error(w, s.tr("Unsupported image order"), http.StatusBadRequest)
+		return
+	}
+	if (e.DateFrom != nil && !validDate(*e.DateFrom)) || (e.DateTo != nil && !validDate(*e.DateTo)) {
+		logWarn(r, "Error parsing date")
+		http.Error(w, s.tr("Error parsing date"), http.StatusBadRequest)
+		return
+	}
+	for _, v := range []*string{e.StripEXIF, e.PreviewEXIF} {
+		if v == nil {
+			continue
+		}
+		if _, ok := privacyValue(*v); !ok {
+			logWarn(r, "Invalid privacy setting", "value", *v)
+			http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
+			return
+		}
+	}
+	if e.updates, ok = s.imageEdits(w, r, albumID, e.Transforms); !ok {
+		return
+	}
+	d.setAlbumImage()
 	for idx, title := range d.meta.Titles {
 		inf := d.m[idx]
 		if d.m[idx] == nil {
-			log.Println("Error parsing form: unexpected index")
+			logWarn(r, "Error parsing form: unexpected index")
 			http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
 			return
 		}
 		inf.title = title
 	}
-	rs := s.db.EditAlbum(session.Uid, albumID, d.meta.Name, d.meta.Edit.Deleted, d.meta.Edit.Titles, d.files, s.tr)
-	n := len(rs.Jobs)
+	rs := s.db.EditAlbum(session.Uid, albumID, d.meta.Name, e, d.files, s.tr)
+	n := len(rs.Jobs) - rs.EditedCnt
 	d.errs = append(d.errs, rs.Errs...)
-	if d.errs != nil {
-		log.Println("album:", albumID, "new:", n)
-		for _, e := range d.errs {
-			fmt.Printf("%s: %s: %s\n", e.FileName, e.Msg, e.err)
-		}
-	}
+	logAlbumErrors(r, albumID, d.errs)
 	if rs.Status != http.StatusOK {
 		http.Error(w, d.errs[len(d.errs)-1].Msg, rs.Status)
 		return
 	}
-	if n > 0 {
+	s.consumeUploads(r, d)
+	if len(rs.Jobs) > 0 {
 		go s.preparePreviews(rs.Jobs)
 	}
+	details := fmt.Sprintf("%d added, %d deleted", n, rs.DeletedCnt)
+	if rs.Deleted {
+		s.auditAs(r, session.Uid, session.Login, auditAlbumDelete, auditTarget{Album: albumID}, details)
+	} else {
+		s.auditAs(r, session.Uid, session.Login, auditAlbumEdit, auditTarget{Album: albumID}, details)
+	}
 	data := struct {
 		Title    string
 		Messages []string
@@ -182,47 +260,63 @@ func (s *server) ServeAPIEditAlbum(w http.ResponseWriter, r *http.Request) {
 
 	if rs.Deleted {
 		data.Title = s.tr("Album deleted")
-		data.Messages = append(data.Messages, s.tr("No images left in the album, album deleted."))
+		data.Messages = append(data.Messages, s.tr("No images left in the album, album moved to the trash."))
+		data.Href = "/trash"
 	} else {
 		data.Title = s.tr("Album updated")
 		if d.meta.Name != name {
 			data.Messages = append(data.Messages, s.tr("Album name modified."))
 		}
-		if len(d.meta.Edit.Titles) > 0 {
-			if rs.TitlesCnt == len(d.meta.Edit.Titles) {
+		if len(e.Titles) > 0 {
+			if rs.TitlesCnt == len(e.Titles) {
 				data.Messages = append(data.Messages, s.tr("All requsted image titles modified."))
 			} else {
-				data.Messages = append(data.Messages, fmt.Sprintf(s.tr("%d out of %d requsted image titles modified."), n, d.imgCnt))
+				data.Messages = append(data.Messages, fmt.Sprintf(s.trn("%d out of %d requsted image titles modified.", len(e.Titles)), rs.TitlesCnt, len(e.Titles)))
 			}
 		}
 		if d.imgCnt > 0 {
 			if n == d.imgCnt {
 				data.Messages = append(data.Messages, s.tr("All uploaded files added to the album."))
 			} else {
-				data.Messages = append(data.Messages, fmt.Sprintf(s.tr("%d out of %d uploaded files added to the album."), n, d.imgCnt))
+				data.Messages = append(data.Messages, fmt.Sprintf(s.trn("%d out of %d uploaded files added to the album.", d.imgCnt), n, d.imgCnt))
 			}
 		}
-		if len(d.meta.Edit.Deleted) > 0 {
-			if rs.DeletedCnt == len(d.meta.Edit.Deleted) {
+		if len(e.Deleted) > 0 {
+			if rs.DeletedCnt == len(e.Deleted) {
 				data.Messages = append(data.Messages, s.tr("All images deleted from the album have been successfully deleted."))
 			} else {
-				data.Messages = append(data.Messages, fmt.Sprintf(s.tr("%d of %d images deleted from the album have been successfully deleted."), rs.DeletedCnt, len(d.meta.Edit.Deleted)))
+				data.Messages = append(data.Messages, fmt.Sprintf(s.trn("%d of %d images deleted from the album have been successfully deleted.", len(e.Deleted)), rs.DeletedCnt, len(e.Deleted)))
 			}
+			data.Messages = append(data.Messages, s.tr("Deleted images can be restored from the trash."))
+		}
+		if len(e.Order) > 0 || e.Sort != "" {
+			data.Messages = append(data.Messages, s.tr("Image order modified."))
+		}
+		if rs.EditedCnt > 0 {
+			data.Messages = append(data.Messages, s.tr("Image edits saved."))
+		}
+		if rs.CoverChanged {
+			data.Messages = append(data.Messages, s.tr("Album cover changed."))
+		}
+		if e.detailsChanged() {
+			data.Messages = append(data.Messages, s.tr("Album details modified."))
 		}
 	}
 	s.executeTemplate(w, "editalbumok.html", &data, http.StatusOK)
 }
 
 type EditAlbumResult struct {
-	Status     int
-	Deleted    bool
-	DeletedCnt int
-	TitlesCnt  int
-	Jobs       []previewJob
-	Errs       []imageError
+	Status       int
+	Deleted      bool
+	DeletedCnt   int
+	TitlesCnt    int
+	EditedCnt    int
+	CoverChanged bool
+	Jobs         []previewJob
+	Errs         []imageError
 }
 
-func (db *DB) EditAlbum(uid int64, albumID int64, name string, deleted []int64, titles map[string]string, files []*uploadInfo, tr func(string) string) (rs EditAlbumResult) {
+func (db *DB) EditAlbum(uid int64, albumID int64, name string, edit *albumEdit, files []*uploadInfo, tr func(string) string) (rs EditAlbumResult) {
 	rs.Status = http.StatusInternalServerError
 	db.filesMu.Lock()
 	defer db.filesMu.Unlock()
@@ -251,36 +345,72 @@ func (db *DB) EditAlbum(uid int64, albumID int64, name string, deleted []int64,
 		rs.Errs = append(rs.Errs, imageError{err, "", tr("Album does not exist or you are not its owner")})
 		return
 	}
-
-	checkDeleteSHA256 := make([]string, 0, len(deleted))
-	for _, imageID := range deleted {
-		var sha256sum string
-		if err := tx.QueryRow("SELECT sha256sum FROM images WHERE iid=? AND album_id=?", imageID, albumID).Scan(&sha256sum); err != nil {
-			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", imageID), ""})
+	var order string
+	var coverID int64
+	if err := tx.QueryRow("SELECT image_order, image_id FROM albums WHERE aid=?", albumID).Scan(&order, &coverID); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	origCoverID := coverID
+	for _, f := range []struct {
+		column string
+		value  *string
+	}{{"description", edit.Description}, {"date_from", edit.DateFrom}, {"date_to", edit.DateTo}} {
+		if f.value == nil {
 			continue
-
 		}
-		r, err := tx.Exec("DELETE FROM images WHERE iid=? AND album_id=?", imageID, albumID)
-		if err != nil {
-			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", imageID), tr("Internal server error")})
+		if _, err := tx.Exec("UPDATE albums SET "+f.column+"=NULLIF(?, '') WHERE aid=?", *f.value, albumID); err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+	}
+	for _, f := range []struct {
+		column string
+		value  *string
+	}{{"strip_exif", edit.StripEXIF}, {"preview_exif", edit.PreviewEXIF}} {
+		if f.value == nil {
+			continue
+		}
+		v, _ := privacyValue(*f.value)
+		if _, err := tx.Exec("UPDATE albums SET "+f.column+"=? WHERE aid=?", v, albumID); err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+	}
+	if edit.Collection != nil {
+		if err := setAlbumCollection(tx, uid, albumID, *edit.Collection); err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
 			return
 		}
-		cnt, err := r.RowsAffected()
+	}
+	if edit.Cover != 0 {
+		coverID = edit.Cover
+	}
+	if edit.Sort != "" && edit.Sort != order {
+		order = edit.Sort
+		if _, err := tx.Exec("UPDATE albums SET image_order=? WHERE aid=?", order, albumID); err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+	}
+
+	deleted := edit.Deleted
+	for _, imageID := range deleted {
+		// deleted images go to the trash, files are removed when it is emptied
+		ok, err := trashImage(tx, uid, albumID, imageID, now)
 		if err != nil {
 			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", imageID), tr("Internal server error")})
 			return
 		}
-		if cnt == 0 {
-			continue
+		if ok {
+			rs.DeletedCnt++
 		}
-		rs.DeletedCnt++
-		checkDeleteSHA256 = append(checkDeleteSHA256, sha256sum)
 	}
 	if rs.DeletedCnt != len(deleted) {
 		rs.Errs = append(rs.Errs, imageError{errors.New("Not found in DB"), tr("%d of %d deleted"), tr("Not found in this album")})
 	}
 
-	for idStr, title := range titles {
+	for idStr, title := range edit.Titles {
 		imageID, err := strconv.ParseInt(idStr, 10, 64)
 		if err != nil {
 			rs.Status = http.StatusBadRequest
@@ -295,6 +425,44 @@ func (db *DB) EditAlbum(uid int64, albumID int64, name string, deleted []int64,
 		rs.TitlesCnt++
 	}
 
+	var oldEdits []previewJob
+	for _, u := range edit.updates {
+		var job previewJob
+		err := tx.QueryRow("SELECT sha256sum, "+imageEditColumns+" FROM images WHERE iid=? AND album_id=?", u.id, albumID).Scan(append([]interface{}{&job.sha256sum}, job.edit.scanArgs()...)...)
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", u.id), tr("Not found in this album")})
+			continue
+		}
+		args := append([]interface{}{u.isPortrait}, u.edit.args()...)
+		_, err = tx.Exec("UPDATE images SET is_portrait=?, edit_rotate=?, edit_flip_h=?, edit_flip_v=?, crop_left=?, crop_top=?, crop_right=?, crop_bottom=? WHERE iid=?", append(args, u.id)...)
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", u.id), tr("Internal server error")})
+			return
+		}
+		if !job.edit.isZero() && job.edit != u.edit {
+			oldEdits = append(oldEdits, job)
+		}
+		rs.Jobs = append(rs.Jobs, previewJob{u.id, job.sha256sum, u.edit})
+		rs.EditedCnt++
+	}
+
+	if len(edit.Order) > 0 {
+		// images not listed keep their relative order after the
+		// listed ones so that no two images share a position
+		ids, err := albumManualOrder(tx, albumID, edit.Order)
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+		for i, imageID := range ids {
+			_, err = tx.Exec("UPDATE images SET position=? WHERE iid=? AND album_id=?", i, imageID, albumID)
+			if err != nil {
+				rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", imageID), tr("Internal server error")})
+				return
+			}
+		}
+	}
+
 	for _, inf := range files {
 		dirName := filepath.Join(db.imagesDir, inf.sha256[:3])
 		destFilename := filepath.Join(dirName, inf.sha256[3:])
@@ -320,12 +488,17 @@ func (db *DB) EditAlbum(uid int64, albumID int64, name string, deleted []int64,
 		toRemove.files = append(toRemove.files, destFilename)
 	}
 
+	var position int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(position)+1, 0) FROM images WHERE album_id=?", albumID).Scan(&position); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
 	var albumImageID int64 = -1
 	albumIsPortrait := false
-	jobs := make([]previewJob, 0, len(fs))
+	jobs := rs.Jobs
 	for _, inf := range fs {
-		r, err := tx.Exec("INSERT INTO images (sha256sum, album_id, title, is_portrait, created, owner_file_name) VALUES (?, ?, ?, ?, ?, ?)",
-			inf.sha256, albumID, inf.title, inf.isPortrait, inf.created, inf.userFileName)
+		r, err := tx.Exec("INSERT INTO images (sha256sum, album_id, title, is_portrait, is_video, created, owner_file_name, position) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			inf.sha256, albumID, inf.title, inf.isPortrait, inf.isVideo, inf.created, inf.userFileName, position)
 		if err != nil {
 			rs.Errs = append(rs.Errs, imageError{err, inf.userFileName, tr("Internal server error")})
 			return
@@ -335,46 +508,37 @@ func (db *DB) EditAlbum(uid int64, albumID int64, name string, deleted []int64,
 			rs.Errs = append(rs.Errs, imageError{err, inf.userFileName, tr("Internal server error")})
 			return
 		}
-		jobs = append(jobs, previewJob{id, inf.sha256})
+		position++
+		jobs = append(jobs, previewJob{id, inf.sha256, imageEdit{}})
 		if inf.isAlbumImage {
 			albumImageID = id
 			albumIsPortrait = inf.isPortrait
 		}
 	}
 	var toRemoveOnSuccess []string
-	previewExt := []string{".1", ".2"}
-	for _, sha256sum := range checkDeleteSHA256 {
+	for _, job := range oldEdits {
 		var exists bool
-		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE sha256sum=? LIMIT 1)", sha256sum).Scan(&exists)
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE sha256sum=? AND edit_rotate=? AND edit_flip_h=? AND edit_flip_v=? AND crop_left=? AND crop_top=? AND crop_right=? AND crop_bottom=? LIMIT 1)",
+			append([]interface{}{job.sha256sum}, job.edit.args()...)...).Scan(&exists)
 		if err != nil {
 			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
 			return
 		}
-		if exists {
-			continue
-		}
-		toRemoveOnSuccess = append(toRemoveOnSuccess, filepath.Join(db.imagesDir, sha256sum[:3], sha256sum[3:]))
-		filename := filepath.Join(db.previewDir, sha256sum[:3], sha256sum[3:])
-		for _, ext := range previewExt {
-			delFileName := filename + ext
-			_, err := os.Stat(delFileName)
-			if err != nil && os.IsNotExist(err) {
-				continue
-			}
-			toRemoveOnSuccess = append(toRemoveOnSuccess, delFileName)
+		if !exists {
+			// previews of the previous edit are no longer used
+			matches, _ := filepath.Glob(previewPath(db.previewDir, job.sha256sum, job.edit) + ".*")
+			toRemoveOnSuccess = append(toRemoveOnSuccess, matches...)
 		}
 	}
-
 	var imageID int64
 	var isPortrait bool
-	err = tx.QueryRow("SELECT iid, is_portrait from images WHERE album_id=? ORDER BY created LIMIT 1", albumID).Scan(&imageID, &isPortrait)
+	err = tx.QueryRow("SELECT iid, is_portrait from images WHERE album_id=? "+imageOrderBy(order)+" LIMIT 1", albumID).Scan(&imageID, &isPortrait)
 	if err != nil {
 		if err != sql.ErrNoRows {
 			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
 			return
 		}
-		_, err = tx.Exec("DELETE FROM albums WHERE aid=?", albumID)
-		if err != nil {
+		if err := trashAlbum(tx, uid, albumID, now); err != nil {
 			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
 			return
 		}
@@ -389,9 +553,20 @@ func (db *DB) EditAlbum(uid int64, albumID int64, name string, deleted []int64,
 		return
 	}
 	if albumImageID == -1 {
+		// keep the current (or requested) cover if it is still in the album
+		err := tx.QueryRow("SELECT is_portrait FROM images WHERE iid=? AND album_id=?", coverID, albumID).Scan(&isPortrait)
+		if err == nil {
+			imageID = coverID
+		} else if err != sql.ErrNoRows {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		} else if edit.Cover != 0 {
+			rs.Errs = append(rs.Errs, imageError{errors.New("Not found in DB"), fmt.Sprintf("image=%d", edit.Cover), tr("Cover image not found in this album")})
+		}
 		albumImageID = imageID
 		albumIsPortrait = isPortrait
 	}
+	rs.CoverChanged = albumImageID != origCoverID
 	_, err = tx.Exec("UPDATE albums SET image_id=?, is_portrait=? WHERE aid=?", albumImageID, albumIsPortrait, albumID)
 	if err != nil {
 		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
@@ -407,3 +582,40 @@ func (db *DB) EditAlbum(uid int64, albumID int64, name string, deleted []int64,
 	rs.Status = http.StatusOK
 	return
 }
+
+// albumManualOrder returns IDs of images of the album with the listed
+// images first (skipping those not in the album or repeated) followed by
+// the rest of the images in their current manual order.
+func albumManualOrder(tx *sql.Tx, albumID int64, listed []int64) ([]int64, error) {
+	rows, err := tx.Query("SELECT iid FROM images WHERE album_id=? "+imageOrderBy(orderManual), albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	inAlbum := make(map[int64]bool)
+	var rest []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		inAlbum[id] = true
+		rest = append(rest, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var ids []int64
+	for _, id := range listed {
+		if inAlbum[id] {
+			ids = append(ids, id)
+			delete(inAlbum, id)
+		}
+	}
+	for _, id := range rest {
+		if inAlbum[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
@@ -0,0 +1,47 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestAlbumManualOrder(t *testing.T) {
+	db := initTestDB(t)
+	albumID, ids := addTestAlbum(t, db, 1, "Trip", testSum('a'), testSum('b'), testSum('c'), testSum('d'))
+	otherID, other := addTestAlbum(t, db, 1, "Other", testSum('e'))
+	// images not listed keep their current relative order after the
+	// listed ones
+	if _, err := db.db.Exec("UPDATE images SET position=4-position WHERE album_id=?", albumID); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		listed, want []int64
+	}{
+		{[]int64{ids[1]}, []int64{ids[1], ids[3], ids[2], ids[0]}},
+		{[]int64{ids[0], ids[1], ids[2], ids[3]}, ids},
+		{[]int64{ids[2], ids[2], ids[0]}, []int64{ids[2], ids[0], ids[3], ids[1]}},
+		{[]int64{other[0], ids[0], 1000}, []int64{ids[0], ids[3], ids[2], ids[1]}},
+		{nil, []int64{ids[3], ids[2], ids[1], ids[0]}},
+	}
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	for _, tt := range tests {
+		got, err := albumManualOrder(tx, albumID, tt.listed)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("albumManualOrder(%v) = %v, want %v", tt.listed, got, tt.want)
+		}
+	}
+	if got, err := albumManualOrder(tx, otherID, ids); err != nil || fmt.Sprint(got) != fmt.Sprint(other) {
+		t.Errorf("albumManualOrder of other album = %v, %v", got, err)
+	}
+}
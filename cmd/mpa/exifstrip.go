@@ -0,0 +1,265 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+)
+
+var ErrUnsupportedStrip = errors.New("removing private metadata is not supported for this file format")
+
+// privateEXIFTags are tags of the EXIF IFD whose values are removed
+// from served originals (in addition to the whole GPS IFD).
+var privateEXIFTags = map[uint16]bool{
+	0x927c: true, // MakerNote (often contains serial numbers)
+	0xa420: true, // ImageUniqueID
+	0xa430: true, // CameraOwnerName
+	0xa431: true, // BodySerialNumber
+	0xa435: true, // LensSerialNumber
+}
+
+// stripPrivateEXIF returns a copy of the JPEG or TIFF based (such as
+// most RAW formats) file with location and serial numbers removed.
+// EXIF data is scrubbed in place (values are zeroed and the GPS IFD is
+// emptied) so offsets stay valid, XMP packets of JPEG files (which
+// may also contain location) are dropped entirely.
+func stripPrivateEXIF(data []byte) ([]byte, error) {
+	switch {
+	case len(data) > 3 && data[0] == 0xff && data[1] == 0xd8:
+		return stripJPEG(data)
+	case len(data) > 8 && (string(data[:4]) == "II*\x00" || string(data[:4]) == "MM\x00*"):
+		b := append([]byte(nil), data...)
+		return b, scrubTIFF(b)
+	}
+	return nil, ErrUnsupportedStrip
+}
+
+var (
+	exifHeader     = []byte("Exif\x00\x00")
+	xmpHeader      = []byte("http://ns.adobe.com/xap/1.0/\x00")
+	xmpExtHeader   = []byte("http://ns.adobe.com/xmp/extension/\x00")
+	ErrInvalidJPEG = errors.New("invalid JPEG file")
+	ErrInvalidTIFF = errors.New("invalid TIFF structure")
+)
+
+func stripJPEG(data []byte) ([]byte, error) {
+	out := make([]byte, 0, len(data))
+	out = append(out, data[:2]...)
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xff {
+			return nil, ErrInvalidJPEG
+		}
+		marker := data[i+1]
+		if marker == 0xda || marker == 0xd9 {
+			// image data follows, no more metadata segments
+			break
+		}
+		if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) || marker == 0xff {
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+		n := int(binary.BigEndian.Uint16(data[i+2:]))
+		if n < 2 || i+2+n > len(data) {
+			return nil, ErrInvalidJPEG
+		}
+		segment := data[i : i+2+n]
+		payload := segment[4:]
+		if marker == 0xe1 {
+			switch {
+			case bytes.HasPrefix(payload, exifHeader):
+				segment = append([]byte(nil), segment...)
+				if err := scrubTIFF(segment[4+len(exifHeader):]); err != nil {
+					return nil, err
+				}
+			case bytes.HasPrefix(payload, xmpHeader) || bytes.HasPrefix(payload, xmpExtHeader):
+				segment = nil
+			}
+		}
+		out = append(out, segment...)
+		i += 2 + n
+	}
+	return append(out, data[i:]...), nil
+}
+
+// tiffTypeSizes are sizes of TIFF field types (indexed by type).
+var tiffTypeSizes = []int{0, 1, 1, 2, 4, 8, 1, 1, 2, 4, 8, 4, 8}
+
+type tiff struct {
+	b     []byte
+	order binary.ByteOrder
+}
+
+// scrubTIFF removes (in place) GPS IFD entries and private tags of
+// the EXIF IFD from TIFF structure b.
+func scrubTIFF(b []byte) error {
+	if len(b) < 8 {
+		return ErrInvalidTIFF
+	}
+	t := tiff{b: b}
+	switch string(b[:2]) {
+	case "II":
+		t.order = binary.LittleEndian
+	case "MM":
+		t.order = binary.BigEndian
+	default:
+		return ErrInvalidTIFF
+	}
+	off := int(t.order.Uint32(b[4:]))
+	for ifd := 0; off != 0 && ifd < 2; ifd++ { // IFD0 and IFD1 (thumbnail)
+		next, err := t.scrubIFD(off, func(tag uint16) int {
+			switch tag {
+			case 0x8825: // GPSInfo
+				return 2
+			case 0x8769: // ExifIFDPointer
+				return 1
+			}
+			return 0
+		})
+		if err != nil {
+			return err
+		}
+		off = next
+	}
+	return nil
+}
+
+// scrubIFD processes the IFD at off. action returns 1 for tags which
+// point to an IFD containing private tags and 2 for tags which point
+// to an IFD to be removed entirely. It returns offset of the next IFD.
+func (t tiff) scrubIFD(off int, action func(tag uint16) int) (int, error) {
+	if off < 8 || off+2 > len(t.b) {
+		return 0, ErrInvalidTIFF
+	}
+	n := int(t.order.Uint16(t.b[off:]))
+	if off+2+12*n+4 > len(t.b) {
+		return 0, ErrInvalidTIFF
+	}
+	for k := 0; k < n; k++ {
+		e := off + 2 + 12*k
+		tag := t.order.Uint16(t.b[e:])
+		switch action(tag) {
+		case 1:
+			if _, err := t.scrubIFD(int(t.order.Uint32(t.b[e+8:])), func(tag uint16) int {
+				if privateEXIFTags[tag] {
+					return 3
+				}
+				return 0
+			}); err != nil {
+				return 0, err
+			}
+		case 2:
+			if err := t.clearIFD(int(t.order.Uint32(t.b[e+8:]))); err != nil {
+				return 0, err
+			}
+		case 3:
+			if err := t.clearValue(e); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return int(t.order.Uint32(t.b[off+2+12*n:])), nil
+}
+
+// clearValue zeroes the value of the IFD entry at e.
+func (t tiff) clearValue(e int) error {
+	typ := int(t.order.Uint16(t.b[e+2:]))
+	if typ >= len(tiffTypeSizes) {
+		return ErrInvalidTIFF
+	}
+	size := int(t.order.Uint32(t.b[e+4:])) * tiffTypeSizes[typ]
+	if size <= 4 {
+		copy(t.b[e+8:e+12], make([]byte, 4))
+		return nil
+	}
+	v := int(t.order.Uint32(t.b[e+8:]))
+	if v < 0 || v+size > len(t.b) {
+		return ErrInvalidTIFF
+	}
+	copy(t.b[v:v+size], make([]byte, size))
+	return nil
+}
+
+// clearIFD zeroes values of all entries of the IFD at off and then
+// makes it empty.
+func (t tiff) clearIFD(off int) error {
+	if off < 8 || off+2 > len(t.b) {
+		return ErrInvalidTIFF
+	}
+	n := int(t.order.Uint16(t.b[off:]))
+	if off+2+12*n+4 > len(t.b) {
+		return ErrInvalidTIFF
+	}
+	for k := 0; k < n; k++ {
+		if err := t.clearValue(off + 2 + 12*k); err != nil {
+			return err
+		}
+	}
+	copy(t.b[off:off+2+12*n+4], make([]byte, 2+12*n+4))
+	return nil
+}
+
+// previewEXIF returns JPEG APP1 segment with EXIF containing only the
+// capture time (in EXIF format 2006:01:02 15:04:05) and copyright
+// (each omitted if empty) or nil if both are empty.
+func previewEXIF(dateTime, copyright string) []byte {
+	type entry struct {
+		tag   uint16
+		value []byte
+	}
+	var ifd0, exifIFD []entry
+	if copyright != "" {
+		ifd0 = append(ifd0, entry{0x8298, append([]byte(copyright), 0)})
+	}
+	if dateTime != "" {
+		ifd0 = append(ifd0, entry{0x8769, nil})
+		exifIFD = append(exifIFD, entry{0x9003, append([]byte(dateTime), 0)})
+	}
+	if len(ifd0) == 0 {
+		return nil
+	}
+	be := binary.BigEndian
+	ifd0Size := 2 + 12*len(ifd0) + 4
+	exifOff := 8 + ifd0Size
+	dataOff := exifOff
+	if len(exifIFD) > 0 {
+		dataOff += 2 + 12*len(exifIFD) + 4
+	}
+	b := make([]byte, dataOff)
+	copy(b, "MM\x00*\x00\x00\x00\x08")
+	write := func(off int, entries []entry) {
+		be.PutUint16(b[off:], uint16(len(entries)))
+		for k, e := range entries {
+			p := off + 2 + 12*k
+			be.PutUint16(b[p:], e.tag)
+			if e.value == nil {
+				be.PutUint16(b[p+2:], 4) // LONG
+				be.PutUint32(b[p+4:], 1)
+				be.PutUint32(b[p+8:], uint32(exifOff))
+				continue
+			}
+			be.PutUint16(b[p+2:], 2) // ASCII
+			be.PutUint32(b[p+4:], uint32(len(e.value)))
+			if len(e.value) <= 4 {
+				copy(b[p+8:], e.value)
+				continue
+			}
+			be.PutUint32(b[p+8:], uint32(len(b)))
+			b = append(b, e.value...)
+		}
+	}
+	write(8, ifd0)
+	if len(exifIFD) > 0 {
+		write(exifOff, exifIFD)
+	}
+	segment := []byte{0xff, 0xe1, 0, 0}
+	segment = append(segment, exifHeader...)
+	segment = append(segment, b...)
+	be.PutUint16(segment[2:], uint16(len(segment)-2))
+	return segment
+}
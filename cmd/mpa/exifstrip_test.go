@@ -0,0 +1,157 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// testIFDEntry is an entry of a TIFF structure built by testTIFF. If
+// sub is non-zero the entry points to the IFD of that index.
+type testIFDEntry struct {
+	tag, typ uint16
+	value    []byte
+	sub      int
+}
+
+// testTIFF returns a TIFF structure with the given IFDs (the first
+// one is IFD0) followed by values which do not fit in the entries.
+func testTIFF(order binary.ByteOrder, ifds ...[]testIFDEntry) []byte {
+	offsets := make([]int, len(ifds))
+	dataOff := 8
+	for i, ifd := range ifds {
+		offsets[i] = dataOff
+		dataOff += 2 + 12*len(ifd) + 4
+	}
+	b := make([]byte, dataOff)
+	if order == binary.LittleEndian {
+		copy(b, "II")
+	} else {
+		copy(b, "MM")
+	}
+	order.PutUint16(b[2:], 42)
+	order.PutUint32(b[4:], 8)
+	for i, ifd := range ifds {
+		order.PutUint16(b[offsets[i]:], uint16(len(ifd)))
+		for k, e := range ifd {
+			p := offsets[i] + 2 + 12*k
+			order.PutUint16(b[p:], e.tag)
+			if e.sub != 0 {
+				order.PutUint16(b[p+2:], 4) // LONG
+				order.PutUint32(b[p+4:], 1)
+				order.PutUint32(b[p+8:], uint32(offsets[e.sub]))
+				continue
+			}
+			order.PutUint16(b[p+2:], e.typ)
+			order.PutUint32(b[p+4:], uint32(len(e.value)/tiffTypeSizes[e.typ]))
+			if len(e.value) <= 4 {
+				copy(b[p+8:], e.value)
+				continue
+			}
+			order.PutUint32(b[p+8:], uint32(len(b)))
+			b = append(b, e.value...)
+		}
+	}
+	return b
+}
+
+// testEXIF returns TIFF structure with camera make, capture time,
+// serial numbers and GPS position.
+func testEXIF(order binary.ByteOrder) []byte {
+	latitude := make([]byte, 24) // 3 RATIONALs
+	for i, v := range []uint32{52, 1, 13, 1, 2955, 100} {
+		order.PutUint32(latitude[4*i:], v)
+	}
+	return testTIFF(order,
+		[]testIFDEntry{
+			{tag: 0x010f, typ: 2, value: []byte("TestCam\x00")}, // Make
+			{tag: 0x8769, sub: 1},                               // ExifIFDPointer
+			{tag: 0x8825, sub: 2},                               // GPSInfo
+		},
+		[]testIFDEntry{
+			{tag: 0x9003, typ: 2, value: []byte("2017:06:01 12:30:00\x00")}, // DateTimeOriginal
+			{tag: 0xa431, typ: 2, value: []byte("BODY-SN-1234\x00")},
+			{tag: 0xa435, typ: 2, value: []byte("LS9\x00")}, // fits in the entry
+		},
+		[]testIFDEntry{
+			{tag: 0x0001, typ: 2, value: []byte("N\x00")},
+			{tag: 0x0002, typ: 5, value: latitude},
+		},
+	)
+}
+
+// testJPEG returns minimal JPEG file structure with the given APP1
+// segment payloads.
+func testJPEG(payloads ...[]byte) []byte {
+	b := []byte{0xff, 0xd8}
+	for _, p := range payloads {
+		b = append(b, 0xff, 0xe1, 0, 0)
+		binary.BigEndian.PutUint16(b[len(b)-2:], uint16(len(p)+2))
+		b = append(b, p...)
+	}
+	return append(b, 0xff, 0xda, 0, 2, 1, 2, 3, 0xff, 0xd9)
+}
+
+func TestStripPrivateEXIF(t *testing.T) {
+	xmp := append(append([]byte(nil), xmpHeader...), "<x:xmpmeta>GPSLatitude 52,13.5N</x:xmpmeta>"...)
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"TIFF little endian", testEXIF(binary.LittleEndian)},
+		{"TIFF big endian", testEXIF(binary.BigEndian)},
+		{"JPEG", testJPEG(append(append([]byte(nil), exifHeader...), testEXIF(binary.BigEndian)...), xmp)},
+		{"JPEG little endian", testJPEG(append(append([]byte(nil), exifHeader...), testEXIF(binary.LittleEndian)...))},
+	}
+	for _, tt := range tests {
+		orig := append([]byte(nil), tt.data...)
+		b, err := stripPrivateEXIF(tt.data)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(tt.data, orig) {
+			t.Errorf("%s: input modified", tt.name)
+		}
+		for _, s := range []string{"TestCam", "2017:06:01 12:30:00"} {
+			if !bytes.Contains(b, []byte(s)) {
+				t.Errorf("%s: %q removed", tt.name, s)
+			}
+		}
+		for _, s := range []string{"BODY-SN-1234", "LS9", "GPSLatitude", "\x00\x00\x0b\x8b", "\x8b\x0b\x00\x00"} {
+			if bytes.Contains(b, []byte(s)) {
+				t.Errorf("%s: %q not removed", tt.name, s)
+			}
+		}
+		if len(tt.data) > 2 && tt.data[0] == 0xff && !bytes.HasSuffix(b, []byte{0xff, 0xda, 0, 2, 1, 2, 3, 0xff, 0xd9}) {
+			t.Errorf("%s: image data not preserved", tt.name)
+		}
+	}
+}
+
+func TestStripPrivateEXIFErrors(t *testing.T) {
+	valid := testEXIF(binary.BigEndian)
+	badIFD := append([]byte(nil), valid...)
+	binary.BigEndian.PutUint32(badIFD[4:], uint32(len(badIFD)))
+	tests := []struct {
+		name string
+		data []byte
+		err  error
+	}{
+		{"PNG", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), ErrUnsupportedStrip},
+		{"empty", nil, ErrUnsupportedStrip},
+		{"IFD offset out of range", badIFD, ErrInvalidTIFF},
+		{"truncated TIFF", valid[:40], ErrInvalidTIFF},
+		{"JPEG bad segment length", []byte{0xff, 0xd8, 0xff, 0xe1, 0xff, 0xff, 0}, ErrInvalidJPEG},
+		{"JPEG garbage between segments", []byte{0xff, 0xd8, 0x00, 0x00, 0x00, 0x00}, ErrInvalidJPEG},
+	}
+	for _, tt := range tests {
+		if _, err := stripPrivateEXIF(tt.data); err != tt.err {
+			t.Errorf("%s: got error %v, want %v", tt.name, err, tt.err)
+		}
+	}
+}
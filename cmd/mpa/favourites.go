@@ -0,0 +1,256 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Users mark images they like as favourites (stored in the favourites
+// table). Favourites of the user are shown as the virtual album My
+// favourites (/favourites) and owners of albums see how many times
+// images of their albums were marked. As with comments, favourites of
+// images moved to the trash get trash_id set to the trash ID of the
+// image, are restored with it and removed when it is removed from the
+// trash.
+
+var ErrImageNotFound = errors.New("image not found")
+
+// favourite describes an image as seen by the user (Count is set only
+// for owners of the album).
+type favourite struct {
+	ImageID   int64 `json:"image_id"`
+	AlbumID   int64 `json:"album_id"`
+	Video     bool  `json:"video"`
+	Favourite bool  `json:"favourite"`
+	Count     int   `json:"count,omitempty"`
+
+	// set only by Favourites for the My favourites album
+	portrait bool
+	title    string
+	comments int
+}
+
+// SetFavourite marks (or unmarks) the image as a favourite of the user.
+func (db *DB) SetFavourite(uid, imageID int64, fav bool) error {
+	var err error
+	if !fav {
+		_, err = db.db.Exec("DELETE FROM favourites WHERE user_id=? AND image_id=? AND trash_id IS NULL", uid, imageID)
+		return err
+	}
+	r, err := db.db.Exec(`
+INSERT OR IGNORE INTO favourites (user_id, image_id, created)
+SELECT ?, iid, ? FROM images WHERE iid=?`, uid, time.Now().UTC().Unix(), imageID)
+	if err != nil {
+		return err
+	}
+	if cnt, err := r.RowsAffected(); err != nil {
+		return err
+	} else if cnt == 0 {
+		var exists bool
+		if err := db.db.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE iid=?)", imageID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return ErrImageNotFound
+		}
+	}
+	return nil
+}
+
+// Favourites returns favourite images of the user, the most recently
+// marked first.
+func (db *DB) Favourites(uid int64) ([]favourite, error) {
+	rows, err := db.db.Query(`
+SELECT iid, album_id, is_video, is_portrait, title, `+commentsCntColumn+`
+FROM favourites JOIN images ON favourites.image_id=images.iid
+WHERE favourites.user_id=? AND favourites.trash_id IS NULL
+ORDER BY favourites.created DESC, favourites.rowid DESC`, uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fs []favourite
+	for rows.Next() {
+		f := favourite{Favourite: true}
+		if err := rows.Scan(&f.ImageID, &f.AlbumID, &f.Video, &f.portrait, &f.title, &f.comments); err != nil {
+			return nil, err
+		}
+		fs = append(fs, f)
+	}
+	return fs, rows.Err()
+}
+
+// AlbumFavourites returns images of the album (in the album order)
+// with favourite marks of the user and, if the user owns the album,
+// the numbers of users who marked them.
+func (db *DB) AlbumFavourites(uid, albumID int64) ([]favourite, error) {
+	var ownerID int64
+	var order string
+	err := db.db.QueryRow("SELECT owner_id, image_order FROM albums WHERE aid=?", albumID).Scan(&ownerID, &order)
+	if err == sql.ErrNoRows {
+		return nil, ErrImageNotFound
+	} else if err != nil {
+		return nil, err
+	}
+	rows, err := db.db.Query(`
+SELECT iid, is_video, `+favouriteColumns+`
+FROM images WHERE album_id=? `+imageOrderBy(order), uid, albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var fs []favourite
+	for rows.Next() {
+		f := favourite{AlbumID: albumID}
+		if err := rows.Scan(&f.ImageID, &f.Video, &f.Favourite, &f.Count); err != nil {
+			return nil, err
+		}
+		if ownerID != uid {
+			f.Count = 0
+		}
+		fs = append(fs, f)
+	}
+	return fs, rows.Err()
+}
+
+// favouriteColumns selects whether an image (of the images table) is a
+// favourite of the user given as the argument and the number of users
+// who marked it.
+const favouriteColumns = `EXISTS(SELECT 1 FROM favourites WHERE image_id=iid AND user_id=? AND trash_id IS NULL),
+(SELECT count(*) FROM favourites WHERE image_id=iid AND trash_id IS NULL)`
+
+// FavouritesCnt returns the number of favourite images of the user.
+func (db *DB) FavouritesCnt(uid int64) (int, error) {
+	var n int
+	err := db.db.QueryRow("SELECT count(*) FROM favourites JOIN images ON image_id=iid WHERE user_id=? AND trash_id IS NULL", uid).Scan(&n)
+	return n, err
+}
+
+// trashFavourites marks favourites of the image as moved to the trash
+// with the image of the given trash ID.
+func trashFavourites(tx *sql.Tx, imageID, tid int64) error {
+	_, err := tx.Exec("UPDATE favourites SET trash_id=? WHERE image_id=? AND trash_id IS NULL", tid, imageID)
+	return err
+}
+
+// restoreFavourites restores favourites of the image of the given
+// trash ID restored as imageID.
+func restoreFavourites(tx *sql.Tx, tid, imageID int64) error {
+	_, err := tx.Exec("UPDATE favourites SET image_id=?, trash_id=NULL WHERE trash_id=?", imageID, tid)
+	return err
+}
+
+// purgeFavourites removes favourites of images no longer in the trash.
+func purgeFavourites(tx *sql.Tx) error {
+	_, err := tx.Exec("DELETE FROM favourites WHERE trash_id IS NOT NULL AND trash_id NOT IN (SELECT tid FROM trash_images)")
+	return err
+}
+
+// ServeFavourites serves the virtual album of favourite images of the
+// user.
+func (s *server) ServeFavourites(w http.ResponseWriter, r *http.Request) {
+	session, err := s.SessionData(r)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Session error"))
+		return
+	}
+	fs, err := s.db.Favourites(session.Uid)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	data := albumData{Title: s.tr("My favourites"), URL: pathQuery(r), Lang: s.lang}
+	for _, f := range fs {
+		im := albumImage{Title: f.title, Video: f.Video, Comments: f.comments, Favourite: true}
+		im.setPreview(f.ImageID, f.portrait, "/view/favourites")
+		data.Images = append(data.Images, im)
+	}
+	s.executeTemplate(w, "album.html", &data, http.StatusOK)
+}
+
+// ServeAPIFavourites returns favourite images of the user or, if the
+// album query parameter is given, all images of the album with
+// favourite marks of the user (and their numbers for the owner):
+//
+//	GET /api/favourites
+//	GET /api/favourites?album=ID
+func (s *server) ServeAPIFavourites(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	session, err := s.SessionData(r)
+	if err != nil {
+		logError(r, "session error", "err", err)
+		http.Error(w, s.tr("Authorization error"), http.StatusForbidden)
+		return
+	}
+	var fs []favourite
+	if v := r.URL.Query().Get("album"); v != "" {
+		var albumID int64
+		if albumID, err = strconv.ParseInt(v, 10, 64); err != nil {
+			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+			return
+		}
+		fs, err = s.db.AlbumFavourites(session.Uid, albumID)
+	} else {
+		fs, err = s.db.Favourites(session.Uid)
+	}
+	if err == ErrImageNotFound {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		logError(r, "favourites error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	if fs == nil {
+		fs = []favourite{}
+	}
+	writeJSON(w, http.StatusOK, struct {
+		Images []favourite `json:"images"`
+	}{fs})
+}
+
+// ServeAPIFavourite marks the image given in the path as a favourite of
+// the user (or unmarks it if the favourite field of the form is
+// false).
+func (s *server) ServeAPIFavourite(w http.ResponseWriter, r *http.Request) {
+	imageID, err := idFromPath(r.URL.Path, "/api/favourite/")
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	session, form, ok := s.parseAPIForm(w, r)
+	if !ok {
+		return
+	}
+	fav := true
+	if v := form.Get("favourite"); v != "" {
+		if fav, err = strconv.ParseBool(v); err != nil {
+			http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
+			return
+		}
+	}
+	switch err := s.db.SetFavourite(session.Uid, imageID, fav); err {
+	case nil:
+	case ErrImageNotFound:
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	default:
+		logError(r, "favourite error", "image", imageID, "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, http.StatusOK, struct {
+		ImageID   int64 `json:"image_id"`
+		Favourite bool  `json:"favourite"`
+	}{imageID, fav})
+}
@@ -0,0 +1,151 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSetFavourite(t *testing.T) {
+	db := initTestDB(t)
+	addTestUsers(t, db, "bob")
+	albumID, ids := addTestAlbum(t, db, 1, "Trip", testSum('a'), testSum('b'))
+
+	// marking twice is the same as marking once
+	for i := 0; i < 2; i++ {
+		if err := db.SetFavourite(2, ids[1], true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.SetFavourite(1, ids[1], true); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetFavourite(2, ids[1]+10, true); err != ErrImageNotFound {
+		t.Errorf("marking missing image: got %v, want %v", err, ErrImageNotFound)
+	}
+	if n, err := db.FavouritesCnt(2); err != nil || n != 1 {
+		t.Errorf("FavouritesCnt = %d, %v, want 1", n, err)
+	}
+
+	// only the owner of the album sees the counts
+	for _, uid := range []int64{1, 2} {
+		fs, err := db.AlbumFavourites(uid, albumID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(fs) != 2 || fs[0].Favourite || !fs[1].Favourite {
+			t.Fatalf("user %d: album favourites %+v", uid, fs)
+		}
+		if want := map[int64]int{1: 2, 2: 0}[uid]; fs[1].Count != want {
+			t.Errorf("user %d sees image marked %d times, want %d", uid, fs[1].Count, want)
+		}
+	}
+
+	if err := db.SetFavourite(2, ids[1], false); err != nil {
+		t.Fatal(err)
+	}
+	if fs, err := db.Favourites(2); err != nil || len(fs) != 0 {
+		t.Errorf("favourites after unmarking: %+v, %v", fs, err)
+	}
+	if fs, err := db.Favourites(1); err != nil || len(fs) != 1 || fs[0].ImageID != ids[1] || fs[0].AlbumID != albumID {
+		t.Errorf("favourites of other user after unmarking: %+v, %v", fs, err)
+	}
+}
+
+func TestFavouritesInTrash(t *testing.T) {
+	db := initTestDB(t)
+	addTestUsers(t, db, "bob")
+	albumID, ids := addTestAlbum(t, db, 1, "Trip", testSum('a'), testSum('b'))
+	for _, uid := range []int64{1, 2} {
+		if err := db.SetFavourite(uid, ids[0], true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	count := func(cond string) int {
+		t.Helper()
+		var n int
+		if err := db.db.QueryRow("SELECT count(*) FROM favourites WHERE " + cond).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+	trash := func(imageID int64) {
+		t.Helper()
+		tx, err := db.db.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok, err := trashImage(tx, 1, albumID, imageID, time.Now().UTC().Unix()); !ok || err != nil {
+			t.Fatalf("trashImage = %t, %v", ok, err)
+		}
+		if err := tx.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	trash(ids[0])
+	if n := count("trash_id IS NOT NULL"); n != 2 {
+		t.Errorf("%d favourites in the trash, want 2", n)
+	}
+	if n, err := db.FavouritesCnt(2); err != nil || n != 0 {
+		t.Errorf("FavouritesCnt with image in the trash = %d, %v", n, err)
+	}
+	// the image is marked again after restoring the album from a
+	// backup while the deleted one waits in the trash: the unique
+	// index covers only favourites not in the trash
+	now := time.Now().UTC()
+	if _, err := db.db.Exec("INSERT INTO images (iid, album_id, sha256sum, title, is_portrait, created, owner_file_name) VALUES (?, ?, ?, '', 0, ?, 'a.jpg')", ids[0], albumID, testSum('a'), now); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.SetFavourite(2, ids[0], true); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec("INSERT INTO favourites (user_id, image_id, created) VALUES (2, ?, 0)", ids[0]); err == nil {
+		t.Error("duplicate favourite not in the trash inserted")
+	}
+
+	_, images, err := db.Trash(1)
+	if err != nil || len(images) != 1 {
+		t.Fatalf("trash has %d images (%v)", len(images), err)
+	}
+	if _, err := db.RestoreTrash(1, nil, []int64{images[0].Tid}); err != nil {
+		t.Fatal(err)
+	}
+	restored := testAlbumImages(t, db, albumID)
+	if len(restored) != 3 {
+		t.Fatalf("album has images %v after restoring", restored)
+	}
+	var restoredID int64 // a new ID as the old one is taken
+	for _, id := range restored {
+		if id != ids[0] && id != ids[1] {
+			restoredID = id
+		}
+	}
+	if fs, err := db.AlbumFavourites(1, albumID); err != nil || len(fs) != 3 {
+		t.Fatalf("album favourites %+v (%v)", fs, err)
+	} else {
+		for _, f := range fs {
+			if want := map[int64]int{ids[0]: 1, ids[1]: 0, restoredID: 2}[f.ImageID]; f.Count != want {
+				t.Errorf("image %d marked %d times, want %d", f.ImageID, f.Count, want)
+			}
+		}
+	}
+	if n := count("trash_id IS NOT NULL"); n != 0 {
+		t.Errorf("%d favourites left in the trash after restoring", n)
+	}
+
+	trash(restoredID)
+	trash(ids[1])
+	if _, err := db.PurgeTrash(1, time.Now().Add(time.Minute).Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if n := count("1"); n != 1 {
+		t.Errorf("%d favourites left after purging the trash, want 1", n)
+	}
+	if fs, err := db.Favourites(2); err != nil || len(fs) != 1 || fs[0].ImageID != ids[0] {
+		t.Errorf("favourites after purging the trash: %+v, %v", fs, err)
+	}
+}
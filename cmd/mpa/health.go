@@ -0,0 +1,99 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// /healthz and /readyz are served without authentication (for
+// container orchestrators and load balancers) so they report only
+// the state of the checks, details of failures are logged.
+
+type healthCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type healthStatus struct {
+	Status string        `json:"status"`
+	Checks []healthCheck `json:"checks,omitempty"`
+}
+
+// ServeHealthz reports that the process is up and serving requests.
+func (s *server) ServeHealthz(w http.ResponseWriter, r *http.Request) {
+	s.writeHealth(w, r, healthStatus{Status: "ok"})
+}
+
+// ServeReadyz reports whether the server is able to serve requests:
+// the database is reachable, directories for files are writable and
+// preview workers are running.
+func (s *server) ServeReadyz(w http.ResponseWriter, r *http.Request) {
+	st := healthStatus{Status: "ok"}
+	add := func(name string, err error, msg string) {
+		c := healthCheck{Name: name, Status: "ok"}
+		if err != nil {
+			logWarn(r, "readiness check failed", "check", name, "err", err)
+			c.Status = "fail"
+			c.Error = msg
+			st.Status = "unavailable"
+		}
+		st.Checks = append(st.Checks, c)
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	var version string
+	add("database", s.db.db.QueryRowContext(ctx, "SELECT value FROM mpa WHERE key='db_version'").Scan(&version), "database not reachable")
+	for _, d := range []struct{ name, path string }{
+		{"images_dir", s.db.imagesDir},
+		{"preview_dir", s.db.previewDir},
+		{"upload_dir", s.db.uploadDir},
+		{"resumable_dir", s.db.resumableDir},
+	} {
+		add(d.name, checkWritable(d.path), "directory not writable")
+	}
+	var err error
+	if atomic.LoadInt32(s.previewRunning) == 0 {
+		err = ErrPreviewNotRunning
+	}
+	add("preview_workers", err, "not running")
+	s.writeHealth(w, r, st)
+}
+
+func (s *server) writeHealth(w http.ResponseWriter, r *http.Request, st healthStatus) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if st.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if r.Method == "GET" {
+		json.NewEncoder(w).Encode(&st)
+	}
+}
+
+// checkWritable checks if a file may be created in the directory.
+func checkWritable(dir string) error {
+	f, err := ioutil.TempFile(dir, ".readyz")
+	if err != nil {
+		return err
+	}
+	name := f.Name()
+	err = f.Close()
+	if err2 := os.Remove(name); err == nil {
+		err = err2
+	}
+	return err
+}
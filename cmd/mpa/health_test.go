@@ -0,0 +1,82 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestServeHealthz(t *testing.T) {
+	s := &server{tr: func(s string) string { return s }}
+	for _, tt := range []struct {
+		method string
+		code   int
+		body   string
+	}{
+		{"GET", 200, "{\"status\":\"ok\"}\n"},
+		{"HEAD", 200, ""},
+		{"POST", 405, "Method not allowed\n"},
+	} {
+		w := httptest.NewRecorder()
+		s.ServeHealthz(w, httptest.NewRequest(tt.method, "/healthz", nil))
+		if w.Code != tt.code || w.Body.String() != tt.body {
+			t.Errorf("%s /healthz: status %d, body %q, want %d, %q", tt.method, w.Code, w.Body.String(), tt.code, tt.body)
+		}
+	}
+}
+
+func TestServeReadyz(t *testing.T) {
+	db := initTestDB(t)
+	s := &server{db: db, previewRunning: new(int32), tr: func(s string) string { return s }}
+	readyz := func() (int, map[string]string) {
+		t.Helper()
+		w := httptest.NewRecorder()
+		s.ServeReadyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		if cc := w.Header().Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("served with Cache-Control %q", cc)
+		}
+		var st healthStatus
+		if err := json.NewDecoder(w.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+		checks := map[string]string{"": st.Status}
+		for _, c := range st.Checks {
+			checks[c.Name] = c.Status
+		}
+		return w.Code, checks
+	}
+
+	atomic.StoreInt32(s.previewRunning, 1)
+	if code, checks := readyz(); code != 200 || checks[""] != "ok" || len(checks) != 7 {
+		t.Errorf("ready server: status %d, checks %v", code, checks)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(db.imagesDir, ".readyz*")); len(matches) != 0 {
+		t.Errorf("files left by the writability check: %v", matches)
+	}
+
+	atomic.StoreInt32(s.previewRunning, 0)
+	if err := os.RemoveAll(db.resumableDir); err != nil {
+		t.Fatal(err)
+	}
+	code, checks := readyz()
+	if code != 503 || checks[""] != "unavailable" {
+		t.Errorf("server not ready: status %d, checks %v", code, checks)
+	}
+	for name, want := range map[string]string{"database": "ok", "images_dir": "ok", "resumable_dir": "fail", "preview_workers": "fail"} {
+		if checks[name] != want {
+			t.Errorf("check %s: status %q, want %q", name, checks[name], want)
+		}
+	}
+
+	db.db.Close()
+	if code, checks := readyz(); code != 503 || checks["database"] != "fail" {
+		t.Errorf("closed database: status %d, checks %v", code, checks)
+	}
+}
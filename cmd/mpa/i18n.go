@@ -0,0 +1,597 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Languages other than the built-in ones (or changes to the built-in
+// translations) are added with message catalogs: LANG.json files in
+// the directory given with -locale_dir, such as
+//
+//	{
+//		"name": "Deutsch",
+//		"messages": {
+//			"Albums": "Alben",
+//			"%d images deleted.": ["%d Bild gelöscht.", "%d Bilder gelöscht."]
+//		}
+//	}
+//
+// Plural messages are given as lists of forms in the order of the
+// plural rule of the language (or of the language named with
+// "plural_rule"). The language of a request is the one chosen by the
+// user, negotiated from Accept-Language or the installation default.
+// Catalogs may be checked with: mpa i18n check, and a catalog to be
+// filled by a translator is written by: mpa i18n export LANG.
+//
+// A message has a single plural form so in messages with two numbers
+// (such as "%d out of %d selected images copied to the album.") the
+// form is chosen by the number the nouns agree with (the total). If
+// both numbers need their own forms one of them is translated as a
+// separate message and included with %s (see images).
+
+// pluralRule selects the plural form used for a number.
+type pluralRule struct {
+	forms int
+	index func(n int) int
+}
+
+var (
+	pluralNone   = pluralRule{1, func(n int) int { return 0 }}
+	pluralOne    = pluralRule{2, func(n int) int { return b2i(n != 1) }}
+	pluralFrench = pluralRule{2, func(n int) int { return b2i(n > 1) }}
+	pluralSlavic = pluralRule{3, func(n int) int {
+		switch {
+		case n%10 == 1 && n%100 != 11:
+			return 0
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20):
+			return 1
+		}
+		return 2
+	}}
+	pluralPolish = pluralRule{3, func(n int) int {
+		switch {
+		case n == 1:
+			return 0
+		case n%10 >= 2 && n%10 <= 4 && (n%100 < 10 || n%100 >= 20):
+			return 1
+		}
+		return 2
+	}}
+	pluralCzech = pluralRule{3, func(n int) int {
+		switch {
+		case n == 1:
+			return 0
+		case n >= 2 && n <= 4:
+			return 1
+		}
+		return 2
+	}}
+)
+
+// pluralRules maps language codes to their plural rules (in the
+// order of forms used by gettext).
+var pluralRules = map[string]pluralRule{
+	"ja": pluralNone, "ko": pluralNone, "zh": pluralNone, "vi": pluralNone, "th": pluralNone, "id": pluralNone,
+	"en": pluralOne, "de": pluralOne, "nl": pluralOne, "sv": pluralOne, "da": pluralOne, "nb": pluralOne, "nn": pluralOne,
+	"no": pluralOne, "fi": pluralOne, "et": pluralOne, "es": pluralOne, "it": pluralOne, "pt": pluralOne, "el": pluralOne,
+	"hu": pluralOne, "bg": pluralOne, "ca": pluralOne, "eo": pluralOne, "tr": pluralOne,
+	"fr": pluralFrench, "pt-br": pluralFrench,
+	"ru": pluralSlavic, "uk": pluralSlavic, "be": pluralSlavic, "sr": pluralSlavic, "hr": pluralSlavic, "bs": pluralSlavic,
+	"pl": pluralPolish,
+	"cs": pluralCzech, "sk": pluralCzech,
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// languageNames are names of built-in languages shown to users.
+var languageNames = map[string]string{
+	"en": "English",
+	"pl": "Polski",
+}
+
+// catalog holds translated messages of a language.
+type catalog struct {
+	lang     string
+	name     string // name of the language in the language itself
+	messages translation
+	plurals  plurals
+	rule     pluralRule
+	fallback *catalog // used for missing messages (English for other languages)
+}
+
+// plurals maps messages to their plural forms.
+type plurals map[string][]string
+
+func (c *catalog) translate(s string) string {
+	if c.messages[s] == "" && c.fallback != nil {
+		return c.fallback.translate(s)
+	}
+	return c.messages.translate(s)
+}
+
+func (c *catalog) htmlTranslate(s string) template.HTML {
+	return template.HTML(c.translate(s))
+}
+
+// translatePlural returns the form of the message for the number n
+// (the message itself if there is no plural translation).
+func (c *catalog) translatePlural(s string, n int) string {
+	forms := c.plurals[s]
+	if i := c.rule.index(n); i < len(forms) && forms[i] != "" {
+		return forms[i]
+	}
+	if c.messages[s] == "" && c.fallback != nil {
+		return c.fallback.translatePlural(s, n)
+	}
+	return c.translate(s)
+}
+
+// images returns the translated number of images for inclusion in
+// messages with another number.
+func (s *server) images(n int) string {
+	return fmt.Sprintf(s.trn("%d images", n), n)
+}
+
+func (c *catalog) funcMap() template.FuncMap {
+	return template.FuncMap{"tr": c.translate, "htmlTr": c.htmlTranslate, "trn": c.translatePlural}
+}
+
+func lookupPluralRule(lang string) (pluralRule, bool) {
+	lang = strings.Replace(strings.ToLower(lang), "_", "-", -1)
+	if r, ok := pluralRules[lang]; ok {
+		return r, true
+	}
+	if i := strings.IndexByte(lang, '-'); i > 0 {
+		r, ok := pluralRules[lang[:i]]
+		return r, ok
+	}
+	return pluralRule{}, false
+}
+
+// builtinCatalogs returns catalogs of the built-in translations.
+func builtinCatalogs() map[string]*catalog {
+	m := make(map[string]*catalog)
+	for lang, t := range translations {
+		rule, _ := lookupPluralRule(lang)
+		m[lang] = &catalog{lang: lang, name: languageNames[lang], messages: copyTranslation(t), plurals: copyPlurals(builtinPlurals[lang]), rule: rule}
+	}
+	for lang, c := range m {
+		if lang != "en" {
+			c.fallback = m["en"]
+		}
+	}
+	return m
+}
+
+func copyTranslation(t translation) translation {
+	c := make(translation, len(t))
+	for k, v := range t {
+		c[k] = v
+	}
+	return c
+}
+
+func copyPlurals(p plurals) plurals {
+	c := make(plurals, len(p))
+	for k, v := range p {
+		c[k] = v
+	}
+	return c
+}
+
+// catalogFile is the format of message catalog files.
+type catalogFile struct {
+	Name       string                     `json:"name"`
+	PluralRule string                     `json:"plural_rule"`
+	Messages   map[string]json.RawMessage `json:"messages"`
+}
+
+// loadCatalogs returns the built-in catalogs extended with catalogs
+// in dir (if not empty).
+func loadCatalogs(dir string) (map[string]*catalog, error) {
+	m := builtinCatalogs()
+	if dir == "" {
+		return m, nil
+	}
+	filenames, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	for _, fn := range filenames {
+		lang := strings.TrimSuffix(filepath.Base(fn), ".json")
+		if err := loadCatalogFile(m, lang, fn); err != nil {
+			return nil, fmt.Errorf("%s: %v", fn, err)
+		}
+	}
+	return m, nil
+}
+
+var langCodeRe = regexp.MustCompile(`^[a-z]{2,3}(-[a-z0-9]{2,8})?$`)
+
+func loadCatalogFile(m map[string]*catalog, lang, fn string) error {
+	if !langCodeRe.MatchString(lang) {
+		return fmt.Errorf("file name is not a lowercase language code such as de or pt-br")
+	}
+	b, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return err
+	}
+	var f catalogFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return err
+	}
+	c := m[lang]
+	if c == nil {
+		c = &catalog{lang: lang, name: lang, messages: translation{"lang-code": lang}, plurals: plurals{}, fallback: m["en"]}
+		c.rule, _ = lookupPluralRule(lang)
+		m[lang] = c
+	}
+	if f.Name != "" {
+		c.name = f.Name
+	}
+	if f.PluralRule != "" {
+		rule, ok := lookupPluralRule(f.PluralRule)
+		if !ok {
+			return fmt.Errorf("unknown plural_rule %q", f.PluralRule)
+		}
+		c.rule = rule
+	}
+	if c.rule.index == nil {
+		return fmt.Errorf("unknown plural rule of language %s (set plural_rule to a language with the same rule)", lang)
+	}
+	for key, raw := range f.Messages {
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			if s != "" {
+				c.messages[key] = s
+			}
+			continue
+		}
+		var forms []string
+		if err := json.Unmarshal(raw, &forms); err != nil {
+			return fmt.Errorf("message %q: expected a string or a list of plural forms", key)
+		}
+		if len(forms) != c.rule.forms {
+			return fmt.Errorf("message %q: expected %d plural forms but found %d", key, c.rule.forms, len(forms))
+		}
+		c.plurals[key] = forms
+	}
+	return nil
+}
+
+// negotiateLanguage returns the language of catalogs best matching
+// the Accept-Language header (or "" if none matches).
+func negotiateLanguage(header string, catalogs map[string]*catalog) string {
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.ToLower(strings.TrimSpace(fields[0]))
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			f = strings.TrimSpace(f)
+			if strings.HasPrefix(f, "q=") {
+				v, err := strconv.ParseFloat(f[2:], 64)
+				if err != nil {
+					v = 0
+				}
+				q = v
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, pref{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		tag := strings.Replace(p.tag, "_", "-", -1)
+		if catalogs[tag] != nil {
+			return tag
+		}
+		if i := strings.IndexByte(tag, '-'); i > 0 && catalogs[tag[:i]] != nil {
+			return tag[:i]
+		}
+	}
+	return ""
+}
+
+// handler is a request handler of a server localized for the request.
+type handler func(s *server, w http.ResponseWriter, r *http.Request)
+
+// forLang returns the server localized for the language (or the
+// default one if the language is not available).
+func (s *server) forLang(lang string) *server {
+	if ls := s.localized[lang]; ls != nil {
+		return ls
+	}
+	return s.localized[""]
+}
+
+// localize serves requests without authentication in the language
+// negotiated from Accept-Language.
+func (s *server) localize(h handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		h(s.requestServer(r, ""), w, r)
+	}
+}
+
+// requestServer returns the server localized for the language chosen
+// by the user, the one negotiated from Accept-Language or the
+// installation default.
+func (s *server) requestServer(r *http.Request, userLang string) *server {
+	if s.localized[userLang] != nil && userLang != "" {
+		return s.localized[userLang]
+	}
+	return s.forLang(negotiateLanguage(r.Header.Get("Accept-Language"), s.catalogs))
+}
+
+type languageOption struct {
+	Code, Name string
+}
+
+// languages returns available languages sorted by their codes.
+func (s *server) languages() []languageOption {
+	var langs []languageOption
+	for code, c := range s.catalogs {
+		langs = append(langs, languageOption{code, c.name})
+	}
+	sort.Slice(langs, func(i, j int) bool { return langs[i].Code < langs[j].Code })
+	return langs
+}
+
+func (s *server) ServeLanguage(w http.ResponseWriter, r *http.Request) {
+	session, err := s.SessionData(r)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Session error"))
+		return
+	}
+	d := struct {
+		Lang      string
+		Selected  string
+		Languages []languageOption
+	}{Lang: s.lang, Languages: s.languages()}
+	if r.Method == "POST" {
+		if err := r.ParseForm(); err != nil {
+			s.parseFormError(w, r, err)
+			return
+		}
+		lang := r.PostForm.Get("lang")
+		if lang != "" && s.catalogs[lang] == nil {
+			s.error(w, s.tr("Bad request"), s.tr("Unsupported language"), http.StatusBadRequest)
+			return
+		}
+		if err := s.db.SetUserLang(session.Uid, lang); err != nil {
+			s.internalError(w, r, err, s.tr("Failed to save the language"))
+			return
+		}
+		http.Redirect(w, r, "/language", http.StatusSeeOther)
+		return
+	}
+	if d.Selected, err = s.db.UserLang(session.Uid); err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	s.executeTemplate(w, "language.html", &d, http.StatusOK)
+}
+
+// UserLang returns the language chosen by the user ("" for the one
+// negotiated from Accept-Language).
+func (db *DB) UserLang(uid int64) (lang string, err error) {
+	err = db.db.QueryRow("SELECT lang FROM users WHERE uid=?", uid).Scan(&lang)
+	return
+}
+
+func (db *DB) SetUserLang(uid int64, lang string) error {
+	_, err := db.db.Exec("UPDATE users SET lang=? WHERE uid=?", lang, uid)
+	return err
+}
+
+// i18nCommand runs the i18n subcommand: check reports messages
+// missing in the catalogs (found in sources given with -src or known
+// by the built-in catalogs) and export writes a catalog with all the
+// messages to be translated.
+func i18nCommand(localeDir string, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: mpa [-locale_dir DIR] i18n check [-src DIR] | export [-src DIR] LANG")
+	}
+	cmd, args := args[0], args[1:]
+	fs := flag.NewFlagSet("i18n "+cmd, flag.ContinueOnError)
+	src := fs.String("src", "", "directory of the program sources (with templates subdirectory) to find messages in")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	catalogs, err := loadCatalogs(localeDir)
+	if err != nil {
+		return err
+	}
+	singular, plural, err := referenceMessages(*src)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cmd == "check" && fs.NArg() == 0:
+		if n := checkCatalogs(os.Stdout, catalogs, singular, plural); n > 0 {
+			return fmt.Errorf("%d problems found", n)
+		}
+		return nil
+	case cmd == "export" && fs.NArg() == 1:
+		c := catalogs[fs.Arg(0)]
+		if c == nil {
+			rule, ok := lookupPluralRule(fs.Arg(0))
+			if !ok {
+				rule = pluralOne
+			}
+			c = &catalog{lang: fs.Arg(0), name: fs.Arg(0), rule: rule}
+		}
+		return exportCatalog(os.Stdout, c, singular, plural)
+	}
+	return fmt.Errorf("unknown i18n command or wrong arguments: %s", strings.Join(append([]string{cmd}, args...), " "))
+}
+
+var (
+	goMessageRe       = regexp.MustCompile(`\b(tr|trn)\("((?:[^"\\]|\\.)*)"`)
+	templateMessageRe = regexp.MustCompile(`\b(tr|htmlTr|trn) "((?:[^"\\]|\\.)*)"`)
+)
+
+// referenceMessages returns messages used in sources in dir or, if
+// dir is empty, messages of the built-in catalogs.
+func referenceMessages(dir string) (singular, plural map[string]bool, err error) {
+	singular, plural = make(map[string]bool), make(map[string]bool)
+	if dir == "" {
+		for _, t := range translations {
+			for k := range t {
+				singular[k] = true
+			}
+		}
+		for _, p := range builtinPlurals {
+			for k := range p {
+				plural[k] = true
+				delete(singular, k)
+			}
+		}
+		delete(singular, "lang-code")
+		return
+	}
+	for _, pattern := range []string{"*.go", "templates/*.html"} {
+		filenames, err := filepath.Glob(filepath.Join(dir, pattern))
+		if err != nil {
+			return nil, nil, err
+		}
+		re := goMessageRe
+		if strings.HasSuffix(pattern, ".html") {
+			re = templateMessageRe
+		}
+		for _, fn := range filenames {
+			b, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return nil, nil, err
+			}
+			for _, m := range re.FindAllStringSubmatch(string(b), -1) {
+				s, err := strconv.Unquote(`"` + m[2] + `"`)
+				if err != nil {
+					continue
+				}
+				if m[1] == "trn" {
+					plural[s] = true
+				} else {
+					singular[s] = true
+				}
+			}
+		}
+	}
+	return
+}
+
+// checkCatalogs writes problems found in catalogs and returns their
+// number. Messages without translation are shown as is, so for
+// English only messages with context (such as "login|Submit") and
+// plural messages are required.
+func checkCatalogs(w io.Writer, catalogs map[string]*catalog, singular, plural map[string]bool) int {
+	problems := 0
+	report := func(lang, kind string, keys []string) {
+		if len(keys) == 0 {
+			return
+		}
+		sort.Strings(keys)
+		problems += len(keys)
+		fmt.Fprintf(w, "%s: %d %s:\n", lang, len(keys), kind)
+		for _, k := range keys {
+			fmt.Fprintf(w, "\t%q\n", k)
+		}
+	}
+	var langs []string
+	for lang := range catalogs {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	for _, lang := range langs {
+		c := catalogs[lang]
+		var missing, missingPlural, unused []string
+		for k := range singular {
+			if c.messages[k] == "" && (lang != "en" || strings.Contains(k, "|")) {
+				missing = append(missing, k)
+			}
+		}
+		for k := range plural {
+			forms := c.plurals[k]
+			if len(forms) != c.rule.forms || containsEmpty(forms) {
+				missingPlural = append(missingPlural, k)
+			}
+		}
+		for k := range c.messages {
+			if k != "lang-code" && !singular[k] && !plural[k] {
+				unused = append(unused, k)
+			}
+		}
+		for k := range c.plurals {
+			if !plural[k] {
+				unused = append(unused, k)
+			}
+		}
+		report(lang, "missing messages", missing)
+		report(lang, "missing plural messages", missingPlural)
+		report(lang, "unknown messages", unused)
+	}
+	if problems == 0 {
+		fmt.Fprintln(w, "ok")
+	}
+	return problems
+}
+
+func containsEmpty(a []string) bool {
+	for _, s := range a {
+		if s == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// exportCatalog writes the catalog file of c with all the messages
+// (empty strings for missing translations).
+func exportCatalog(w io.Writer, c *catalog, singular, plural map[string]bool) error {
+	messages := make(map[string]interface{})
+	for k := range singular {
+		messages[k] = c.messages[k]
+	}
+	for k := range plural {
+		forms := make([]string, c.rule.forms)
+		copy(forms, c.plurals[k])
+		messages[k] = forms
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "\t")
+	return enc.Encode(&struct {
+		Name     string                 `json:"name"`
+		Messages map[string]interface{} `json:"messages"`
+	}{c.name, messages})
+}
@@ -0,0 +1,146 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPluralRules(t *testing.T) {
+	// form indexes of numbers 0, 1, 2, ... for each rule
+	tests := map[string]struct {
+		rule  pluralRule
+		forms map[int]int
+	}{
+		"pl": {pluralPolish, map[int]int{0: 2, 1: 0, 2: 1, 4: 1, 5: 2, 11: 2, 12: 2, 14: 2, 21: 2, 22: 1, 25: 2, 101: 2, 102: 1, 112: 2, 1000: 2}},
+		"ru": {pluralSlavic, map[int]int{0: 2, 1: 0, 2: 1, 4: 1, 5: 2, 11: 2, 12: 2, 14: 2, 21: 0, 22: 1, 25: 2, 101: 0, 111: 2, 112: 2, 1001: 0}},
+		"en": {pluralOne, map[int]int{0: 1, 1: 0, 2: 1, 21: 1}},
+		"fr": {pluralFrench, map[int]int{0: 0, 1: 0, 2: 1}},
+		"cs": {pluralCzech, map[int]int{0: 2, 1: 0, 2: 1, 4: 1, 5: 2, 22: 2}},
+	}
+	for lang, tt := range tests {
+		if r, ok := lookupPluralRule(lang); !ok || r.forms != tt.rule.forms {
+			t.Errorf("%s: plural rule not found or has %d forms", lang, r.forms)
+		}
+		for n, want := range tt.forms {
+			if got := tt.rule.index(n); got != want {
+				t.Errorf("%s: form of %d is %d, want %d", lang, n, got, want)
+			}
+		}
+	}
+	if r, ok := lookupPluralRule("pt_BR"); !ok || r.index(0) != 0 {
+		t.Error("pt_BR does not use the French plural rule")
+	}
+	if _, ok := lookupPluralRule("xx-yy"); ok {
+		t.Error("plural rule found for unknown language")
+	}
+}
+
+func TestNegotiateLanguage(t *testing.T) {
+	catalogs := map[string]*catalog{"en": {}, "pl": {}, "pt-br": {}}
+	tests := []struct {
+		header, want string
+	}{
+		{"", ""},
+		{"pl", "pl"},
+		{"de, pl", "pl"},
+		{"en-US,en;q=0.9,pl;q=0.8", "en"},
+		{"en;q=0.5, pl;q=0.8", "pl"},
+		{"pl;q=0.5, en", "en"},
+		{"pl-PL;q=0.9, en;q=0.1", "pl"},
+		{"pt-BR", "pt-br"},
+		{"pt_br", "pt-br"},
+		{"pt-PT", ""}, // only the main language is tried for variants
+		{"pl;q=0, en;q=0.1", "en"},
+		{"pl;q=x, en;q=0.1", "en"},
+		{"*, de", ""},
+		{" pl ; q=0.7 , en ; q=0.6", "pl"},
+		{"en;level=1;q=0.3, pl;q=0.4", "pl"},
+		{"de;q=0.9, fr", ""},
+	}
+	for _, tt := range tests {
+		if got := negotiateLanguage(tt.header, catalogs); got != tt.want {
+			t.Errorf("negotiateLanguage(%q) = %q, want %q", tt.header, got, tt.want)
+		}
+	}
+}
+
+func TestLoadCatalogFile(t *testing.T) {
+	tests := []struct {
+		lang, src string
+		err       string
+	}{
+		{"de", `{"name": "Deutsch", "messages": {"Albums": "Alben", "%d images deleted.": ["%d Bild gelöscht.", "%d Bilder gelöscht."]}}`, ""},
+		{"de", `{"messages": {"%d images deleted.": ["%d Bilder gelöscht."]}}`, "expected 2 plural forms but found 1"},
+		{"pl", `{"messages": {"%d images deleted.": ["a", "b"]}}`, "expected 3 plural forms but found 2"},
+		{"ru", `{"messages": {"%d images deleted.": ["a", "b", "c"]}}`, ""},
+		{"ja", `{"messages": {"%d images deleted.": ["a", "b"]}}`, "expected 1 plural forms but found 2"},
+		{"xx", `{"messages": {}}`, "unknown plural rule of language xx"},
+		{"xx", `{"plural_rule": "pl", "messages": {"%d images deleted.": ["a", "b", "c"]}}`, ""},
+		{"xx", `{"plural_rule": "yy", "messages": {}}`, `unknown plural_rule "yy"`},
+		{"de", `{"messages": {"Albums": 1}}`, "expected a string or a list of plural forms"},
+		{"De", `{"messages": {}}`, "not a lowercase language code"},
+		{"de", `{"messages": `, "unexpected end of JSON input"},
+	}
+	dir := t.TempDir()
+	for i, tt := range tests {
+		fn := filepath.Join(dir, fmt.Sprintf("%d.json", i))
+		if err := ioutil.WriteFile(fn, []byte(tt.src), 0644); err != nil {
+			t.Fatal(err)
+		}
+		err := loadCatalogFile(builtinCatalogs(), tt.lang, fn)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("loading %s catalog %s: got error %v, want %q", tt.lang, tt.src, err, tt.err)
+		}
+	}
+
+	m := builtinCatalogs()
+	fn := filepath.Join(dir, "de.json")
+	if err := loadCatalogFile(m, "de", fn); err == nil {
+		t.Fatal("loading missing file succeeded")
+	}
+	if err := ioutil.WriteFile(fn, []byte(tests[0].src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadCatalogFile(m, "de", fn); err != nil {
+		t.Fatal(err)
+	}
+	c := m["de"]
+	for _, tt := range []struct{ got, want string }{
+		{c.name, "Deutsch"},
+		{c.translate("Albums"), "Alben"},
+		{c.translatePlural("%d images deleted.", 2), "%d Bilder gelöscht."},
+		{c.translate("Logout"), m["en"].translate("Logout")}, // falls back to English
+	} {
+		if tt.got != tt.want {
+			t.Errorf("loaded catalog: got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestTwoNumberMessages(t *testing.T) {
+	cat := builtinCatalogs()["pl"]
+	s := &server{trn: cat.translatePlural}
+	tests := []struct {
+		got, want string
+	}{
+		{fmt.Sprintf(s.trn("%s moved to %d new albums.", 1), s.images(1), 1), "1 obraz przeniesiono do 1 nowego albumu."},
+		{fmt.Sprintf(s.trn("%s moved to %d new albums.", 1), s.images(5), 1), "5 obrazów przeniesiono do 1 nowego albumu."},
+		{fmt.Sprintf(s.trn("%s moved to %d new albums.", 3), s.images(22), 3), "22 obrazy przeniesiono do 3 nowych albumów."},
+		{fmt.Sprintf(s.trn("%s from %d albums added to the album.", 1), s.images(2), 1), "2 obrazy z 1 albumu dodano do albumu."},
+		{fmt.Sprintf(s.trn("%s from %d albums added to the album.", 2), s.images(1), 2), "1 obraz z 2 albumów dodano do albumu."},
+		{fmt.Sprintf(s.trn("%d out of %d selected images moved to the album.", 1), 1, 1), "1 z 1 wybranego obrazu przeniesiono do albumu."},
+		{fmt.Sprintf(s.trn("%d out of %d selected images moved to the album.", 5), 1, 5), "1 z 5 wybranych obrazów przeniesiono do albumu."},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
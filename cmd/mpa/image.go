@@ -7,9 +7,7 @@ package main
 import (
 	"database/sql"
 	"errors"
-	"log"
 	"net/http"
-	"path/filepath"
 	"strconv"
 	"strings"
 )
@@ -20,19 +18,17 @@ func (s *server) ServeImageOrig(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
 		return
 	}
-	var sha256sum string
-	err = s.db.db.QueryRow("SELECT sha256sum FROM images where iid=?", id).Scan(&sha256sum)
+	p, err := s.db.ImagePrivacy(id)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
 			return
 		}
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-		log.Println(err)
+		logError(r, "original image error", "err", err)
 		return
 	}
-	filename := filepath.Join(s.db.imagesDir, sha256sum[:3], sha256sum[3:])
-	http.ServeFile(w, r, filename)
+	s.serveOrig(w, r, id, p)
 }
 
 var ErrPrefixNotFound = errors.New("prefix not found")
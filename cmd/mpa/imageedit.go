@@ -0,0 +1,198 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	"math"
+	"net/http"
+	"path/filepath"
+	"strconv"
+
+	"github.com/anthonynsimon/bild/transform"
+)
+
+// imageEdit is a non-destructive edit of an image applied on top of
+// its EXIF orientation: clockwise rotation, then flips, then crop.
+// The original file is never modified, edited previews are stored
+// next to the unedited ones under a name derived from the edit.
+type imageEdit struct {
+	Rotate int        `json:"rotate"` // 0, 90, 180 or 270 degrees clockwise
+	FlipH  bool       `json:"flipH"`
+	FlipV  bool       `json:"flipV"`
+	Crop   [4]float64 `json:"crop"` // left, top, right, bottom as fractions of size, all zero for no crop
+}
+
+// imageEditColumns are columns of the images table holding imageEdit
+// in the order of imageEdit.scanArgs.
+const imageEditColumns = "edit_rotate, edit_flip_h, edit_flip_v, crop_left, crop_top, crop_right, crop_bottom"
+
+func (e *imageEdit) scanArgs() []interface{} {
+	return []interface{}{&e.Rotate, &e.FlipH, &e.FlipV, &e.Crop[0], &e.Crop[1], &e.Crop[2], &e.Crop[3]}
+}
+
+func (e imageEdit) args() []interface{} {
+	return []interface{}{e.Rotate, e.FlipH, e.FlipV, e.Crop[0], e.Crop[1], e.Crop[2], e.Crop[3]}
+}
+
+func (e imageEdit) isZero() bool {
+	return e == imageEdit{}
+}
+
+func (e imageEdit) cropped() bool {
+	return e.Crop != [4]float64{}
+}
+
+func (e imageEdit) valid() bool {
+	if e.Rotate != 0 && e.Rotate != 90 && e.Rotate != 180 && e.Rotate != 270 {
+		return false
+	}
+	if !e.cropped() {
+		return true
+	}
+	c := e.Crop
+	return 0 <= c[0] && c[0] < c[2] && c[2] <= 1 && 0 <= c[1] && c[1] < c[3] && c[3] <= 1
+}
+
+// suffix returns the suffix of preview file names for the edit (empty
+// for unedited images so their previews keep their old names).
+func (e imageEdit) suffix() string {
+	if e.isZero() {
+		return ""
+	}
+	h := sha256.Sum256([]byte(fmt.Sprintf("%d %t %t %g %g %g %g", e.Rotate, e.FlipH, e.FlipV, e.Crop[0], e.Crop[1], e.Crop[2], e.Crop[3])))
+	return "-" + hex.EncodeToString(h[:4])
+}
+
+// apply applies the edit to the (already EXIF oriented) image.
+func (e imageEdit) apply(img image.Image) image.Image {
+	if e.Rotate != 0 {
+		img = rotate(img, e.Rotate)
+	}
+	if e.FlipH {
+		img = transform.FlipH(img)
+	}
+	if e.FlipV {
+		img = transform.FlipV(img)
+	}
+	if e.cropped() {
+		b := img.Bounds()
+		w, h := float64(b.Dx()), float64(b.Dy())
+		r := image.Rect(b.Min.X+round(e.Crop[0]*w), b.Min.Y+round(e.Crop[1]*h), b.Min.X+round(e.Crop[2]*w), b.Min.Y+round(e.Crop[3]*h))
+		if !r.Empty() {
+			img = transform.Crop(img, r)
+		}
+	}
+	return img
+}
+
+// rotate returns the image rotated clockwise by 90, 180 or 270
+// degrees. Pixels are moved exactly (without interpolation).
+func rotate(img image.Image, degrees int) image.Image {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	src := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(src, src.Bounds(), img, b.Min, draw.Src)
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	if degrees != 180 {
+		dst = image.NewRGBA(image.Rect(0, 0, h, w))
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			dx, dy := w-1-x, h-1-y // 180 degrees
+			switch degrees {
+			case 90:
+				dx, dy = h-1-y, x
+			case 270:
+				dx, dy = y, w-1-x
+			}
+			copy(dst.Pix[dst.PixOffset(dx, dy):dst.PixOffset(dx, dy)+4], src.Pix[src.PixOffset(x, y):src.PixOffset(x, y)+4])
+		}
+	}
+	return dst
+}
+
+// size returns the size of the edited image given the size of the
+// (EXIF oriented) image.
+func (e imageEdit) size(w, h int) (int, int) {
+	if e.Rotate == 90 || e.Rotate == 270 {
+		w, h = h, w
+	}
+	if e.cropped() {
+		w = round((e.Crop[2] - e.Crop[0]) * float64(w))
+		h = round((e.Crop[3] - e.Crop[1]) * float64(h))
+	}
+	return w, h
+}
+
+func round(f float64) int {
+	return int(math.Floor(f + 0.5))
+}
+
+func previewPath(previewDir, sha256sum string, edit imageEdit) string {
+	return filepath.Join(previewDir, sha256sum[:3], sha256sum[3:]+edit.suffix())
+}
+
+// imageEditUpdate is a validated edit of an image of the album
+// together with the resulting orientation of the image.
+type imageEditUpdate struct {
+	id         int64
+	edit       imageEdit
+	isPortrait bool
+}
+
+// imageEdits validates edits requested for images of the album and
+// computes orientation of edited images. On error it responds to the
+// client and returns false.
+func (s *server) imageEdits(w http.ResponseWriter, r *http.Request, albumID int64, edits map[string]imageEdit) ([]imageEditUpdate, bool) {
+	var updates []imageEditUpdate
+	for idStr, edit := range edits {
+		imageID, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			logWarn(r, "Error parsing image ID", "err", err)
+			http.Error(w, s.tr("Error parsing image ID"), http.StatusBadRequest)
+			return nil, false
+		}
+		if !edit.valid() {
+			logWarn(r, "Invalid image edit", "image", imageID, "edit", fmt.Sprintf("%+v", edit))
+			http.Error(w, s.tr("Invalid image edit"), http.StatusBadRequest)
+			return nil, false
+		}
+		var sha256sum string
+		var video bool
+		err = s.db.db.QueryRow("SELECT sha256sum, is_video FROM images WHERE iid=? AND album_id=?", imageID, albumID).Scan(&sha256sum, &video)
+		if err != nil {
+			if err == sql.ErrNoRows {
+				http.Error(w, s.tr("Not found in this album"), http.StatusBadRequest)
+				return nil, false
+			}
+			logError(r, "image edit error", "image", imageID, "err", err)
+			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+			return nil, false
+		}
+		if video {
+			http.Error(w, s.tr("Videos cannot be edited"), http.StatusBadRequest)
+			return nil, false
+		}
+		cfg, orientation, err := s.decodeImageConfig(filepath.Join(s.db.imagesDir, sha256sum[:3], sha256sum[3:]))
+		if err != nil {
+			logError(r, "Could not determine image size", "image", imageID, "err", err)
+			http.Error(w, s.tr("Could not determine image size"), http.StatusInternalServerError)
+			return nil, false
+		}
+		width, height := cfg.Width, cfg.Height
+		if orientation > 4 {
+			width, height = height, width
+		}
+		width, height = edit.size(width, height)
+		updates = append(updates, imageEditUpdate{imageID, edit, height > width})
+	}
+	return updates, true
+}
@@ -0,0 +1,139 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"image"
+	"image/color"
+	"reflect"
+	"testing"
+)
+
+func TestImageEditValid(t *testing.T) {
+	tests := []struct {
+		edit imageEdit
+		ok   bool
+	}{
+		{imageEdit{}, true},
+		{imageEdit{Rotate: 90, FlipH: true}, true},
+		{imageEdit{Rotate: 180, FlipV: true}, true},
+		{imageEdit{Rotate: 270}, true},
+		{imageEdit{Rotate: 45}, false},
+		{imageEdit{Rotate: -90}, false},
+		{imageEdit{Rotate: 360}, false},
+		{imageEdit{Crop: [4]float64{0, 0, 1, 1}}, true},
+		{imageEdit{Crop: [4]float64{0.25, 0.1, 0.75, 0.9}}, true},
+		{imageEdit{Crop: [4]float64{0.5, 0, 0.5, 1}}, false},
+		{imageEdit{Crop: [4]float64{0.75, 0, 0.25, 1}}, false},
+		{imageEdit{Crop: [4]float64{0, 0.5, 1, 0.5}}, false},
+		{imageEdit{Crop: [4]float64{-0.1, 0, 1, 1}}, false},
+		{imageEdit{Crop: [4]float64{0, 0, 1.1, 1}}, false},
+		{imageEdit{Crop: [4]float64{0, 0, 1, 1.5}}, false},
+		{imageEdit{Rotate: 90, Crop: [4]float64{0, 0, 0, 0}}, true},
+	}
+	for _, tt := range tests {
+		if got := tt.edit.valid(); got != tt.ok {
+			t.Errorf("%+v.valid() = %t, want %t", tt.edit, got, tt.ok)
+		}
+	}
+}
+
+func TestImageEditSize(t *testing.T) {
+	tests := []struct {
+		edit         imageEdit
+		w, h         int
+		wantW, wantH int
+	}{
+		{imageEdit{}, 400, 300, 400, 300},
+		{imageEdit{FlipH: true, FlipV: true}, 400, 300, 400, 300},
+		{imageEdit{Rotate: 90}, 400, 300, 300, 400},
+		{imageEdit{Rotate: 180}, 400, 300, 400, 300},
+		{imageEdit{Rotate: 270}, 400, 300, 300, 400},
+		{imageEdit{Crop: [4]float64{0, 0, 0.5, 0.5}}, 400, 300, 200, 150},
+		{imageEdit{Crop: [4]float64{0.25, 0.1, 0.75, 0.9}}, 400, 300, 200, 240},
+		// the crop is relative to the rotated image
+		{imageEdit{Rotate: 90, Crop: [4]float64{0, 0, 0.5, 0.25}}, 400, 300, 150, 100},
+		// sizes are rounded to the nearest pixel
+		{imageEdit{Crop: [4]float64{0, 0, 1.0 / 3, 1}}, 100, 10, 33, 10},
+		{imageEdit{Crop: [4]float64{0, 0, 2.0 / 3, 1}}, 100, 10, 67, 10},
+	}
+	for _, tt := range tests {
+		w, h := tt.edit.size(tt.w, tt.h)
+		if w != tt.wantW || h != tt.wantH {
+			t.Errorf("%+v.size(%d, %d) = %d, %d, want %d, %d", tt.edit, tt.w, tt.h, w, h, tt.wantW, tt.wantH)
+		}
+	}
+}
+
+// testGrid returns the image with rows of pixels of the given gray
+// levels.
+func testGrid(rows ...[]uint8) image.Image {
+	img := image.NewGray(image.Rect(0, 0, len(rows[0]), len(rows)))
+	for y, row := range rows {
+		for x, v := range row {
+			img.SetGray(x, y, color.Gray{v})
+		}
+	}
+	return img
+}
+
+// testGridLevels returns gray levels of pixels of the image by rows.
+func testGridLevels(img image.Image) [][]uint8 {
+	b := img.Bounds()
+	var rows [][]uint8
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		var row []uint8
+		for x := b.Min.X; x < b.Max.X; x++ {
+			row = append(row, color.GrayModel.Convert(img.At(x, y)).(color.Gray).Y)
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+func TestImageEditApply(t *testing.T) {
+	const (
+		a = 10 * (iota + 1)
+		b
+		c
+		d
+		e
+		f
+	)
+	src := [][]uint8{
+		{a, b, c},
+		{d, e, f},
+	}
+	tests := []struct {
+		edit imageEdit
+		want [][]uint8
+	}{
+		{imageEdit{}, src},
+		{imageEdit{Rotate: 90}, [][]uint8{{d, a}, {e, b}, {f, c}}},
+		{imageEdit{Rotate: 180}, [][]uint8{{f, e, d}, {c, b, a}}},
+		{imageEdit{Rotate: 270}, [][]uint8{{c, f}, {b, e}, {a, d}}},
+		{imageEdit{FlipH: true}, [][]uint8{{c, b, a}, {f, e, d}}},
+		{imageEdit{FlipV: true}, [][]uint8{{d, e, f}, {a, b, c}}},
+		{imageEdit{FlipH: true, FlipV: true}, [][]uint8{{f, e, d}, {c, b, a}}},
+		// flips are applied after the rotation
+		{imageEdit{Rotate: 90, FlipH: true}, [][]uint8{{a, d}, {b, e}, {c, f}}},
+		{imageEdit{Crop: [4]float64{1.0 / 3, 0, 1, 0.5}}, [][]uint8{{b, c}}},
+		{imageEdit{Crop: [4]float64{0, 0.5, 2.0 / 3, 1}}, [][]uint8{{d, e}}},
+		// the crop is relative to the rotated and flipped image
+		{imageEdit{Rotate: 90, Crop: [4]float64{0, 0, 0.5, 1}}, [][]uint8{{d}, {e}, {f}}},
+		{imageEdit{Rotate: 270, FlipV: true, Crop: [4]float64{0, 0, 1, 1.0 / 3}}, [][]uint8{{a, d}}},
+	}
+	for _, tt := range tests {
+		img := tt.edit.apply(testGrid(src...))
+		got := testGridLevels(img)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%+v.apply() = %v, want %v", tt.edit, got, tt.want)
+		}
+		size := img.Bounds().Size()
+		if w, h := tt.edit.size(3, 2); size.X != w || size.Y != h {
+			t.Errorf("%+v.apply() has size %v, size() returns %d, %d", tt.edit, size, w, h)
+		}
+	}
+}
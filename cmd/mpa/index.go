@@ -1,37 +1,69 @@
 package main
 
 import (
-	"log"
 	"net/http"
 )
 
 func (s *server) ServeIndex(w http.ResponseWriter, r *http.Request) {
 	session, err := s.SessionData(r)
 	if err != nil {
-		log.Println(err)
-		s.internalError(w, err, s.tr("Session error"))
+		s.internalError(w, r, err, s.tr("Session error"))
 		return
 	}
 	me, others, err := s.db.MeAndOtherUsers(session.Uid)
 	if err != nil {
-		log.Println(err)
-		s.internalError(w, err, s.tr("Internal server error"))
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	collections, err := s.db.Collections(0)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	for _, c := range collections {
+		if c.OwnerID == session.Uid {
+			me.Collections = append(me.Collections, c)
+			continue
+		}
+		for i := range others {
+			if others[i].uid == c.OwnerID {
+				others[i].Collections = append(others[i].Collections, c)
+			}
+		}
+	}
+	used, err := s.db.UserStorageUsage(session.Uid)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	limits, err := s.db.StorageLimits(session.Uid)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	favourites, err := s.db.FavouritesCnt(session.Uid)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
 		return
 	}
 	data := struct {
-		Lang   string
-		Admin  bool
-		Me     userAlbusCnt
-		Others []userAlbusCnt
-	}{s.lang, session.Admin, me, others}
+		Lang       string
+		Admin      bool
+		Me         userAlbusCnt
+		Others     []userAlbusCnt
+		Storage    storageInfo
+		Favourites int
+	}{s.lang, session.Admin, me, others, newStorageInfo(used, limits.quota), favourites}
 	s.executeTemplate(w, "index.html", &data, http.StatusOK)
 }
 
 type userAlbusCnt struct {
-	Login     string
-	Name      string
-	Surname   string
-	AlbumsCnt int64
+	uid         int64
+	Login       string
+	Name        string
+	Surname     string
+	AlbumsCnt   int64
+	Collections []collection
 }
 
 func (db *DB) MeAndOtherUsers(uid int64) (me userAlbusCnt, others []userAlbusCnt, err error) {
@@ -48,11 +80,10 @@ ORDER BY users.surname, users.name
 	defer rows.Close()
 	for rows.Next() {
 		var u userAlbusCnt
-		var id int64
-		if err := rows.Scan(&id, &u.Login, &u.Name, &u.Surname, &u.AlbumsCnt); err != nil {
+		if err := rows.Scan(&u.uid, &u.Login, &u.Name, &u.Surname, &u.AlbumsCnt); err != nil {
 			return userAlbusCnt{}, nil, err
 		}
-		if id != uid {
+		if u.uid != uid {
 			others = append(others, u)
 		} else {
 			me = u
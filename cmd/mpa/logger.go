@@ -5,29 +5,245 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
+// Log entries consist of a message and key-value pairs and are
+// written as text (key=value) or as JSON objects, one per line.
+// Entries logged while serving a request include its ID. Access log
+// entries may be written in Apache combined log format instead.
+// Output of the standard log package (used by the net/http server to
+// report errors) is redirected to the logger at error level so that
+// all lines share the same format.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+func parseLogLevel(s string) (logLevel, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unsupported log level %q (expected debug, info, warn or error)", s)
+}
+
+const (
+	logFormatText     = "text"
+	logFormatJSON     = "json"
+	logFormatCombined = "combined" // text, with the access log in Apache combined log format
+)
+
+type appLogger struct {
+	mu     sync.Mutex
+	w      io.Writer
+	format string
+	level  logLevel
+}
+
+var lg = &appLogger{w: os.Stderr, format: logFormatText, level: levelInfo}
+
+// setupLogging configures the logger and redirects the standard log
+// package to it.
+func setupLogging(format, level string) error {
+	l, err := parseLogLevel(level)
+	if err != nil {
+		return err
+	}
+	switch format {
+	case logFormatText, logFormatJSON, logFormatCombined:
+	default:
+		return fmt.Errorf("unsupported log format %q (expected text, json or combined)", format)
+	}
+	lg.mu.Lock()
+	lg.format = format
+	lg.level = l
+	lg.mu.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+	return nil
+}
+
+// stdLogWriter writes lines logged with the standard log package as
+// error level entries.
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(b []byte) (int, error) {
+	lg.log(nil, levelError, string(bytes.TrimRight(b, "\n")))
+	return len(b), nil
+}
+
+func logDebug(r *http.Request, msg string, kv ...interface{}) { lg.log(r, levelDebug, msg, kv...) }
+func logInfo(r *http.Request, msg string, kv ...interface{})  { lg.log(r, levelInfo, msg, kv...) }
+func logWarn(r *http.Request, msg string, kv ...interface{})  { lg.log(r, levelWarn, msg, kv...) }
+func logError(r *http.Request, msg string, kv ...interface{}) { lg.log(r, levelError, msg, kv...) }
+
+// logFatal writes the error level entry and exits the program.
+func logFatal(msg string, kv ...interface{}) {
+	lg.log(nil, levelError, msg, kv...)
+	os.Exit(1)
+}
+
+// log writes the entry with key-value pairs kv (and the ID of the
+// request r if it is not nil) if the level is enabled.
+func (l *appLogger) log(r *http.Request, level logLevel, msg string, kv ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if level < l.level {
+		return
+	}
+	if r != nil {
+		if info := reqInfo(r); info != nil {
+			kv = append([]interface{}{"request_id", info.id}, kv...)
+		}
+	}
+	t := time.Now().UTC()
+	var b bytes.Buffer
+	if l.format == logFormatJSON {
+		m := map[string]interface{}{"time": t.Format(time.RFC3339Nano), "level": levelNames[level], "msg": msg}
+		for i := 0; i+1 < len(kv); i += 2 {
+			v := kv[i+1]
+			switch x := v.(type) {
+			case error:
+				v = x.Error()
+			case time.Duration:
+				v = x.Seconds()
+			}
+			m[fmt.Sprint(kv[i])] = v
+		}
+		enc := json.NewEncoder(&b)
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(m); err != nil {
+			fmt.Fprintf(&b, "{\"level\":\"ERROR\",\"msg\":%q}\n", err.Error())
+		}
+	} else {
+		fmt.Fprintf(&b, "%s %-5s %s", t.Format("2006-01-02T15:04:05.000Z"), levelNames[level], msg)
+		for i := 0; i+1 < len(kv); i += 2 {
+			fmt.Fprintf(&b, " %v=%s", kv[i], quoteLogValue(fmt.Sprint(kv[i+1])))
+		}
+		b.WriteByte('\n')
+	}
+	l.w.Write(b.Bytes())
+}
+
+func quoteLogValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
+
+// requestInfo is shared (through the request context) by the logger
+// and the handlers of the request.
+type requestInfo struct {
+	id    string
+	login string // set by authenticate
+}
+
+type requestInfoKey struct{}
+
+func reqInfo(r *http.Request) *requestInfo {
+	info, _ := r.Context().Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// newRequestID returns the ID sent by a proxy in X-Request-ID header
+// (if it looks sane) or a new random one.
+func newRequestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-ID"); id != "" && len(id) <= 64 && strings.Trim(id,
+		"0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ-_.") == "" {
+		return id
+	}
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
 type logger struct {
 	handler http.Handler
+	metrics *metrics
 }
 
 func (l *logger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	t := time.Now()
-	path := r.URL.Path
-	if r.URL.RawQuery != "" {
-		path += "?" + r.URL.RawQuery
-	}
-	rw := &responseWriter{w, 0, false}
+	info := &requestInfo{id: newRequestID(r)}
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+	w.Header().Set("X-Request-ID", info.id)
+	rw := &responseWriter{ResponseWriter: w}
 	defer func() {
-		log.Println(remoteAddr(r), r.Host, r.Method, path, "-", rw.status, http.StatusText(rw.status), time.Since(t))
+		status := rw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		lg.access(r, info, t, status, rw.bytes)
+		if l.metrics != nil {
+			l.metrics.request(routePattern(l.handler, r), r.Method, status, time.Since(t))
+		}
 	}()
 	l.handler.ServeHTTP(rw, r)
 }
 
+// access writes the access log entry of the request.
+func (l *appLogger) access(r *http.Request, info *requestInfo, start time.Time, status int, n int64) {
+	l.mu.Lock()
+	format := l.format
+	l.mu.Unlock()
+	if format == logFormatCombined {
+		user := info.login
+		if user == "" {
+			user = "-"
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		size := "-"
+		if n > 0 {
+			size = strconv.FormatInt(n, 10)
+		}
+		line := fmt.Sprintf("%s - %s [%s] %q %d %s %q %q\n", host, user, start.Format("02/Jan/2006:15:04:05 -0700"),
+			r.Method+" "+r.URL.RequestURI()+" "+r.Proto, status, size, orDash(r.Referer()), orDash(r.UserAgent()))
+		l.mu.Lock()
+		l.w.Write([]byte(line))
+		l.mu.Unlock()
+		return
+	}
+	l.log(r, levelInfo, "request", "remote", remoteAddr(r), "host", r.Host, "method", r.Method, "path", r.URL.RequestURI(),
+		"status", status, "bytes", n, "duration", time.Since(start), "login", info.login,
+		"referer", r.Referer(), "user_agent", r.UserAgent())
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
 func remoteAddr(r *http.Request) string {
 	forward := r.Header.Get("X-Forwarded-For")
 	if forward != "" {
@@ -40,6 +256,7 @@ type responseWriter struct {
 	http.ResponseWriter
 	status      int
 	wroteHeader bool
+	bytes       int64
 }
 
 func (w *responseWriter) WriteHeader(status int) {
@@ -52,5 +269,7 @@ func (w *responseWriter) Write(b []byte) (int, error) {
 	if !w.wroteHeader {
 		w.WriteHeader(http.StatusOK)
 	}
-	return w.ResponseWriter.Write(b)
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
 }
@@ -0,0 +1,69 @@
+// Copyright 2016 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	lg.w = &buf
+	defer func() {
+		lg.w = os.Stderr
+		setupLogging(logFormatText, "info")
+		log.SetOutput(os.Stderr)
+	}()
+	if err := setupLogging(logFormatJSON, "warn"); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, &requestInfo{id: "req1"}))
+
+	logInfo(r, "not logged")
+	logWarn(r, "warning", "album", 7)
+	logError(nil, "failure", "err", errors.New("disk full"))
+	log.Print("http: Accept error")
+	var entries []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var m map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Fatalf("invalid JSON log line %q: %v", line, err)
+		}
+		entries = append(entries, m)
+	}
+	want := []map[string]interface{}{
+		{"level": "WARN", "msg": "warning", "album": 7.0, "request_id": "req1"},
+		{"level": "ERROR", "msg": "failure", "err": "disk full"},
+		{"level": "ERROR", "msg": "http: Accept error"},
+	}
+	if len(entries) != len(want) {
+		t.Fatalf("got log entries:\n%s\nwant %d", buf.String(), len(want))
+	}
+	for i, w := range want {
+		for k, v := range w {
+			if entries[i][k] != v {
+				t.Errorf("entry %d: %s = %v, want %v", i, k, entries[i][k], v)
+			}
+		}
+	}
+
+	buf.Reset()
+	if err := setupLogging(logFormatText, "debug"); err != nil {
+		t.Fatal(err)
+	}
+	logDebug(nil, "created", "name", "my album", "n", 2)
+	if s := buf.String(); !strings.HasSuffix(s, ` DEBUG created name="my album" n=2`+"\n") {
+		t.Errorf("got text log line %q", s)
+	}
+}
@@ -10,80 +10,144 @@ import (
 	"flag"
 	"fmt"
 	"html/template"
-	"log"
 	"net/http"
-	"path/filepath"
+	"os"
 	"runtime"
 	"strings"
+	"time"
 )
 
 var Version = "mpa-0.1"
 
 func main() {
-	dbFileName := flag.String("f", "", "sqlite3 database file name")
+	cfg := newConfig(flag.CommandLine)
+	configFile := flag.String("config", "", "config file of key = value lines with keys named as options (-f is database), default: $MPA_CONFIG")
 	dbInit := flag.String("init", "", "initialize the database file (argument is options such as lang=en or lang=pl)")
-	httpAddr := flag.String("http", ":8080", "HTTP listen address")
-	insecureCookie := flag.Bool("insecure_cookie", false, "if client should send cookie over plain HTTP connection")
+	admin := defineAdminFlags(flag.CommandLine)
 	version := flag.Bool("v", false, "show program version")
 	flag.Parse()
 	if *version {
 		fmt.Println(Version)
 		return
 	}
-	if *dbFileName == "" {
-		log.Fatal("option -f is requiered")
+	if flag.Arg(0) == "i18n" {
+		if cfg.localeDir == "" {
+			cfg.localeDir = os.Getenv("MPA_LOCALE_DIR")
+		}
+		if err := i18nCommand(cfg.localeDir, flag.Args()[1:]); err != nil {
+			logFatal("error", "err", err)
+		}
+		return
+	}
+	if err := cfg.load(flag.CommandLine, *configFile); err != nil {
+		logFatal("configuration error", "err", err)
 	}
-	db, err := OpenDB(*dbFileName)
+	if err := setupLogging(cfg.logFormat, cfg.logLevel); err != nil {
+		logFatal("configuration error", "err", err)
+	}
+	db, err := OpenDB(cfg.dbFileName, cfg.filesDir)
 	if err != nil {
-		log.Fatal(err)
+		logFatal("failed to open database", "err", err)
 	}
-	filesDir := *dbFileName + ".mpa"
 	if *dbInit != "" {
-		lang, err := parseOptions(*dbInit)
+		catalogs, err := loadCatalogs(cfg.localeDir)
 		if err != nil {
-			log.Fatal("failed to initialize database: ", err)
+			logFatal("failed to initialize database", "err", err)
 		}
-		if err = db.Init(lang); err != nil {
-			log.Fatal("failed to initialize database: ", err)
+		lang, err := parseOptions(*dbInit, catalogs)
+		if err != nil {
+			logFatal("failed to initialize database", "err", err)
 		}
-		if err := ensureDirExists(filepath.Join(filesDir), 0700); err != nil {
-			log.Fatal("error: ", err)
+		u, err := admin.newUser()
+		if err != nil {
+			logFatal("failed to initialize database", "err", err)
+		}
+		if err = db.Init(lang, u); err != nil {
+			logFatal("failed to initialize database", "err", err)
+		}
+		if err := ensureDirExists(cfg.filesDir, 0700); err != nil {
+			logFatal("error", "err", err)
+		}
+		if u != nil {
+			printGenerated(u.login, u.password, u.generated)
+		}
+		return
+	}
+	if flag.Arg(0) == "user" {
+		if err := userCommand(db, flag.Args()[1:]); err != nil {
+			logFatal("error", "err", err)
 		}
 		return
 	}
-	s, err := newServer(db, !*insecureCookie, filesDir)
+	s, err := newServer(db, cfg)
 	if err != nil {
-		log.Fatal("error: ", err)
-	}
-	http.HandleFunc("/", s.authenticate(s.ServeIndex))
-	http.HandleFunc("/new/album", s.authenticate(s.ServeNewAlbum))
-	http.HandleFunc("/api/new/album", s.authenticate(s.ServeAPINewAlbum))
-	http.HandleFunc("/edit/album/", s.authenticate(s.ServeEditAlbum))
-	http.HandleFunc("/api/edit/album/", s.authenticate(s.ServeAPIEditAlbum))
-	http.HandleFunc("/albums/", s.authenticate(s.ServeAlbums))
-	http.HandleFunc("/album/", s.authenticate(s.ServeAlbum))
-	http.HandleFunc("/preview/", s.authenticate(s.ServePreview))
-	http.HandleFunc("/view/", s.authenticate(s.ServeView))
-	http.HandleFunc("/image/", s.authenticate(s.ServeImage))
-	http.HandleFunc("/api/image/", s.authenticate(s.ServeImage))
-	http.HandleFunc("/image/orig/", s.authenticate(s.ServeImageOrig))
-	http.HandleFunc("/login", s.ServeLogin)
-	http.HandleFunc("/api/login", s.ServeAPILogin)
+		logFatal("error", "err", err)
+	}
+	http.HandleFunc("/", s.authenticate((*server).ServeIndex))
+	http.HandleFunc("/new/album", s.authenticate((*server).ServeNewAlbum))
+	http.HandleFunc("/api/new/album", s.authenticate((*server).ServeAPINewAlbum))
+	http.HandleFunc("/edit/album/", s.authenticate((*server).ServeEditAlbum))
+	http.HandleFunc("/api/edit/album/", s.authenticate((*server).ServeAPIEditAlbum))
+	http.HandleFunc("/api/transfer/album/", s.authenticate((*server).ServeAPITransferImages))
+	http.HandleFunc("/api/merge/album/", s.authenticate((*server).ServeAPIMergeAlbums))
+	http.HandleFunc("/api/split/album/", s.authenticate((*server).ServeAPISplitAlbum))
+	http.HandleFunc("/api/delete/album/", s.authenticate((*server).ServeAPIDeleteAlbum))
+	http.HandleFunc("/api/upload", s.authenticate((*server).ServeAPIUpload))
+	http.HandleFunc("/api/upload/", s.authenticate((*server).ServeAPIUpload))
+	http.HandleFunc("/api/check/files", s.authenticate((*server).ServeAPICheckFiles))
+	http.HandleFunc("/api/comments", s.authenticate((*server).ServeAPIComments))
+	http.HandleFunc("/api/new/comment", s.authenticate((*server).ServeAPINewComment))
+	http.HandleFunc("/api/edit/comment/", s.authenticate((*server).ServeAPIEditComment))
+	http.HandleFunc("/api/delete/comment/", s.authenticate((*server).ServeAPIDeleteComment))
+	http.HandleFunc("/favourites", s.authenticate((*server).ServeFavourites))
+	http.HandleFunc("/api/favourites", s.authenticate((*server).ServeAPIFavourites))
+	http.HandleFunc("/api/favourite/", s.authenticate((*server).ServeAPIFavourite))
+	http.HandleFunc("/duplicates", s.authenticate((*server).ServeDuplicates))
+	http.HandleFunc("/trash", s.authenticate((*server).ServeTrash))
+	http.HandleFunc("/trash/preview/", s.authenticate((*server).ServeTrashPreview))
+	http.HandleFunc("/api/duplicates", s.authenticate((*server).ServeAPIDeleteDuplicates))
+	http.HandleFunc("/albums/", s.authenticate((*server).ServeAlbums))
+	http.HandleFunc("/album/", s.authenticate((*server).ServeAlbum))
+	http.HandleFunc("/preview/", s.authenticate((*server).ServePreview))
+	http.HandleFunc("/view/", s.authenticate((*server).ServeView))
+	http.HandleFunc("/image/", s.authenticate((*server).ServeImage))
+	http.HandleFunc("/api/image/", s.authenticate((*server).ServeImage))
+	http.HandleFunc("/image/orig/", s.authenticate((*server).ServeImageOrig))
+	http.HandleFunc("/video/", s.authenticate((*server).ServeVideo))
+	http.HandleFunc("/login", s.localize((*server).ServeLogin))
+	http.HandleFunc("/api/login", s.localize((*server).ServeAPILogin))
 	http.HandleFunc("/logout/", s.ServeLogout)
-	http.HandleFunc("/password", s.authenticate(s.ServeChangePassword))
-	http.HandleFunc("/new/user", s.authenticate(s.authorizeAsAdmin(s.ServeNewUser)))
-	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(newDir("static/"))))
+	http.HandleFunc("/password", s.authenticate((*server).ServeChangePassword))
+	http.HandleFunc("/privacy", s.authenticate((*server).ServePrivacy))
+	http.HandleFunc("/language", s.authenticate((*server).ServeLanguage))
+	http.HandleFunc("/new/user", s.authenticate(s.authorizeAsAdmin((*server).ServeNewUser)))
+	http.HandleFunc("/admin", s.authenticate(s.authorizeAsAdmin((*server).ServeAdmin)))
+	http.HandleFunc("/admin/audit", s.authenticate(s.authorizeAsAdmin((*server).ServeAudit)))
+	http.HandleFunc("/admin/appearance", s.authenticate(s.authorizeAsAdmin((*server).ServeAppearance)))
+	if cfg.metricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/metrics", s.ServeMetrics)
+		go func() {
+			logFatal("metrics server error", "err", http.ListenAndServe(cfg.metricsAddr, mux))
+		}()
+	} else {
+		http.HandleFunc("/metrics", s.authenticate(s.authorizeAsAdmin((*server).ServeMetrics)))
+	}
+	http.HandleFunc("/static/", s.assets.ServeStatic)
 	http.HandleFunc("/favicon.ico", ServeFavicon)
-	log.Fatal(http.ListenAndServe(*httpAddr, &logger{http.DefaultServeMux}))
+	http.HandleFunc("/healthz", s.ServeHealthz)
+	http.HandleFunc("/readyz", s.ServeReadyz)
+	logInfo(nil, "listening", "addr", cfg.httpAddr, "version", Version)
+	logFatal("server error", "err", http.ListenAndServe(cfg.httpAddr, &logger{http.DefaultServeMux, s.metrics}))
 }
 
-func parseOptions(options string) (lang string, err error) {
+func parseOptions(options string, catalogs map[string]*catalog) (lang string, err error) {
 	mask := 0
 	for _, s := range strings.Split(options, ",") {
 		switch {
 		case strings.HasPrefix(s, "lang="):
 			lang = strings.TrimPrefix(s, "lang=")
-			if lang != "en" && lang != "pl" {
+			if catalogs[lang] == nil {
 				return "", fmt.Errorf("unsupported language: %s", lang)
 			}
 			mask |= 1
@@ -98,32 +162,103 @@ func parseOptions(options string) (lang string, err error) {
 }
 
 type server struct {
-	db      *DB
-	t       *template.Template
-	s       *Sessions
-	tr      func(string) string
-	lang    string
-	secure  bool // if client should send cookie only on HTTPS encrypted connection
-	preview chan previewRequest
+	db              *DB
+	t               *template.Template
+	cat             *catalog
+	assets          *assets
+	s               *Sessions
+	tr              func(string) string
+	trn             func(string, int) string
+	lang            string
+	catalogs        map[string]*catalog
+	localized       map[string]*server // by language ("" for the installation default)
+	site            *site
+	secure          bool // if client should send cookie only on HTTPS encrypted connection
+	sessionLifetime time.Duration
+	preview         chan previewRequest
+	ffmpeg          *ffmpeg
+	heic            *heicConverter
+	uploads         *resumableUploads
+	metrics         *metrics
+
+	previewRunning *int32 // accessed atomically, 1 while previewMaster runs
 }
 
-func newServer(db *DB, secure bool, filesDir string) (*server, error) {
+func newServer(db *DB, cfg *config) (*server, error) {
+	if err := db.Upgrade(); err != nil {
+		return nil, err
+	}
 	lang, err := db.GetMPAOptions()
 	if err != nil {
 		return nil, err
 	}
-	tr := translations[lang]
-	if tr == nil {
-		log.Printf("unsupported translation language %s, using en (i.e., English) instead", lang)
-		tr = translations["en"]
+	if cfg.lang != "" {
+		lang = cfg.lang
+	}
+	catalogs, err := loadCatalogs(cfg.localeDir)
+	if err != nil {
+		return nil, err
+	}
+	if catalogs[lang] == nil {
+		if cfg.lang != "" {
+			return nil, fmt.Errorf("unsupported language: %s", lang)
+		}
+		logWarn(nil, "unsupported translation language, using en (i.e., English) instead", "lang", lang)
+		lang = "en"
+	}
+	if err := db.EnsureDirs(); err != nil {
+		return nil, err
+	}
+	c := make(chan previewRequest)
+	s := &server{db: db, s: NewSessions(), catalogs: catalogs, secure: !cfg.insecureCookie, preview: c,
+		ffmpeg: newFFmpeg(cfg.ffmpegPath), heic: newHEICConverter(cfg.heicConverter), sessionLifetime: cfg.sessionLifetime,
+		uploads: &resumableUploads{busy: make(map[string]bool), maxChunkSize: cfg.maxChunkSize, expiry: cfg.uploadExpiry},
+		metrics: newMetrics(), previewRunning: new(int32), localized: make(map[string]*server), site: &site{}}
+	settings, err := db.SiteSettings()
+	if err != nil {
+		return nil, err
+	}
+	if s.assets, err = newAssets(cfg.dev, cfg.themeDir); err != nil {
+		return nil, err
 	}
-	m := template.FuncMap{"tr": tr.translate, "htmlTr": tr.htmlTranslate}
-	t, err := newTemplate("html", m,
+	s.site.set(settings)
+	for l, cat := range catalogs {
+		t, err := s.parseTemplates(cat)
+		if err != nil {
+			return nil, err
+		}
+		ls := *s
+		ls.t, ls.cat, ls.tr, ls.trn, ls.lang = t, cat, cat.translate, cat.translatePlural, l
+		s.localized[l] = &ls
+	}
+	def := s.localized[lang]
+	s.t, s.cat, s.tr, s.trn, s.lang = def.t, def.cat, def.tr, def.trn, def.lang
+	s.localized[""] = def
+	workers := cfg.workers
+	if workers == 0 {
+		workers = runtime.NumCPU()
+	}
+	go s.previewMaster(workers)
+	go s.expireUploads()
+	go s.purgeTrash()
+	return s, nil
+}
+
+// parseTemplates returns templates translated with the catalog.
+func (s *server) parseTemplates(cat *catalog) (*template.Template, error) {
+	m := cat.funcMap()
+	m["site"] = s.site.get
+	return s.assets.parseTemplates("html", m,
+		"templates/theme.html",
+		"templates/comments.html",
 		"templates/album.html",
+		"templates/albums.html",
+		"templates/duplicates.html", "templates/admin.html", "templates/appearance.html", "templates/trash.html", "templates/audit.html",
 		"templates/editalbum.html",
 		"templates/editalbumok.html",
 		"templates/error.html",
 		"templates/index.html",
+		"templates/language.html",
 		"templates/login.html",
 		"templates/loginapi.html",
 		"templates/newalbum.html",
@@ -131,29 +266,33 @@ func newServer(db *DB, secure bool, filesDir string) (*server, error) {
 		"templates/newuser.html",
 		"templates/newuserok.html",
 		"templates/password.html",
+		"templates/privacy.html",
 		"templates/view.html")
-	if err != nil {
-		return nil, err
-	}
-	if err := db.EnsureDirs(); err != nil {
-		return nil, err
+}
+
+// templates returns parsed templates (parsed again on each call in
+// dev mode).
+func (s *server) templates() (*template.Template, error) {
+	if s.assets.dev {
+		return s.parseTemplates(s.cat)
 	}
-	c := make(chan previewRequest)
-	s := &server{db: db, t: t, s: NewSessions(), tr: tr.translate, lang: lang, secure: secure, preview: c}
-	go s.previewMaster(runtime.NumCPU())
-	return s, nil
+	return s.t, nil
 }
 
 func (s *server) executeTemplate(w http.ResponseWriter, name string, data interface{}, code int) {
 	var b bytes.Buffer
-	if err := s.t.ExecuteTemplate(&b, name, data); err != nil {
-		log.Println(err)
+	t, err := s.templates()
+	if err == nil {
+		err = t.ExecuteTemplate(&b, name, data)
+	}
+	if err != nil {
+		logError(nil, "template execution error", "template", name, "err", err)
 		s.templateExecutionError(w)
 		return
 	}
 	w.WriteHeader(code)
 	if _, err := b.WriteTo(w); err != nil {
-		log.Println(err)
+		logWarn(nil, "writing response failed", "err", err)
 	}
 }
 
@@ -163,15 +302,19 @@ func (s *server) templateExecutionError(w http.ResponseWriter) {
 		Lang, Title, Text string
 	}{s.lang, s.tr("Internal server error"), s.tr("Error during template execution")}
 	var b bytes.Buffer
-	if err := s.t.ExecuteTemplate(&b, "error.html", &data); err != nil {
-		log.Println(err)
+	t, err := s.templates()
+	if err == nil {
+		err = t.ExecuteTemplate(&b, "error.html", &data)
+	}
+	if err != nil {
+		logError(nil, "template execution error", "template", "error.html", "err", err)
 		w.Header().Set("Content-Type", "text/plain")
 		http.Error(w, data.Title+": "+data.Text, http.StatusInternalServerError)
 		return
 	}
 	w.WriteHeader(http.StatusInternalServerError)
 	if _, err := b.WriteTo(w); err != nil {
-		log.Println(err)
+		logWarn(nil, "writing response failed", "err", err)
 	}
 }
 
@@ -185,12 +328,12 @@ func (s *server) error(w http.ResponseWriter, title, text string, code int) {
 	}{s.lang, title, text}, code)
 }
 
-func (s *server) parseFormError(w http.ResponseWriter, err error) {
-	log.Println(err)
+func (s *server) parseFormError(w http.ResponseWriter, r *http.Request, err error) {
+	logWarn(r, "Error parsing form", "err", err)
 	s.error(w, s.tr("Bad request"), s.tr("Error parsing form"), http.StatusBadRequest)
 }
 
-func (s *server) internalError(w http.ResponseWriter, err error, msg string) {
-	log.Println(err)
+func (s *server) internalError(w http.ResponseWriter, r *http.Request, err error, msg string) {
+	logError(r, "Internal server error", "err", err)
 	s.error(w, s.tr("Internal server error"), msg, http.StatusInternalServerError)
 }
@@ -0,0 +1,198 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"html"
+	"html/template"
+	"net/url"
+	"strings"
+)
+
+// renderMarkdown converts a small subset of Markdown (paragraphs,
+// headings, lists, block quotes, emphasis, code spans and links) to
+// HTML. All text is escaped and only http, https, mailto and relative
+// links are allowed so the result is safe to include in pages.
+func renderMarkdown(src string) template.HTML {
+	var b bytes.Buffer
+	var para []string
+	list := ""
+	closeBlock := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>")
+			writeInline(&b, strings.Join(para, " "))
+			b.WriteString("</p>\n")
+			para = nil
+		}
+		if list != "" {
+			b.WriteString("</" + list + ">\n")
+			list = ""
+		}
+	}
+	for _, line := range strings.Split(strings.Replace(src, "\r\n", "\n", -1), "\n") {
+		line = strings.TrimRight(line, " \t")
+		trimmed := strings.TrimLeft(line, " ")
+		switch {
+		case trimmed == "":
+			closeBlock()
+		case headingLevel(trimmed) > 0:
+			closeBlock()
+			level := headingLevel(trimmed)
+			if level > 4 {
+				level = 4
+			}
+			tag := string([]byte{'h', byte('2' + level)})
+			b.WriteString("<" + tag + ">")
+			writeInline(&b, strings.TrimSpace(strings.TrimLeft(trimmed, "#")))
+			b.WriteString("</" + tag + ">\n")
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* "):
+			startList(&b, &para, &list, "ul", closeBlock)
+			b.WriteString("<li>")
+			writeInline(&b, trimmed[2:])
+			b.WriteString("</li>\n")
+		case orderedItem(trimmed) > 0:
+			startList(&b, &para, &list, "ol", closeBlock)
+			b.WriteString("<li>")
+			writeInline(&b, strings.TrimSpace(trimmed[orderedItem(trimmed):]))
+			b.WriteString("</li>\n")
+		case strings.HasPrefix(trimmed, ">"):
+			closeBlock()
+			b.WriteString("<blockquote>")
+			writeInline(&b, strings.TrimSpace(trimmed[1:]))
+			b.WriteString("</blockquote>\n")
+		default:
+			if list != "" {
+				closeBlock()
+			}
+			para = append(para, trimmed)
+		}
+	}
+	closeBlock()
+	return template.HTML(b.String())
+}
+
+func startList(b *bytes.Buffer, para *[]string, list *string, tag string, closeBlock func()) {
+	if len(*para) > 0 || (*list != "" && *list != tag) {
+		closeBlock()
+	}
+	if *list == "" {
+		b.WriteString("<" + tag + ">\n")
+		*list = tag
+	}
+}
+
+// headingLevel returns number of leading '#' characters followed by a
+// space or zero if line is not a heading.
+func headingLevel(line string) int {
+	i := 0
+	for i < len(line) && line[i] == '#' {
+		i++
+	}
+	if i > 0 && i < len(line) && line[i] == ' ' {
+		return i
+	}
+	return 0
+}
+
+// orderedItem returns length of the "1. " prefix of an ordered list
+// item or zero if line is not an ordered list item.
+func orderedItem(line string) int {
+	i := 0
+	for i < len(line) && line[i] >= '0' && line[i] <= '9' {
+		i++
+	}
+	if i > 0 && i+1 < len(line) && line[i] == '.' && line[i+1] == ' ' {
+		return i + 2
+	}
+	return 0
+}
+
+func writeInline(b *bytes.Buffer, s string) {
+	for len(s) > 0 {
+		switch {
+		case s[0] == '\\' && len(s) > 1 && strings.IndexByte("\\`*_[]()#", s[1]) >= 0:
+			b.WriteString(html.EscapeString(s[1:2]))
+			s = s[2:]
+			continue
+		case s[0] == '`':
+			if end := strings.IndexByte(s[1:], '`'); end >= 0 {
+				b.WriteString("<code>" + html.EscapeString(s[1:1+end]) + "</code>")
+				s = s[end+2:]
+				continue
+			}
+		case strings.HasPrefix(s, "**") || strings.HasPrefix(s, "__"):
+			if end := strings.Index(s[2:], s[:2]); end > 0 {
+				b.WriteString("<strong>")
+				writeInline(b, s[2:2+end])
+				b.WriteString("</strong>")
+				s = s[end+4:]
+				continue
+			}
+		case s[0] == '*' || s[0] == '_':
+			if end := strings.IndexByte(s[1:], s[0]); end > 0 {
+				b.WriteString("<em>")
+				writeInline(b, s[1:1+end])
+				b.WriteString("</em>")
+				s = s[end+2:]
+				continue
+			}
+		case s[0] == '[':
+			if text, url, n := parseLink(s); n > 0 {
+				if safeURL(url) {
+					b.WriteString(`<a href="` + html.EscapeString(url) + `" rel="nofollow noopener">`)
+					writeInline(b, text)
+					b.WriteString("</a>")
+				} else {
+					writeInline(b, text)
+				}
+				s = s[n:]
+				continue
+			}
+		}
+		b.WriteString(html.EscapeString(s[:1]))
+		s = s[1:]
+	}
+}
+
+// parseLink parses link of the form [text](url) at the beginning of s
+// and returns its text, url and length (zero if s does not start with a link).
+// Parentheses in the url have to be balanced (as in
+// https://en.wikipedia.org/wiki/Go_(programming_language)).
+func parseLink(s string) (string, string, int) {
+	end := strings.Index(s, "](")
+	if end < 0 {
+		return "", "", 0
+	}
+	depth := 0
+	for i := end + 2; i < len(s); i++ {
+		switch s[i] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return s[1:end], strings.TrimSpace(s[end+2 : i]), i + 1
+			}
+			depth--
+		}
+	}
+	return "", "", 0
+}
+
+// safeURL reports whether the link target is an http, https or mailto
+// URL or a path on this server. Browsers treat backslashes as slashes
+// and drop tabs and newlines so these are rejected in relative links
+// (such as /\example.com) which would point to another host otherwise.
+func safeURL(s string) bool {
+	l := strings.ToLower(s)
+	if strings.HasPrefix(l, "http://") || strings.HasPrefix(l, "https://") || strings.HasPrefix(l, "mailto:") {
+		return true
+	}
+	if !strings.HasPrefix(s, "/") || strings.ContainsAny(s, "\\\t\r\n") {
+		return false
+	}
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme == "" && u.Host == ""
+}
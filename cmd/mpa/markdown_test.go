@@ -0,0 +1,78 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import "testing"
+
+func TestRenderMarkdown(t *testing.T) {
+	tests := []struct {
+		src, want string
+	}{
+		{"", ""},
+		{"Hello\nworld", "<p>Hello world</p>\n"},
+		{"one\n\ntwo", "<p>one</p>\n<p>two</p>\n"},
+		{"# Title", "<h3>Title</h3>\n"},
+		{"### Sub", "<h5>Sub</h5>\n"},
+		{"###### Deep", "<h6>Deep</h6>\n"},
+		{"#hashtag", "<p>#hashtag</p>\n"},
+		{"- a\n- b", "<ul>\n<li>a</li>\n<li>b</li>\n</ul>\n"},
+		{"1. a\n2. b", "<ol>\n<li>a</li>\n<li>b</li>\n</ol>\n"},
+		{"- a\n1. b", "<ul>\n<li>a</li>\n</ul>\n<ol>\n<li>b</li>\n</ol>\n"},
+		{"text\n- item", "<p>text</p>\n<ul>\n<li>item</li>\n</ul>\n"},
+		{"- item\ntext", "<ul>\n<li>item</li>\n</ul>\n<p>text</p>\n"},
+		{"> quote", "<blockquote>quote</blockquote>\n"},
+		{"*em* _em_ **strong** __strong__", "<p><em>em</em> <em>em</em> <strong>strong</strong> <strong>strong</strong></p>\n"},
+		{"`a < b`", "<p><code>a &lt; b</code></p>\n"},
+		{`\*not em\*`, "<p>*not em*</p>\n"},
+		{"<script>alert(1)</script>", "<p>&lt;script&gt;alert(1)&lt;/script&gt;</p>\n"},
+		{"a & \"b\"", "<p>a &amp; &#34;b&#34;</p>\n"},
+		{"[site](https://example.com/?a=1&b=2)", `<p><a href="https://example.com/?a=1&amp;b=2" rel="nofollow noopener">site</a></p>` + "\n"},
+		{"[**bold** link](/album/1)", `<p><a href="/album/1" rel="nofollow noopener"><strong>bold</strong> link</a></p>` + "\n"},
+		{"[x](javascript:alert(1))", "<p>x</p>\n"},
+		{"[Go](https://en.wikipedia.org/wiki/Go_(programming_language)) lang", `<p><a href="https://en.wikipedia.org/wiki/Go_(programming_language)" rel="nofollow noopener">Go</a> lang</p>` + "\n"},
+		{"([a](/a))", `<p>(<a href="/a" rel="nofollow noopener">a</a>)</p>` + "\n"},
+		{"[x](/a(b)", "<p>[x](/a(b)</p>\n"},
+		{"[x](//example.com)", "<p>x</p>\n"},
+		{`[x](/\example.com)`, "<p>x</p>\n"},
+		{`[x](" onmouseover="alert(1))`, "<p>x</p>\n"},
+		{"[unclosed](/a", "<p>[unclosed](/a</p>\n"},
+		{"line\r\nnext", "<p>line next</p>\n"},
+	}
+	for _, tt := range tests {
+		if got := string(renderMarkdown(tt.src)); got != tt.want {
+			t.Errorf("renderMarkdown(%q) = %q, want %q", tt.src, got, tt.want)
+		}
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	tests := []struct {
+		url string
+		ok  bool
+	}{
+		{"http://example.com", true},
+		{"HTTPS://example.com/a?b=c", true},
+		{"mailto:user@example.com", true},
+		{"/album/1", true},
+		{"/view/1#2", true},
+		{"", false},
+		{"album/1", false},
+		{"javascript:alert(1)", false},
+		{"JavaScript:alert(1)", false},
+		{"data:text/html,<script>alert(1)</script>", false},
+		{"ftp://example.com", false},
+		{"//example.com", false},
+		{`/\example.com`, false},
+		{`/\/example.com`, false},
+		{"/\t/example.com", false},
+		{"/\n/example.com", false},
+		{"/a\\b", false},
+	}
+	for _, tt := range tests {
+		if got := safeURL(tt.url); got != tt.ok {
+			t.Errorf("safeURL(%q) = %t, want %t", tt.url, got, tt.ok)
+		}
+	}
+}
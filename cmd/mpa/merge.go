@@ -0,0 +1,436 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ServeAPIMergeAlbums merges the selected albums into the album given
+// in the path.
+func (s *server) ServeAPIMergeAlbums(w http.ResponseWriter, r *http.Request) {
+	albumID, err := idFromPath(r.URL.Path, "/api/merge/album/")
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	session, form, ok := s.parseAPIForm(w, r)
+	if !ok {
+		return
+	}
+	others, err := parseIDs(form["album"])
+	if err != nil {
+		logWarn(r, "Error parsing form", "err", err)
+		http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
+		return
+	}
+	if len(others) == 0 {
+		http.Error(w, s.tr("No albums selected"), http.StatusBadRequest)
+		return
+	}
+	seen := map[int64]bool{albumID: true}
+	for _, id := range others {
+		if seen[id] {
+			http.Error(w, s.tr("Target album must be different from the source album"), http.StatusBadRequest)
+			return
+		}
+		seen[id] = true
+	}
+	name := form.Get("name")
+	if name == "" {
+		http.Error(w, s.tr("Album name not specified"), http.StatusBadRequest)
+		return
+	}
+	var coverID int64
+	if cover := form.Get("cover"); cover != "" {
+		if coverID, err = strconv.ParseInt(cover, 10, 64); err != nil {
+			logWarn(r, "Error parsing image ID", "err", err)
+			http.Error(w, s.tr("Error parsing image ID"), http.StatusBadRequest)
+			return
+		}
+	}
+	rs := s.db.MergeAlbums(session.Uid, albumID, others, name, coverID, s.tr)
+	logAlbumErrors(r, albumID, rs.Errs)
+	if rs.Status != http.StatusOK {
+		http.Error(w, rs.Errs[len(rs.Errs)-1].Msg, rs.Status)
+		return
+	}
+	data := struct {
+		Title    string
+		Messages []string
+		Problems []imageError
+		Href     string
+	}{Title: s.tr("Albums merged"), Problems: rs.Errs, Href: fmt.Sprintf("/album/%d", albumID)}
+	s.auditAs(r, session.Uid, session.Login, auditAlbumMerge, auditTarget{Album: albumID}, fmt.Sprintf("albums %v, %d images", others, rs.ImagesCnt))
+	data.Messages = append(data.Messages, fmt.Sprintf(s.trn("%s from %d albums added to the album.", rs.AlbumsCnt), s.images(rs.ImagesCnt), rs.AlbumsCnt))
+	s.executeTemplate(w, "editalbumok.html", &data, http.StatusOK)
+}
+
+// ServeAPISplitAlbum splits the album by date boundaries (each
+// boundary starts a new album) or moves the selected images to a new
+// album.
+func (s *server) ServeAPISplitAlbum(w http.ResponseWriter, r *http.Request) {
+	albumID, err := idFromPath(r.URL.Path, "/api/split/album/")
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	session, form, ok := s.parseAPIForm(w, r)
+	if !ok {
+		return
+	}
+	imageIDs, err := parseIDs(form["image"])
+	if err != nil {
+		logWarn(r, "Error parsing image ID", "err", err)
+		http.Error(w, s.tr("Error parsing image ID"), http.StatusBadRequest)
+		return
+	}
+	var boundaries []time.Time
+	for _, d := range form["date"] {
+		t, err := parseDate(d)
+		if err != nil {
+			logWarn(r, "Error parsing date", "err", err)
+			http.Error(w, s.tr("Error parsing date"), http.StatusBadRequest)
+			return
+		}
+		boundaries = append(boundaries, t)
+	}
+	names := form["name"]
+	data := struct {
+		Title    string
+		Messages []string
+		Problems []imageError
+		Href     string
+	}{Title: s.tr("Album split")}
+	switch {
+	case len(imageIDs) > 0 && len(boundaries) == 0:
+		if len(names) == 0 || names[0] == "" {
+			http.Error(w, s.tr("Album name not specified"), http.StatusBadRequest)
+			return
+		}
+		rs := s.db.TransferImages(session.Uid, albumID, imageIDs, 0, names[0], false, s.tr)
+		logAlbumErrors(r, albumID, rs.Errs)
+		if rs.Status != http.StatusOK {
+			http.Error(w, rs.Errs[len(rs.Errs)-1].Msg, rs.Status)
+			return
+		}
+		data.Problems = rs.Errs
+		data.Href = fmt.Sprintf("/album/%d", rs.TargetID)
+		s.auditAs(r, session.Uid, session.Login, auditAlbumSplit, auditTarget{Album: albumID}, fmt.Sprintf("%d images to album %d", rs.Cnt, rs.TargetID))
+		data.Messages = append(data.Messages, fmt.Sprintf(s.trn("%s moved to %d new albums.", 1), s.images(rs.Cnt), 1))
+		if rs.SourceDeleted {
+			data.Messages = append(data.Messages, s.tr("No images left in the album, album deleted."))
+		}
+	case len(boundaries) > 0 && len(imageIDs) == 0:
+		rs := s.db.SplitAlbum(session.Uid, albumID, boundaries, names, s.tr)
+		logAlbumErrors(r, albumID, rs.Errs)
+		if rs.Status != http.StatusOK {
+			http.Error(w, rs.Errs[len(rs.Errs)-1].Msg, rs.Status)
+			return
+		}
+		data.Problems = rs.Errs
+		data.Href = "/albums/" + session.Login
+		s.auditAs(r, session.Uid, session.Login, auditAlbumSplit, auditTarget{Album: albumID}, fmt.Sprintf("%d images to albums %v", rs.ImagesCnt, rs.AlbumIDs))
+		data.Messages = append(data.Messages, fmt.Sprintf(s.trn("%s moved to %d new albums.", len(rs.AlbumIDs)), s.images(rs.ImagesCnt), len(rs.AlbumIDs)))
+		if rs.SourceDeleted {
+			data.Messages = append(data.Messages, s.tr("No images left in the album, album deleted."))
+		}
+	default:
+		http.Error(w, s.tr("Please specify either date boundaries or selected images"), http.StatusBadRequest)
+		return
+	}
+	s.executeTemplate(w, "editalbumok.html", &data, http.StatusOK)
+}
+
+// parseAPIForm checks the method and session of the API request and
+// parses its (multipart) form.
+func (s *server) parseAPIForm(w http.ResponseWriter, r *http.Request) (SessionData, url.Values, bool) {
+	if r.Method != "POST" {
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+		return SessionData{}, nil, false
+	}
+	session, err := s.SessionData(r)
+	if err != nil {
+		logError(r, "session error", "err", err)
+		// Forbidden used as API calls expect modal login served on Unauthorized.
+		http.Error(w, s.tr("Authorization error"), http.StatusForbidden)
+		return SessionData{}, nil, false
+	}
+	if err := r.ParseMultipartForm(65536); err != nil {
+		logWarn(r, "Error parsing form", "err", err)
+		http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
+		return SessionData{}, nil, false
+	}
+	return session, r.PostForm, true
+}
+
+// logAlbumErrors logs problems with images of the album.
+func logAlbumErrors(r *http.Request, albumID int64, errs []imageError) {
+	for _, e := range errs {
+		if e.err != nil {
+			logWarn(r, e.Msg, "album", albumID, "file", e.FileName, "err", e.err)
+		} else {
+			logWarn(r, e.Msg, "album", albumID, "file", e.FileName)
+		}
+	}
+}
+
+// parseDate parses date (and optionally time) as send by HTML date
+// and datetime-local inputs. The result is the wall clock time in UTC
+// (see wallClock) so it does not depend on the time zone of the
+// server.
+func parseDate(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		t, err = time.Parse("2006-01-02T15:04", s)
+	}
+	return t, err
+}
+
+// wallClock returns the wall clock time of t (in its own location) as
+// if it was UTC time. Image times are local times of the camera so
+// they are compared with dates given by the user this way.
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+type MergeAlbumsResult struct {
+	Status    int
+	AlbumsCnt int
+	ImagesCnt int
+	Errs      []imageError
+}
+
+// MergeAlbums moves all images of the albums others (in their order)
+// to the end of the album albumID, deletes the emptied albums and
+// renames the album. If coverID is non zero the image is set as the
+// cover of the merged album. All albums must be owned by uid.
+func (db *DB) MergeAlbums(uid, albumID int64, others []int64, name string, coverID int64, tr func(string) string) (rs MergeAlbumsResult) {
+	rs.Status = http.StatusInternalServerError
+	tx, err := db.db.Begin()
+	if err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	defer tx.Rollback()
+	for _, id := range append([]int64{albumID}, others...) {
+		if err := checkAlbumOwner(tx, id, uid); err != nil {
+			rs.Status = http.StatusForbidden
+			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("album=%d", id), tr("Album does not exist or you are not its owner")})
+			return
+		}
+	}
+	now := time.Now().UTC().Unix()
+	if _, err = tx.Exec("UPDATE albums SET name=?, modified=? WHERE aid=?", name, now, albumID); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	var position int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(position)+1, 0) FROM images WHERE album_id=?", albumID).Scan(&position); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	for _, id := range others {
+		ids, err := albumImageIDs(tx, id)
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("album=%d", id), tr("Internal server error")})
+			return
+		}
+		for _, imageID := range ids {
+			if _, err := tx.Exec("UPDATE images SET album_id=?, position=? WHERE iid=?", albumID, position, imageID); err != nil {
+				rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", imageID), tr("Internal server error")})
+				return
+			}
+			position++
+		}
+		if err := moveAlbumComments(tx, id, albumID); err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("album=%d", id), tr("Internal server error")})
+			return
+		}
+		if _, err := tx.Exec("DELETE FROM albums WHERE aid=?", id); err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("album=%d", id), tr("Internal server error")})
+			return
+		}
+		rs.AlbumsCnt++
+		rs.ImagesCnt += len(ids)
+	}
+	if coverID != 0 {
+		r, err := tx.Exec("UPDATE albums SET image_id=? WHERE aid=? AND EXISTS(SELECT 1 FROM images WHERE iid=? AND album_id=?)", coverID, albumID, coverID, albumID)
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+		if cnt, err := r.RowsAffected(); err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		} else if cnt == 0 {
+			rs.Errs = append(rs.Errs, imageError{errors.New("Not found in DB"), fmt.Sprintf("image=%d", coverID), tr("Cover image not found in this album")})
+		}
+	}
+	if _, err := updateAlbumCover(tx, albumID); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	rs.Status = http.StatusOK
+	return
+}
+
+type SplitAlbumResult struct {
+	Status        int
+	AlbumIDs      []int64
+	ImagesCnt     int
+	SourceDeleted bool
+	Errs          []imageError
+}
+
+type splitBoundary struct {
+	t    time.Time
+	name string
+}
+
+// SplitAlbum moves images of the album taken at or after the earliest
+// of the boundaries to new albums, one album per boundary. The new
+// album of boundaries[i] is named names[i] or, if not given, after the
+// original album and the boundary date.
+func (db *DB) SplitAlbum(uid, albumID int64, boundaries []time.Time, names []string, tr func(string) string) (rs SplitAlbumResult) {
+	rs.Status = http.StatusInternalServerError
+	bs := make([]splitBoundary, len(boundaries))
+	for i, t := range boundaries {
+		bs[i].t = t
+		if i < len(names) {
+			bs[i].name = names[i]
+		}
+	}
+	sort.SliceStable(bs, func(i, j int) bool { return bs[i].t.Before(bs[j].t) })
+	tx, err := db.db.Begin()
+	if err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	defer tx.Rollback()
+	if err := checkAlbumOwner(tx, albumID, uid); err != nil {
+		rs.Status = http.StatusForbidden
+		rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("album=%d", albumID), tr("Album does not exist or you are not its owner")})
+		return
+	}
+	var name, order string
+	if err := tx.QueryRow("SELECT name, image_order FROM albums WHERE aid=?", albumID).Scan(&name, &order); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	rows, err := tx.Query("SELECT iid, created FROM images WHERE album_id=? "+imageOrderBy(order), albumID)
+	if err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	parts := make([][]int64, len(bs)+1)
+	for rows.Next() {
+		var id int64
+		var created string
+		if err := rows.Scan(&id, &created); err != nil {
+			rows.Close()
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+		t, err := parseDBTime(created)
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", id), tr("Could not determine image time")})
+			continue
+		}
+		t = wallClock(t)
+		k := sort.Search(len(bs), func(i int) bool { return t.Before(bs[i].t) })
+		parts[k] = append(parts[k], id)
+	}
+	err = rows.Err()
+	rows.Close()
+	if err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+
+	now := time.Now().UTC().Unix()
+	for k := 1; k < len(parts); k++ {
+		if len(parts[k]) == 0 {
+			continue
+		}
+		newName := bs[k-1].name
+		if newName == "" {
+			newName = fmt.Sprintf("%s (%s)", name, bs[k-1].t.Format("2006-01-02"))
+		}
+		r, err := tx.Exec("INSERT INTO albums (owner_id, created, modified, name, image_order) VALUES (?, ?, ?, ?, ?)", uid, now, now, newName, order)
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+		id, err := r.LastInsertId()
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+		for position, imageID := range parts[k] {
+			if _, err := tx.Exec("UPDATE images SET album_id=?, position=? WHERE iid=?", id, position, imageID); err != nil {
+				rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", imageID), tr("Internal server error")})
+				return
+			}
+		}
+		if _, err := updateAlbumCover(tx, id); err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+		rs.AlbumIDs = append(rs.AlbumIDs, id)
+		rs.ImagesCnt += len(parts[k])
+	}
+	if len(rs.AlbumIDs) == 0 {
+		rs.Status = http.StatusBadRequest
+		rs.Errs = append(rs.Errs, imageError{errors.New("no images after boundary"), "", tr("No images taken after the given dates")})
+		return
+	}
+	if _, err := tx.Exec("UPDATE albums SET modified=? WHERE aid=?", now, albumID); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	if rs.SourceDeleted, err = updateAlbumCover(tx, albumID); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	rs.Status = http.StatusOK
+	return
+}
+
+// albumImageIDs returns IDs of images of the album in the album order.
+func albumImageIDs(q Queryer, albumID int64) ([]int64, error) {
+	var order string
+	if err := q.QueryRow("SELECT image_order FROM albums WHERE aid=?", albumID).Scan(&order); err != nil {
+		return nil, err
+	}
+	rows, err := q.Query("SELECT iid FROM images WHERE album_id=? "+imageOrderBy(order), albumID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,66 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestSplitAlbum(t *testing.T) {
+	db := initTestDB(t)
+	cest := time.FixedZone("CEST", 2*60*60)
+	now := time.Now().UTC()
+	if _, err := db.db.Exec("INSERT INTO albums (aid, owner_id, image_id, is_portrait, created, modified, name) VALUES (1, 1, 1, 0, ?, ?, 'Trip')", now, now); err != nil {
+		t.Fatal(err)
+	}
+	// image 3 is taken on June 3 local time but June 2 in UTC
+	for i, created := range []time.Time{
+		time.Date(2017, 6, 1, 10, 0, 0, 0, cest),
+		time.Date(2017, 6, 2, 23, 30, 0, 0, cest),
+		time.Date(2017, 6, 3, 1, 0, 0, 0, cest),
+	} {
+		if _, err := db.db.Exec("INSERT INTO images (iid, album_id, sha256sum, title, is_portrait, created, owner_file_name, position) VALUES (?, 1, ?, '', 0, ?, 'img.jpg', ?)",
+			i+1, testSum(byte('a'+i)), created, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var boundaries []time.Time
+	for _, s := range []string{"2017-06-03", "2017-06-02"} {
+		b, err := parseDate(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		boundaries = append(boundaries, b)
+	}
+	// names are given in the order of the (unsorted) boundaries
+	rs := db.SplitAlbum(1, 1, boundaries, []string{"Third day"}, func(s string) string { return s })
+	if rs.Status != http.StatusOK {
+		t.Fatalf("SplitAlbum returned status %d: %v", rs.Status, rs.Errs)
+	}
+	if len(rs.AlbumIDs) != 2 || rs.ImagesCnt != 2 || rs.SourceDeleted {
+		t.Fatalf("SplitAlbum created albums %v with %d images (source deleted %t), want 2 albums with 2 images", rs.AlbumIDs, rs.ImagesCnt, rs.SourceDeleted)
+	}
+	for _, want := range []struct {
+		iid  int64
+		name string
+	}{
+		{1, "Trip"},
+		{2, "Trip (2017-06-02)"},
+		{3, "Third day"},
+	} {
+		var name string
+		if err := db.db.QueryRow("SELECT name FROM albums JOIN images ON album_id=aid WHERE iid=?", want.iid).Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		if name != want.name {
+			t.Errorf("image %d moved to album %q, want %q", want.iid, name, want.name)
+		}
+	}
+	if !boundaries[0].Equal(time.Date(2017, 6, 3, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("boundaries modified by SplitAlbum: %v", boundaries)
+	}
+}
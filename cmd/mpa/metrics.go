@@ -0,0 +1,230 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics are exposed at /metrics in the Prometheus text format,
+// either to admins on the main listen address or to anyone on a
+// separate one (-metrics_http option) not meant to be public. Request
+// metrics are labelled by the route (ServeMux pattern) rather than
+// the path to keep the number of series bounded.
+
+var requestBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+var previewBuckets = []float64{.1, .25, .5, 1, 2.5, 5, 10, 30, 60}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // per bucket (not cumulative)
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[i]++
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(b *bytes.Buffer, name, labels string) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	var cum uint64
+	for i, le := range h.buckets {
+		cum += h.counts[i]
+		fmt.Fprintf(b, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, sep, formatFloat(le), cum)
+	}
+	fmt.Fprintf(b, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(b, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(b, "%s_count%s %d\n", name, labels, h.count)
+}
+
+type requestKey struct {
+	route, method string
+	code          int
+}
+
+type metrics struct {
+	mu              sync.Mutex
+	requests        map[requestKey]uint64
+	latency         map[string]*histogram // by route
+	uploadBytes     uint64
+	uploadFiles     uint64
+	previewWorkers  int
+	previewQueue    int
+	previewBusy     int
+	previewTime     *histogram
+	previewFailures uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:    make(map[requestKey]uint64),
+		latency:     make(map[string]*histogram),
+		previewTime: newHistogram(previewBuckets),
+	}
+}
+
+func (m *metrics) request(route, method string, code int, d time.Duration) {
+	switch method {
+	case "GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS":
+	default:
+		method = "other"
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{route, method, code}]++
+	h := m.latency[route]
+	if h == nil {
+		h = newHistogram(requestBuckets)
+		m.latency[route] = h
+	}
+	h.observe(d.Seconds())
+}
+
+// upload records received bytes and the number of completely
+// received files.
+func (m *metrics) upload(n int64, files int) {
+	m.mu.Lock()
+	m.uploadBytes += uint64(n)
+	m.uploadFiles += uint64(files)
+	m.mu.Unlock()
+}
+
+func (m *metrics) previewState(workers, queued, busy int) {
+	m.mu.Lock()
+	m.previewWorkers, m.previewQueue, m.previewBusy = workers, queued, busy
+	m.mu.Unlock()
+}
+
+func (m *metrics) previewDone(d time.Duration, err error) {
+	m.mu.Lock()
+	m.previewTime.observe(d.Seconds())
+	if err != nil {
+		m.previewFailures++
+	}
+	m.mu.Unlock()
+}
+
+// routePattern returns the pattern of the handler which serves the
+// request (or "" if the handler is not a ServeMux).
+func routePattern(h http.Handler, r *http.Request) string {
+	mux, ok := h.(*http.ServeMux)
+	if !ok {
+		return ""
+	}
+	_, pattern := mux.Handler(r)
+	if pattern == "" {
+		return "none"
+	}
+	return pattern
+}
+
+// ServeMetrics serves metrics in the Prometheus text format.
+func (s *server) ServeMetrics(w http.ResponseWriter, r *http.Request) {
+	var storage int64
+	var images, albums, users, trashed int64
+	err := s.db.ensureFileSizes()
+	if err == nil {
+		storage, err = s.db.TotalStorageUsage()
+	}
+	if err == nil {
+		err = s.db.db.QueryRow(`SELECT (SELECT count(*) FROM images), (SELECT count(*) FROM albums), (SELECT count(*) FROM users),
+(SELECT count(*) FROM trash_images)`).Scan(&images, &albums, &users, &trashed)
+	}
+	if err != nil {
+		logError(r, "metrics", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	var b bytes.Buffer
+	m := s.metrics
+	m.mu.Lock()
+	writeMetricHeader(&b, "mpa_http_requests_total", "counter", "Number of HTTP requests by route, method and status code.")
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.code < b.code
+	})
+	for _, k := range keys {
+		fmt.Fprintf(&b, "mpa_http_requests_total{route=\"%s\",method=\"%s\",code=\"%d\"} %d\n", escapeLabel(k.route), k.method, k.code, m.requests[k])
+	}
+	writeMetricHeader(&b, "mpa_http_request_duration_seconds", "histogram", "Time of serving HTTP requests by route.")
+	routes := make([]string, 0, len(m.latency))
+	for route := range m.latency {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		m.latency[route].write(&b, "mpa_http_request_duration_seconds", "route=\""+escapeLabel(route)+"\"")
+	}
+	writeMetric(&b, "mpa_upload_bytes_total", "counter", "Bytes of uploaded files received.", m.uploadBytes)
+	writeMetric(&b, "mpa_upload_files_total", "counter", "Number of completely received uploaded files.", m.uploadFiles)
+	writeMetric(&b, "mpa_preview_workers", "gauge", "Number of preview workers.", m.previewWorkers)
+	writeMetric(&b, "mpa_preview_queue_length", "gauge", "Number of previews waiting for a worker.", m.previewQueue)
+	writeMetric(&b, "mpa_preview_busy_workers", "gauge", "Number of workers creating previews.", m.previewBusy)
+	writeMetricHeader(&b, "mpa_preview_duration_seconds", "histogram", "Time of creating previews of an image.")
+	m.previewTime.write(&b, "mpa_preview_duration_seconds", "")
+	writeMetric(&b, "mpa_preview_failures_total", "counter", "Number of failed preview creations.", m.previewFailures)
+	m.mu.Unlock()
+	writeMetric(&b, "mpa_sessions", "gauge", "Number of active sessions.", s.s.Count())
+	writeMetric(&b, "mpa_storage_bytes", "gauge", "Total size of stored originals.", storage)
+	writeMetric(&b, "mpa_images", "gauge", "Number of images in albums.", images)
+	writeMetric(&b, "mpa_albums", "gauge", "Number of albums.", albums)
+	writeMetric(&b, "mpa_users", "gauge", "Number of users.", users)
+	writeMetric(&b, "mpa_trash_images", "gauge", "Number of images in the trash.", trashed)
+	writeMetric(&b, "go_goroutines", "gauge", "Number of goroutines that currently exist.", runtime.NumGoroutine())
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(b.Bytes())
+}
+
+func writeMetricHeader(b *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func writeMetric(b *bytes.Buffer, name, typ, help string, v interface{}) {
+	writeMetricHeader(b, name, typ, help)
+	fmt.Fprintf(b, "%s %v\n", name, v)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
@@ -0,0 +1,114 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{.1, 1, 10})
+	for _, v := range []float64{.05, .1, .5, 3, 20} {
+		h.observe(v)
+	}
+	var b bytes.Buffer
+	h.write(&b, "x", `route="/"`)
+	want := `x_bucket{route="/",le="0.1"} 2
+x_bucket{route="/",le="1"} 3
+x_bucket{route="/",le="10"} 4
+x_bucket{route="/",le="+Inf"} 5
+x_sum{route="/"} 23.65
+x_count{route="/"} 5
+`
+	if b.String() != want {
+		t.Errorf("histogram with labels:\n%s\nwant:\n%s", b.String(), want)
+	}
+	b.Reset()
+	newHistogram([]float64{1}).write(&b, "y", "")
+	if want := "y_bucket{le=\"1\"} 0\ny_bucket{le=\"+Inf\"} 0\ny_sum 0\ny_count 0\n"; b.String() != want {
+		t.Errorf("empty histogram:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestRoutePattern(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(http.ResponseWriter, *http.Request) {})
+	mux.HandleFunc("/album/", func(http.ResponseWriter, *http.Request) {})
+	for path, want := range map[string]string{
+		"/":            "/",
+		"/album/12":    "/album/",
+		"/unknown/a/b": "/",
+	} {
+		if got := routePattern(mux, httptest.NewRequest("GET", path, nil)); got != want {
+			t.Errorf("route of %s is %q, want %q", path, got, want)
+		}
+	}
+	if got := routePattern(http.NotFoundHandler(), httptest.NewRequest("GET", "/", nil)); got != "" {
+		t.Errorf("route of handler other than ServeMux is %q", got)
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	db := initTestDB(t)
+	addTestAlbum(t, db, 1, "Trip", testSum('a'), testSum('b'))
+	s := &server{db: db, s: NewSessions(), metrics: newMetrics(), tr: func(s string) string { return s }}
+	if _, err := s.s.NewSession(time.Hour, SessionData{Uid: 1}); err != nil {
+		t.Fatal(err)
+	}
+	s.metrics.request("/album/", "GET", 200, 30*time.Millisecond)
+	s.metrics.request("/album/", "GET", 200, 2*time.Second)
+	s.metrics.request("/album/", "BREW", 405, time.Millisecond)
+	s.metrics.request(`/a"b`, "POST", 500, time.Millisecond)
+	s.metrics.upload(1000, 2)
+	s.metrics.upload(24, 0)
+	s.metrics.previewState(4, 7, 3)
+	s.metrics.previewDone(time.Second, nil)
+
+	w := httptest.NewRecorder()
+	s.ServeMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != 200 || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fatalf("status %d, Content-Type %q", w.Code, w.Header().Get("Content-Type"))
+	}
+	lines := make(map[string]bool)
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		lines[line] = true
+	}
+	for _, want := range []string{
+		`mpa_http_requests_total{route="/album/",method="GET",code="200"} 2`,
+		`mpa_http_requests_total{route="/album/",method="other",code="405"} 1`,
+		`mpa_http_requests_total{route="/a\"b",method="POST",code="500"} 1`,
+		`mpa_http_request_duration_seconds_bucket{route="/album/",le="0.05"} 2`,
+		`mpa_http_request_duration_seconds_bucket{route="/album/",le="+Inf"} 3`,
+		`mpa_http_request_duration_seconds_count{route="/album/"} 3`,
+		"# TYPE mpa_upload_bytes_total counter",
+		"mpa_upload_bytes_total 1024",
+		"mpa_upload_files_total 2",
+		"mpa_preview_workers 4",
+		"mpa_preview_queue_length 7",
+		"mpa_preview_busy_workers 3",
+		`mpa_preview_duration_seconds_bucket{le="1"} 1`,
+		"mpa_preview_failures_total 0",
+		"mpa_sessions 1",
+		"mpa_storage_bytes 128",
+		"mpa_images 2",
+		"mpa_albums 1",
+		"mpa_users 1",
+		"mpa_trash_images 0",
+	} {
+		if !lines[want] {
+			t.Errorf("metrics do not contain line %s", want)
+		}
+	}
+	for line := range lines {
+		if line != "" && !strings.HasPrefix(line, "# HELP ") && !strings.HasPrefix(line, "# TYPE ") && strings.Count(line, " ") != 1 {
+			t.Errorf("malformed line %q", line)
+		}
+	}
+}
@@ -9,13 +9,12 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"image"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -30,7 +29,7 @@ func (s *server) ServeNewAlbum(w http.ResponseWriter, r *http.Request) {
 func (s *server) ServeAPINewAlbum(w http.ResponseWriter, r *http.Request) {
 	session, err := s.SessionData(r)
 	if err != nil {
-		log.Println(err)
+		logError(r, "session error", "err", err)
 		// Forbidden used as API calls expect modal login served on Unauthorized.
 		// Actually it is probably internal server error.
 		http.Error(w, s.tr("Unauthorized error"), http.StatusUnauthorized)
@@ -38,7 +37,7 @@ func (s *server) ServeAPINewAlbum(w http.ResponseWriter, r *http.Request) {
 	}
 	tempDir, err := ioutil.TempDir(s.db.uploadDir, "tmp")
 	if err != nil {
-		log.Println(err)
+		logError(r, "new album error", "err", err)
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 		return
 	}
@@ -48,25 +47,27 @@ func (s *server) ServeAPINewAlbum(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if d.meta.Name == "" {
-		log.Println("Bad request: Album name not specified")
+		logWarn(r, "Album name not specified")
 		http.Error(w, s.tr("Album name not specified"), http.StatusBadRequest)
 		return
 	}
 	if len(d.files) == 0 {
 		if len(d.errs) > 0 {
-			log.Println("Bad request: no uploaded image was successfully rpocessed")
+			logWarn(r, "No uploaded image was successfully processed")
 			http.Error(w, s.tr("No uploaded image was successfully processed"), http.StatusBadRequest)
 		} else {
-			log.Println("Bad request: no images uploaded")
+			logWarn(r, "No images uploaded")
 			http.Error(w, s.tr("No images uploaded"), http.StatusBadRequest)
 		}
 		return
 	}
-	d.files[0].isAlbumImage = true
+	if !d.setAlbumImage() {
+		d.files[0].isAlbumImage = true
+	}
 	for idx, title := range d.meta.Titles {
 		inf := d.m[idx]
 		if d.m[idx] == nil {
-			log.Println("Error parsing form: unexpected index")
+			logWarn(r, "Error parsing form: unexpected index")
 			http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
 			return
 		}
@@ -75,22 +76,19 @@ func (s *server) ServeAPINewAlbum(w http.ResponseWriter, r *http.Request) {
 	jobs, albumID, errs2 := s.db.AddAlbum(session.Uid, d.meta.Name, d.files, s.tr)
 	n := len(jobs)
 	d.errs = append(d.errs, errs2...)
-	if d.errs != nil {
-		log.Println("album:", albumID, "new:", n)
-		for _, e := range d.errs {
-			fmt.Printf("%s: %s: %s\n", e.FileName, e.Msg, e.err)
-		}
-	}
+	logAlbumErrors(r, albumID, d.errs)
 	if n == 0 {
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 		return
 	}
+	s.consumeUploads(r, d)
 	go s.preparePreviews(jobs)
+	s.auditAs(r, session.Uid, session.Login, auditAlbumCreate, auditTarget{Album: albumID}, fmt.Sprintf("%q, %d images", d.meta.Name, n))
 	msg := ""
 	if n == d.imgCnt {
 		msg = s.tr("All uploaded files added to the new album.")
 	} else {
-		msg = fmt.Sprintf(s.tr("%d out of %d uploaded files added to the new album."), n, d.imgCnt)
+		msg = fmt.Sprintf(s.trn("%d out of %d uploaded files added to the new album.", d.imgCnt), n, d.imgCnt)
 	}
 	s.executeTemplate(w, "newalbumok.html", &struct {
 		Message  string
@@ -101,26 +99,89 @@ func (s *server) ServeAPINewAlbum(w http.ResponseWriter, r *http.Request) {
 
 type uploadData struct {
 	meta struct {
-		Name   string
-		Titles map[string]string
-		Edit   struct {
-			Deleted []int64
-			Titles  map[string]string
+		Name     string
+		Titles   map[string]string
+		Cover    string                  // index of the uploaded image to be used as album cover
+		Uploads  map[string]string       // IDs of completed resumable uploads by index
+		Existing map[string]existingFile // files already stored on the server by index
+		Edit     albumEdit
+	}
+	imgCnt  int
+	files   []*uploadInfo
+	uploads []string // IDs of attached resumable uploads
+	m       map[string]*uploadInfo
+	errs    []imageError
+}
+
+// validIndexes reports whether indexes of resumable uploads and
+// existing files given in the metadata are non-negative integers.
+func (d *uploadData) validIndexes() bool {
+	for idx := range d.meta.Uploads {
+		if !validIndex(idx) {
+			return false
+		}
+	}
+	for idx := range d.meta.Existing {
+		if !validIndex(idx) {
+			return false
 		}
 	}
-	imgCnt int
-	files  []*uploadInfo
-	m      map[string]*uploadInfo
-	errs   []imageError
+	return true
+}
+
+func validIndex(idx string) bool {
+	n, err := strconv.Atoi(idx)
+	return err == nil && n >= 0 && strconv.Itoa(n) == idx
+}
+
+// albumEdit describes changes requested to images already present in
+// the album.
+type albumEdit struct {
+	Deleted []int64
+	Titles  map[string]string
+	Order   []int64 // image IDs in the requested manual order
+	Sort    string  // new image order of the album
+	Cover   int64   // ID of the image to be used as album cover
+
+	Description *string // album description in Markdown
+	DateFrom    *string // event date range, empty for derived from images
+	DateTo      *string
+	Collection  *string // name of the collection, empty for none
+	StripEXIF   *string // privacy settings "on", "off" or empty to inherit
+	PreviewEXIF *string
+
+	Transforms map[string]imageEdit // non-destructive edits by image ID
+	updates    []imageEditUpdate    // validated Transforms
+}
+
+func (e *albumEdit) detailsChanged() bool {
+	return e.Description != nil || e.DateFrom != nil || e.DateTo != nil || e.Collection != nil ||
+		e.StripEXIF != nil || e.PreviewEXIF != nil
+}
+
+// setAlbumImage marks the uploaded image requested as album cover and
+// reports whether it was successfully uploaded.
+func (d *uploadData) setAlbumImage() bool {
+	if d.meta.Cover == "" {
+		return false
+	}
+	inf := d.m[d.meta.Cover]
+	if inf == nil || inf.tmpFileName == "" {
+		return false
+	}
+	inf.isAlbumImage = true
+	return true
 }
 
 type uploadInfo struct {
 	tmpFileName  string
 	formName     string
+	index        int // index of the file in the form
 	userFileName string
 	title        string
 	sha256       string
 	isPortrait   bool
+	isVideo      bool
 	isAlbumImage bool
 	created      time.Time
 }
@@ -133,9 +194,22 @@ type imageError struct {
 
 func (s *server) upload(w http.ResponseWriter, r *http.Request, tempDir string) (*uploadData, bool) {
 	d := uploadData{m: make(map[string]*uploadInfo)}
+	session, err := s.SessionData(r)
+	if err != nil {
+		logError(r, "session error", "err", err)
+		http.Error(w, s.tr("Authorization error"), http.StatusForbidden)
+		return nil, false
+	}
+	limits, err := s.db.StorageLimits(session.Uid)
+	if err != nil {
+		logError(r, "upload error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return nil, false
+	}
+	sizes := make(map[string]int64) // of new files by sha256 sum
 	mr, err := r.MultipartReader()
 	if err != nil {
-		log.Println(err)
+		logWarn(r, "Error parsing form", "err", err)
 		http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
 		return nil, false
 	}
@@ -145,72 +219,128 @@ func (s *server) upload(w http.ResponseWriter, r *http.Request, tempDir string)
 			break
 		}
 		if err != nil {
-			log.Println(err)
+			logWarn(r, "Error parsing form", "err", err)
 			http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
 			return nil, false
 		}
 		formName := p.FormName()
 		if formName == "metadata" {
 			if err := json.NewDecoder(p).Decode(&d.meta); err != nil {
-				log.Println(err)
+				logWarn(r, "Error parsing metadata", "err", err)
+				http.Error(w, s.tr("Error parsing metadata"), http.StatusBadRequest)
+				return nil, false
+			}
+			if !d.validIndexes() {
 				http.Error(w, s.tr("Error parsing metadata"), http.StatusBadRequest)
 				return nil, false
 			}
-			fmt.Println(&d.meta)
+			logDebug(r, "upload metadata", "name", d.meta.Name, "titles", len(d.meta.Titles),
+				"uploads", len(d.meta.Uploads), "existing", len(d.meta.Existing))
 			continue
 		}
 		idx := strings.TrimPrefix(formName, "image:")
 		if len(idx) == len(formName) {
-			log.Println("unexpected form name " + formName)
+			logWarn(r, "Error parsing form: unexpected form name", "name", formName)
 			http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
 			return nil, false
 		}
 
 		d.imgCnt++
 		filename := filepath.Join(tempDir, strconv.Itoa(len(d.files)))
-		n, sha256, err := writeFileSha256(filename, p)
-		if err != nil {
-			d.errs = append(d.errs, imageError{err, p.FileName(), s.tr("Internal server error")})
+		var src io.Reader = p
+		if limits.maxFileSize > 0 {
+			// read one byte more to detect files exceeding the limit
+			src = io.LimitReader(p, limits.maxFileSize+1)
+		}
+		n, sha256, err := writeFileSha256(filename, src)
+		if err == nil && limits.maxFileSize > 0 && n > limits.maxFileSize {
+			os.Remove(filename)
+			d.errs = append(d.errs, imageError{ErrFileTooLarge, p.FileName(), fmt.Sprintf(s.tr("File too large (maximum %s)"), formatFileSize(limits.maxFileSize))})
 			d.m[idx] = &uploadInfo{}
 			continue
 		}
-		isPort, err := isPortrait(filename)
 		if err != nil {
-			d.errs = append(d.errs, imageError{err, p.FileName(), s.tr("Could not determine image size")})
+			d.errs = append(d.errs, imageError{err, p.FileName(), s.tr("Internal server error")})
 			d.m[idx] = &uploadInfo{}
 			continue
 		}
-		var created time.Time
-		t, err := exifDateTimeFromFile(filename)
-		if err != nil {
-			created = time.Now().UTC()
-			d.errs = append(d.errs, imageError{err, p.FileName(), s.tr("Could not determine image time, current time assumed")})
-		} else {
-			created = t
+		sizes[sha256] = n
+		s.metrics.upload(n, 1)
+		s.addUploadedFile(&d, idx, formName, p.FileName(), filename, sha256)
+		logDebug(r, "uploaded file", "form_name", formName, "file_name", p.FileName(),
+			"content_type", p.Header.Get("Content-Type"), "size", n, "sha256", sha256)
+	}
+	// completed resumable uploads are counted before they are
+	// attached so that they are kept if the quota is exceeded
+	for _, id := range d.meta.Uploads {
+		if u, err := s.db.ResumableUpload(session.Uid, id); err == nil && u.received == u.size && u.sha256sum != "" {
+			sizes[u.sha256sum] = u.size
 		}
-		inf := &uploadInfo{tmpFileName: filename, formName: formName, userFileName: p.FileName(), sha256: sha256, isPortrait: isPort, created: created}
-		d.files = append(d.files, inf)
-		d.m[idx] = inf
-		fmt.Println(p.Header, n, p.FormName(), p.FileName(), sha256)
 	}
+	if !s.checkQuota(w, r, session.Uid, sizes, 0) {
+		return nil, false
+	}
+	if len(d.meta.Uploads) > 0 || len(d.meta.Existing) > 0 {
+		s.attachUploads(&d, session.Uid, tempDir)
+		s.attachExisting(&d, session.Uid)
+	}
+	// keep the order in which files were selected
+	sort.SliceStable(d.files, func(i, j int) bool { return d.files[i].index < d.files[j].index })
 	return &d, true
 }
 
-func isPortrait(filename string) (bool, error) {
-	f, err := os.Open(filename)
+// addUploadedFile examines the uploaded file (already stored under
+// filename) and adds it to the uploaded files or records the error.
+func (s *server) addUploadedFile(d *uploadData, idx, formName, userFileName, filename, sha256 string) {
+	video, err := isVideo(filename)
 	if err != nil {
-		return false, err
+		d.errs = append(d.errs, imageError{err, userFileName, s.tr("Internal server error")})
+		d.m[idx] = &uploadInfo{}
+		return
+	}
+	var isPort bool
+	if video {
+		isPort, err = s.videoIsPortrait(filename)
+		if err != nil {
+			d.errs = append(d.errs, imageError{err, userFileName, s.tr("Could not process video")})
+			d.m[idx] = &uploadInfo{}
+			return
+		}
+	} else {
+		isPort, err = s.isPortrait(filename)
+		if err == ErrNoHEICConverter {
+			d.errs = append(d.errs, imageError{err, userFileName, s.tr("HEIC images are not supported by this server")})
+			d.m[idx] = &uploadInfo{}
+			return
+		} else if err != nil {
+			d.errs = append(d.errs, imageError{err, userFileName, s.tr("Could not determine image size")})
+			d.m[idx] = &uploadInfo{}
+			return
+		}
+	}
+	var created, t time.Time
+	if video {
+		t, err = s.ffmpeg.creationTime(filename)
+	} else {
+		t, err = exifDateTimeFromFile(filename)
 	}
-	defer f.Close()
-	cfg, _, err := image.DecodeConfig(f)
 	if err != nil {
-		return false, err
+		created = time.Now().UTC()
+		d.errs = append(d.errs, imageError{err, userFileName, s.tr("Could not determine image time, current time assumed")})
+	} else {
+		created = t
 	}
-	_, err = f.Seek(0, os.SEEK_SET)
+	index, _ := strconv.Atoi(idx)
+	inf := &uploadInfo{tmpFileName: filename, formName: formName, index: index, userFileName: userFileName, sha256: sha256, isPortrait: isPort, isVideo: video, created: created}
+	d.files = append(d.files, inf)
+	d.m[idx] = inf
+}
+
+func (s *server) isPortrait(filename string) (bool, error) {
+	cfg, orientation, err := s.decodeImageConfig(filename)
 	if err != nil {
 		return false, err
 	}
-	orientation, _ := exifOrientation(f)
 	if orientation > 4 {
 		return cfg.Width > cfg.Height, nil
 	}
@@ -281,9 +411,9 @@ func (db *DB) AddAlbum(uid int64, name string, files []*uploadInfo, tr func(stri
 	var imageID int64
 	isPortrait := false
 	jobs := make([]previewJob, 0, len(fs))
-	for _, inf := range fs {
-		r, err := tx.Exec("INSERT INTO images (sha256sum, album_id, title, is_portrait, created, owner_file_name) VALUES (?, ?, ?, ?, ?, ?)",
-			inf.sha256, albumID, inf.title, inf.isPortrait, inf.created, inf.userFileName)
+	for i, inf := range fs {
+		r, err := tx.Exec("INSERT INTO images (sha256sum, album_id, title, is_portrait, is_video, created, owner_file_name, position) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			inf.sha256, albumID, inf.title, inf.isPortrait, inf.isVideo, inf.created, inf.userFileName, i)
 		if err != nil {
 			errs = append(errs, imageError{err, inf.userFileName, tr("Internal server error")})
 			return
@@ -293,7 +423,7 @@ func (db *DB) AddAlbum(uid int64, name string, files []*uploadInfo, tr func(stri
 			errs = append(errs, imageError{err, inf.userFileName, tr("Internal server error")})
 			return
 		}
-		jobs = append(jobs, previewJob{id, inf.sha256})
+		jobs = append(jobs, previewJob{id, inf.sha256, imageEdit{}})
 		if inf.isAlbumImage {
 			imageID = id
 			isPortrait = inf.isPortrait
@@ -5,7 +5,6 @@
 package main
 
 import (
-	"log"
 	"net/http"
 	"unicode"
 
@@ -43,7 +42,7 @@ func (s *server) ServeChangePassword(w http.ResponseWriter, r *http.Request) {
 
 	session, err := s.SessionData(r)
 	if err != nil {
-		log.Println(err)
+		logError(r, "session error", "err", err)
 		d.Message = s.tr("Session retrieving error")
 		s.executeTemplate(w, "password.html", &d, http.StatusInternalServerError)
 		return
@@ -62,7 +61,7 @@ func (s *server) ServeChangePassword(w http.ResponseWriter, r *http.Request) {
 			d.PasswordMsg = s.tr("Incorrect password")
 			s.executeTemplate(w, "password.html", &d, http.StatusUnauthorized)
 		} else {
-			log.Println(err)
+			logError(r, "change password error", "err", err)
 			d.PasswordMsg = s.tr("Internal server error")
 			s.executeTemplate(w, "password.html", &d, http.StatusInternalServerError)
 		}
@@ -78,14 +77,15 @@ func (s *server) ServeChangePassword(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if err := s.db.ChangePassword(session.Uid, []byte(newPassword)); err != nil {
-		log.Println(err)
+		logError(r, "change password error", "err", err)
 		d.Message = s.tr("Internal server error")
 		s.executeTemplate(w, "password.html", &d, http.StatusInternalServerError)
 		return
 	}
+	s.auditAs(r, session.Uid, session.Login, auditPasswordChange, auditTarget{User: session.Uid}, "")
 	if session.RequirePasswordChange {
 		if err := s.SessionSetPasswordChanged(r); err != nil {
-			log.Println(err)
+			logError(r, "change password error", "err", err)
 		}
 	}
 	http.Redirect(w, r, "/", http.StatusSeeOther)
@@ -11,10 +11,11 @@ import (
 	"image/jpeg"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sync/atomic"
+	"time"
 
 	"github.com/anthonynsimon/bild/transform"
 	"github.com/nfnt/resize"
@@ -28,7 +29,7 @@ func (s *server) ServeImage(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if filename, ok := s.ensurePreview(w, r, id, ".1"); ok {
-		http.ServeFile(w, r, filename)
+		s.servePreviewFile(w, r, id, filename)
 	}
 }
 
@@ -50,34 +51,41 @@ func (s *server) ServePreview(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 	if filename, ok := s.ensurePreview(w, r, id, ".2"); ok {
-		http.ServeFile(w, r, filename)
+		s.servePreviewFile(w, r, id, filename)
 	}
 }
 
 func (s *server) ensurePreview(w http.ResponseWriter, r *http.Request, id int64, ext string) (string, bool) {
 	var sha256sum string
-	err := s.db.db.QueryRow("SELECT sha256sum FROM images where iid=?", id).Scan(&sha256sum)
+	var edit imageEdit
+	err := s.db.db.QueryRow("SELECT sha256sum, "+imageEditColumns+" FROM images where iid=?", id).Scan(append([]interface{}{&sha256sum}, edit.scanArgs()...)...)
 	if err != nil {
 		if err == sql.ErrNoRows {
 			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
 			return "", false
 		}
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-		log.Println(err)
+		logError(r, "preview error", "err", err)
 		return "", false
 	}
-	filename := filepath.Join(s.db.previewDir, sha256sum[:3], sha256sum[3:]+ext)
+	return s.ensurePreviewFile(w, r, previewJob{id, sha256sum, edit}, ext)
+}
+
+// ensurePreviewFile returns the name of the preview file of the job
+// (with extension ext) creating it if necessary.
+func (s *server) ensurePreviewFile(w http.ResponseWriter, r *http.Request, job previewJob, ext string) (string, bool) {
+	filename := previewPath(s.db.previewDir, job.sha256sum, job.edit) + ext
 	if _, err := os.Stat(filename); err != nil {
 		if !os.IsNotExist(err) {
+			logError(r, "preview error", "image", job.id, "err", err)
 			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-			log.Println(err)
 			return "", false
 		}
 		result := make(chan error)
-		s.preview <- previewRequest{id, sha256sum, result}
+		s.preview <- previewRequest{job, result}
 		if err = <-result; err != nil {
+			logError(r, "preview error", "image", job.id, "err", err)
 			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-			log.Println(err)
 			return "", false
 		}
 	}
@@ -85,34 +93,43 @@ func (s *server) ensurePreview(w http.ResponseWriter, r *http.Request, id int64,
 }
 
 type previewRequest struct {
-	id        int64
-	sha256sum string
-	result    chan<- error
+	previewJob
+	result chan<- error
 }
 
 type previewJob struct {
 	id        int64
 	sha256sum string
+	edit      imageEdit
+}
+
+// key identifies previews created by the job.
+func (job previewJob) key() string {
+	return job.sha256sum + job.edit.suffix()
 }
 
 type previewResult struct {
-	sha256sum string
-	err       error
+	key string
+	err error
 }
 
 func (s *server) preparePreviews(jobs []previewJob) {
 	result := make(chan error)
 	for _, job := range jobs {
-		s.preview <- previewRequest{job.id, job.sha256sum, result}
+		s.preview <- previewRequest{job, result}
 		if err := <-result; err != nil {
-			log.Printf("preview %d (%s): %v", job.id, job.sha256sum[:7], err)
+			logError(nil, "preview error", "image", job.id, "sha256", job.sha256sum[:7], "err", err)
 		}
 	}
 }
 
 var ErrQuit = errors.New("quit")
 
+var ErrPreviewNotRunning = errors.New("preview workers not running")
+
 func (s *server) previewMaster(workersCnt int) {
+	atomic.StoreInt32(s.previewRunning, 1)
+	defer atomic.StoreInt32(s.previewRunning, 0)
 	m := make(map[string][]previewRequest)
 	q := []previewJob{}
 	requests := make(chan previewJob)
@@ -122,11 +139,11 @@ func (s *server) previewMaster(workersCnt int) {
 		go s.previewWorker(results, requests)
 	}
 	addReq := func(req previewRequest) {
-		s := m[req.sha256sum]
+		s := m[req.key()]
 		if len(s) == 0 {
-			q = append(q, previewJob{req.id, req.sha256sum})
+			q = append(q, req.previewJob)
 		}
-		m[req.sha256sum] = append(s, req)
+		m[req.key()] = append(s, req)
 		if len(q) > 0 && working < workersCnt {
 			requests <- q[0]
 			q = q[1:]
@@ -135,13 +152,14 @@ func (s *server) previewMaster(workersCnt int) {
 	}
 	handleResult := func(result previewResult) {
 		working--
-		for _, req := range m[result.sha256sum] {
+		for _, req := range m[result.key] {
 			req.result <- result.err
 		}
-		delete(m, result.sha256sum)
+		delete(m, result.key)
 	}
 For:
 	for {
+		s.metrics.previewState(workersCnt, len(q), working)
 		c := s.preview
 		if len(q) > 4096 {
 			c = nil
@@ -174,16 +192,24 @@ For:
 
 func (s *server) previewWorker(results chan<- previewResult, requests <-chan previewJob) {
 	for req := range requests {
-		log.Printf("creating preview for image %d (%s)\n", req.id, req.sha256sum[:7])
-		results <- previewResult{req.sha256sum, s.createPreviews(req.sha256sum)}
+		logDebug(nil, "creating preview", "image", req.id, "sha256", req.sha256sum[:7])
+		t := time.Now()
+		err := s.createPreviews(req.sha256sum, req.edit)
+		s.metrics.previewDone(time.Since(t), err)
+		results <- previewResult{req.key(), err}
 	}
 }
 
-func (s *server) createPreviews(sha256sum string) error {
+func (s *server) createPreviews(sha256sum string, edit imageEdit) error {
 	dirName := filepath.Join(s.db.previewDir, sha256sum[:3])
-	filename := filepath.Join(dirName, sha256sum[3:])
+	filename := previewPath(s.db.previewDir, sha256sum, edit)
 	filename1 := filename + ".1"
 	filename2 := filename + ".2"
+	orig := filepath.Join(s.db.imagesDir, sha256sum[:3], sha256sum[3:])
+	video, err := isVideo(orig)
+	if err != nil {
+		return err
+	}
 	exists := 0
 	if _, err := os.Stat(filename1); err != nil {
 		if !os.IsNotExist(err) {
@@ -200,12 +226,25 @@ func (s *server) createPreviews(sha256sum string) error {
 		exists++
 	}
 	if exists == 2 {
+		if video {
+			return s.createRendition(orig, filename+videoExt)
+		}
 		return nil
 	}
-	img, orientation, err := s.readImage(sha256sum)
+	var img image.Image
+	orientation := 1
+	if video {
+		img, err = s.videoPoster(orig)
+	} else {
+		img, orientation, err = s.readImage(sha256sum)
+	}
 	if err != nil {
 		return err
 	}
+	if !edit.isZero() {
+		img = edit.apply(applyOrientation(img, orientation))
+		orientation = 1
+	}
 
 	if err := ensureDirExists(dirName, 0755); err != nil {
 		if !os.IsExist(err) {
@@ -216,26 +255,23 @@ func (s *server) createPreviews(sha256sum string) error {
 	if err := s.createPreview(filename1, img, 1280, orientation); err != nil {
 		return err
 	}
-	return s.createPreview(filename2, img, 320, orientation)
-}
-
-func (s *server) readImage(sha256sum string) (image.Image, int, error) {
-	filename := filepath.Join(s.db.imagesDir, sha256sum[:3], sha256sum[3:])
-	f, err := os.Open(filename)
-	if err != nil {
-		return nil, 0, err
+	if err := s.createPreview(filename2, img, 320, orientation); err != nil {
+		return err
 	}
-	defer f.Close()
-
-	orientation, _ := exifOrientation(f)
-	if _, err := f.Seek(0, os.SEEK_SET); err != nil {
-		return nil, 0, err
+	if !video && edit.isZero() {
+		if err := s.db.SetPerceptualHash(sha256sum, dHash(img, orientation)); err != nil {
+			// not fatal, computed later from the preview if missing
+			logWarn(nil, "perceptual hash error", "sha256", sha256sum[:7], "err", err)
+		}
 	}
-	img, _, err := image.Decode(f)
-	if err != nil {
-		return nil, 0, err
+	if video {
+		return s.createRendition(orig, filename+videoExt)
 	}
-	return img, orientation, f.Close()
+	return nil
+}
+
+func (s *server) readImage(sha256sum string) (image.Image, int, error) {
+	return s.decodeImage(filepath.Join(s.db.imagesDir, sha256sum[:3], sha256sum[3:]))
 }
 
 func (s *server) createPreview(filename string, img image.Image, maxSize uint, orientation int) error {
@@ -0,0 +1,266 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/rwcarlsen/goexif/exif"
+)
+
+// Privacy settings are stored in columns strip_exif and preview_exif
+// of the albums and users tables (NULL meaning inherit) and as server
+// defaults under the same keys in the mpa table. A setting of an album
+// overrides the one of its owner which overrides the server default.
+//
+// strip_exif: serve originals to users other than the owner with GPS
+// location and serial numbers removed.
+//
+// preview_exif: keep capture time and copyright in previews (which
+// otherwise contain no EXIF at all).
+
+// imagePrivacy is the effective privacy setting of an image.
+type imagePrivacy struct {
+	sha256sum   string
+	video       bool
+	ownerID     int64
+	stripEXIF   bool
+	previewEXIF bool
+}
+
+func (db *DB) ImagePrivacy(id int64) (p imagePrivacy, err error) {
+	err = db.db.QueryRow(`
+SELECT i.sha256sum, i.is_video, a.owner_id,
+COALESCE(a.strip_exif, u.strip_exif, (SELECT CAST(value AS INTEGER) FROM mpa WHERE key='strip_exif'), 1),
+COALESCE(a.preview_exif, u.preview_exif, (SELECT CAST(value AS INTEGER) FROM mpa WHERE key='preview_exif'), 0)
+FROM images AS i JOIN albums AS a ON i.album_id=a.aid LEFT OUTER JOIN users AS u ON a.owner_id=u.uid
+WHERE i.iid=?`, id).Scan(&p.sha256sum, &p.video, &p.ownerID, &p.stripEXIF, &p.previewEXIF)
+	return
+}
+
+// privacyValue converts setting "on", "off" or "" (inherit) to the
+// value stored in the database.
+func privacyValue(v string) (interface{}, bool) {
+	switch v {
+	case "":
+		return nil, true
+	case "on":
+		return 1, true
+	case "off":
+		return 0, true
+	}
+	return nil, false
+}
+
+// privacySQL is an SQL expression converting setting column to "on",
+// "off" or "" (inherit).
+func privacySQL(column string) string {
+	return "CASE WHEN " + column + " IS NULL THEN '' WHEN " + column + " THEN 'on' ELSE 'off' END"
+}
+
+// restrictOriginal reports whether the original of the image must not
+// be served unmodified to the current user.
+func (s *server) restrictOriginal(r *http.Request, p imagePrivacy) (bool, error) {
+	if !p.stripEXIF {
+		return false, nil
+	}
+	session, err := s.SessionData(r)
+	if err != nil {
+		return false, err
+	}
+	return session.Uid != p.ownerID, nil
+}
+
+// serveOrig serves the original image or video with private metadata
+// removed if required by privacy settings. Formats which cannot be
+// scrubbed are replaced by the large preview (images) or the web
+// rendition (videos).
+func (s *server) serveOrig(w http.ResponseWriter, r *http.Request, id int64, p imagePrivacy) {
+	filename := filepath.Join(s.db.imagesDir, p.sha256sum[:3], p.sha256sum[3:])
+	restrict, err := s.restrictOriginal(r, p)
+	if err != nil {
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "original image error", "err", err)
+		return
+	}
+	if !restrict {
+		http.ServeFile(w, r, filename)
+		return
+	}
+	if p.video {
+		if !s.ffmpeg.available() {
+			http.Error(w, s.tr("Original not available due to privacy settings"), http.StatusForbidden)
+			return
+		}
+		if filename, ok := s.ensurePreview(w, r, id, videoExt); ok {
+			w.Header().Set("Content-Type", "video/mp4")
+			http.ServeFile(w, r, filename)
+		}
+		return
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "original image error", "err", err)
+		return
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "original image error", "err", err)
+		return
+	}
+	data, err = stripPrivateEXIF(data)
+	if err != nil {
+		if err != ErrUnsupportedStrip {
+			logWarn(r, "stripping EXIF failed", "image", id, "err", err)
+		}
+		if filename, ok := s.ensurePreview(w, r, id, ".1"); ok {
+			w.Header().Set("Cache-Control", "no-cache")
+			http.ServeFile(w, r, filename)
+		}
+		return
+	}
+	http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(data))
+}
+
+// servePreviewFile serves the preview adding capture time and
+// copyright of the original if enabled by privacy settings.
+func (s *server) servePreviewFile(w http.ResponseWriter, r *http.Request, id int64, filename string) {
+	// revalidate as previews change when the image is edited
+	w.Header().Set("Cache-Control", "no-cache")
+	p, err := s.db.ImagePrivacy(id)
+	if err != nil {
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "preview error", "err", err)
+		return
+	}
+	if !p.previewEXIF || p.video {
+		http.ServeFile(w, r, filename)
+		return
+	}
+	var segment []byte
+	if f, err := os.Open(filepath.Join(s.db.imagesDir, p.sha256sum[:3], p.sha256sum[3:])); err == nil {
+		if x, err := exif.Decode(f); err == nil {
+			var dateTime, copyright string
+			if t, err := x.DateTime(); err == nil {
+				dateTime = t.Format("2006:01:02 15:04:05")
+			}
+			if tag, err := x.Get(exif.Copyright); err == nil {
+				copyright, _ = tag.StringVal()
+			}
+			segment = previewEXIF(dateTime, copyright)
+		}
+		f.Close()
+	}
+	if segment == nil {
+		http.ServeFile(w, r, filename)
+		return
+	}
+	fi, err := os.Stat(filename)
+	if err != nil {
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "preview error", "err", err)
+		return
+	}
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "preview error", "err", err)
+		return
+	}
+	out := make([]byte, 0, len(data)+len(segment))
+	out = append(append(append(out, data[:2]...), segment...), data[2:]...)
+	http.ServeContent(w, r, "", fi.ModTime(), bytes.NewReader(out))
+}
+
+type privacyData struct {
+	Lang        string
+	StripEXIF   string
+	PreviewEXIF string
+	Admin       bool
+	Global      struct{ StripEXIF, PreviewEXIF bool }
+	Message     string
+	Saved       bool
+}
+
+// ServePrivacy shows and saves privacy settings of the user (and
+// server defaults for admins).
+func (s *server) ServePrivacy(w http.ResponseWriter, r *http.Request) {
+	session, err := s.SessionData(r)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Session error"))
+		return
+	}
+	d := privacyData{Lang: s.lang, Admin: session.Admin}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		status = s.savePrivacy(r, &d, session)
+	}
+	err = s.db.db.QueryRow("SELECT "+privacySQL("strip_exif")+", "+privacySQL("preview_exif")+" FROM users WHERE uid=?", session.Uid).Scan(&d.StripEXIF, &d.PreviewEXIF)
+	if err == nil {
+		err = s.db.db.QueryRow(`
+SELECT COALESCE((SELECT CAST(value AS INTEGER) FROM mpa WHERE key='strip_exif'), 1),
+COALESCE((SELECT CAST(value AS INTEGER) FROM mpa WHERE key='preview_exif'), 0)`).Scan(&d.Global.StripEXIF, &d.Global.PreviewEXIF)
+	}
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	s.executeTemplate(w, "privacy.html", &d, status)
+}
+
+func (s *server) savePrivacy(r *http.Request, d *privacyData, session SessionData) int {
+	if err := r.ParseForm(); err != nil {
+		logWarn(r, "Error parsing form", "err", err)
+		d.Message = s.tr("Error parsing form")
+		return http.StatusBadRequest
+	}
+	strip, ok1 := privacyValue(r.PostForm.Get("strip_exif"))
+	preview, ok2 := privacyValue(r.PostForm.Get("preview_exif"))
+	if !ok1 || !ok2 {
+		d.Message = s.tr("Error parsing form")
+		return http.StatusBadRequest
+	}
+	tx, err := s.db.db.Begin()
+	if err != nil {
+		logError(r, "save privacy error", "err", err)
+		d.Message = s.tr("Internal server error")
+		return http.StatusInternalServerError
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec("UPDATE users SET strip_exif=?, preview_exif=? WHERE uid=?", strip, preview, session.Uid)
+	if err == nil && session.Admin {
+		for _, key := range []string{"strip_exif", "preview_exif"} {
+			value := "0"
+			if r.PostForm.Get("global_"+key) != "" {
+				value = "1"
+			}
+			if _, err = tx.Exec("UPDATE mpa SET value=? WHERE key=?", value, key); err != nil {
+				break
+			}
+		}
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		logError(r, "save privacy error", "err", err)
+		d.Message = s.tr("Internal server error")
+		return http.StatusInternalServerError
+	}
+	d.Saved = true
+	details := fmt.Sprintf("strip_exif=%s, preview_exif=%s", r.PostForm.Get("strip_exif"), r.PostForm.Get("preview_exif"))
+	if session.Admin {
+		details += fmt.Sprintf(", global strip_exif=%t, preview_exif=%t", r.PostForm.Get("global_strip_exif") != "", r.PostForm.Get("global_preview_exif") != "")
+	}
+	s.auditAs(r, session.Uid, session.Login, auditPrivacyChange, auditTarget{User: session.Uid}, details)
+	return http.StatusOK
+}
@@ -0,0 +1,440 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Resumable uploads follow the core of the tus protocol: the client
+// creates an upload with POST /api/upload (sending JSON with name,
+// size and optionally sha256 of the file), sends consecutive chunks
+// with PATCH /api/upload/ID (with Upload-Offset header equal to the
+// number of bytes already received) and after a dropped connection
+// asks for the offset to resume from with HEAD /api/upload/ID.
+// The server computes sha256 of the completed upload (and rejects it
+// if it differs from the one sent). Completed uploads are attached to
+// an album by listing their IDs in the uploads field of the metadata
+// sent to /api/new/album or /api/edit/album/ID instead of including
+// the files in the form.
+
+// resumableUploads tracks uploads which are currently receiving a
+// chunk so concurrent PATCH requests do not corrupt the file.
+type resumableUploads struct {
+	mu   sync.Mutex
+	busy map[string]bool
+
+	maxChunkSize int64
+	// expiry is the time after the last received chunk after which
+	// unfinished (or never attached) uploads are removed.
+	expiry time.Duration
+}
+
+func (u *resumableUploads) lock(id string) bool {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.busy[id] {
+		return false
+	}
+	u.busy[id] = true
+	return true
+}
+
+func (u *resumableUploads) unlock(id string) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.busy, id)
+}
+
+var ErrUploadIncomplete = errors.New("upload not found or incomplete")
+
+type resumableUpload struct {
+	id             string
+	ownerID        int64
+	fileName       string
+	size           int64
+	received       int64
+	expectedSHA256 string // sent by the client, empty if not sent
+	sha256sum      string // computed on completion, empty until then
+}
+
+func (db *DB) resumableFileName(id string) string {
+	return filepath.Join(db.resumableDir, id)
+}
+
+func (db *DB) ResumableUpload(uid int64, id string) (u resumableUpload, err error) {
+	err = db.db.QueryRow("SELECT id, owner_id, file_name, size, received, expected_sha256, sha256sum FROM uploads WHERE id=? AND owner_id=?", id, uid).Scan(
+		&u.id, &u.ownerID, &u.fileName, &u.size, &u.received, &u.expectedSHA256, &u.sha256sum)
+	return
+}
+
+func (db *DB) RemoveResumableUpload(id string) error {
+	if _, err := db.db.Exec("DELETE FROM uploads WHERE id=?", id); err != nil {
+		return err
+	}
+	if err := os.Remove(db.resumableFileName(id)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// ExpireResumableUploads removes uploads not modified for the expiry
+// duration.
+func (db *DB) ExpireResumableUploads(expiry time.Duration) error {
+	rows, err := db.db.Query("SELECT id FROM uploads WHERE modified < ?", time.Now().Add(-expiry).Unix())
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if err := db.RemoveResumableUpload(id); err != nil {
+			return err
+		}
+	}
+	if len(ids) > 0 {
+		logInfo(nil, "removed expired uploads", "count", len(ids))
+	}
+	return nil
+}
+
+func (s *server) expireUploads() {
+	for {
+		if err := s.db.ExpireResumableUploads(s.uploads.expiry); err != nil {
+			logError(nil, "expiring uploads error", "err", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+func (s *server) ServeAPIUpload(w http.ResponseWriter, r *http.Request) {
+	session, err := s.SessionData(r)
+	if err != nil {
+		logError(r, "session error", "err", err)
+		http.Error(w, s.tr("Authorization error"), http.StatusForbidden)
+		return
+	}
+	w.Header().Set("Tus-Resumable", "1.0.0")
+	if r.URL.Path == "/api/upload" {
+		if r.Method != "POST" {
+			http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+			return
+		}
+		s.createUpload(w, r, session.Uid)
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/api/upload/")
+	u, err := s.db.ResumableUpload(session.Uid, id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, s.tr("Upload not found"), http.StatusNotFound)
+			return
+		}
+		logError(r, "upload error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	switch r.Method {
+	case "HEAD", "GET":
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.received, 10))
+		w.Header().Set("Upload-Length", strconv.FormatInt(u.size, 10))
+		w.WriteHeader(http.StatusOK)
+	case "PATCH":
+		s.receiveChunk(w, r, u)
+	case "DELETE":
+		if !s.uploads.lock(u.id) {
+			http.Error(w, s.tr("Upload in progress"), http.StatusConflict)
+			return
+		}
+		defer s.uploads.unlock(u.id)
+		if err := s.db.RemoveResumableUpload(u.id); err != nil {
+			logError(r, "upload error", "err", err)
+			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, s.tr("Method not allowed"), http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *server) createUpload(w http.ResponseWriter, r *http.Request, uid int64) {
+	var req struct {
+		Name   string
+		Size   int64
+		SHA256 string
+	}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 4096)).Decode(&req); err != nil {
+		logWarn(r, "Error parsing metadata", "err", err)
+		http.Error(w, s.tr("Error parsing metadata"), http.StatusBadRequest)
+		return
+	}
+	req.SHA256 = strings.ToLower(req.SHA256)
+	if req.Size <= 0 || (req.SHA256 != "" && !validSHA256(req.SHA256)) {
+		http.Error(w, s.tr("Error parsing metadata"), http.StatusBadRequest)
+		return
+	}
+	limits, err := s.db.StorageLimits(uid)
+	if err != nil {
+		logError(r, "create upload error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	if limits.maxFileSize > 0 && req.Size > limits.maxFileSize {
+		http.Error(w, fmt.Sprintf(s.tr("File too large (maximum %s)"), formatFileSize(limits.maxFileSize)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if req.SHA256 != "" {
+		if !s.checkQuota(w, r, uid, map[string]int64{req.SHA256: req.Size}, 0) {
+			return
+		}
+	} else if !s.checkQuota(w, r, uid, nil, req.Size) {
+		return
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		logError(r, "create upload error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	id := hex.EncodeToString(b)
+	f, err := os.Create(s.db.resumableFileName(id))
+	if err == nil {
+		err = f.Close()
+	}
+	if err == nil {
+		_, err = s.db.db.Exec("INSERT INTO uploads (id, owner_id, file_name, size, received, expected_sha256, sha256sum, modified) VALUES (?, ?, ?, ?, 0, ?, '', ?)",
+			id, uid, req.Name, req.Size, req.SHA256, time.Now().Unix())
+	}
+	if err != nil {
+		logError(r, "create upload error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/api/upload/"+id)
+	w.Header().Set("Upload-Offset", "0")
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Id     string `json:"id"`
+		Offset int64  `json:"offset"`
+	}{id, 0})
+}
+
+func validSHA256(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
+
+// receiveChunk appends the request body to the upload. Bytes received
+// before the connection dropped are kept so the client can resume
+// from the offset reported by HEAD.
+func (s *server) receiveChunk(w http.ResponseWriter, r *http.Request, u resumableUpload) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, s.tr("Missing or invalid Upload-Offset header"), http.StatusBadRequest)
+		return
+	}
+	if !s.uploads.lock(u.id) {
+		http.Error(w, s.tr("Upload in progress"), http.StatusConflict)
+		return
+	}
+	defer s.uploads.unlock(u.id)
+	// re-read after locking as a concurrent request might have finished
+	if u, err = s.db.ResumableUpload(u.ownerID, u.id); err != nil {
+		http.Error(w, s.tr("Upload not found"), http.StatusNotFound)
+		return
+	}
+	if offset != u.received {
+		w.Header().Set("Upload-Offset", strconv.FormatInt(u.received, 10))
+		http.Error(w, s.tr("Upload offset does not match"), http.StatusConflict)
+		return
+	}
+	f, err := os.OpenFile(s.db.resumableFileName(u.id), os.O_WRONLY, 0)
+	if err != nil {
+		logError(r, "upload chunk error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Seek(u.received, io.SeekStart); err != nil {
+		logError(r, "upload chunk error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	limit := u.size - u.received
+	if limit > s.uploads.maxChunkSize {
+		limit = s.uploads.maxChunkSize
+	}
+	n, copyErr := io.Copy(f, io.LimitReader(r.Body, limit))
+	if err := f.Close(); err != nil {
+		logError(r, "upload chunk error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	u.received += n
+	completed := 0
+	if u.received == u.size {
+		completed = 1
+	}
+	s.metrics.upload(n, completed)
+	if _, err := s.db.db.Exec("UPDATE uploads SET received=?, modified=? WHERE id=?", u.received, time.Now().Unix(), u.id); err != nil {
+		logError(r, "upload chunk error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	if copyErr != nil && u.received < u.size {
+		logWarn(r, "upload interrupted", "upload", u.id, "received", u.received, "size", u.size, "err", copyErr)
+		return
+	}
+	if u.received == u.size && u.sha256sum == "" {
+		if err := s.verifyUpload(&u); err == ErrChecksumMismatch {
+			logWarn(r, "Checksum of the uploaded file does not match", "upload", u.id)
+			http.Error(w, s.tr("Checksum of the uploaded file does not match"), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			logError(r, "upload chunk error", "err", err)
+			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Upload-Offset", strconv.FormatInt(u.received, 10))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var ErrChecksumMismatch = errors.New("checksum of the uploaded file does not match")
+
+// verifyUpload computes the checksum of the completed upload (which
+// must be locked) and stores it. If it differs from the checksum sent
+// by the client the upload is removed and ErrChecksumMismatch is
+// returned. Only verified uploads may be attached so the checksum is
+// computed again (on the next chunk or when attaching) if this fails.
+func (s *server) verifyUpload(u *resumableUpload) error {
+	sum, err := fileSha256(s.db.resumableFileName(u.id))
+	if err != nil {
+		return err
+	}
+	if u.expectedSHA256 != "" && sum != u.expectedSHA256 {
+		if err := s.db.RemoveResumableUpload(u.id); err != nil {
+			return err
+		}
+		return ErrChecksumMismatch
+	}
+	if _, err := s.db.db.Exec("UPDATE uploads SET sha256sum=? WHERE id=?", sum, u.id); err != nil {
+		return err
+	}
+	u.sha256sum = sum
+	return nil
+}
+
+func fileSha256(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// attachUploads adds completed resumable uploads referenced in the
+// metadata to the uploaded files. The files are linked into tempDir so
+// that the uploads are kept (and may be attached again) until
+// consumeUploads is called after the album is saved.
+func (s *server) attachUploads(d *uploadData, uid int64, tempDir string) {
+	for idx, id := range d.meta.Uploads {
+		d.imgCnt++
+		filename := filepath.Join(tempDir, strconv.Itoa(len(d.files))+"u")
+		u, err := s.linkUpload(uid, id, filename)
+		if err != nil {
+			msg := s.tr("Internal server error")
+			switch err {
+			case ErrUploadIncomplete:
+				msg = s.tr("Upload not found or incomplete")
+			case ErrUploadBusy:
+				msg = s.tr("Upload in progress")
+			case ErrChecksumMismatch:
+				msg = s.tr("Checksum of the uploaded file does not match")
+			}
+			d.errs = append(d.errs, imageError{err, u.fileName, msg})
+			d.m[idx] = &uploadInfo{}
+			continue
+		}
+		d.uploads = append(d.uploads, id)
+		s.addUploadedFile(d, idx, "upload:"+id, u.fileName, filename, u.sha256sum)
+	}
+}
+
+var ErrUploadBusy = errors.New("upload in progress")
+
+// linkUpload makes the completed (and verified) upload of the user
+// available as filename.
+func (s *server) linkUpload(uid int64, id, filename string) (resumableUpload, error) {
+	if !s.uploads.lock(id) {
+		return resumableUpload{}, ErrUploadBusy
+	}
+	defer s.uploads.unlock(id)
+	u, err := s.db.ResumableUpload(uid, id)
+	if err == sql.ErrNoRows || (err == nil && u.received != u.size) {
+		return u, ErrUploadIncomplete
+	} else if err != nil {
+		return u, err
+	}
+	if u.sha256sum == "" {
+		if err := s.verifyUpload(&u); err != nil {
+			return u, err
+		}
+	}
+	if err := os.Link(s.db.resumableFileName(id), filename); err != nil {
+		return u, err
+	}
+	return u, nil
+}
+
+// consumeUploads removes resumable uploads attached to the album which
+// has been saved.
+func (s *server) consumeUploads(r *http.Request, d *uploadData) {
+	for _, id := range d.uploads {
+		if !s.uploads.lock(id) {
+			continue
+		}
+		if err := s.db.RemoveResumableUpload(id); err != nil {
+			logError(r, "removing attached upload failed", "upload", id, "err", err)
+		}
+		s.uploads.unlock(id)
+	}
+}
@@ -0,0 +1,95 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// addTestUpload adds the upload of user uid with the given content of
+// which received bytes have been received.
+func addTestUpload(t *testing.T, db *DB, uid int64, id string, data []byte, received int, expected string) {
+	t.Helper()
+	if _, err := db.db.Exec("INSERT INTO uploads (id, owner_id, file_name, size, received, expected_sha256, sha256sum, modified) VALUES (?, ?, ?, ?, ?, ?, '', ?)",
+		id, uid, id+".jpg", len(data), received, expected, time.Now().Unix()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(db.resumableFileName(id), data[:received], 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLinkUpload(t *testing.T) {
+	db := initTestDB(t)
+	s := &server{db: db, uploads: &resumableUploads{busy: make(map[string]bool)}}
+	data := []byte("image data")
+	h := sha256.Sum256(data)
+	sum := hex.EncodeToString(h[:])
+	addTestUpload(t, db, 1, "done", data, len(data), sum)
+	addTestUpload(t, db, 1, "unverified", data, len(data), "")
+	addTestUpload(t, db, 1, "partial", data, 5, "")
+	addTestUpload(t, db, 1, "corrupted", data, len(data), testSum('0'))
+	dir := t.TempDir()
+
+	tests := []struct {
+		uid int64
+		id  string
+		err error
+	}{
+		{1, "done", nil},
+		{1, "unverified", nil},
+		{1, "partial", ErrUploadIncomplete},
+		{1, "missing", ErrUploadIncomplete},
+		{2, "done", ErrUploadIncomplete}, // uploads of other users are not found
+		{1, "corrupted", ErrChecksumMismatch},
+	}
+	for i, tt := range tests {
+		filename := filepath.Join(dir, tt.id+string(rune('a'+i)))
+		u, err := s.linkUpload(tt.uid, tt.id, filename)
+		if err != tt.err {
+			t.Errorf("linkUpload(%d, %q) returned error %v, want %v", tt.uid, tt.id, err, tt.err)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+		if u.sha256sum != sum {
+			t.Errorf("linkUpload(%d, %q) returned checksum %q, want %q", tt.uid, tt.id, u.sha256sum, sum)
+		}
+		if b, err := ioutil.ReadFile(filename); err != nil || string(b) != string(data) {
+			t.Errorf("linked file of upload %q contains %q (%v)", tt.id, b, err)
+		}
+	}
+	if _, err := db.ResumableUpload(1, "corrupted"); err == nil {
+		t.Error("upload with checksum mismatch not removed")
+	}
+
+	// attached uploads are kept until the album is saved
+	s.uploads.lock("unverified")
+	if _, err := s.linkUpload(1, "unverified", filepath.Join(dir, "busy")); err != ErrUploadBusy {
+		t.Errorf("linking locked upload returned error %v, want %v", err, ErrUploadBusy)
+	}
+	s.uploads.unlock("unverified")
+	for _, id := range []string{"done", "unverified"} {
+		if _, err := db.ResumableUpload(1, id); err != nil {
+			t.Errorf("upload %q removed before the album is saved: %v", id, err)
+		}
+	}
+	s.consumeUploads(nil, &uploadData{uploads: []string{"done", "unverified"}})
+	for _, id := range []string{"done", "unverified"} {
+		if _, err := db.ResumableUpload(1, id); err == nil {
+			t.Errorf("upload %q not removed after the album is saved", id)
+		}
+		if _, err := os.Stat(db.resumableFileName(id)); !os.IsNotExist(err) {
+			t.Errorf("file of upload %q not removed (%v)", id, err)
+		}
+	}
+}
@@ -107,6 +107,14 @@ func (s *Sessions) Remove(v string) {
 	delete(s.m, v)
 }
 
+// Count returns the number of active sessions.
+func (s *Sessions) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.expire()
+	return len(s.m)
+}
+
 // expire removes expired sessions. The map with with sessions is only
 // iterated if some session is already expired. Caller should lock the
 // mutex before calling expire.
@@ -6,6 +6,8 @@ function setupViewMode(params) {
 	var p = params;
 	var nav = document.getElementById("nav");
 	var text = document.getElementById("text");
+	var video = document.getElementById("video");
+	var star = document.getElementById("star");
 	var body = document.body;
 	var n = parseInt(window.location.hash.substr(1));
 	for (var i = 0; i < p.images.length; i++) {
@@ -14,8 +16,23 @@ function setupViewMode(params) {
 			break;
 		}
 	}
+	var comments = setupComments(p.comments, function() { return ["image", p.images[p.idx]]; });
 	function updateNav() {
 		text.firstChild.nodeValue = "" + (p.idx + 1) + " / " + p.images.length;
+		updateStar();
+		comments.reload();
+	}
+	function updateStar() {
+		star.firstChild.nodeValue = p.favourites[p.idx] ? "\u2605" : "\u2606";
+	}
+	// nextIdx returns the index of the image shown after the one of the
+	// given index in the slide show (favourite one if p.onlyFavourites).
+	function nextIdx(idx) {
+		idx++;
+		while (p.onlyFavourites && idx < p.images.length && !p.favourites[idx]) {
+			idx++;
+		}
+		return idx;
 	}
 	var next = new Image();
 	function handleError(idx) {
@@ -33,6 +50,12 @@ function setupViewMode(params) {
 		if (idx < 0 || idx >= p.images.length) {
 			return;
 		}
+		video.pause();
+		if (p.videos != null && p.videos[idx]) {
+			showVideo(idx, slideShow);
+			return;
+		}
+		video.className = "hidden";
 		var src = "/image/" + p.images[idx];
 		next.onerror = function() { handleError(idx); };
 		next.onload = function() {
@@ -42,23 +65,55 @@ function setupViewMode(params) {
 			body.style.backgroundImage = "url(" + src + ")";
 			updateNav();
 			if (slideShow) {
-				timeout = setTimeout(showImage, 3000, idx + 1, true);
+				timeout = setTimeout(showImage, 3000, nextIdx(idx), true);
 			}
 		};
 		next.src = src;
 	}
+	function showVideo(idx, slideShow) {
+		p.idx = idx;
+		body.style.backgroundImage = "none";
+		video.poster = "/image/" + p.images[idx];
+		video.src = "/video/" + p.images[idx];
+		video.className = "";
+		video.onended = slideShow ? function() { showImage(nextIdx(idx), true); } : null;
+		updateNav();
+		if (slideShow) {
+			video.play();
+		}
+	}
 	showImage(p.idx);
 	document.onkeydown = function(e) {
+		if (e.target.tagName == "TEXTAREA") {
+			return;
+		}
 		if (e.keyCode == 32) {
 			showImage(p.idx + 1, false);
 		} else if (e.keyCode == 8) {
 			showImage(p.idx - 1, false);
 		}
 	};
-	p.slideShow = function () {
+	p.toggleComments = comments.toggle;
+	p.toggleFavourite = function() {
+		var idx = p.idx;
+		var d = new FormData();
+		d.append("favourite", !p.favourites[idx]);
+		var r = new XMLHttpRequest();
+		r.open("POST", "/api/favourite/" + p.images[idx]);
+		setupHTTPEventListeners(r, p.connectionError, p.toggleFavourite, function(status) {
+			if (status == 200) {
+				p.favourites[idx] = JSON.parse(r.response).favourite;
+				updateStar();
+			}
+		});
+		r.send(d);
+	};
+	p.slideShow = function (onlyFavourites) {
 		nav.className = "hidden";
+		comments.hide();
 		hidden = true;
-		timeout = setTimeout(showImage, 3000, p.idx + 1, true);
+		p.onlyFavourites = onlyFavourites;
+		timeout = setTimeout(showImage, 3000, nextIdx(p.idx), true);
 	};
  	var hidden = true;
 	body.addEventListener("click", function(event) {
@@ -90,6 +145,131 @@ function setupViewMode(params) {
 	}, false);
 }
 
+// setupComments sets up the comment thread (element with ID comments)
+// on the item returned by target as [parameter name, ID] (such as
+// ["image", 5]). Messages m are translated by the template.
+function setupComments(m, target) {
+	var panel = document.getElementById("comments");
+	var list = document.getElementById("commentList");
+	var text = document.getElementById("commentText");
+	function request(method, url, data, done) {
+		var r = new XMLHttpRequest();
+		r.open(method, url);
+		setupHTTPEventListeners(r, m.connectionError, function() { request(method, url, data, done); }, function(status) {
+			if (status >= 200 && status < 300) {
+				done(r);
+			}
+		});
+		r.send(data);
+	}
+	function element(tag, className, value) {
+		var e = document.createElement(tag);
+		e.className = className;
+		if (value != null) {
+			e.appendChild(document.createTextNode(value));
+		}
+		return e;
+	}
+	function button(label, action) {
+		var b = element("button", "pseudo", label);
+		b.type = "button";
+		b.setAttribute("data-action", action);
+		return b;
+	}
+	function formatTime(s) {
+		var t = new Date(s);
+		var pad = function(n) { return (n < 10 ? "0" : "") + n; };
+		return t.getFullYear() + "-" + pad(t.getMonth() + 1) + "-" + pad(t.getDate()) + " " + pad(t.getHours()) + ":" + pad(t.getMinutes());
+	}
+	// render shows comments using text nodes only so that their text
+	// is never interpreted as HTML.
+	function render(comments) {
+		while (list.firstChild) {
+			list.removeChild(list.firstChild);
+		}
+		if (comments.length == 0) {
+			list.appendChild(element("p", "comment-empty", m.noComments));
+		}
+		for (var i = 0; i < comments.length; i++) {
+			var c = comments[i];
+			var div = element("div", "comment");
+			div.setAttribute("data-id", c.id);
+			var header = element("div", "comment-header");
+			header.appendChild(element("strong", "", c.author));
+			header.appendChild(element("small", "", formatTime(c.created) + (c.edited ? " (" + m.edited + ")" : "")));
+			div.appendChild(header);
+			div.appendChild(element("p", "comment-text", c.text));
+			if (c.can_edit) {
+				div.appendChild(button(m.edit, "edit"));
+			}
+			if (c.can_delete) {
+				div.appendChild(button(m.del, "delete"));
+			}
+			list.appendChild(div);
+		}
+	}
+	function reload() {
+		if (panel.classList.contains("hidden")) {
+			return;
+		}
+		var t = target();
+		request("GET", "/api/comments?" + t[0] + "=" + t[1], null, function(r) { render(JSON.parse(r.response).comments); });
+	}
+	document.getElementById("commentForm").onsubmit = function() {
+		var t = target();
+		var d = new FormData();
+		d.append(t[0], t[1]);
+		d.append("text", text.value);
+		request("POST", "/api/new/comment", d, function() {
+			text.value = "";
+			reload();
+		});
+		return false;
+	};
+	list.addEventListener("click", function(e) {
+		var action = e.target.getAttribute("data-action");
+		if (action == null) {
+			return;
+		}
+		var div = e.target.parentNode;
+		var id = div.getAttribute("data-id");
+		if (action == "delete") {
+			if (confirm(m.confirmDelete)) {
+				request("POST", "/api/delete/comment/" + id, new FormData(), reload);
+			}
+		} else if (action == "edit") {
+			var p = div.getElementsByClassName("comment-text")[0];
+			var area = element("textarea", "comment-edit");
+			area.value = p.textContent;
+			area.maxLength = text.maxLength;
+			var header = div.getElementsByClassName("comment-header")[0];
+			while (div.lastChild != header) {
+				div.removeChild(div.lastChild);
+			}
+			div.appendChild(area);
+			div.appendChild(button(m.save, "save"));
+			div.appendChild(button(m.cancel, "cancel"));
+			area.focus();
+		} else if (action == "save") {
+			var d = new FormData();
+			d.append("text", div.getElementsByClassName("comment-edit")[0].value);
+			request("POST", "/api/edit/comment/" + id, d, reload);
+		} else if (action == "cancel") {
+			reload();
+		}
+	});
+	return {
+		reload: reload,
+		toggle: function() {
+			panel.classList.toggle("hidden");
+			reload();
+		},
+		hide: function() {
+			panel.classList.add("hidden");
+		}
+	};
+}
+
 function progress() {
 	var prog = document.getElementById('progress');
 	var percent = document.getElementById('percent');
@@ -130,47 +310,261 @@ function setupHTTPEventListeners(r, connectionError, callback, onResponse) {
 		}
 	};
 	r.onload = function() {
-		if (r.status == 200) {
-		} else if (r.status == 401) {
-			var login = document.getElementById("login");
-			login.onkeydown = function(e) {
-				if (e.keyCode == 13) {
-					document.getElementById("modal_login").checked = false;
-					loginOnClick(function() { callback(); });
-					return false;
-				} else if (e.keyCode == 27) {
-					document.getElementById("modal_login").checked = false;
-				}
-			};
-			login.innerHTML = r.response;
-			document.getElementById("modal_login").checked = true;
-			document.getElementById("login_submit").onclick = function() { loginOnClick(function() { callback(); }); };
-		} else {
-			showError(r.response);
-		}
+		handleHTTPResponse(r, callback);
 		if (onResponse != null) {
 			onResponse(r.status);
 		}
 	};
 }
 
-function setupEditAlbum(submitURL, origName, imgs, clickMsg, noSubmitMsg, connectionError) {
+// handleHTTPResponse shows the login modal (retrying with callback
+// after login) or an error message for unsuccessful responses.
+function handleHTTPResponse(r, callback) {
+	if (r.status >= 200 && r.status < 300) {
+	} else if (r.status == 401) {
+		var login = document.getElementById("login");
+		login.onkeydown = function(e) {
+			if (e.keyCode == 13) {
+				document.getElementById("modal_login").checked = false;
+				loginOnClick(function() { callback(); });
+				return false;
+			} else if (e.keyCode == 27) {
+				document.getElementById("modal_login").checked = false;
+			}
+		};
+		login.innerHTML = r.response;
+		document.getElementById("modal_login").checked = true;
+		document.getElementById("login_submit").onclick = function() { loginOnClick(function() { callback(); }); };
+	} else {
+		showError(r.response);
+	}
+}
+
+var chunkSize = 8 << 20;
+
+// maxHashSize is the size of the largest file for which sha256 is
+// computed in the browser (as the whole file is read into memory).
+var maxHashSize = 256 << 20;
+
+// knownFiles computes sha256 sums of files of items (if supported by
+// the browser) storing them in their sha256 fields and asks the server
+// which of them it already has. It calls done with an object whose
+// keys are the known sums (empty on errors).
+function knownFiles(items, done) {
+	if (!window.crypto || !window.crypto.subtle || !window.FileReader) {
+		done({});
+		return;
+	}
+	var idx = 0;
+	var check = function() {
+		var sums = [];
+		for (var i = 0; i < items.length; i++) {
+			if (items[i].sha256 != null) {
+				sums.push(items[i].sha256);
+			}
+		}
+		if (sums.length == 0) {
+			done({});
+			return;
+		}
+		var r = new XMLHttpRequest();
+		r.open("POST", "/api/check/files");
+		r.setRequestHeader("Content-Type", "application/json");
+		r.onerror = function() {
+			done({});
+		};
+		r.onload = function() {
+			var known = {};
+			if (r.status == 200) {
+				var k = JSON.parse(r.response).known;
+				for (var i = 0; i < k.length; i++) {
+					known[k[i]] = true;
+				}
+			}
+			done(known);
+		};
+		r.send(JSON.stringify({sha256: sums}));
+	};
+	var next = function() {
+		if (idx == items.length) {
+			check();
+			return;
+		}
+		var o = items[idx++];
+		if (o.sha256 != null || o.file.size > maxHashSize) {
+			next();
+			return;
+		}
+		var reader = new FileReader();
+		reader.onload = function() {
+			window.crypto.subtle.digest("SHA-256", reader.result).then(function(h) {
+				var b = new Uint8Array(h), hex = "";
+				for (var i = 0; i < b.length; i++) {
+					hex += (b[i] < 16 ? "0" : "") + b[i].toString(16);
+				}
+				o.sha256 = hex;
+				next();
+			}, next);
+		};
+		reader.onerror = next;
+		reader.readAsArrayBuffer(o.file);
+	};
+	next();
+}
+
+// resumableUpload uploads files of items (objects with file field) in
+// chunks to /api/upload storing upload IDs in their uploadID fields.
+// After a dropped connection it asks the server for the offset to
+// resume from. It calls done when all files are uploaded and failed
+// with the unsuccessful request (or null after too many connection
+// errors) otherwise.
+function resumableUpload(items, prog, done, failed) {
+	var total = 0, base = 0, idx = 0, retries = 0;
+	for (var i = 0; i < items.length; i++) {
+		total += items[i].file.size;
+	}
+	var request = function(method, url, headers, body, onOK) {
+		var r = new XMLHttpRequest();
+		r.open(method, url);
+		for (var h in headers) {
+			r.setRequestHeader(h, headers[h]);
+		}
+		r.onerror = function() {
+			if (++retries > 10) {
+				failed(null);
+				return;
+			}
+			setTimeout(step, 2000 * retries);
+		};
+		r.onload = function() {
+			var o = items[idx];
+			if (r.status >= 200 && r.status < 300) {
+				retries = 0;
+				onOK(r);
+			} else if ((r.status == 404 || r.status == 409) && o.uploadID != null && retries++ < 10) {
+				// expired (start again) or offset mismatch (resume)
+				if (r.status == 404) {
+					o.uploadID = null;
+				}
+				step();
+			} else {
+				failed(r);
+			}
+		};
+		if (body != null && body.size != null) {
+			r.upload.addEventListener("progress", function(e) {
+				prog.update(base + items[idx].offset + e.loaded, total);
+			});
+		}
+		r.send(body);
+	};
+	var send = function(o) {
+		if (o.offset == o.file.size) {
+			base += o.file.size;
+			idx++;
+			step();
+			return;
+		}
+		var end = Math.min(o.offset + chunkSize, o.file.size);
+		request("PATCH", "/api/upload/" + o.uploadID, {"Upload-Offset": o.offset, "Content-Type": "application/offset+octet-stream"},
+			o.file.slice(o.offset, end), function(r) {
+				o.offset = parseInt(r.getResponseHeader("Upload-Offset"));
+				send(o);
+			});
+	};
+	var step = function() {
+		if (idx == items.length) {
+			done();
+			return;
+		}
+		var o = items[idx];
+		if (o.uploadID == null) {
+			request("POST", "/api/upload", {"Content-Type": "application/json"},
+				JSON.stringify({name: o.file.name, size: o.file.size, sha256: o.sha256 || ""}), function(r) {
+					o.uploadID = JSON.parse(r.response).id;
+					o.offset = 0;
+					send(o);
+				});
+		} else {
+			request("HEAD", "/api/upload/" + o.uploadID, {}, null, function(r) {
+				o.offset = parseInt(r.getResponseHeader("Upload-Offset"));
+				send(o);
+			});
+		}
+	};
+	step();
+}
+
+function setupEditAlbum(submitURL, origName, imgs, clickMsg, noSubmitMsg, connectionError, cover) {
 	var images = document.getElementById("images");
 	var multi = document.getElementById("multi");
 	var modal1 = document.getElementById('modal_1');
 	var title = document.getElementById('title');
 	var upload = document.getElementById("upload");
+	var imageOrder = document.getElementById("imageOrder");
 	var prog = new progress();
+	this.cover = -1;
 	for (var i = 0; i < imgs.length; i++) {
 		imgs[i].origTitle = imgs[i].title;
+		if (imgs[i].id == cover) {
+			this.cover = i;
+		}
 	}
 	this.isEdit = imgs.length > 0;
 	this.origName = origName;
+	this.origCover = this.cover;
+	this.origOrder = imageOrder != null ? imageOrder.value : "";
+	this.reordered = false;
 	this.images = imgs;
 	this.deleted = [];
 	this.modalIdx = 0;
+	this.setCover = function() {
+		if (this.cover >= 0 && this.images[this.cover] != null) {
+			document.getElementById("img_"+this.cover).classList.remove("cover");
+		}
+		this.cover = this.modalIdx;
+		document.getElementById("img_"+this.cover).classList.add("cover");
+	};
+	var transform = document.getElementById("transform");
+	function readTransform() {
+		var t = {rotate: parseInt(document.getElementById("rotate").value),
+			 flipH: document.getElementById("flipH").checked,
+			 flipV: document.getElementById("flipV").checked,
+			 crop: [0, 0, 0, 0]};
+		var m = [];
+		for (var i = 0; i < 4; i++) {
+			m.push((parseFloat(document.getElementById("crop_" + i).value) || 0) / 100);
+		}
+		if (m[0] > 0 || m[1] > 0 || m[2] > 0 || m[3] > 0) {
+			t.crop = [m[0], m[1], 1 - m[2], 1 - m[3]];
+		}
+		return t;
+	}
+	function showTransform(t) {
+		document.getElementById("rotate").value = "" + t.rotate;
+		document.getElementById("flipH").checked = t.flipH;
+		document.getElementById("flipV").checked = t.flipV;
+		var cropped = t.crop[2] > 0;
+		var m = cropped ? [t.crop[0], t.crop[1], 1 - t.crop[2], 1 - t.crop[3]] : [0, 0, 0, 0];
+		for (var i = 0; i < 4; i++) {
+			document.getElementById("crop_" + i).value = Math.round(m[i] * 10000) / 100;
+		}
+	}
+	function sameTransform(a, b) {
+		return a.rotate == b.rotate && a.flipH == b.flipH && a.flipV == b.flipV &&
+			a.crop[0] == b.crop[0] && a.crop[1] == b.crop[1] && a.crop[2] == b.crop[2] && a.crop[3] == b.crop[3];
+	}
 	this.addTitle = function() {
 		var o = this.images[this.modalIdx];
+		if (transform != null && o.id != null && !o.video) {
+			o.transform = readTransform();
+			var div = document.getElementById("img_"+this.modalIdx);
+			if (sameTransform(o.transform, o.edit)) {
+				div.classList.remove("edited");
+			} else {
+				div.classList.add("edited");
+			}
+		}
 		var span = document.getElementById("title_"+this.modalIdx);
 		var old = o.title;
 		o.title = title.value;
@@ -198,6 +592,13 @@ function setupEditAlbum(submitURL, origName, imgs, clickMsg, noSubmitMsg, connec
 	this.edit = function(idx) {
 		this.modalIdx = idx;
 		title.value = this.images[idx].title;
+		if (transform != null) {
+			var o = this.images[idx];
+			transform.className = o.id != null && !o.video ? "" : "hidden";
+			if (o.id != null && !o.video) {
+				showTransform(o.transform || o.edit);
+			}
+		}
 		title.focus();
 		modal1.checked = true; 
 		return false;
@@ -211,10 +612,86 @@ function setupEditAlbum(submitURL, origName, imgs, clickMsg, noSubmitMsg, connec
 			modal1.checked = false;
 		}
 	};
+	var dragged = null;
+	this.setupDrag = function(div) {
+		div.addEventListener("dragstart", function(e) {
+			dragged = div;
+			e.dataTransfer.effectAllowed = "move";
+			e.dataTransfer.setData("text/plain", div.id);
+		});
+		div.addEventListener("dragover", function(e) {
+			if (dragged != null) {
+				e.preventDefault();
+			}
+		});
+		div.addEventListener("drop", function(e) {
+			e.preventDefault();
+			if (dragged == null || dragged == div) {
+				return;
+			}
+			var next = div;
+			for (var n = dragged; n != null; n = n.nextSibling) {
+				if (n == div) {
+					// moving forward so insert after the target
+					next = div.nextSibling;
+					break;
+				}
+			}
+			images.insertBefore(dragged, next);
+			dragged = null;
+			obj.reordered = true;
+			if (imageOrder != null) {
+				imageOrder.value = "manual";
+			}
+		});
+		div.addEventListener("dragend", function(e) {
+			dragged = null;
+		});
+	};
+	for (var i = 0; i < imgs.length; i++) {
+		this.setupDrag(document.getElementById("img_"+i));
+	}
 	this.submit = function() {
 		var meta = {name: document.getElementById("albumName").value, titles: {}, edit: {deleted: this.deleted, titles: {}}};
 		var d = new FormData();
+		var files = [];
 		var ok = this.deleted.length > 0 || (this.isEdit && meta.name != this.origName);
+		if (this.reordered) {
+			meta.edit.order = [];
+			for (var n = images.firstChild; n != null; n = n.nextSibling) {
+				if (n.id == null || n.id.substr(0, 4) != "img_") {
+					continue;
+				}
+				var o = this.images[parseInt(n.id.substr(4))];
+				if (o != null && o.id != null) {
+					meta.edit.order.push(o.id);
+				}
+			}
+			ok = true;
+		}
+		if (imageOrder != null && imageOrder.value != this.origOrder) {
+			meta.edit.sort = imageOrder.value;
+			ok = true;
+		}
+		if (this.cover != this.origCover && this.cover >= 0 && this.images[this.cover] != null) {
+			var c = this.images[this.cover];
+			if (c.id != null) {
+				meta.edit.cover = c.id;
+			} else {
+				meta.cover = "" + this.cover;
+			}
+			ok = true;
+		}
+		var details = {description: "description", dateFrom: "dateFrom", dateTo: "dateTo", collection: "collection",
+			       stripEXIF: "stripEXIF", previewEXIF: "previewEXIF"};
+		for (var k in details) {
+			var el = document.getElementById(details[k]);
+			// select elements have no defaultValue
+			if (el != null && el.value != (el.hasAttribute("data-orig") ? el.getAttribute("data-orig") : el.defaultValue)) {
+				meta.edit[k] = el.value;
+				ok = true;
+			}
+		}
 		for (var i = 0; i < this.images.length; i++) {
 			var o = this.images[i];
 			if (o == null) {
@@ -225,19 +702,67 @@ function setupEditAlbum(submitURL, origName, imgs, clickMsg, noSubmitMsg, connec
 					meta.edit.titles[o.id] = o.title;
 					ok = true;
 				}
+				if (o.transform != null && !sameTransform(o.transform, o.edit)) {
+					if (meta.edit.transforms == null) {
+						meta.edit.transforms = {};
+					}
+					meta.edit.transforms[o.id] = o.transform;
+					ok = true;
+				}
 			} else {
-				d.append("image:" + i, o.file);
+				files.push(i);
 				meta.titles[i] = o.title;
 				ok = true;
 			}
 		}
-		d.append("metadata", JSON.stringify(meta));
 		if (meta.name == "" || !ok) {
 			showError(noSubmitMsg);
 			return;
 		}
 		upload.disabled = true;
 		prog.show();
+		if (files.length == 0) {
+			this.postAlbum(d, meta);
+			return;
+		}
+		var items = [];
+		for (var i = 0; i < files.length; i++) {
+			items.push(this.images[files[i]]);
+		}
+		knownFiles(items, function(known) {
+			// files the server already has are attached without
+			// uploading, others are uploaded in chunks so that a
+			// dropped connection does not restart the whole upload
+			var toUpload = [], idxs = [];
+			meta.existing = {};
+			for (var i = 0; i < files.length; i++) {
+				var o = items[i];
+				if (o.sha256 != null && known[o.sha256]) {
+					meta.existing[files[i]] = {sha256: o.sha256, name: o.file.name};
+				} else {
+					toUpload.push(o);
+					idxs.push(files[i]);
+				}
+			}
+			resumableUpload(toUpload, prog, function() {
+				meta.uploads = {};
+				for (var i = 0; i < toUpload.length; i++) {
+					meta.uploads[idxs[i]] = toUpload[i].uploadID;
+				}
+				obj.postAlbum(d, meta);
+			}, function(r) {
+				if (r == null) {
+					showError(connectionError);
+				} else {
+					handleHTTPResponse(r, function() { obj.submit(); });
+				}
+				upload.disabled = false;
+				prog.hide();
+			});
+		});
+	};
+	this.postAlbum = function(d, meta) {
+		d.append("metadata", JSON.stringify(meta));
 		var r = new XMLHttpRequest();
 		r.open("POST", submitURL);
 		setupHTTPEventListeners(
@@ -259,6 +784,107 @@ function setupEditAlbum(submitURL, origName, imgs, clickMsg, noSubmitMsg, connec
 		});
 		r.send(d);
 	};
+	this.setupTransfer = function(transferURL, noSelectionMsg) {
+		var modal = document.getElementById("modal_transfer");
+		var target = document.getElementById("target");
+		var targetName = document.getElementById("targetName");
+		this.targetChanged = function() {
+			targetName.className = target.value == "0" ? "" : "hidden";
+		};
+		this.showTransfer = function() {
+			document.getElementById("bmenu").checked = false;
+			this.targetChanged();
+			modal.checked = true;
+		};
+		this.transfer = function() {
+			var ids = this.selected();
+			if (ids.length == 0) {
+				showError(noSelectionMsg);
+				return;
+			}
+			var d = new FormData();
+			for (var i = 0; i < ids.length; i++) {
+				d.append("image", ids[i]);
+			}
+			d.append("target", target.value);
+			d.append("name", targetName.value);
+			if (document.getElementById("copy").checked) {
+				d.append("copy", "on");
+			}
+			this.post(transferURL, d, function() { obj.transfer(); });
+		};
+	};
+	this.showModal = function(id) {
+		document.getElementById("bmenu").checked = false;
+		document.getElementById(id).checked = true;
+	};
+	this.post = function(url, d, retry) {
+		var r = new XMLHttpRequest();
+		r.open("POST", url);
+		setupHTTPEventListeners(
+			r, connectionError, retry,
+			function(status) {
+				if (status == 200) {
+					document.getElementById("result").innerHTML = r.response;
+					images.className = "hidden";
+				}
+			});
+		r.send(d);
+	};
+	this.selected = function() {
+		var ids = [];
+		for (var i = 0; i < this.images.length; i++) {
+			var o = this.images[i];
+			var sel = document.getElementById("sel_" + i);
+			if (o != null && o.id != null && sel != null && sel.checked) {
+				ids.push(o.id);
+			}
+		}
+		return ids;
+	};
+	this.setupMergeSplit = function(mergeURL, splitURL, noAlbumsMsg) {
+		this.merge = function() {
+			var d = new FormData();
+			var albums = document.getElementsByName("merge");
+			var n = 0;
+			for (var i = 0; i < albums.length; i++) {
+				if (albums[i].checked) {
+					d.append("album", albums[i].value);
+					n++;
+				}
+			}
+			if (n == 0) {
+				showError(noAlbumsMsg);
+				return;
+			}
+			d.append("name", document.getElementById("albumName").value);
+			var c = this.cover >= 0 ? this.images[this.cover] : null;
+			if (c != null && c.id != null) {
+				d.append("cover", c.id);
+			}
+			this.post(mergeURL, d, function() { obj.merge(); });
+		};
+		this.split = function() {
+			var d = new FormData();
+			if (document.getElementById("splitMode").value == "selected") {
+				var ids = this.selected();
+				for (var i = 0; i < ids.length; i++) {
+					d.append("image", ids[i]);
+				}
+			} else {
+				d.append("date", document.getElementById("splitDate").value);
+			}
+			d.append("name", document.getElementById("splitName").value);
+			this.post(splitURL, d, function() { obj.split(); });
+		};
+	};
+	this.setupDelete = function(deleteURL) {
+		this.deleteAlbum = function(cnt) {
+			var d = new FormData();
+			d.append("images", cnt);
+			this.post(deleteURL, d, function() { obj.deleteAlbum(cnt); });
+		};
+	};
 	this.addImage = function(file) {
 		var input = document.createElement("input");
 		input.setAttribute("title", clickMsg);
@@ -276,6 +902,12 @@ function setupEditAlbum(submitURL, origName, imgs, clickMsg, noSubmitMsg, connec
 		div.id = "img_" + idx;
 		div.appendChild(label);
 		div.appendChild(span);
+		if (file.type.substr(0, 6) == "video/") {
+			var play = document.createElement("span");
+			play.className = "play";
+			play.appendChild(document.createTextNode("\u25B6"));
+			label.appendChild(play);
+		}
 		if (URL.createObjectURL) {
 			label.style['background-image'] = 'url('+URL.createObjectURL(file)+')';
 		} else {
@@ -332,6 +964,37 @@ function loginOnClick(callback) {
 	return false;
 }
 
+function setupDuplicates(groups, best, confirmMsg, connectionError) {
+	this.remove = function(ids) {
+		if (!confirm(confirmMsg)) {
+			return;
+		}
+		var r = new XMLHttpRequest();
+		r.open("POST", "/api/duplicates");
+		r.setRequestHeader("Content-Type", "application/json");
+		setupHTTPEventListeners(
+			r, connectionError, function() { obj.remove(ids); },
+			function(status) {
+				if (status == 200) {
+					location.reload();
+				}
+			});
+		r.send(JSON.stringify({delete: ids}));
+	};
+	this.keep = function(g, id) {
+		var ids = [];
+		for (var i = 0; i < groups[g].length; i++) {
+			if (groups[g][i] != id) {
+				ids.push(groups[g][i]);
+			}
+		}
+		this.remove(ids);
+	};
+	this.keepBest = function(g) {
+		this.keep(g, best[g]);
+	};
+}
+
 function requestFullScreen() {
 	var d = document.documentElement;
 	if (d.mozRequestFullScreen && !document.mozFullScreenElement) {
@@ -0,0 +1,345 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Storage use of a user is the total size of distinct originals in
+// albums and the trash of the user. As files are stored once (by
+// sha256 sum) a file present in albums of several users is counted in
+// full for each of them: it is what they would use if they were alone
+// and it does not change when other users delete their copies.
+// Previews are not counted.
+//
+// Sizes of stored files are kept in the files table which is filled
+// lazily (see ensureFileSizes) so that all the ways in which images
+// are added to albums need not care about it.
+//
+// Limits are stored in the mpa table as default_quota and
+// max_file_size (in bytes, 0 meaning no limit) and in users.quota
+// (NULL meaning the server default, 0 meaning no limit).
+
+var ErrFileTooLarge = errors.New("file too large")
+
+// storageLimits are the limits effective for a user (0 meaning no
+// limit).
+type storageLimits struct {
+	quota       int64
+	maxFileSize int64
+}
+
+func (db *DB) StorageLimits(uid int64) (l storageLimits, err error) {
+	err = db.db.QueryRow(`
+SELECT COALESCE((SELECT quota FROM users WHERE uid=?), (SELECT CAST(value AS INTEGER) FROM mpa WHERE key='default_quota'), 0),
+COALESCE((SELECT CAST(value AS INTEGER) FROM mpa WHERE key='max_file_size'), 0)`, uid).Scan(&l.quota, &l.maxFileSize)
+	return
+}
+
+// ensureFileSizes records sizes of stored files missing from the
+// files table.
+func (db *DB) ensureFileSizes() error {
+	rows, err := db.db.Query("SELECT sha256sum FROM images UNION SELECT sha256sum FROM trash_images EXCEPT SELECT sha256sum FROM files")
+	if err != nil {
+		return err
+	}
+	var sums []string
+	for rows.Next() {
+		var sum string
+		if err := rows.Scan(&sum); err != nil {
+			rows.Close()
+			return err
+		}
+		sums = append(sums, sum)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, sum := range sums {
+		fi, err := os.Stat(filepath.Join(db.imagesDir, sum[:3], sum[3:]))
+		if err != nil {
+			if os.IsNotExist(err) {
+				continue // album being added, file not moved yet
+			}
+			return err
+		}
+		if _, err := db.db.Exec("INSERT OR REPLACE INTO files (sha256sum, size) VALUES (?, ?)", sum, fi.Size()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// StorageUsage returns storage use of users by their uid.
+func (db *DB) StorageUsage() (map[int64]int64, error) {
+	if err := db.ensureFileSizes(); err != nil {
+		return nil, err
+	}
+	rows, err := db.db.Query(`
+SELECT owner_id, SUM(size) FROM
+(SELECT albums.owner_id, images.sha256sum FROM images JOIN albums ON images.album_id=albums.aid
+UNION SELECT owner_id, sha256sum FROM trash_images)
+JOIN files USING (sha256sum) GROUP BY owner_id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	m := make(map[int64]int64)
+	for rows.Next() {
+		var uid, size int64
+		if err := rows.Scan(&uid, &size); err != nil {
+			return nil, err
+		}
+		m[uid] = size
+	}
+	return m, rows.Err()
+}
+
+func (db *DB) UserStorageUsage(uid int64) (size int64, err error) {
+	if err := db.ensureFileSizes(); err != nil {
+		return 0, err
+	}
+	err = db.db.QueryRow(`
+SELECT COALESCE(SUM(size), 0) FROM
+(SELECT images.sha256sum FROM images JOIN albums ON images.album_id=albums.aid WHERE albums.owner_id=?
+UNION SELECT sha256sum FROM trash_images WHERE owner_id=?)
+JOIN files USING (sha256sum)`, uid, uid).Scan(&size)
+	return
+}
+
+// TotalStorageUsage returns the total size of stored originals.
+func (db *DB) TotalStorageUsage() (size int64, err error) {
+	err = db.db.QueryRow("SELECT COALESCE(SUM(size), 0) FROM files WHERE sha256sum IN (SELECT sha256sum FROM images UNION SELECT sha256sum FROM trash_images)").Scan(&size)
+	return
+}
+
+// checkQuota reports an error (and returns false) if storing new files
+// with the given sizes (by sha256 sum) and unknown bytes of files whose
+// sums are not known yet would exceed the quota of the user.
+func (s *server) checkQuota(w http.ResponseWriter, r *http.Request, uid int64, sizes map[string]int64, unknown int64) bool {
+	limits, err := s.db.StorageLimits(uid)
+	if err == nil && limits.quota == 0 {
+		return true
+	}
+	var used int64
+	if err == nil {
+		used, err = s.db.UserStorageUsage(uid)
+	}
+	added := unknown
+	for sum, size := range sizes {
+		if err != nil {
+			break
+		}
+		var owned bool
+		if owned, err = s.db.OwnsFile(uid, sum); !owned {
+			added += size
+		}
+	}
+	if err != nil {
+		logError(r, "quota error", "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return false
+	}
+	if added > 0 && used+added > limits.quota {
+		http.Error(w, fmt.Sprintf(s.tr("Storage quota exceeded: %s used of %s, the upload needs %s more."),
+			formatFileSize(used), formatFileSize(limits.quota), formatFileSize(added)), http.StatusRequestEntityTooLarge)
+		return false
+	}
+	return true
+}
+
+// storageInfo describes storage use for templates.
+type storageInfo struct {
+	Used    string
+	Quota   string // "" if no limit
+	Percent int64
+}
+
+func newStorageInfo(used, quota int64) storageInfo {
+	si := storageInfo{Used: formatFileSize(used)}
+	if quota > 0 {
+		si.Quota = formatFileSize(quota)
+		si.Percent = 100 * used / quota
+	}
+	return si
+}
+
+type storageUser struct {
+	Uid     int64
+	Login   string
+	Name    string
+	Surname string
+	Used    string
+	Quota   string // in MiB, "" for the server default
+	Percent int64  // of the effective quota, -1 if no limit
+}
+
+type adminData struct {
+	Lang         string
+	Users        []storageUser
+	Total        string
+	DefaultQuota string // in MiB, "0" for no limit
+	MaxFileSize  string // in MiB, "0" for no limit
+	Retention    int64  // of the trash in days, 0 for no limit
+	Message      string
+	Saved        bool
+}
+
+// ServeAdmin serves the admin console listing users with their
+// storage use and saves storage limits and trash retention.
+func (s *server) ServeAdmin(w http.ResponseWriter, r *http.Request) {
+	d := adminData{Lang: s.lang}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		status = s.saveAdminSettings(r, &d)
+	}
+	usage, err := s.db.StorageUsage()
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	var total, defaultQuota, maxFileSize int64
+	err = s.db.db.QueryRow(`
+SELECT COALESCE((SELECT CAST(value AS INTEGER) FROM mpa WHERE key='default_quota'), 0),
+COALESCE((SELECT CAST(value AS INTEGER) FROM mpa WHERE key='max_file_size'), 0)`).Scan(&defaultQuota, &maxFileSize)
+	if err == nil {
+		total, err = s.db.TotalStorageUsage()
+	}
+	var retention time.Duration
+	if err == nil {
+		retention, err = s.db.TrashRetention()
+	}
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	d.Retention = int64(retention / (24 * time.Hour))
+	d.Total = formatFileSize(total)
+	d.DefaultQuota = formatMiB(defaultQuota)
+	d.MaxFileSize = formatMiB(maxFileSize)
+	rows, err := s.db.db.Query("SELECT uid, login, name, surname, quota FROM users ORDER BY surname, name")
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var u storageUser
+		var quota sql.NullInt64
+		if err := rows.Scan(&u.Uid, &u.Login, &u.Name, &u.Surname, &quota); err != nil {
+			s.internalError(w, r, err, s.tr("Internal server error"))
+			return
+		}
+		u.Used = formatFileSize(usage[u.Uid])
+		effective := defaultQuota
+		if quota.Valid {
+			u.Quota = formatMiB(quota.Int64)
+			effective = quota.Int64
+		}
+		u.Percent = -1
+		if effective > 0 {
+			u.Percent = 100 * usage[u.Uid] / effective
+		}
+		d.Users = append(d.Users, u)
+	}
+	if err := rows.Err(); err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	s.executeTemplate(w, "admin.html", &d, status)
+}
+
+func (s *server) saveAdminSettings(r *http.Request, d *adminData) int {
+	if err := r.ParseForm(); err != nil {
+		logWarn(r, "Error parsing form", "err", err)
+		d.Message = s.tr("Error parsing form")
+		return http.StatusBadRequest
+	}
+	defaultQuota, ok1 := parseMiB(r.PostForm.Get("default_quota"))
+	maxFileSize, ok2 := parseMiB(r.PostForm.Get("max_file_size"))
+	if !ok1 || !ok2 || defaultQuota == nil || maxFileSize == nil {
+		d.Message = s.tr("Sizes must be given as a number of MiB (0 for no limit)")
+		return http.StatusBadRequest
+	}
+	quotas := make(map[int64]interface{})
+	for key, values := range r.PostForm {
+		if !strings.HasPrefix(key, "quota_") {
+			continue
+		}
+		uid, err := strconv.ParseInt(strings.TrimPrefix(key, "quota_"), 10, 64)
+		quota, ok := parseMiB(values[0])
+		if err != nil || !ok {
+			d.Message = s.tr("Sizes must be given as a number of MiB (0 for no limit)")
+			return http.StatusBadRequest
+		}
+		quotas[uid] = quota
+	}
+	retention, err := strconv.ParseInt(strings.TrimSpace(r.PostForm.Get("trash_retention_days")), 10, 32)
+	if err != nil || retention < 0 {
+		d.Message = s.tr("Trash retention must be given as a number of days (0 for no limit)")
+		return http.StatusBadRequest
+	}
+	tx, err := s.db.db.Begin()
+	if err != nil {
+		logError(r, "save admin settings error", "err", err)
+		d.Message = s.tr("Internal server error")
+		return http.StatusInternalServerError
+	}
+	defer tx.Rollback()
+	for _, kv := range []struct {
+		key   string
+		value interface{}
+	}{{"default_quota", defaultQuota}, {"max_file_size", maxFileSize}, {"trash_retention_days", retention}} {
+		if _, err = tx.Exec("UPDATE mpa SET value=? WHERE key=?", strconv.FormatInt(kv.value.(int64), 10), kv.key); err != nil {
+			break
+		}
+	}
+	for uid, quota := range quotas {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec("UPDATE users SET quota=? WHERE uid=?", quota, uid)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		logError(r, "save admin settings error", "err", err)
+		d.Message = s.tr("Internal server error")
+		return http.StatusInternalServerError
+	}
+	d.Saved = true
+	s.audit(r, auditSettingsChange, auditTarget{}, fmt.Sprintf("default quota %s MiB, max file size %s MiB, trash retention %d days",
+		formatMiB(defaultQuota.(int64)), formatMiB(maxFileSize.(int64)), retention))
+	return http.StatusOK
+}
+
+// parseMiB converts the number of MiB to the number of bytes (as
+// int64) or nil if the string is empty.
+func parseMiB(v string) (interface{}, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, true
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 || n >= 1<<43 {
+		return nil, false
+	}
+	return n << 20, true
+}
+
+func formatMiB(n int64) string {
+	return strconv.FormatFloat(float64(n)/(1<<20), 'f', -1, 64)
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseMiB(t *testing.T) {
+	tests := []struct {
+		s    string
+		want interface{}
+		ok   bool
+	}{
+		{"", nil, true},
+		{"  ", nil, true},
+		{"0", int64(0), true},
+		{"1", int64(1 << 20), true},
+		{" 100 ", int64(100 << 20), true},
+		{"8796093022207", int64(8796093022207 << 20), true},
+		{"8796093022208", nil, false}, // 1<<43 MiB overflows int64 bytes
+		{"-1", nil, false},
+		{"1.5", nil, false},
+		{"1MiB", nil, false},
+		{"abc", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := parseMiB(tt.s)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parseMiB(%q) = %v, %t, want %v, %t", tt.s, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestFormatMiB(t *testing.T) {
+	tests := []struct {
+		n    int64
+		want string
+	}{
+		{0, "0"},
+		{1 << 20, "1"},
+		{100 << 20, "100"},
+		{3 << 19, "1.5"},
+	}
+	for _, tt := range tests {
+		if got := formatMiB(tt.n); got != tt.want {
+			t.Errorf("formatMiB(%d) = %q, want %q", tt.n, got, tt.want)
+		}
+		if tt.n%(1<<20) != 0 {
+			continue
+		}
+		if n, ok := parseMiB(formatMiB(tt.n)); !ok || n != tt.n {
+			t.Errorf("parseMiB(formatMiB(%d)) = %v, %t", tt.n, n, ok)
+		}
+	}
+}
+
+func TestStorageUsage(t *testing.T) {
+	db := initTestDB(t)
+	if err := db.AddUser(db.db, "bob", "", "", "", 0, false, []byte("Secret1!x")); err != nil {
+		t.Fatal(err)
+	}
+	// files of addTestAlbum contain their 64 byte sums
+	addTestAlbum(t, db, 1, "Trip", testSum('a'), testSum('b'))
+	addTestAlbum(t, db, 1, "Again", testSum('a'))
+	addTestAlbum(t, db, 2, "Home", testSum('a'), testSum('c'))
+
+	usage, err := db.StorageUsage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// shared file a is counted in full for both users but once for
+	// the user having it in two albums
+	if usage[1] != 128 || usage[2] != 128 || len(usage) != 2 {
+		t.Errorf("StorageUsage = %v, want 128 bytes for each user", usage)
+	}
+	if used, err := db.UserStorageUsage(2); err != nil || used != 128 {
+		t.Errorf("UserStorageUsage = %d, %v", used, err)
+	}
+	if used, err := db.UserStorageUsage(3); err != nil || used != 0 {
+		t.Errorf("UserStorageUsage of user without albums = %d, %v", used, err)
+	}
+	if total, err := db.TotalStorageUsage(); err != nil || total != 192 {
+		t.Errorf("TotalStorageUsage = %d, %v, want 192", total, err)
+	}
+}
+
+func TestStorageLimits(t *testing.T) {
+	db := initTestDB(t)
+	if err := db.AddUser(db.db, "bob", "", "", "", 0, false, []byte("Secret1!x")); err != nil {
+		t.Fatal(err)
+	}
+	addTestAlbum(t, db, 2, "Home", testSum('a'))
+	if _, err := db.db.Exec("UPDATE mpa SET value='200' WHERE key='default_quota'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec("UPDATE mpa SET value='100' WHERE key='max_file_size'"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec("UPDATE users SET quota=0 WHERE uid=1"); err != nil {
+		t.Fatal(err)
+	}
+	if l, err := db.StorageLimits(1); err != nil || l.quota != 0 || l.maxFileSize != 100 {
+		t.Errorf("limits of user without quota: %+v, %v", l, err)
+	}
+	if l, err := db.StorageLimits(2); err != nil || l.quota != 200 || l.maxFileSize != 100 {
+		t.Errorf("limits of user with default quota: %+v, %v", l, err)
+	}
+
+	s := &server{db: db, tr: func(s string) string { return s }}
+	checkQuota := func(uid int64, sizes map[string]int64, unknown int64) int {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest("POST", "/api/new/album", nil)
+		if !s.checkQuota(w, r, uid, sizes, unknown) {
+			if !strings.Contains(w.Body.String(), "Storage quota exceeded") {
+				t.Errorf("quota error %q", w.Body.String())
+			}
+			return w.Code
+		}
+		return http.StatusOK
+	}
+	// 64 bytes used of 200
+	if code := checkQuota(2, map[string]int64{testSum('b'): 100}, 36); code != http.StatusOK {
+		t.Errorf("upload filling the quota: status %d", code)
+	}
+	if code := checkQuota(2, map[string]int64{testSum('b'): 100}, 37); code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload exceeding the quota: status %d", code)
+	}
+	// files already in albums of the user take no space
+	if code := checkQuota(2, map[string]int64{testSum('a'): 1000}, 0); code != http.StatusOK {
+		t.Errorf("upload of stored file: status %d", code)
+	}
+	if code := checkQuota(1, nil, 1<<40); code != http.StatusOK {
+		t.Errorf("upload of user without quota: status %d", code)
+	}
+}
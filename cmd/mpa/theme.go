@@ -0,0 +1,164 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// Admins set the site title, logo, primary colour and theme (light,
+// dark or auto following the browser) at /admin/appearance. Operators
+// may also replace templates and static files by putting files of the
+// same names in the templates and static subdirectories of the
+// directory given with -theme_dir (such as static/theme.css or
+// static/logo.svg to be used as the logo /static/logo.svg).
+
+// siteSettings describes the appearance of the site.
+type siteSettings struct {
+	Title string // "" for the translated default
+	Logo  string // URL of the logo image, "" for no logo
+	Color string // primary colour as #rrggbb
+	Theme string // auto, light or dark
+}
+
+var defaultSiteSettings = siteSettings{Color: "#0074d9", Theme: "auto"}
+
+var siteThemes = []string{"auto", "light", "dark"}
+
+// site holds settings shared by servers localized for all languages.
+type site struct {
+	mu       sync.RWMutex
+	settings siteSettings
+}
+
+func (s *site) get() siteSettings {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.settings
+}
+
+func (s *site) set(settings siteSettings) {
+	s.mu.Lock()
+	s.settings = settings
+	s.mu.Unlock()
+}
+
+// SiteSettings returns the appearance settings stored in the database.
+func (db *DB) SiteSettings() (siteSettings, error) {
+	st := defaultSiteSettings
+	rows, err := db.db.Query("SELECT key, value FROM mpa WHERE key IN ('site_title', 'site_logo', 'site_color', 'site_theme')")
+	if err != nil {
+		return st, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var key, value string
+		if err := rows.Scan(&key, &value); err != nil {
+			return st, err
+		}
+		switch key {
+		case "site_title":
+			st.Title = value
+		case "site_logo":
+			st.Logo = value
+		case "site_color":
+			st.Color = value
+		case "site_theme":
+			st.Theme = value
+		}
+	}
+	return st, rows.Err()
+}
+
+func (db *DB) SetSiteSettings(st siteSettings) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, kv := range [][2]string{{"site_title", st.Title}, {"site_logo", st.Logo}, {"site_color", st.Color}, {"site_theme", st.Theme}} {
+		if _, err := tx.Exec("UPDATE mpa SET value=? WHERE key=?", kv[1], kv[0]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+var colorRe = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// check returns a message describing the first invalid setting (or
+// "" if all are valid).
+func (st *siteSettings) check(tr func(string) string) string {
+	switch {
+	case utf8.RuneCountInString(st.Title) > 100:
+		return tr("Site title must have at most 100 characters")
+	case st.Logo != "" && !(strings.HasPrefix(st.Logo, "/") && !strings.HasPrefix(st.Logo, "//")) && !strings.HasPrefix(st.Logo, "https://"):
+		return tr("Logo must be a path on this site (such as /static/logo.png) or an https:// URL")
+	case !colorRe.MatchString(st.Color):
+		return tr("Colour must be given as #rrggbb")
+	case !stringIn(st.Theme, siteThemes):
+		return tr("Unsupported theme")
+	}
+	return ""
+}
+
+func stringIn(s string, a []string) bool {
+	for _, v := range a {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+type appearanceData struct {
+	Lang     string
+	Settings siteSettings
+	Message  string
+	Saved    bool
+}
+
+// ServeAppearance serves the admin page setting the site title, logo,
+// colour and theme.
+func (s *server) ServeAppearance(w http.ResponseWriter, r *http.Request) {
+	d := appearanceData{Lang: s.lang, Settings: s.site.get()}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		status = s.saveAppearance(r, &d)
+	}
+	s.executeTemplate(w, "appearance.html", &d, status)
+}
+
+func (s *server) saveAppearance(r *http.Request, d *appearanceData) int {
+	if err := r.ParseForm(); err != nil {
+		logWarn(r, "Error parsing form", "err", err)
+		d.Message = s.tr("Error parsing form")
+		return http.StatusBadRequest
+	}
+	d.Settings = siteSettings{
+		Title: strings.TrimSpace(r.PostForm.Get("title")),
+		Logo:  strings.TrimSpace(r.PostForm.Get("logo")),
+		Color: strings.TrimSpace(r.PostForm.Get("color")),
+		Theme: r.PostForm.Get("theme"),
+	}
+	if d.Message = d.Settings.check(s.tr); d.Message != "" {
+		return http.StatusBadRequest
+	}
+	if err := s.db.SetSiteSettings(d.Settings); err != nil {
+		logError(r, "save appearance error", "err", err)
+		d.Message = s.tr("Internal server error")
+		return http.StatusInternalServerError
+	}
+	s.site.set(d.Settings)
+	d.Saved = true
+	s.audit(r, auditSettingsChange, auditTarget{}, fmt.Sprintf("site title %q, logo %q, colour %s, theme %s",
+		d.Settings.Title, d.Settings.Logo, d.Settings.Color, d.Settings.Theme))
+	return http.StatusOK
+}
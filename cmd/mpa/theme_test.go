@@ -0,0 +1,110 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSiteSettingsCheck(t *testing.T) {
+	valid := siteSettings{Title: "Family photos", Logo: "/static/logo.svg", Color: "#A0b1c2", Theme: "dark"}
+	tests := []struct {
+		change func(*siteSettings)
+		valid  bool
+	}{
+		{func(st *siteSettings) {}, true},
+		{func(st *siteSettings) { st.Title = strings.Repeat("ż", 100) }, true},
+		{func(st *siteSettings) { st.Title = strings.Repeat("ż", 101) }, false},
+		{func(st *siteSettings) { st.Logo = "" }, true},
+		{func(st *siteSettings) { st.Logo = "https://example.com/logo.png" }, true},
+		{func(st *siteSettings) { st.Logo = "http://example.com/logo.png" }, false},
+		{func(st *siteSettings) { st.Logo = "//example.com/logo.png" }, false},
+		{func(st *siteSettings) { st.Logo = "javascript:alert(1)" }, false},
+		{func(st *siteSettings) { st.Color = "#0074d" }, false},
+		{func(st *siteSettings) { st.Color = "red" }, false},
+		{func(st *siteSettings) { st.Color = "#0074d9;}" }, false},
+		{func(st *siteSettings) { st.Theme = "auto" }, true},
+		{func(st *siteSettings) { st.Theme = "" }, false},
+	}
+	for _, tt := range tests {
+		st := valid
+		tt.change(&st)
+		if msg := st.check(func(s string) string { return s }); (msg == "") != tt.valid {
+			t.Errorf("check(%+v) = %q, want valid %t", st, msg, tt.valid)
+		}
+	}
+}
+
+func TestSaveAppearance(t *testing.T) {
+	db := initTestDB(t)
+	if st, err := db.SiteSettings(); err != nil || st != defaultSiteSettings {
+		t.Fatalf("settings of new database: %+v, %v", st, err)
+	}
+	s := &server{db: db, site: &site{settings: defaultSiteSettings}, assets: &assets{}, lang: "en", tr: func(s string) string { return s },
+		t: template.Must(template.New("html").Parse(`{{define "appearance.html"}}{{.Message}}{{end}}`))}
+	post := func(form url.Values) int {
+		r := httptest.NewRequest("POST", "/admin/appearance", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		s.ServeAppearance(w, withSession(r, 1))
+		return w.Code
+	}
+
+	if code := post(url.Values{"title": {" Photos "}, "logo": {"/static/logo.svg"}, "color": {"#112233"}, "theme": {"light"}}); code != 200 {
+		t.Fatalf("saving appearance: status %d", code)
+	}
+	want := siteSettings{Title: "Photos", Logo: "/static/logo.svg", Color: "#112233", Theme: "light"}
+	if st, err := db.SiteSettings(); err != nil || st != want {
+		t.Errorf("saved settings %+v, %v, want %+v", st, err, want)
+	}
+	if st := s.site.get(); st != want {
+		t.Errorf("settings in use %+v, want %+v", st, want)
+	}
+
+	if code := post(url.Values{"title": {"Other"}, "color": {"blue"}, "theme": {"dark"}}); code != 400 {
+		t.Errorf("saving invalid appearance: status %d", code)
+	}
+	if st, err := db.SiteSettings(); err != nil || st != want || s.site.get() != want {
+		t.Errorf("settings changed by invalid form: %+v, %v", st, err)
+	}
+}
+
+func TestThemeTemplateOverride(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "templates"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	src := `{{define "custom"}}<p>{{.}}</p>{{end}}`
+	if err := ioutil.WriteFile(filepath.Join(dir, "templates", "error.html"), []byte(src), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, err := newAssets(false, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl, err := a.parseTemplates("html", template.FuncMap{}, "templates/error.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&b, "custom", "<x>"); err != nil {
+		t.Fatal(err)
+	}
+	if b.String() != "<p>&lt;x&gt;</p>" {
+		t.Errorf("overridden template rendered %q", b.String())
+	}
+	// files missing in the theme directory are embedded ones
+	if _, err := a.readFile("templates/login.html"); err != nil {
+		t.Errorf("reading template not overridden: %v", err)
+	}
+}
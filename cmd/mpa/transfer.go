@@ -0,0 +1,280 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ServeAPITransferImages moves or copies selected images of the album
+// to another album (existing or new) of the same owner.
+func (s *server) ServeAPITransferImages(w http.ResponseWriter, r *http.Request) {
+	albumID, err := idFromPath(r.URL.Path, "/api/transfer/album/")
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	session, form, ok := s.parseAPIForm(w, r)
+	if !ok {
+		return
+	}
+	imageIDs, err := parseIDs(form["image"])
+	if err != nil {
+		logWarn(r, "Error parsing image ID", "err", err)
+		http.Error(w, s.tr("Error parsing image ID"), http.StatusBadRequest)
+		return
+	}
+	if len(imageIDs) == 0 {
+		http.Error(w, s.tr("No images selected"), http.StatusBadRequest)
+		return
+	}
+	var targetID int64
+	if target := form.Get("target"); target != "" {
+		targetID, err = strconv.ParseInt(target, 10, 64)
+		if err != nil {
+			logWarn(r, "Error parsing form", "err", err)
+			http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
+			return
+		}
+	}
+	name := form.Get("name")
+	if targetID == 0 && name == "" {
+		http.Error(w, s.tr("Album name not specified"), http.StatusBadRequest)
+		return
+	}
+	if targetID == albumID {
+		http.Error(w, s.tr("Target album must be different from the source album"), http.StatusBadRequest)
+		return
+	}
+	copyImages := form.Get("copy") == "on"
+	rs := s.db.TransferImages(session.Uid, albumID, imageIDs, targetID, name, copyImages, s.tr)
+	logAlbumErrors(r, albumID, rs.Errs)
+	if rs.Status != http.StatusOK {
+		http.Error(w, rs.Errs[len(rs.Errs)-1].Msg, rs.Status)
+		return
+	}
+	data := struct {
+		Title    string
+		Messages []string
+		Problems []imageError
+		Href     string
+	}{Problems: rs.Errs, Href: fmt.Sprintf("/album/%d", rs.TargetID)}
+	details := fmt.Sprintf("%d images moved to album %d", rs.Cnt, rs.TargetID)
+	if copyImages {
+		details = fmt.Sprintf("%d images copied to album %d", rs.Cnt, rs.TargetID)
+	}
+	s.auditAs(r, session.Uid, session.Login, auditImagesTransfer, auditTarget{Album: albumID}, details)
+	if copyImages {
+		data.Title = s.tr("Images copied")
+		if rs.Cnt == len(imageIDs) {
+			data.Messages = append(data.Messages, s.tr("All selected images copied to the album."))
+		} else {
+			data.Messages = append(data.Messages, fmt.Sprintf(s.trn("%d out of %d selected images copied to the album.", len(imageIDs)), rs.Cnt, len(imageIDs)))
+		}
+	} else {
+		data.Title = s.tr("Images moved")
+		if rs.Cnt == len(imageIDs) {
+			data.Messages = append(data.Messages, s.tr("All selected images moved to the album."))
+		} else {
+			data.Messages = append(data.Messages, fmt.Sprintf(s.trn("%d out of %d selected images moved to the album.", len(imageIDs)), rs.Cnt, len(imageIDs)))
+		}
+	}
+	if rs.SourceDeleted {
+		data.Messages = append(data.Messages, s.tr("No images left in the album, album deleted."))
+	}
+	s.executeTemplate(w, "editalbumok.html", &data, http.StatusOK)
+}
+
+func parseIDs(a []string) ([]int64, error) {
+	ids := make([]int64, 0, len(a))
+	for _, s := range a {
+		id, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+type TransferImagesResult struct {
+	Status        int
+	TargetID      int64
+	Cnt           int
+	SourceDeleted bool
+	Errs          []imageError
+}
+
+// TransferImages moves (or copies if copyImages is true) images of the
+// album albumID to the album targetID or, if targetID is zero, to a
+// new album of the given name. Both albums must be owned by uid. As
+// originals are content addressed no files are touched, only image
+// records are moved or duplicated.
+func (db *DB) TransferImages(uid, albumID int64, imageIDs []int64, targetID int64, name string, copyImages bool, tr func(string) string) (rs TransferImagesResult) {
+	rs.Status = http.StatusInternalServerError
+	tx, err := db.db.Begin()
+	if err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	defer tx.Rollback()
+	if err := checkAlbumOwner(tx, albumID, uid); err != nil {
+		rs.Status = http.StatusForbidden
+		rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("album=%d", albumID), tr("Album does not exist or you are not its owner")})
+		return
+	}
+	now := time.Now().UTC().Unix()
+	if targetID == 0 {
+		r, err := tx.Exec("INSERT INTO albums (owner_id, created, modified, name) VALUES (?, ?, ?, ?)", uid, now, now, name)
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+		targetID, err = r.LastInsertId()
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+	} else if err := checkAlbumOwner(tx, targetID, uid); err != nil {
+		rs.Status = http.StatusForbidden
+		rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("album=%d", targetID), tr("Album does not exist or you are not its owner")})
+		return
+	}
+	rs.TargetID = targetID
+
+	var position int64
+	if err := tx.QueryRow("SELECT COALESCE(MAX(position)+1, 0) FROM images WHERE album_id=?", targetID).Scan(&position); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	for _, imageID := range imageIDs {
+		var r sql.Result
+		if copyImages {
+			r, err = tx.Exec(`
+INSERT INTO images (sha256sum, album_id, title, is_portrait, is_video, created, owner_file_name, position, `+imageEditColumns+`)
+SELECT sha256sum, ?, title, is_portrait, is_video, created, owner_file_name, ?, `+imageEditColumns+` FROM images WHERE iid=? AND album_id=?`,
+				targetID, position, imageID, albumID)
+		} else {
+			r, err = tx.Exec("UPDATE images SET album_id=?, position=? WHERE iid=? AND album_id=?", targetID, position, imageID, albumID)
+		}
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", imageID), tr("Internal server error")})
+			return
+		}
+		cnt, err := r.RowsAffected()
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, fmt.Sprintf("image=%d", imageID), tr("Internal server error")})
+			return
+		}
+		if cnt == 0 {
+			rs.Errs = append(rs.Errs, imageError{errors.New("Not found in DB"), fmt.Sprintf("image=%d", imageID), tr("Not found in this album")})
+			continue
+		}
+		position++
+		rs.Cnt++
+	}
+	if rs.Cnt == 0 {
+		rs.Status = http.StatusBadRequest
+		rs.Errs = append(rs.Errs, imageError{errors.New("no images transferred"), "", tr("No images selected")})
+		return
+	}
+	for _, id := range []int64{albumID, targetID} {
+		if _, err := tx.Exec("UPDATE albums SET modified=? WHERE aid=?", now, id); err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+		deleted, err := updateAlbumCover(tx, id)
+		if err != nil {
+			rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+			return
+		}
+		if id == albumID {
+			rs.SourceDeleted = deleted
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		rs.Errs = append(rs.Errs, imageError{err, "", tr("Internal server error")})
+		return
+	}
+	rs.Status = http.StatusOK
+	return
+}
+
+// Queryer is implemented by both *sql.DB and *sql.Tx.
+type Queryer interface {
+	Execer
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+var ErrNotAlbumOwner = errors.New("album does not exist or user is not its owner")
+
+func checkAlbumOwner(q Queryer, albumID, uid int64) error {
+	var ownerID int64
+	if err := q.QueryRow("SELECT owner_id FROM albums WHERE aid=?", albumID).Scan(&ownerID); err != nil {
+		if err == sql.ErrNoRows {
+			return ErrNotAlbumOwner
+		}
+		return err
+	}
+	if ownerID != uid {
+		return ErrNotAlbumOwner
+	}
+	return nil
+}
+
+// updateAlbumCover keeps the current cover of the album if it is still
+// in the album or otherwise sets the first image of the album as its
+// cover. An album with no images left is deleted in which case true is
+// returned.
+func updateAlbumCover(q Queryer, albumID int64) (bool, error) {
+	var order string
+	var coverID int64
+	if err := q.QueryRow("SELECT image_order, COALESCE(image_id, 0) FROM albums WHERE aid=?", albumID).Scan(&order, &coverID); err != nil {
+		return false, err
+	}
+	var isPortrait bool
+	err := q.QueryRow("SELECT is_portrait FROM images WHERE iid=? AND album_id=?", coverID, albumID).Scan(&isPortrait)
+	if err == sql.ErrNoRows {
+		err = q.QueryRow("SELECT iid, is_portrait FROM images WHERE album_id=? "+imageOrderBy(order)+" LIMIT 1", albumID).Scan(&coverID, &isPortrait)
+		if err == sql.ErrNoRows {
+			_, err = q.Exec("DELETE FROM albums WHERE aid=?", albumID)
+			return err == nil, err
+		}
+	}
+	if err != nil {
+		return false, err
+	}
+	_, err = q.Exec("UPDATE albums SET image_id=?, is_portrait=? WHERE aid=?", coverID, isPortrait, albumID)
+	return false, err
+}
+
+type albumName struct {
+	Id   int64
+	Name string
+}
+
+// UserAlbums returns IDs and names of all albums of the user.
+func (db *DB) UserAlbums(uid int64) ([]albumName, error) {
+	rows, err := db.db.Query("SELECT aid, name FROM albums WHERE owner_id=? ORDER BY modified DESC", uid)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var albums []albumName
+	for rows.Next() {
+		var a albumName
+		if err := rows.Scan(&a.Id, &a.Name); err != nil {
+			return nil, err
+		}
+		albums = append(albums, a)
+	}
+	return albums, rows.Err()
+}
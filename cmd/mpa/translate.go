@@ -36,101 +36,300 @@ var enTranslation = translation{
 var plTranslation = translation{
 	"lang-code": "pl",
 
-	"%d of %d images deleted from the album have been successfully deleted.": "%d z %d obrazów usuniętych z albumu zostało poprawnie usuniętych.",
-	"%d out of %d requsted image titles modified.":                           "Wprowadzono %d z %d żądanych zmian tytułów.",
-	"%d out of %d uploaded files added to the album.":                        "%d z %d przesłanych plików dodano do albumu.",
-	"%d out of %d uploaded files added to the new album.":                    "%d z %d przesłanych plików dodano do nowego albumu.",
+	"%d of %d deleted":                                                                   "%d z %d usunięto",
+	"0 means no limit. Files present in albums of several users count for each of them.": "0 oznacza brak limitu. Pliki obecne w albumach kilku użytkowników liczą się każdemu z nich.",
+	"Action":                                                                             "Akcja",
 	"Add title or delete":                                                    "Dodaj tytuł lub usuń",
 	"Add user":                                                               "Dodaj użytkownika",
 	"Admin account required":                                                 "Wymagane konto administratora",
 	"Admin":                                                                  "Admin",
+	"Administration":                                                         "Administracja",
+	"Album ID":                                                               "ID albumu",
+	"Album cover changed.":                                                   "Zmieniono okładkę albumu.",
 	"Album deleted":                                                          "Album usunęty",
+	"Album details modified.":                                                "Zmieniono szczegóły albumu.",
+	"Album details":                                                          "Szczegóły albumu",
 	"Album does not exist or you are not its owner":                          "Album nie istnieje albo nie jesteś jego właścicielem",
 	"Album name modified.":                                                   "Zmodyfikowano nazwę albumu",
 	"Album name not specified":                                               "Nie określono nazwy albumu",
 	"Album name":                                                             "Nazwa albumu",
+	"Album settings override user settings which override the server default. Owners always download their originals unmodified.": "Ustawienia albumu mają pierwszeństwo przed ustawieniami użytkownika, a te przed domyślnymi serwera. Właściciel zawsze pobiera niezmienione oryginały.",
+	"Album split":                                                            "Podzielono album",
 	"Album updated":                                                          "Album uaktualniony",
+	"Albums merged":                                                          "Połączono albumy",
+	"Albums of user":                                                         "Albumy użytkownika",
 	"Albums":                                                                 "Albumy",
 	"All albums":                                                             "Wszystkie albumy",
 	"All images deleted from the album have been successfully deleted.": "Wszystkie obrazy usunięte z albumu zostały pomyślnie usunięte.",
 	"All requsted image titles modified.":                               "Wprowadzono wszystkie żądane zmiany tytułów.",
+	"All selected images copied to the album.":                          "Wszystkie wybrane obrazy skopiowano do albumu.",
+	"All selected images moved to the album.":                           "Wszystkie wybrane obrazy przeniesiono do albumu.",
 	"All uploaded files added to the album.":                            "Wszystkie przesłane pliki dodano do albumu.",
 	"All uploaded files added to the new album.":                        "Wszystkie przesłane pliki dodano do nowego albumu.",
+	"All":                                                               "Wszystkie",
+	"Appearance":                                                        "Wygląd",
+	"Audit log":                                                         "Dziennik zdarzeń",
 	"Authorization error":                                               "Błąd upoważnienia",
-	"Bad request: error parsing form":                                   "Błędne zapytanie: błąd parsowania formularza",
+	"Automatic (as preferred by the browser)":                           "Automatyczny (według preferencji przeglądarki)",
+	"Bad request":                                                       "Błędne żądanie",
+	"Browser language":                                                  "Język przeglądarki",
+	"Cancel":                                                            "Anuluj",
+	"Checksum of the uploaded file does not match":                      "Suma kontrolna przesłanego pliku nie zgadza się",
 	"Click to add title or delete the image":                            "Kliknij aby dodać tytuł lub usunąć obraz",
 	"Close":                                                "Zamknij",
+	"Collection":                                           "Kolekcja",
+	"Colour must be given as #rrggbb":                      "Kolor należy podać jako #rrggbb",
+	"Colour":                                               "Kolor",
+	"Comment must have at most %d characters":              "Komentarz może mieć najwyżej %d znaków",
+	"Comment must not be empty":                            "Komentarz nie może być pusty",
+	"Comments":                                             "Komentarze",
 	"Connection error":                                     "Błąd połączenia",
 	"Could not determine image size":                       "Nie udało się określić rozmiaru obrazu",
+	"Could not determine image time":                       "Nie udało się określić czasu obrazu",
 	"Could not determine image time, current time assumed": "Nie udało się określić czasu obrazu, przyjęto aktualny czas",
+	"Could not process video":                              "Nie udało się przetworzyć wideo",
+	"Cover image not found in this album":                  "Nie znaleziono obrazu okładki w tym albumie",
+	"Crop (percent from left, top, right and bottom edge)": "Przytnij (procent od lewej, górnej, prawej i dolnej krawędzi)",
 	"Current password":                                     "Aktualne hasło",
+	"Dark":                                                 "Ciemny",
+	"Date from":                                            "Data od",
+	"Date to":                                              "Data do",
+	"Default quota (MiB)":                                  "Domyślny limit (MiB)",
+	"Delete album":                                         "Usuń album",
+	"Delete the album together with all its images? Number of images:": "Usunąć album razem ze wszystkimi obrazami? Liczba obrazów:",
+	"Delete the images? Deleted images are moved to the trash.": "Usunąć zdjęcia? Usunięte zdjęcia są przenoszone do kosza.",
+	"Delete this comment?":                                      "Usunąć ten komentarz?",
 	"Delete":                                               "Usuń",
+	"Deleted albums can be restored from the trash.":       "Usunięte albumy można przywrócić z kosza.",
+	"Deleted images can be restored from the trash.":       "Usunięte obrazy można przywrócić z kosza.",
+	"Deleted items are removed permanently after the given number of days": "Usunięte elementy są trwale usuwane po podanej liczbie dni",
+	"Deleted on":                                                           "Usunięto",
+	"Description (Markdown)":                               "Opis (Markdown)",
+	"Details":                                              "Szczegóły",
 	"Down":                                                 "Dół",
 	"Drop images or click here": "Upuść obrazy lub kliknij tutaj",
 	"Edit album":                "Edytuj album",
+	"Edit":                      "Edytuj",
 	"Editing album":             "Edycja albumu",
 	"Email already registered":  "Email już zarejestrowany",
 	"Email":                     "Email",
+	"Empty trash":               "Opróżnij kosz",
 	"Error during template execution": "Błąd podczas wykonania szablonu",
+	"Error parsing album ID":          "Błąd parsowania ID albumu",
+	"Error parsing date":              "Błąd parsowania daty",
 	"Error parsing form":              "Błąd parsowania formularza",
+	"Error parsing image ID":          "Błąd parsowania identyfikatora obrazu",
 	"Error parsing metadata":          "Błąd parsowania metadanych",
 	"Error":                           "Błąd",
+	"Export CSV":                      "Eksport CSV",
+	"Export JSON":                     "Eksport JSON",
+	"Failed to save the language":     "Nie udało się zapisać języka",
+	"Favourite":                       "Ulubione",
 	"Field":                           "Pole",
+	"File not found on the server, please upload it": "Nie znaleziono pliku na serwerze, prześlij go",
+	"File too large (maximum %s)":                    "Plik jest za duży (maksymalnie %s)",
 	"File":                            "Plik",
+	"Files of the logo and replacements of templates and static files may be put in the directory given with the -theme_dir option.": "Pliki logo oraz zamienniki szablonów i plików statycznych można umieścić w katalogu podanym opcją -theme_dir.",
+	"Filter":                          "Filtruj",
+	"Flip horizontally":               "Odbij w poziomie",
+	"Flip vertically":                 "Odbij w pionie",
+	"From":                            "Od",
+	"Group":                           "Grupa",
+	"HEIC images are not supported by this server": "Obrazy HEIC nie są obsługiwane przez ten serwer",
+	"Image edits saved.":                           "Zapisano edycję obrazów.",
+	"Image order modified.":           "Zmieniono kolejność obrazów.",
+	"Images copied":                   "Skopiowano obrazy",
+	"Images moved":                    "Przeniesiono obrazy",
+	"Images taken on or after the date": "Obrazy wykonane w dniu lub po dniu",
+	"Images":                            "Obrazy",
 	"Incorrect email address":                         "Niepoprawny adres email",
 	"Incorrect login or password.":                    "Niepoprawny login lub hasło.",
 	"Incorrect password":                              "Niepoprawne hasło",
 	"Internal server error":                           "Wewnętrzny błąd serwera",
+	"Invalid image edit":                              "Nieprawidłowa edycja obrazu",
+	"Keep best":                                       "Zachowaj najlepsze",
+	"Keep capture date and copyright in previews":     "Zachowuj datę wykonania i prawa autorskie w podglądach",
+	"Keep deleted items in the trash (days)":          "Przechowuj usunięte elementy w koszu (dni)",
+	"Keep images also in this album (copy)":           "Zachowaj obrazy również w tym albumie (kopiuj)",
+	"Keep only this":                                  "Zachowaj tylko to",
+	"Language of the user interface":                  "Język interfejsu użytkownika",
+	"Language":                                        "Język",
+	"Leave dates empty to use capture times of images.": "Pozostaw daty puste, aby użyć czasu wykonania zdjęć.",
+	"Light":                                             "Jasny",
 	"Login already registered":                        "Login już zarejestrowany",
 	"Login must have at least three characters":       "Login musi mieć przynajmniej 3 litery",
 	"Login must start with lowercase letter":          "Login musi zaczynać się on małej litery",
 	"Login required":                                  "Wymagane zalogowanie",
 	"Login":                                           "Login",
+	"Logo URL":                                        "URL logo",
+	"Logo must be a path on this site (such as /static/logo.png) or an https:// URL": "Logo musi być ścieżką w tej witrynie (np. /static/logo.png) albo adresem https://",
 	"Logout":                                          "Wyloguj",
+	"Manual order":                                    "Kolejność ręczna",
+	"Maximum file size (MiB)":                         "Maksymalny rozmiar pliku (MiB)",
+	"Merge albums into this album":                    "Połącz albumy z tym albumem",
+	"Merge albums":                                    "Połącz albumy",
 	"Method not allowed":                              "Niedozwolona metoda",
+	"Missing or invalid Upload-Offset header":         "Brak lub nieprawidłowy nagłówek Upload-Offset",
+	"Move or copy selected images":                    "Przenieś lub kopiuj wybrane obrazy",
+	"Move or copy":                                    "Przenieś lub kopiuj",
 	"My albums":                                       "Moje albumy",
+	"My favourites":                                   "Moje ulubione",
 	"Name may not be empty":                           "Imię nie może być puste",
 	"New album created":                               "Utworzono nowy album",
+	"New album name":                                  "Nazwa nowego albumu",
 	"New album":                                       "Nowy album",
 	"New and repeated passwords does not match":       "Nowe i powtórzone hasła są różne",
 	"New password and current password are identical": "Nowe hasło i aktualne hasło są identyczne",
 	"New password":                                    "Nowe hasło",
 	"New user":                                        "Nowy użytkownik",
+	"No albums selected":                              "Nie wybrano żadnych albumów",
 	"No changes or empty album name":                  "Brak zmian lub pusta nazwa albumu",
 	"No changes to the album requested":               "Nie zażądano żadnych zmian w albumie",
-	"No images left in the album, album deleted.":     "Żaden obraz nie został w albumie, album usunięto.",
+	"No comments yet.":                                "Brak komentarzy.",
+	"No favourite images yet. Mark images you like with the star when viewing them.": "Brak ulubionych obrazów. Oznacz gwiazdką obrazy, które ci się podobają, podczas ich oglądania.",
+	"No images left in the album, album deleted.":     "W albumie nie pozostały żadne obrazy, album usunięto.",
+	"No images left in the album, album moved to the trash.": "Żaden obraz nie został w albumie, album przeniesiono do kosza.",
+	"No images selected":                              "Nie wybrano żadnych obrazów",
+	"No images taken after the given dates":           "Brak obrazów wykonanych po podanych datach",
 	"No images uploaded":                              "Nie przesłano żadnych obrazów",
+	"No matching entries.":                            "Brak pasujących wpisów.",
+	"No possible duplicates found.":                   "Nie znaleziono możliwych duplikatów.",
+	"No rotation":                                     "Bez obrotu",
 	"No uploaded image was successfully processed":    "Żaden z przesłanych obrazów nie został pomyślnie przetworzony",
+	"No":                                              "Nie",
+	"Not found in the trash":                          "Nie znaleziono w koszu",
+	"Not found in this album":                         "Nie znaleziono w tym albumie",
+	"Not found in your albums":                        "Nie znaleziono w Twoich albumach",
 	"Only lowercase letters and digits allowed":       "Tylko małe liter y cyfry dozwolone",
+	"Only the most recent entries are shown, exports contain all matching entries.": "Pokazano tylko najnowsze wpisy, eksport zawiera wszystkie pasujące wpisy.",
+	"Original not available due to privacy settings":  "Oryginał niedostępny z powodu ustawień prywatności",
+	"Other albums":                                    "Pozostałe albumy",
 	"Other users":                                     "Inni użytkownicy",
+	"Owner's default":                                 "Domyślne właściciela",
+	"Page not found":                                  "Nie znaleziono strony",
 	"Password change required":                        "Wymagana zmiana hasła",
 	"Password must have at least 8 characters":        "Hasło musi mieć przynajmniej 8 znaków",
 	"Password": "Hasło",
+	"Permanently remove all items in the trash?": "Trwale usunąć wszystkie elementy z kosza?",
 	"Please specify album name and add at least one image": "Proszę określić nazwę albumu i dodać co najmniej jeden obraz",
-	"Please use POST.":                                     "Proszę użyć POST.",
+	"Please specify either date boundaries or selected images": "Proszę podać daty podziału albo wybrać obrazy",
+	"Possible duplicates":                                  "Możliwe duplikaty",
+	"Post comment":                                         "Dodaj komentarz",
+	"Privacy settings saved.":                              "Zapisano ustawienia prywatności.",
+	"Privacy settings":                                     "Ustawienia prywatności",
 	"Problem":                                              "Problem",
 	"Problems":                                             "Problemy",
+	"Quota (MiB)":                                          "Limit (MiB)",
+	"Remote address":                                       "Adres zdalny",
+	"Remove location and serial numbers from originals":    "Usuwaj lokalizację i numery seryjne z oryginałów",
 	"Repeat password":                                      "Powtórzone hasło",
+	"Restore":                                              "Przywróć",
+	"Restored from the trash":                              "Przywrócono z kosza",
+	"Rotate 180°":                                          "Obróć o 180°",
+	"Rotate left":                                          "Obróć w lewo",
+	"Rotate right":                                         "Obróć w prawo",
+	"Save":                                                 "Zapisz",
 	"See the album":                                        "Zobacz ten album",
 	"See the new album":                                    "Zobacz ten nowy album",
+	"See the trash":                                        "Zobacz kosz",
+	"Selected images":                                      "Wybrane obrazy",
+	"Server default":                                       "Domyślne serwera",
 	"Session error":                                        "Błąd sesji",
 	"Session retrieving error":                             "Błąd pobierania sesji",
+	"Set as cover":                                         "Ustaw jako okładkę",
+	"Settings saved.":                                      "Zapisano ustawienia.",
+	"Site title must have at most 100 characters":          "Tytuł witryny może mieć co najwyżej 100 znaków",
+	"Site title":                                           "Tytuł witryny",
+	"Sizes must be given as a number of MiB (0 for no limit)": "Rozmiary należy podać jako liczbę MiB (0 oznacza brak limitu)",
+	"Slide show of favourites":                                "Pokaz slajdów ulubionych",
+	"Sort by capture time":                                 "Sortuj wg czasu wykonania",
+	"Sort by file name":                                    "Sortuj wg nazwy pliku",
+	"Split album":                                          "Podziel album",
+	"Storage quota exceeded: %s used of %s, the upload needs %s more.": "Przekroczono limit miejsca: zajęte %s z %s, przesłanie wymaga jeszcze %s.",
+	"Storage used":                                         "Zajęte miejsce",
+	"Storage":                                              "Miejsce na dysku",
 	"Surname may not be empty":                             "Nazwisko nie może być puste",
 	"Surname":                                              "Nazwisko",
+	"Target album must be different from the source album": "Album docelowy musi być różny od albumu źródłowego",
+	"Target":                                               "Obiekt",
+	"The album has been modified in the meantime, please reload the page": "Album został w międzyczasie zmieniony, odśwież stronę",
+	"The trash is empty.":                                  "Kosz jest pusty.",
+	"Theme":                                                "Motyw",
+	"Time":                                                 "Czas",
 	"Title":                                                "Tytuł",
 	"To edit album you must be its owner": "Aby edytować album musisz być jego właścicielem",
+	"To":                                  "Do",
+	"Too many files":                      "Zbyt wiele plików",
+	"Total size of stored originals":      "Łączny rozmiar przechowywanych oryginałów",
+	"Trash emptied, images removed permanently": "Kosz opróżniony, trwale usunięto obrazów",
+	"Trash retention must be given as a number of days (0 for no limit)": "Czas przechowywania w koszu należy podać jako liczbę dni (0 oznacza bez limitu)",
+	"Trash":                                                              "Kosz",
+	"Unauthorized error":                                                 "Błąd autoryzacji",
+	"Unsupported export format":                                          "Nieobsługiwany format eksportu",
+	"Unsupported image order":             "Nieobsługiwana kolejność obrazów",
+	"Unsupported language":                "Nieobsługiwany język",
+	"Unsupported theme":                   "Nieobsługiwany motyw",
 	"Up":                     "Góra",
 	"Update":                 "Uaktualnij",
+	"Upload in progress":     "Trwa przesyłanie",
+	"Upload not found or incomplete": "Nie znaleziono przesyłanego pliku lub jest niekompletny",
+	"Upload not found":       "Nie znaleziono przesyłanego pliku",
+	"Upload offset does not match": "Niezgodne przesunięcie przesyłanego pliku",
 	"Upload":                 "Prześlij",
 	"Value":                  "Wartość",
+	"Videos cannot be edited": "Nie można edytować filmów",
+	"With the browser language the server default is used if the language of the browser is not available.": "Przy języku przeglądarki używany jest domyślny język serwera, jeśli język przeglądarki nie jest dostępny.",
+	"Write a comment":                                                                                       "Napisz komentarz",
+	"Yes":                     "Tak",
+	"You may not change this comment": "Nie możesz zmienić tego komentarza",
 	"Your password":          "Twoje hasło",
+	"album":                  "album",
 	"albums":                 "albumy",
+	"edited":                 "edytowano",
+	"image":                  "zdjęcie",
 	"login|Submit":           "Zaloguj się",
 	"no":                     "nie",
+	"of":                     "z",
 	"person|Name":            "Imię",
 	"submit|Change password": "Zmień hasło",
 	"title|Change password":  "Zmiana hasła",
+	"user":                   "użytkownik",
 	"yes": "tak",
 
 	"Password must contain at least one lowercase letter, one uppercase letter, one digit and one other character": "Hasło musi zawierać co najmniej jedną małą literę, jedną dużą literę, jedną cyfrę i jeden inny znak",
 }
+
+// builtinPlurals are plural forms of the built-in translations (in the
+// order of forms of the plural rule of the language).
+var builtinPlurals = map[string]plurals{
+	"en": {
+		"%d comments":                                                            {"%d comment", "%d comments"},
+		"%d images":                                                              {"%d image", "%d images"},
+		"%d images deleted.":                                                     {"%d image deleted.", "%d images deleted."},
+		"%d of %d images deleted from the album have been successfully deleted.": {"%d of %d image deleted from the album has been successfully deleted.", "%d of %d images deleted from the album have been successfully deleted."},
+		"%d out of %d requsted image titles modified.":                           {"%d out of %d requested image title modified.", "%d out of %d requested image titles modified."},
+		"%d out of %d selected images copied to the album.":                      {"%d out of %d selected image copied to the album.", "%d out of %d selected images copied to the album."},
+		"%d out of %d selected images moved to the album.":                       {"%d out of %d selected image moved to the album.", "%d out of %d selected images moved to the album."},
+		"%d out of %d uploaded files added to the album.":                        {"%d out of %d uploaded file added to the album.", "%d out of %d uploaded files added to the album."},
+		"%d out of %d uploaded files added to the new album.":                    {"%d out of %d uploaded file added to the new album.", "%d out of %d uploaded files added to the new album."},
+		"%s from %d albums added to the album.":                                  {"%s from %d album added to the album.", "%s from %d albums added to the album."},
+		"%s moved to %d new albums.":                                             {"%s moved to %d new album.", "%s moved to %d new albums."},
+		"Favourite of %d users":                                                  {"Favourite of %d user", "Favourite of %d users"},
+		"The album and its %d images have been moved to the trash.":              {"The album and its %d image have been moved to the trash.", "The album and its %d images have been moved to the trash."},
+	},
+	"pl": {
+		"%d comments":                                                            {"%d komentarz", "%d komentarze", "%d komentarzy"},
+		"%d images":                                                              {"%d obraz", "%d obrazy", "%d obrazów"},
+		"%d images deleted.":                                                     {"Usunięto %d zdjęcie.", "Usunięto %d zdjęcia.", "Usunięto %d zdjęć."},
+		"%d of %d images deleted from the album have been successfully deleted.": {"%d z %d obrazu usuniętego z albumu usunięto poprawnie.", "%d z %d obrazów usuniętych z albumu usunięto poprawnie.", "%d z %d obrazów usuniętych z albumu usunięto poprawnie."},
+		"%d out of %d requsted image titles modified.":                           {"Wprowadzono %d z %d żądanej zmiany tytułu.", "Wprowadzono %d z %d żądanych zmian tytułów.", "Wprowadzono %d z %d żądanych zmian tytułów."},
+		"%d out of %d selected images copied to the album.":                      {"%d z %d wybranego obrazu skopiowano do albumu.", "%d z %d wybranych obrazów skopiowano do albumu.", "%d z %d wybranych obrazów skopiowano do albumu."},
+		"%d out of %d selected images moved to the album.":                       {"%d z %d wybranego obrazu przeniesiono do albumu.", "%d z %d wybranych obrazów przeniesiono do albumu.", "%d z %d wybranych obrazów przeniesiono do albumu."},
+		"%d out of %d uploaded files added to the album.":                        {"%d z %d przesłanego pliku dodano do albumu.", "%d z %d przesłanych plików dodano do albumu.", "%d z %d przesłanych plików dodano do albumu."},
+		"%d out of %d uploaded files added to the new album.":                    {"%d z %d przesłanego pliku dodano do nowego albumu.", "%d z %d przesłanych plików dodano do nowego albumu.", "%d z %d przesłanych plików dodano do nowego albumu."},
+		"%s from %d albums added to the album.":                                  {"%s z %d albumu dodano do albumu.", "%s z %d albumów dodano do albumu.", "%s z %d albumów dodano do albumu."},
+		"%s moved to %d new albums.":                                             {"%s przeniesiono do %d nowego albumu.", "%s przeniesiono do %d nowych albumów.", "%s przeniesiono do %d nowych albumów."},
+		"Favourite of %d users":                                                  {"Ulubione %d użytkownika", "Ulubione %d użytkowników", "Ulubione %d użytkowników"},
+		"The album and its %d images have been moved to the trash.":              {"Album i jego %d obraz przeniesiono do kosza.", "Album i jego %d obrazy przeniesiono do kosza.", "Album i jego %d obrazów przeniesiono do kosza."},
+	},
+}
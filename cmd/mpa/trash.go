@@ -0,0 +1,565 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// Deleted images and albums are moved (with all their columns) to the
+// trash_images and trash_albums tables so that the rest of the program
+// never sees them. Trash rows have their own keys (tid) as IDs of
+// deleted rows may be reused by SQLite. Images deleted together with
+// their album reference it by trash_album_id and are restored with
+// it. Other images are restored to their album or, if it no longer
+// exists, to a new album of the same name. Original IDs are kept on
+// restore unless they have been reused in the meantime.
+//
+// Files are removed only when the trash is emptied (by the user or
+// after trash_retention_days stored in the mpa table) and no image
+// references them anymore.
+
+var ErrTrashNotFound = errors.New("not found in the trash")
+
+const (
+	trashAlbumColumns = "owner_id, image_id, is_portrait, created, modified, name, image_order, description, date_from, date_to, collection_id, strip_exif, preview_exif"
+	trashImageColumns = "sha256sum, title, is_portrait, is_video, created, owner_file_name, position, phash, " + imageEditColumns
+)
+
+// trashImage moves the image of the album to the trash. It returns
+// false if there is no such image in the album.
+func trashImage(tx *sql.Tx, uid, albumID, imageID, now int64) (bool, error) {
+	r, err := tx.Exec(`
+INSERT INTO trash_images (deleted, owner_id, album_name, iid, album_id, `+trashImageColumns+`)
+SELECT ?, ?, (SELECT name FROM albums WHERE aid=images.album_id), iid, album_id, `+trashImageColumns+`
+FROM images WHERE iid=? AND album_id=?`, now, uid, imageID, albumID)
+	if err != nil {
+		return false, err
+	}
+	if cnt, err := r.RowsAffected(); err != nil || cnt == 0 {
+		return false, err
+	}
+	tid, err := r.LastInsertId()
+	if err == nil {
+		err = trashComments(tx, 0, imageID, tid)
+	}
+	if err == nil {
+		err = trashFavourites(tx, imageID, tid)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM images WHERE iid=?", imageID)
+	}
+	return err == nil, err
+}
+
+// trashAlbum moves the album (whose images must be already in the
+// trash or elsewhere) to the trash. Only images moved to the trash with
+// the same time now go with the album, images deleted earlier stay
+// separate trash items.
+func trashAlbum(tx *sql.Tx, uid, albumID, now int64) error {
+	r, err := tx.Exec("INSERT INTO trash_albums (deleted, aid, "+trashAlbumColumns+") SELECT ?, aid, "+trashAlbumColumns+" FROM albums WHERE aid=? AND owner_id=?", now, albumID, uid)
+	if err != nil {
+		return err
+	}
+	tid, err := r.LastInsertId()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("UPDATE trash_images SET trash_album_id=? WHERE album_id=? AND owner_id=? AND deleted=? AND trash_album_id IS NULL", tid, albumID, uid, now)
+	if err == nil {
+		err = trashComments(tx, albumID, 0, tid)
+	}
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM albums WHERE aid=?", albumID)
+	}
+	return err
+}
+
+var ErrAlbumChanged = errors.New("number of images in the album differs from the confirmed one")
+
+// DeleteAlbum moves the album of the user with all its images to the
+// trash provided it still contains the confirmed number of images
+// (ErrAlbumChanged is returned otherwise).
+func (db *DB) DeleteAlbum(uid, albumID int64, confirmedCnt int) error {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := checkAlbumOwner(tx, albumID, uid); err != nil {
+		return err
+	}
+	ids, err := albumImageIDs(tx, albumID)
+	if err != nil {
+		return err
+	}
+	if len(ids) != confirmedCnt {
+		return ErrAlbumChanged
+	}
+	now := time.Now().UTC().Unix()
+	for _, id := range ids {
+		if _, err := trashImage(tx, uid, albumID, id, now); err != nil {
+			return err
+		}
+	}
+	if err := trashAlbum(tx, uid, albumID, now); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ServeAPIDeleteAlbum deletes the album given in the path. The form
+// must contain the number of images shown to the user when asking for
+// confirmation.
+func (s *server) ServeAPIDeleteAlbum(w http.ResponseWriter, r *http.Request) {
+	albumID, err := idFromPath(r.URL.Path, "/api/delete/album/")
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	session, form, ok := s.parseAPIForm(w, r)
+	if !ok {
+		return
+	}
+	cnt, err := strconv.Atoi(form.Get("images"))
+	if err != nil {
+		http.Error(w, s.tr("Error parsing form"), http.StatusBadRequest)
+		return
+	}
+	switch err := s.db.DeleteAlbum(session.Uid, albumID, cnt); err {
+	case nil:
+	case ErrNotAlbumOwner:
+		http.Error(w, s.tr("Album does not exist or you are not its owner"), http.StatusForbidden)
+		return
+	case ErrAlbumChanged:
+		http.Error(w, s.tr("The album has been modified in the meantime, please reload the page"), http.StatusConflict)
+		return
+	default:
+		logError(r, "delete album error", "album", albumID, "err", err)
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		return
+	}
+	data := struct {
+		Title    string
+		Messages []string
+		Problems []imageError
+		Href     string
+	}{Title: s.tr("Album deleted"), Href: "/trash"}
+	s.auditAs(r, session.Uid, session.Login, auditAlbumDelete, auditTarget{Album: albumID}, fmt.Sprintf("%d images", cnt))
+	data.Messages = append(data.Messages, fmt.Sprintf(s.trn("The album and its %d images have been moved to the trash.", cnt), cnt))
+	s.executeTemplate(w, "editalbumok.html", &data, http.StatusOK)
+}
+
+// restoreAlbum restores the album from the trash together with images
+// deleted with it and returns its ID.
+func restoreAlbum(tx *sql.Tx, uid, tid int64) (int64, error) {
+	r, err := tx.Exec(`
+INSERT INTO albums (aid, `+trashAlbumColumns+`)
+SELECT CASE WHEN EXISTS(SELECT 1 FROM albums WHERE aid=t.aid) THEN NULL ELSE t.aid END, `+trashAlbumColumns+`
+FROM trash_albums AS t WHERE tid=? AND owner_id=?`, tid, uid)
+	if err != nil {
+		return 0, err
+	}
+	if cnt, err := r.RowsAffected(); err != nil || cnt == 0 {
+		if err == nil {
+			err = ErrTrashNotFound
+		}
+		return 0, err
+	}
+	albumID, err := r.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := restoreAlbumComments(tx, tid, albumID); err != nil {
+		return 0, err
+	}
+	if err := restoreImages(tx, albumID, "trash_album_id=?", tid); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM trash_albums WHERE tid=?", tid); err != nil {
+		return 0, err
+	}
+	_, err = updateAlbumCover(tx, albumID)
+	return albumID, err
+}
+
+// restoreImage restores the image (not deleted with its album) from
+// the trash and returns ID of the album it was restored to.
+func restoreImage(tx *sql.Tx, uid, tid, now int64) (int64, error) {
+	var albumID int64
+	var albumName string
+	err := tx.QueryRow("SELECT album_id, album_name FROM trash_images WHERE tid=? AND owner_id=? AND trash_album_id IS NULL", tid, uid).Scan(&albumID, &albumName)
+	if err == sql.ErrNoRows {
+		return 0, ErrTrashNotFound
+	} else if err != nil {
+		return 0, err
+	}
+	r, err := tx.Exec("UPDATE albums SET modified=? WHERE aid=? AND owner_id=?", now, albumID, uid)
+	if err != nil {
+		return 0, err
+	}
+	if cnt, err := r.RowsAffected(); err != nil {
+		return 0, err
+	} else if cnt == 0 {
+		// the album has been deleted (e.g. merged into another one)
+		r, err := tx.Exec("INSERT INTO albums (owner_id, created, modified, name) VALUES (?, ?, ?, ?)", uid, now, now, albumName)
+		if err != nil {
+			return 0, err
+		}
+		if albumID, err = r.LastInsertId(); err != nil {
+			return 0, err
+		}
+	}
+	if err := restoreImages(tx, albumID, "tid=?", tid); err != nil {
+		return 0, err
+	}
+	_, err = updateAlbumCover(tx, albumID)
+	return albumID, err
+}
+
+// restoreImages moves images matching the condition from the trash to
+// the album.
+func restoreImages(tx *sql.Tx, albumID int64, cond string, arg interface{}) error {
+	rows, err := tx.Query("SELECT tid FROM trash_images WHERE "+cond+" ORDER BY iid", arg)
+	if err != nil {
+		return err
+	}
+	var tids []int64
+	for rows.Next() {
+		var tid int64
+		if err := rows.Scan(&tid); err != nil {
+			rows.Close()
+			return err
+		}
+		tids = append(tids, tid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	// one by one as a new ID given to one image may be the original
+	// ID of the next one
+	for _, tid := range tids {
+		r, err := tx.Exec(`
+INSERT INTO images (iid, album_id, `+trashImageColumns+`)
+SELECT CASE WHEN EXISTS(SELECT 1 FROM images WHERE iid=t.iid) THEN NULL ELSE t.iid END, ?, `+trashImageColumns+`
+FROM trash_images AS t WHERE tid=?`, albumID, tid)
+		var imageID int64
+		if err == nil {
+			imageID, err = r.LastInsertId()
+		}
+		if err == nil {
+			err = restoreImageComments(tx, tid, imageID)
+		}
+		if err == nil {
+			err = restoreFavourites(tx, tid, imageID)
+		}
+		if err == nil {
+			_, err = tx.Exec("DELETE FROM trash_images WHERE tid=?", tid)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RestoreTrash restores albums and images (given by their trash IDs) of
+// the user and returns the number of restored items.
+func (db *DB) RestoreTrash(uid int64, albums, images []int64) (int, error) {
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	now := time.Now().UTC().Unix()
+	for _, tid := range albums {
+		if _, err := restoreAlbum(tx, uid, tid); err != nil {
+			return 0, err
+		}
+	}
+	for _, tid := range images {
+		if _, err := restoreImage(tx, uid, tid, now); err != nil {
+			return 0, err
+		}
+	}
+	return len(albums) + len(images), tx.Commit()
+}
+
+// PurgeTrash permanently removes items deleted before the given time
+// from the trash of the user (or of all users if uid is 0) together
+// with files no longer referenced by any image. It returns the number
+// of removed images.
+func (db *DB) PurgeTrash(uid int64, before int64) (int, error) {
+	db.filesMu.Lock()
+	defer db.filesMu.Unlock()
+	tx, err := db.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	const cond = "(?=0 OR owner_id=?) AND deleted<?"
+	rows, err := tx.Query("SELECT DISTINCT sha256sum FROM trash_images WHERE "+cond, uid, uid, before)
+	if err != nil {
+		return 0, err
+	}
+	var sums []string
+	for rows.Next() {
+		var sum string
+		if err := rows.Scan(&sum); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		sums = append(sums, sum)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	r, err := tx.Exec("DELETE FROM trash_images WHERE "+cond, uid, uid, before)
+	if err != nil {
+		return 0, err
+	}
+	n, err := r.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("DELETE FROM trash_albums WHERE "+cond+" AND tid NOT IN (SELECT trash_album_id FROM trash_images WHERE trash_album_id IS NOT NULL)", uid, uid, before); err != nil {
+		return 0, err
+	}
+	if err := purgeComments(tx); err != nil {
+		return 0, err
+	}
+	if err := purgeFavourites(tx); err != nil {
+		return 0, err
+	}
+	var toRemove []string
+	for _, sum := range sums {
+		var exists bool
+		err := tx.QueryRow("SELECT EXISTS(SELECT 1 FROM images WHERE sha256sum=?) OR EXISTS(SELECT 1 FROM trash_images WHERE sha256sum=?)", sum, sum).Scan(&exists)
+		if err != nil {
+			return 0, err
+		}
+		if exists {
+			continue
+		}
+		if _, err := tx.Exec("DELETE FROM files WHERE sha256sum=?", sum); err != nil {
+			return 0, err
+		}
+		toRemove = append(toRemove, filepath.Join(db.imagesDir, sum[:3], sum[3:]))
+		// all previews (including edited ones and video renditions)
+		matches, _ := filepath.Glob(filepath.Join(db.previewDir, sum[:3], sum[3:]) + "*")
+		toRemove = append(toRemove, matches...)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for _, fn := range toRemove {
+		if err := os.Remove(fn); err != nil {
+			logError(nil, "purge trash error", "err", err)
+		}
+	}
+	return int(n), nil
+}
+
+// TrashRetention returns for how long deleted items are kept in the
+// trash (0 meaning forever).
+func (db *DB) TrashRetention() (time.Duration, error) {
+	var days int64
+	err := db.db.QueryRow("SELECT COALESCE((SELECT CAST(value AS INTEGER) FROM mpa WHERE key='trash_retention_days'), 0)").Scan(&days)
+	return time.Duration(days) * 24 * time.Hour, err
+}
+
+// purgeTrash removes items older than the retention period from the
+// trash every hour.
+func (s *server) purgeTrash() {
+	for {
+		retention, err := s.db.TrashRetention()
+		if err == nil && retention > 0 {
+			var n int
+			n, err = s.db.PurgeTrash(0, time.Now().Add(-retention).UTC().Unix())
+			if n > 0 {
+				logInfo(nil, "purged images from the trash", "count", n)
+			}
+		}
+		if err != nil {
+			logError(nil, "purge trash error", "err", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+type trashItem struct {
+	Tid       int64
+	Name      string
+	Deleted   time.Time
+	PreviewID int64 // trash ID of the image shown as preview (0 if none)
+	ImagesCnt int
+	Class     string
+}
+
+type trashData struct {
+	Lang      string
+	Albums    []trashItem
+	Images    []trashItem
+	Retention int64 // in days
+	Message   string
+	Restored  int
+	Purged    int
+	Emptied   bool
+}
+
+func (db *DB) Trash(uid int64) (albums, images []trashItem, err error) {
+	rows, err := db.db.Query(`
+SELECT a.tid, a.name, a.deleted, COALESCE((SELECT tid FROM trash_images WHERE trash_album_id=a.tid AND iid=a.image_id), 0), a.is_portrait,
+(SELECT count(*) FROM trash_images WHERE trash_album_id=a.tid)
+FROM trash_albums AS a WHERE owner_id=? ORDER BY deleted DESC, tid DESC`, uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var t trashItem
+		var deleted int64
+		var portrait bool
+		if err := rows.Scan(&t.Tid, &t.Name, &deleted, &t.PreviewID, &portrait, &t.ImagesCnt); err != nil {
+			return nil, nil, err
+		}
+		t.Deleted = time.Unix(deleted, 0)
+		t.Class = previewClass(portrait)
+		albums = append(albums, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	rows2, err := db.db.Query("SELECT tid, album_name, deleted, is_portrait FROM trash_images WHERE owner_id=? AND trash_album_id IS NULL ORDER BY deleted DESC, tid DESC", uid)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows2.Close()
+	for rows2.Next() {
+		var t trashItem
+		var deleted int64
+		var portrait bool
+		if err := rows2.Scan(&t.Tid, &t.Name, &deleted, &portrait); err != nil {
+			return nil, nil, err
+		}
+		t.Deleted = time.Unix(deleted, 0)
+		t.PreviewID = t.Tid
+		t.Class = previewClass(portrait)
+		images = append(images, t)
+	}
+	return albums, images, rows2.Err()
+}
+
+func previewClass(portrait bool) string {
+	if portrait {
+		return "preview portrait"
+	}
+	return "preview"
+}
+
+// ServeTrash lists the trash of the user and restores items or
+// empties the trash on POST.
+func (s *server) ServeTrash(w http.ResponseWriter, r *http.Request) {
+	session, err := s.SessionData(r)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Session error"))
+		return
+	}
+	d := trashData{Lang: s.lang}
+	status := http.StatusOK
+	if r.Method == "POST" {
+		status = s.changeTrash(r, &d, session.Uid)
+	}
+	retention, err := s.db.TrashRetention()
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	d.Retention = int64(retention / (24 * time.Hour))
+	d.Albums, d.Images, err = s.db.Trash(session.Uid)
+	if err != nil {
+		s.internalError(w, r, err, s.tr("Internal server error"))
+		return
+	}
+	s.executeTemplate(w, "trash.html", &d, status)
+}
+
+func (s *server) changeTrash(r *http.Request, d *trashData, uid int64) int {
+	if err := r.ParseForm(); err != nil {
+		logWarn(r, "Error parsing form", "err", err)
+		d.Message = s.tr("Error parsing form")
+		return http.StatusBadRequest
+	}
+	if r.PostForm.Get("empty") != "" {
+		n, err := s.db.PurgeTrash(uid, time.Now().UTC().Unix()+1)
+		if err != nil {
+			logError(r, "change trash error", "err", err)
+			d.Message = s.tr("Internal server error")
+			return http.StatusInternalServerError
+		}
+		d.Purged = n
+		d.Emptied = true
+		s.audit(r, auditTrashEmpty, auditTarget{}, fmt.Sprintf("%d items", n))
+		return http.StatusOK
+	}
+	albums, err1 := parseIDs(r.PostForm["album"])
+	images, err2 := parseIDs(r.PostForm["image"])
+	if err1 != nil || err2 != nil {
+		d.Message = s.tr("Error parsing form")
+		return http.StatusBadRequest
+	}
+	n, err := s.db.RestoreTrash(uid, albums, images)
+	if err == ErrTrashNotFound {
+		d.Message = s.tr("Not found in the trash")
+		return http.StatusBadRequest
+	} else if err != nil {
+		logError(r, "change trash error", "err", err)
+		d.Message = s.tr("Internal server error")
+		return http.StatusInternalServerError
+	}
+	d.Restored = n
+	s.audit(r, auditTrashRestore, auditTarget{}, fmt.Sprintf("albums %v, images %v", albums, images))
+	return http.StatusOK
+}
+
+// ServeTrashPreview serves the preview of the image in the trash of
+// the user.
+func (s *server) ServeTrashPreview(w http.ResponseWriter, r *http.Request) {
+	session, err := s.SessionData(r)
+	if err != nil {
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "trash preview error", "err", err)
+		return
+	}
+	tid, err := idFromPath(r.URL.Path, "/trash/preview/")
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	var job previewJob
+	err = s.db.db.QueryRow("SELECT iid, sha256sum, "+imageEditColumns+" FROM trash_images WHERE tid=? AND owner_id=?", tid, session.Uid).Scan(
+		append([]interface{}{&job.id, &job.sha256sum}, job.edit.scanArgs()...)...)
+	if err == sql.ErrNoRows {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	} else if err != nil {
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "trash preview error", "err", err)
+		return
+	}
+	if filename, ok := s.ensurePreviewFile(w, r, job, ".2"); ok {
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeFile(w, r, filename)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"html/template"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testAlbumImages(t *testing.T, db *DB, albumID int64) []int64 {
+	t.Helper()
+	ids, err := albumImageIDs(db.db, albumID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func testEqualIDs(a, b []int64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestTrashRestoreAndPurge(t *testing.T) {
+	db := initTestDB(t)
+	albumID, ids := addTestAlbum(t, db, 1, "Trip", testSum('a'), testSum('b'), testSum('c'))
+	otherID, _ := addTestAlbum(t, db, 1, "Other", testSum('a'))
+	if err := db.ensureFileSizes(); err != nil {
+		t.Fatal(err)
+	}
+
+	// image b is deleted on its own before the album is deleted
+	tx, err := db.db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := trashImage(tx, 1, albumID, ids[1], time.Now().UTC().Add(-time.Hour).Unix()); !ok || err != nil {
+		t.Fatalf("trashImage = %t, %v", ok, err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.DeleteAlbum(1, albumID, 3); err != ErrAlbumChanged {
+		t.Fatalf("DeleteAlbum with wrong confirmed count returned %v, want %v", err, ErrAlbumChanged)
+	}
+	if err := db.DeleteAlbum(1, albumID, 2); err != nil {
+		t.Fatal(err)
+	}
+	albums, images, err := db.Trash(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(albums) != 1 || albums[0].ImagesCnt != 2 || len(images) != 1 {
+		t.Fatalf("trash contains %d albums (%+v) and %d images, want album with 2 images and 1 separate image", len(albums), albums, len(images))
+	}
+	var cnt int
+	if err := db.db.QueryRow("SELECT count(*) FROM albums WHERE aid=?", albumID).Scan(&cnt); err != nil || cnt != 0 {
+		t.Fatalf("deleted album still exists (%v)", err)
+	}
+	if err := db.db.QueryRow("SELECT count(*) FROM images WHERE album_id=?", albumID).Scan(&cnt); err != nil || cnt != 0 {
+		t.Fatalf("deleted album still has %d images (%v)", cnt, err)
+	}
+
+	tests := []struct {
+		name           string
+		albums, images []int64
+		want           []int64 // images of the album after restoring
+	}{
+		{"album", []int64{albums[0].Tid}, nil, []int64{ids[0], ids[2]}},
+		{"image", nil, []int64{images[0].Tid}, ids},
+	}
+	for _, tt := range tests {
+		n, err := db.RestoreTrash(1, tt.albums, tt.images)
+		if err != nil {
+			t.Fatalf("restoring %s: %v", tt.name, err)
+		}
+		if n != len(tt.albums)+len(tt.images) {
+			t.Errorf("restoring %s: restored %d items", tt.name, n)
+		}
+		if got := testAlbumImages(t, db, albumID); !testEqualIDs(got, tt.want) {
+			t.Errorf("restoring %s: album has images %v, want %v", tt.name, got, tt.want)
+		}
+	}
+	if albums, images, err := db.Trash(1); err != nil || len(albums) != 0 || len(images) != 0 {
+		t.Fatalf("trash not empty after restoring (%d albums, %d images, %v)", len(albums), len(images), err)
+	}
+	if _, err := db.RestoreTrash(1, []int64{albums[0].Tid}, nil); err == nil {
+		t.Error("restoring album no longer in the trash succeeded")
+	}
+
+	if err := db.DeleteAlbum(1, albumID, 3); err != nil {
+		t.Fatal(err)
+	}
+	// other users cannot purge the trash
+	if n, err := db.PurgeTrash(2, time.Now().Add(time.Minute).Unix()); err != nil || n != 0 {
+		t.Fatalf("PurgeTrash of other user = %d, %v", n, err)
+	}
+	// items deleted after the given time are kept
+	if n, err := db.PurgeTrash(1, time.Now().Add(-time.Minute).Unix()); err != nil || n != 0 {
+		t.Fatalf("PurgeTrash before deletion = %d, %v", n, err)
+	}
+	n, err := db.PurgeTrash(1, time.Now().Add(time.Minute).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 3 {
+		t.Errorf("purged %d images, want 3", n)
+	}
+	if albums, images, err := db.Trash(1); err != nil || len(albums) != 0 || len(images) != 0 {
+		t.Fatalf("trash not empty after purging (%d albums, %d images, %v)", len(albums), len(images), err)
+	}
+	for _, tt := range []struct {
+		sum    string
+		exists bool
+	}{
+		{testSum('a'), true}, // still used by the other album
+		{testSum('b'), false},
+		{testSum('c'), false},
+	} {
+		_, err := os.Stat(filepath.Join(db.imagesDir, tt.sum[:3], tt.sum[3:]))
+		if exists := err == nil; exists != tt.exists {
+			t.Errorf("file %s exists = %t, want %t", tt.sum[:7], exists, tt.exists)
+		}
+		var recorded bool
+		if err := db.db.QueryRow("SELECT EXISTS(SELECT 1 FROM files WHERE sha256sum=?)", tt.sum).Scan(&recorded); err != nil {
+			t.Fatal(err)
+		}
+		if recorded != tt.exists {
+			t.Errorf("size of file %s recorded = %t, want %t", tt.sum[:7], recorded, tt.exists)
+		}
+	}
+	if ids := testAlbumImages(t, db, otherID); len(ids) != 1 {
+		t.Errorf("other album has images %v, want one", ids)
+	}
+}
+
+func TestServeAPIDeleteAlbum(t *testing.T) {
+	db := initTestDB(t)
+	albumID, _ := addTestAlbum(t, db, 1, "Trip", testSum('a'), testSum('b'))
+	s := &server{db: db, assets: &assets{}, tr: func(s string) string { return s }, trn: func(s string, n int) string { return s },
+		t: template.Must(template.New("html").Parse(`{{define "editalbumok.html"}}{{range .Messages}}{{.}}{{end}}{{end}}`))}
+
+	del := func(method, path string, uid int64, images string) *httptest.ResponseRecorder {
+		t.Helper()
+		var b bytes.Buffer
+		mw := multipart.NewWriter(&b)
+		if err := mw.WriteField("images", images); err != nil {
+			t.Fatal(err)
+		}
+		if err := mw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		r := httptest.NewRequest(method, path, &b)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		s.ServeAPIDeleteAlbum(w, withSession(r, uid))
+		return w
+	}
+	path := "/api/delete/album/" + strconv.FormatInt(albumID, 10)
+	for _, tt := range []struct {
+		method, path string
+		uid          int64
+		images       string
+		code         int
+	}{
+		{"GET", path, 1, "2", http.StatusMethodNotAllowed},
+		{"POST", "/api/delete/album/x", 1, "2", http.StatusNotFound},
+		{"POST", path, 2, "2", http.StatusForbidden},
+		{"POST", path, 1, "", http.StatusBadRequest},
+		{"POST", path, 1, "3", http.StatusConflict}, // an image added in the meantime
+	} {
+		if w := del(tt.method, tt.path, tt.uid, tt.images); w.Code != tt.code {
+			t.Errorf("%s %s by user %d confirming %q images: status %d, want %d", tt.method, tt.path, tt.uid, tt.images, w.Code, tt.code)
+		}
+	}
+	if ids := testAlbumImages(t, db, albumID); len(ids) != 2 {
+		t.Fatalf("album has images %v after failed deletions", ids)
+	}
+
+	w := del("POST", path, 1, "2")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "moved to the trash") {
+		t.Fatalf("deleting album: status %d, response %q", w.Code, w.Body.String())
+	}
+	albums, images, err := db.Trash(1)
+	if err != nil || len(albums) != 1 || albums[0].ImagesCnt != 2 || len(images) != 0 {
+		t.Errorf("trash after deleting album: %+v, %+v, %v", albums, images, err)
+	}
+	if w := del("POST", path, 1, "0"); w.Code != http.StatusForbidden {
+		t.Errorf("deleting deleted album: status %d", w.Code)
+	}
+}
@@ -7,7 +7,6 @@ package main
 import (
 	"crypto/rand"
 	"encoding/base64"
-	"log"
 	"net/http"
 	"net/mail"
 	"strings"
@@ -71,7 +70,7 @@ func (s *server) createNewUser(w http.ResponseWriter, r *http.Request, d *loginD
 	}
 	session, err := s.SessionData(r)
 	if err != nil {
-		log.Println(err)
+		logError(r, "session error", "err", err)
 		d.Message = s.tr("Session retrieving error")
 		return http.StatusInternalServerError
 	}
@@ -81,7 +80,7 @@ func (s *server) createNewUser(w http.ResponseWriter, r *http.Request, d *loginD
 			d.Message = s.tr("Incorrect password")
 			return http.StatusUnauthorized
 		} else {
-			log.Println(err)
+			logError(r, "create new user error", "err", err)
 			d.Message = s.tr("Internal server error")
 			return http.StatusInternalServerError
 		}
@@ -95,7 +94,7 @@ func (s *server) createNewUser(w http.ResponseWriter, r *http.Request, d *loginD
 	}
 	randomPass, err := randomPassword()
 	if err != nil {
-		log.Println(err)
+		logError(r, "create new user error", "err", err)
 		d.Message = s.tr("Internal server error")
 		return http.StatusInternalServerError
 	}
@@ -117,10 +116,15 @@ func (s *server) createNewUser(w http.ResponseWriter, r *http.Request, d *loginD
 				}
 			}
 		}
-		log.Println(err)
+		logError(r, "create new user error", "err", err)
 		d.Message = s.tr("Internal server error")
 		return http.StatusInternalServerError
 	}
+	details := d.Login
+	if d.Admin {
+		details += " (admin)"
+	}
+	s.audit(r, auditUserCreate, auditTarget{User: s.db.lookupUid(d.Login)}, details)
 	d.TmpPassword = string(randomPass)
 	s.executeTemplate(w, "newuserok.html", &d, http.StatusOK)
 	return http.StatusOK
@@ -0,0 +1,257 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+// isVideo reports whether the file contains a video in one of the
+// supported container formats (MP4/QuickTime/3GP, Matroska/WebM or
+// AVI) judging by its header.
+func isVideo(filename string) (bool, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	var b [12]byte
+	if _, err := io.ReadFull(f, b[:]); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return false, nil
+		}
+		return false, err
+	}
+	switch {
+	case string(b[4:8]) == "ftyp":
+		// HEIF and AVIF images and CR3 RAW files use the same
+		// container as MP4
+		brand := string(b[8:12])
+		return !heifBrands[brand] && brand != "avif" && brand != "avis" && brand != "crx ", nil
+	case string(b[4:8]) == "moov" || string(b[4:8]) == "mdat" || string(b[4:8]) == "wide":
+		return true, nil
+	case bytes.Equal(b[:4], []byte{0x1a, 0x45, 0xdf, 0xa3}):
+		return true, nil
+	case string(b[:4]) == "RIFF" && string(b[8:12]) == "AVI ":
+		return true, nil
+	}
+	return false, nil
+}
+
+// ffmpeg runs an external ffmpeg binary to extract poster frames and
+// to create web friendly renditions of videos. If the binary is not
+// available videos are still accepted but shown with a placeholder
+// poster and served in their original format.
+type ffmpeg struct {
+	path string // empty if ffmpeg is not available
+}
+
+func newFFmpeg(path string) *ffmpeg {
+	if path == "" {
+		return &ffmpeg{}
+	}
+	p, err := exec.LookPath(path)
+	if err != nil {
+		logWarn(nil, "ffmpeg not available, video posters and renditions disabled", "err", err)
+		return &ffmpeg{}
+	}
+	return &ffmpeg{path: p}
+}
+
+var ErrNoFFmpeg = errors.New("ffmpeg not available")
+
+func (f *ffmpeg) available() bool {
+	return f != nil && f.path != ""
+}
+
+func (f *ffmpeg) run(args ...string) ([]byte, error) {
+	if !f.available() {
+		return nil, ErrNoFFmpeg
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(f.path, args...)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	return stderr.Bytes(), err
+}
+
+// poster writes a representative frame of the video to dst as JPEG.
+func (f *ffmpeg) poster(src, dst string) error {
+	out, err := f.run("-y", "-v", "error", "-i", src, "-vf", "thumbnail", "-frames:v", "1", "-f", "image2", "-c:v", "mjpeg", dst)
+	if err != nil {
+		return ffmpegError(err, out)
+	}
+	return nil
+}
+
+// rendition writes an H.264/AAC MP4 version of the video (at most
+// 1280 pixels wide) suitable for playback in browsers to dst.
+func (f *ffmpeg) rendition(src, dst string) error {
+	out, err := f.run("-y", "-v", "error", "-i", src,
+		"-map", "0:v:0", "-map", "0:a:0?",
+		"-vf", "scale=trunc(min(1280\\,iw)/2)*2:-2",
+		"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p",
+		"-c:a", "aac", "-b:a", "128k",
+		"-map_metadata", "-1", "-movflags", "+faststart", "-f", "mp4", dst)
+	if err != nil {
+		return ffmpegError(err, out)
+	}
+	return nil
+}
+
+var creationTimeRe = regexp.MustCompile(`creation_time\s*:\s*(\S+)`)
+
+// creationTime returns the capture time stored in the video metadata.
+func (f *ffmpeg) creationTime(src string) (time.Time, error) {
+	// ffmpeg without an output file fails but still prints metadata
+	out, err := f.run("-hide_banner", "-i", src)
+	if err == ErrNoFFmpeg {
+		return time.Time{}, err
+	}
+	m := creationTimeRe.FindSubmatch(out)
+	if m == nil {
+		return time.Time{}, errors.New("video creation time not found")
+	}
+	return time.Parse(time.RFC3339Nano, string(m[1]))
+}
+
+func ffmpegError(err error, out []byte) error {
+	if out = bytes.TrimSpace(out); len(out) > 0 {
+		return errors.New("ffmpeg: " + string(out))
+	}
+	return err
+}
+
+// videoPoster returns the poster frame of the video or a placeholder
+// image if ffmpeg is not available.
+func (s *server) videoPoster(filename string) (image.Image, error) {
+	if !s.ffmpeg.available() {
+		img := image.NewRGBA(image.Rect(0, 0, 640, 360))
+		draw.Draw(img, img.Bounds(), &image.Uniform{color.Gray{0x40}}, image.ZP, draw.Src)
+		return img, nil
+	}
+	f, err := ioutil.TempFile(s.db.uploadDir, "tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmpFileName := f.Name()
+	defer os.Remove(tmpFileName)
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := s.ffmpeg.poster(filename, tmpFileName); err != nil {
+		return nil, err
+	}
+	f, err = os.Open(tmpFileName)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// videoIsPortrait reports whether the video is higher than wide. If
+// ffmpeg is not available landscape orientation is assumed.
+func (s *server) videoIsPortrait(filename string) (bool, error) {
+	if !s.ffmpeg.available() {
+		return false, nil
+	}
+	img, err := s.videoPoster(filename)
+	if err != nil {
+		return false, err
+	}
+	size := img.Bounds().Size()
+	return size.Y > size.X, nil
+}
+
+// createRendition creates web friendly rendition of the video (if
+// ffmpeg is available and it does not exist yet).
+func (s *server) createRendition(src, dst string) error {
+	if !s.ffmpeg.available() {
+		return nil
+	}
+	if _, err := os.Stat(dst); err == nil || !os.IsNotExist(err) {
+		return err
+	}
+	f, err := ioutil.TempFile(s.db.uploadDir, "tmp")
+	if err != nil {
+		return err
+	}
+	tmpFileName := f.Name()
+	defer func() {
+		if tmpFileName != "" {
+			_ = os.Remove(tmpFileName)
+		}
+	}()
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := s.ffmpeg.rendition(src, tmpFileName); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFileName, dst); err != nil {
+		return err
+	}
+	tmpFileName = ""
+	return nil
+}
+
+func (s *server) ServeVideo(w http.ResponseWriter, r *http.Request) {
+	id, err := idFromPath(r.URL.Path, "/video/")
+	if err != nil {
+		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		return
+	}
+	p, err := s.db.ImagePrivacy(id)
+	if err == nil && !p.video {
+		err = sql.ErrNoRows // renditions are not created for images
+	}
+	if err != nil {
+		if err == sql.ErrNoRows {
+			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+			return
+		}
+		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+		logError(r, "video error", "err", err)
+		return
+	}
+	if s.ffmpeg.available() {
+		if filename, ok := s.ensurePreview(w, r, id, videoExt); ok {
+			w.Header().Set("Content-Type", "video/mp4")
+			http.ServeFile(w, r, filename)
+		}
+		return
+	}
+	// no rendition without ffmpeg, serve the original (which may
+	// contain location)
+	if restrict, err := s.restrictOriginal(r, p); err != nil || restrict {
+		if err != nil {
+			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+			logError(r, "video error", "err", err)
+			return
+		}
+		http.Error(w, s.tr("Original not available due to privacy settings"), http.StatusForbidden)
+		return
+	}
+	http.ServeFile(w, r, filepath.Join(s.db.imagesDir, p.sha256sum[:3], p.sha256sum[3:]))
+}
+
+// videoExt is the file name extension of video renditions in the
+// preview directory.
+const videoExt = ".mp4"
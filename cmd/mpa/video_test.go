@@ -0,0 +1,80 @@
+// Copyright 2017 Łukasz Pankowski <lukpank at o2 dot pl>. All rights
+// reserved.  This source code is licensed under the terms of the MIT
+// license. See LICENSE file for details.
+
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestIsVideo(t *testing.T) {
+	tests := []struct {
+		header string
+		video  bool
+	}{
+		{"\x00\x00\x00\x18ftypmp42", true},
+		{"\x00\x00\x00\x14ftypqt  ", true},
+		{"\x00\x00\x00\x18ftyp3gp4", true},
+		{"\x00\x00\x00\x18ftypheic", false},
+		{"\x00\x00\x00\x18ftypmif1", false},
+		{"\x00\x00\x00\x1cftypavif", false},
+		{"\x00\x00\x00\x1cftypavis", false},
+		{"\x00\x00\x00\x18ftypcrx ", false},
+		{"\x00\x00\x00\x08wide\x00\x00\x00\x00", true},
+		{"\x1a\x45\xdf\xa3\x00\x00\x00\x00\x00\x00\x00\x00", true},
+		{"RIFF\x00\x00\x00\x00AVI ", true},
+		{"RIFF\x00\x00\x00\x00WEBP", false},
+		{"\xff\xd8\xff\xe1\x00\x00Exif\x00\x00", false},
+		{"short", false},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		filename := filepath.Join(dir, "file")
+		if err := ioutil.WriteFile(filename, []byte(tt.header), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if video, err := isVideo(filename); err != nil || video != tt.video {
+			t.Errorf("isVideo(%q) = %t, %v, want %t", tt.header, video, err, tt.video)
+		}
+	}
+}
+
+func TestServeVideoOfImage(t *testing.T) {
+	db := initTestDB(t)
+	now := time.Now().UTC()
+	if _, err := db.db.Exec("INSERT INTO albums (aid, owner_id, image_id, is_portrait, created, modified, name) VALUES (1, 1, 1, 0, ?, ?, 'Trip')", now, now); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.db.Exec("INSERT INTO images (iid, album_id, sha256sum, title, is_portrait, created, owner_file_name) VALUES (1, 1, ?, '', 0, ?, 'img.jpg')", testSum('a'), now); err != nil {
+		t.Fatal(err)
+	}
+	// renditions would be requested from the preview workers
+	preview := make(chan previewRequest)
+	defer close(preview)
+	requested := make(chan int64, 4)
+	go func() {
+		for req := range preview {
+			requested <- req.id
+			req.result <- errors.New("no preview workers")
+		}
+	}()
+	for _, ff := range []*ffmpeg{{path: "ffmpeg"}, {}} {
+		s := &server{db: db, ffmpeg: ff, preview: preview, tr: func(s string) string { return s }}
+		for _, path := range []string{"/video/1", "/video/2"} {
+			w := httptest.NewRecorder()
+			s.ServeVideo(w, httptest.NewRequest("GET", path, nil))
+			if w.Code != 404 {
+				t.Errorf("GET %s (ffmpeg %q) returned status %d, want 404", path, ff.path, w.Code)
+			}
+		}
+	}
+	if len(requested) != 0 {
+		t.Error("video rendition of image requested")
+	}
+}
@@ -6,61 +6,57 @@ package main
 
 import (
 	"database/sql"
-	"log"
 	"net/http"
 )
 
 func (s *server) ServeView(w http.ResponseWriter, r *http.Request) {
-	albumID, err := idFromPath(r.URL.Path, "/view/")
+	session, err := s.SessionData(r)
 	if err != nil {
-		http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+		s.internalError(w, r, err, s.tr("Session error"))
 		return
 	}
-	var name string
-	err = s.db.db.QueryRow("SELECT name FROM albums WHERE aid=?", albumID).Scan(&name)
-	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
-			return
-		}
-		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-		log.Println(err)
-		return
-	}
-	rows, err := s.db.db.Query("SELECT iid from images WHERE album_id=? ORDER BY created", albumID)
-	if err != nil {
-		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
-		log.Println(err)
-		return
-	}
-	defer rows.Close()
-
-	type img struct {
-		Src   string
-		Class string
-		Href  string
-	}
 	data := struct {
-		Title  string
-		Lang   string
-		Images []int64
+		Title      string
+		Lang       string
+		Images     []int64
+		Videos     []bool
+		Favourites []bool
 	}{
-		Title: name,
-		Lang:  s.lang,
+		Lang:       s.lang,
+		Images:     []int64{},
+		Videos:     []bool{},
+		Favourites: []bool{},
 	}
-	for rows.Next() {
-		var id int64
-		if err := rows.Scan(&id); err != nil {
-			log.Println(err)
+	var fs []favourite
+	if r.URL.Path == "/view/favourites" {
+		data.Title = s.tr("My favourites")
+		fs, err = s.db.Favourites(session.Uid)
+	} else {
+		var albumID int64
+		if albumID, err = idFromPath(r.URL.Path, "/view/"); err != nil {
+			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+			return
+		}
+		err = s.db.db.QueryRow("SELECT name FROM albums WHERE aid=?", albumID).Scan(&data.Title)
+		if err == sql.ErrNoRows {
+			http.Error(w, s.tr("Page not found"), http.StatusNotFound)
+			return
+		} else if err != nil {
 			http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
+			logError(r, "view error", "err", err)
 			return
 		}
-		data.Images = append(data.Images, id)
+		fs, err = s.db.AlbumFavourites(session.Uid, albumID)
 	}
-	if err := rows.Err(); err != nil {
-		log.Println(err)
+	if err != nil {
+		logError(r, "view error", "err", err)
 		http.Error(w, s.tr("Internal server error"), http.StatusInternalServerError)
 		return
 	}
+	for _, f := range fs {
+		data.Images = append(data.Images, f.ImageID)
+		data.Videos = append(data.Videos, f.Video)
+		data.Favourites = append(data.Favourites, f.Favourite)
+	}
 	s.executeTemplate(w, "view.html", &data, http.StatusOK)
 }